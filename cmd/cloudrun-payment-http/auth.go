@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RequireToken only passes requests that carry the token as bearer token in their
+// Authorization header to the handler. Other requests are answered with a 401.
+func RequireToken(token string, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		auth := string(ctx.Request.Header.Peek("Authorization"))
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			ctx.Response.Header.Set("WWW-Authenticate", "Bearer")
+			ctx.SetStatusCode(http.StatusUnauthorized)
+			ctx.SetBodyString(http.StatusText(http.StatusUnauthorized))
+			return
+		}
+
+		h(ctx)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("secret", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer other", http.StatusUnauthorized},
+		{"token without scheme", "secret", http.StatusUnauthorized},
+		{"prefix of the token", "Bearer secre", http.StatusUnauthorized},
+		{"token", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			if len(tt.header) > 0 {
+				ctx.Request.Header.Set("Authorization", tt.header)
+			}
+
+			h(&ctx)
+
+			if got := ctx.Response.StatusCode(); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/valyala/fasthttp"
+)
+
+// AuthorizePayment validates the creditcard and holds the amount so it can be captured later.
+func AuthorizePayment(ctx *fasthttp.RequestCtx) {
+	// Unmarshal the PaymentRequested event to a struct
+	req, err := events.UnmarshalPaymentRequestedEvent(ctx.Request.Body())
+	if err != nil {
+		ErrorHandler(ctx, "AuthorizePayment", "UnmarshalPaymentRequestedEvent", err)
+		return
+	}
+
+	// Count attempts by the address of the client that sent the request
+	req.Data.ClientIP = clientIP(ctx)
+
+	evt, err := svc.Authorize(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "AuthorizePayment", "Authorize", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "AuthorizePayment", evt)
+}
+
+// CapturePayment captures an authorized payment.
+func CapturePayment(ctx *fasthttp.RequestCtx) {
+	req, err := paymentAction(ctx, events.PaymentCaptureRequestedEventName)
+	if err != nil {
+		ErrorHandler(ctx, "CapturePayment", "UnmarshalPaymentActionDetails", err)
+		return
+	}
+
+	evt, err := svc.Capture(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "CapturePayment", "Capture", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "CapturePayment", evt)
+}
+
+// VoidPayment releases an authorized payment that hasn't been captured.
+func VoidPayment(ctx *fasthttp.RequestCtx) {
+	req, err := paymentAction(ctx, events.PaymentVoidRequestedEventName)
+	if err != nil {
+		ErrorHandler(ctx, "VoidPayment", "UnmarshalPaymentActionDetails", err)
+		return
+	}
+
+	evt, err := svc.Void(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "VoidPayment", "Void", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "VoidPayment", evt)
+}
+
+// RefundPayment refunds a captured payment.
+func RefundPayment(ctx *fasthttp.RequestCtx) {
+	req, err := paymentAction(ctx, events.PaymentRefundRequestedEventName)
+	if err != nil {
+		ErrorHandler(ctx, "RefundPayment", "UnmarshalPaymentActionDetails", err)
+		return
+	}
+
+	evt, err := svc.Refund(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "RefundPayment", "Refund", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "RefundPayment", evt)
+}
+
+// ApprovePayment authorizes a payment that was held for review.
+func ApprovePayment(ctx *fasthttp.RequestCtx) {
+	req, err := paymentAction(ctx, events.PaymentApproveRequestedEventName)
+	if err != nil {
+		ErrorHandler(ctx, "ApprovePayment", "UnmarshalPaymentActionDetails", err)
+		return
+	}
+
+	evt, err := svc.Approve(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "ApprovePayment", "Approve", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "ApprovePayment", evt)
+}
+
+// RejectPayment declines a payment that was held for review.
+func RejectPayment(ctx *fasthttp.RequestCtx) {
+	req, err := paymentAction(ctx, events.PaymentRejectRequestedEventName)
+	if err != nil {
+		ErrorHandler(ctx, "RejectPayment", "UnmarshalPaymentActionDetails", err)
+		return
+	}
+
+	evt, err := svc.Reject(ctx, req)
+	if err != nil {
+		ErrorHandler(ctx, "RejectPayment", "Reject", err)
+		return
+	}
+
+	writePaymentEvent(ctx, "RejectPayment", evt)
+}
+
+// paymentAction creates the PaymentActionRequested event from the transaction ID in
+// the path and the optional amount, order ID, and request ID in the body of the request.
+// The request ID can be passed in the Idempotency-Key header as well.
+func paymentAction(ctx *fasthttp.RequestCtx, eventName string) (events.PaymentActionRequestedEvent, error) {
+	req := events.PaymentActionRequestedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "HTTP",
+			Type:   eventName,
+		},
+	}
+
+	if body := ctx.Request.Body(); len(body) > 0 {
+		if err := json.Unmarshal(body, &req.Data); err != nil {
+			return req, err
+		}
+	}
+
+	req.Data.TransactionID = fmt.Sprintf("%v", ctx.UserValue("transactionID"))
+	if len(req.Data.RequestID) == 0 {
+		req.Data.RequestID = string(ctx.Request.Header.Peek("Idempotency-Key"))
+	}
+
+	return req, nil
+}
+
+// writePaymentEvent writes the event as the response, with the statuscode of the event.
+func writePaymentEvent(ctx *fasthttp.RequestCtx, function string, evt events.PaymentEvent) {
+	payload, err := evt.Marshal()
+	if err != nil {
+		ErrorHandler(ctx, function, "Marshal", err)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(evt.Data.Status)
+	ctx.Write(payload)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	ledgermemory "github.com/retgits/acme-serverless-payment/internal/ledger/memory"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/valyala/fasthttp"
+)
+
+func TestPaymentActions(t *testing.T) {
+	l := ledgermemory.New()
+	svc = payment.New(validator.New(), nil, payment.WithLedger(l))
+	defer func() { svc = nil }()
+
+	err := l.Record(ledger.Entry{
+		TransactionID:    "txn-1",
+		OrderID:          "order-1",
+		Amount:           "10.00",
+		Success:          true,
+		State:            ledger.StateAuthorized,
+		AuthorizedAmount: "10.00",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The statuscode of the response is the one of the resulting event
+	tests := []struct {
+		name          string
+		handler       fasthttp.RequestHandler
+		transactionID string
+		body          string
+		want          int
+	}{
+		{"refund before capture", RefundPayment, "txn-1", "", http.StatusConflict},
+		{"capture too much", CapturePayment, "txn-1", `{"amount":"10.01"}`, http.StatusBadRequest},
+		{"capture part", CapturePayment, "txn-1", `{"amount":"6.00"}`, http.StatusOK},
+		{"refund", RefundPayment, "txn-1", `{"orderID":"order-1"}`, http.StatusOK},
+		{"void unknown payment", VoidPayment, "txn-2", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("transactionID", tt.transactionID)
+		ctx.Request.SetBodyString(tt.body)
+
+		tt.handler(ctx)
+
+		if got := ctx.Response.StatusCode(); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
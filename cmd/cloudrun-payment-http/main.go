@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/fasthttp/router"
 	"github.com/getsentry/sentry-go"
 	sentryfasthttp "github.com/getsentry/sentry-go/fasthttp"
+	"github.com/retgits/acme-serverless-payment/internal/config"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
 	gcrwavefront "github.com/retgits/gcr-wavefront"
 	"github.com/valyala/fasthttp"
 )
@@ -29,10 +33,11 @@ func CORSHandler(ctx *fasthttp.RequestCtx) {
 }
 
 // ErrorHandler takes the activity where the error occured and the error object and sends a message to sentry.
+// Creditcard data is redacted from the message and the response.
 func ErrorHandler(ctx *fasthttp.RequestCtx, function string, method string, err error) {
-	sentry.CaptureException(fmt.Errorf("error in %s::%s %s", function, method, err.Error()))
+	sentry.CaptureException(fmt.Errorf("error in %s::%s %s", function, method, redact.String(err.Error())))
 	ctx.SetStatusCode(http.StatusBadRequest)
-	ctx.SetBodyString(err.Error())
+	ctx.SetBodyString(redact.String(err.Error()))
 }
 
 func main() {
@@ -66,9 +71,11 @@ func main() {
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  service,
-		Release:     version,
-		Environment: os.Getenv("STAGE"),
+		ServerName:       service,
+		Release:          version,
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       redact.BeforeSend,
+		BeforeBreadcrumb: redact.BeforeBreadcrumb,
 	}); err != nil {
 		log.Fatalf("error configuring sentry: %s", err.Error())
 	}
@@ -92,6 +99,46 @@ func main() {
 		log.Fatalf("error configuring wavefront: %s", err.Error())
 	}
 
+	// The client address of a request is taken from the X-Forwarded-For entry that
+	// the outermost of the trusted proxies added
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("error parsing TRUSTED_PROXIES %q", v)
+		}
+		trustedProxies = n
+	}
+
+	// Create the payment service with the configuration in the environment.
+	// Events are sent to Pub/Sub when only a topic is configured. When no
+	// emitter is configured, the result is only returned to the caller
+	fallback := ""
+	if os.Getenv("PUBSUB_TOPIC") != "" {
+		fallback = "pubsub"
+	}
+	payments, err := config.FromEnv(config.Platform{
+		Emitter: fallback,
+		Ledger:  true,
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	svc = payments.Payment
+	ledgerStore = payments.Ledger
+
+	// Send the events in the outbox in the background, when the service
+	// has an outbox
+	if payments.Relay != nil {
+		interval := time.Second
+		if v := os.Getenv("OUTBOX_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval <= 0 {
+				log.Fatalf("error parsing OUTBOX_INTERVAL %q", v)
+			}
+		}
+		go payments.Relay.Run(context.Background(), interval)
+	}
+
 	// Wrap the sentryHandler with the Wavefront middleware to make sure all events
 	// are sent to sentry before sending data to Wavefront
 	router := router.New()
@@ -99,6 +146,24 @@ func main() {
 
 	// Add routes to the router
 	router.POST("/pay", cfg.WrapFastHTTPRequest(sentryHandler.Handle(ValidatePayment)))
+	router.POST("/pay/authorize", cfg.WrapFastHTTPRequest(sentryHandler.Handle(AuthorizePayment)))
+
+	// The endpoints that look up payments in the ledger, and the endpoints that
+	// change existing payments, are only served to callers with the token in
+	// API_TOKEN, and not at all when it isn't set
+	token := os.Getenv("API_TOKEN")
+	if token == "" {
+		log.Print("warning: API_TOKEN is not set, so GET /pay/{transactionID} and GET /orders/{orderID}/payments are disabled, and payments can't be captured, voided, refunded, or reviewed over HTTP")
+	} else {
+		router.GET("/pay/{transactionID}", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(GetPayment))))
+		router.GET("/orders/{orderID}/payments", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(GetOrderPayments))))
+
+		router.POST("/pay/{transactionID}/capture", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(CapturePayment))))
+		router.POST("/pay/{transactionID}/void", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(VoidPayment))))
+		router.POST("/pay/{transactionID}/refund", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(RefundPayment))))
+		router.POST("/pay/{transactionID}/approve", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(ApprovePayment))))
+		router.POST("/pay/{transactionID}/reject", cfg.WrapFastHTTPRequest(RequireToken(token, sentryHandler.Handle(RejectPayment))))
+	}
 
 	// Start the server
 	log.Printf("successfully started %s server", servicename)
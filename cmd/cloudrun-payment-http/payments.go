@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	"github.com/valyala/fasthttp"
+)
+
+// ledgerStore is the ledger used to look up payments.
+var ledgerStore ledger.Store
+
+// GetPayment returns the ledger entry of a single transaction.
+func GetPayment(ctx *fasthttp.RequestCtx) {
+	transactionID := fmt.Sprintf("%v", ctx.UserValue("transactionID"))
+
+	entry, err := ledgerStore.Get(transactionID)
+	if err == ledger.ErrNotFound {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetBodyString(err.Error())
+		return
+	}
+	if err != nil {
+		ErrorHandler(ctx, "GetPayment", "Get", err)
+		return
+	}
+
+	writeJSON(ctx, "GetPayment", entry)
+}
+
+// GetOrderPayments returns the ledger entries of all payment attempts for an order.
+func GetOrderPayments(ctx *fasthttp.RequestCtx) {
+	orderID := fmt.Sprintf("%v", ctx.UserValue("orderID"))
+
+	entries, err := ledgerStore.ListByOrder(orderID)
+	if err != nil {
+		ErrorHandler(ctx, "GetOrderPayments", "ListByOrder", err)
+		return
+	}
+
+	writeJSON(ctx, "GetOrderPayments", entries)
+}
+
+// writeJSON writes the JSON encoding of v as the response.
+func writeJSON(ctx *fasthttp.RequestCtx, function string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		ErrorHandler(ctx, function, "Marshal", err)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Write(payload)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	ledgermemory "github.com/retgits/acme-serverless-payment/internal/ledger/memory"
+	"github.com/valyala/fasthttp"
+)
+
+func TestGetPayment(t *testing.T) {
+	ledgerStore = ledgermemory.New()
+	defer func() { ledgerStore = nil }()
+
+	if err := ledgerStore.Record(ledger.Entry{TransactionID: "1", OrderID: "order-1", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		transactionID string
+		want          int
+	}{
+		{"1", http.StatusOK},
+		{"2", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("transactionID", tt.transactionID)
+
+		GetPayment(ctx)
+
+		if got := ctx.Response.StatusCode(); got != tt.want {
+			t.Errorf("GetPayment() of transaction %s status = %d, want %d", tt.transactionID, got, tt.want)
+		}
+	}
+}
+
+func TestGetOrderPayments(t *testing.T) {
+	ledgerStore = ledgermemory.New()
+	defer func() { ledgerStore = nil }()
+
+	for _, id := range []string{"1", "2"} {
+		if err := ledgerStore.Record(ledger.Entry{TransactionID: id, OrderID: "order-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An order without payments has an empty list, not an error
+	for orderID, want := range map[string]int{"order-1": 2, "order-2": 0} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.SetUserValue("orderID", orderID)
+
+		GetOrderPayments(ctx)
+
+		var entries []ledger.Entry
+		if err := json.Unmarshal(ctx.Response.Body(), &entries); err != nil {
+			t.Fatalf("GetOrderPayments() returned %q: %s", ctx.Response.Body(), err.Error())
+		}
+		if len(entries) != want {
+			t.Errorf("GetOrderPayments() of %s returned %d entries, want %d", orderID, len(entries), want)
+		}
+	}
+}
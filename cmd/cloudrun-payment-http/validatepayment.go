@@ -1,21 +1,24 @@
 package main
 
 import (
-	"log"
 	"net/http"
-	"time"
+	"strings"
 
-	"github.com/getsentry/sentry-go"
-	"github.com/gofrs/uuid"
 	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
 	"github.com/valyala/fasthttp"
 )
 
+// svc is the payment service used to validate the payments. The HTTP service
+// returns the result to the caller, and only sends events when an EventEmitter
+// is configured.
+var svc *payment.Service
+
 // ValidatePayment ...
 func ValidatePayment(ctx *fasthttp.RequestCtx) {
 	// Unmarshal the PaymentRequested event to a struct
-	req, err := acmeserverless.UnmarshalPaymentRequestedEvent(ctx.Request.Body())
+	req, err := events.UnmarshalPaymentRequestedEvent(ctx.Request.Body())
 	if err != nil {
 		ErrorHandler(ctx, "ValidatePayment", "UnmarshalPaymentRequestedEvent", err)
 		return
@@ -35,67 +38,28 @@ func ValidatePayment(ctx *fasthttp.RequestCtx) {
 		legacyPaymentType = true
 	}
 
-	// Send a breadcrumb to Sentry with the validation request
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.PaymentRequestedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(req.Data),
-	})
-
-	// Generate the event to emit
-	evt := acmeserverless.CreditCardValidatedEvent{
-		Metadata: acmeserverless.Metadata{
-			Domain: acmeserverless.PaymentDomain,
-			Source: "ValidateCreditCard",
-			Type:   acmeserverless.CreditCardValidatedEventName,
-			Status: "success",
-		},
-		Data: acmeserverless.CreditCardValidationDetails{
-			Success:       true,
-			Status:        http.StatusOK,
-			Message:       acmeserverless.DefaultSuccessStatus,
-			Amount:        req.Data.Total,
-			OrderID:       req.Data.OrderID,
-			TransactionID: uuid.Must(uuid.NewV4()).String(),
-		},
-	}
+	// Count attempts by the address of the client that sent the request
+	req.Data.ClientIP = clientIP(ctx)
 
-	// Check the creditcard is valid.
-	// If the creditcard is not valid, update the event to emit
-	// with new information
-	check := validator.New()
-	err = check.Creditcard(req.Data.Card)
+	// Validate the payment
+	evt, err := svc.Process(ctx, req)
 	if err != nil {
-		evt.Metadata.Status = "error"
-		evt.Data.Success = false
-		evt.Data.Status = http.StatusBadRequest
-		evt.Data.Message = acmeserverless.DefaultErrorStatus
-		evt.Data.TransactionID = "-1"
-		log.Println(err.Error())
+		ErrorHandler(ctx, "ValidatePayment", "Process", err)
+		return
 	}
 
-	// Send a breadcrumb to Sentry with the validation result
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.CreditCardValidatedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(evt.Data),
-	})
-
 	// If the total could not be parsed, it is likely an older Shop Payment request
 	// and should have a different response format.
 	var payload []byte
-	var e error
 	if legacyPaymentType {
-		payload, e = evt.Data.Marshal()
-		if e != nil {
+		payload, err = evt.Data.Marshal()
+		if err != nil {
 			ErrorHandler(ctx, "ValidatePayment", "MarshalLegacyPayment", err)
 			return
 		}
 	} else {
-		payload, e = evt.Marshal()
-		if e != nil {
+		payload, err = evt.Marshal()
+		if err != nil {
 			ErrorHandler(ctx, "ValidatePayment", "Marshal", err)
 			return
 		}
@@ -104,3 +68,28 @@ func ValidatePayment(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(http.StatusOK)
 	ctx.Write(payload)
 }
+
+// trustedProxies is the number of proxies in front of the service that add the address
+// they received the request from to the X-Forwarded-For header. On Google Cloud Run,
+// that is the Google Front End.
+var trustedProxies = 1
+
+// clientIP returns the IP address of the client that sent the request. The trusted proxies
+// in front of the service append the address they received the request from to the
+// X-Forwarded-For header, so the client address is the entry the first of them added.
+// The entries before it are sent by the client, and can't be trusted. Without trusted
+// proxies, the address of the connection is used.
+func clientIP(ctx *fasthttp.RequestCtx) string {
+	forwarded := string(ctx.Request.Header.Peek("X-Forwarded-For"))
+	if trustedProxies == 0 || len(forwarded) == 0 {
+		return ctx.RemoteIP().String()
+	}
+
+	entries := strings.Split(forwarded, ",")
+	i := len(entries) - trustedProxies
+	if i < 0 {
+		i = 0
+	}
+
+	return strings.TrimSpace(entries[i])
+}
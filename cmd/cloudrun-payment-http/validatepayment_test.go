@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(n int) { trustedProxies = n }(trustedProxies)
+
+	tests := []struct {
+		name      string
+		proxies   int
+		forwarded string
+		want      string
+	}{
+		{"address added by the proxy", 1, "203.0.113.7", "203.0.113.7"},
+		{"address sent by the client", 1, "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"addresses sent by the client", 1, "198.51.100.1,198.51.100.2,203.0.113.7", "203.0.113.7"},
+		{"two proxies", 2, "198.51.100.1, 203.0.113.7, 192.0.2.10", "203.0.113.7"},
+		{"fewer entries than proxies", 3, "203.0.113.7, 192.0.2.10", "203.0.113.7"},
+		{"no header", 1, "", "192.0.2.1"},
+		{"no trusted proxies", 0, "198.51.100.1", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = tt.proxies
+
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, nil)
+			if len(tt.forwarded) > 0 {
+				ctx.Request.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			if got := clientIP(&ctx); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
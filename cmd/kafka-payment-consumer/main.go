@@ -0,0 +1,232 @@
+// Package main is a payment service, because nothing in life is really free...
+//
+// The Payment service is part of the [ACME Fitness Serverless Shop](https://github.com/retgits/acme-serverless).
+// The goal of this specific service is to validate credit card payments. This consumer reads the
+// "PaymentRequested" events from a Kafka topic as part of a consumer group, and sends the resulting
+// "CreditCardValidated" events using the configured emitter. The offset of a message is committed
+// only after its result was sent, so a request is never lost when the consumer stops.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/getsentry/sentry-go"
+	"github.com/retgits/acme-serverless-payment/internal/config"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/kafka"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+)
+
+const (
+	// backoff is how long the consumer waits before it processes a message that
+	// failed the first time. It grows by the same amount for every attempt after that.
+	backoff = time.Second
+
+	// maxBackoff is the longest the consumer waits before it processes a
+	// message that failed again.
+	maxBackoff = 30 * time.Second
+)
+
+// consumer handles the messages of the partitions claimed by the consumer
+// group and implements the methods of the ConsumerGroupHandler interface.
+type consumer struct {
+	svc         *payment.Service
+	router      *deadletter.Router
+	relay       *outbox.Relay
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// Setup is called at the start of a new session, before the messages are consumed.
+func (c *consumer) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is called at the end of a session, after all messages are consumed.
+func (c *consumer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim processes the messages of a partition one at a time, in order, and
+// commits the offset of every message after its result was sent. A message that
+// fails is processed again, until it succeeds, is moved to the dead-letter queue,
+// or is dropped, so the messages after it are not processed before it.
+func (c *consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		if err := c.process(session.Context(), msg); err != nil {
+			// The session ended, so the message is consumed again by
+			// whichever consumer claims the partition next
+			return nil
+		}
+
+		session.MarkMessage(msg, "")
+		session.Commit()
+	}
+
+	return nil
+}
+
+// process passes the message to the payment service, and sends the events in the
+// outbox, until that succeeds, the message is moved to the dead-letter queue, or it
+// is dropped. It only returns an error when the context is done first.
+func (c *consumer) process(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	for attempts := 1; ; attempts++ {
+		err := c.handle(ctx, msg, attempts)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("error processing message %s/%d/%d, attempt %d: %s", msg.Topic, msg.Partition, msg.Offset, attempts, redact.String(err.Error()))
+
+		wait := time.Duration(attempts) * c.backoff
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// handle processes the message once. Messages that can't be processed are moved to
+// the dead-letter queue, when one is configured, as are messages that failed
+// maxAttempts times, so they don't hold up their partition. Without a dead-letter
+// queue, those messages are dropped: malformed messages right away, as processing
+// them again will never succeed, and others after maxAttempts attempts.
+func (c *consumer) handle(ctx context.Context, msg *sarama.ConsumerMessage, attempts int) error {
+	err := c.svc.Handle(ctx, msg.Value)
+
+	src := deadletter.Source{
+		Transport:   "kafka",
+		MessageID:   msg.Topic + "/" + strconv.Itoa(int(msg.Partition)) + "/" + strconv.FormatInt(msg.Offset, 10),
+		EventSource: msg.Topic,
+	}
+
+	switch {
+	case err == nil:
+	case c.router != nil && attempts >= c.maxAttempts:
+		err = c.router.RouteLast(ctx, msg.Value, err, attempts, src)
+	case c.router != nil:
+		err = c.router.Route(ctx, msg.Value, err, attempts, src)
+	case errors.Is(err, payment.ErrMalformedRequest):
+		log.Printf("dropping malformed message %s: %s", src.MessageID, redact.String(err.Error()))
+		err = nil
+	case attempts >= c.maxAttempts:
+		log.Printf("dropping message %s after %d attempts: %s", src.MessageID, attempts, redact.String(err.Error()))
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send the events in the outbox, so the offset is only committed when
+	// the result was sent
+	if c.relay != nil {
+		if _, err := c.relay.Drain(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	// Initialize a connection to Sentry to capture errors and traces
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:              os.Getenv("SENTRY_DSN"),
+		ServerName:       "kafka-payment-consumer",
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       redact.BeforeSend,
+		BeforeBreadcrumb: redact.BeforeBreadcrumb,
+	}); err != nil {
+		log.Fatalf("error configuring sentry: %s", err.Error())
+	}
+
+	// Get the topic with the payment requests, and the consumer group
+	topic := os.Getenv("KAFKA_REQUEST_TOPIC")
+	if topic == "" {
+		log.Fatal("the topic with the payment requests must be set with KAFKA_REQUEST_TOPIC")
+	}
+
+	group := os.Getenv("KAFKA_GROUP")
+	if group == "" {
+		group = "payment"
+	}
+
+	maxAttempts := 5
+	if v := os.Getenv("KAFKA_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("error parsing KAFKA_MAX_ATTEMPTS %q", v)
+		}
+		maxAttempts = n
+	}
+
+	// Create the payment service with the configuration in the environment.
+	// Events are sent to Kafka when no emitter is configured
+	svc, err := config.FromEnv(config.Platform{
+		Emitter: "kafka",
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	c := &consumer{
+		svc:         svc.Payment,
+		router:      svc.Router,
+		relay:       svc.Relay,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+
+	// Join the consumer group. Offsets are committed by the consumer after the
+	// result of a message was sent, and a new group starts at the oldest message
+	cfg, err := kafka.Config()
+	if err != nil {
+		log.Fatalf("error configuring kafka: %s", err.Error())
+	}
+	cfg.Consumer.Offsets.AutoCommit.Enable = false
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	consumerGroup, err := sarama.NewConsumerGroup(kafka.Brokers(), group, cfg)
+	if err != nil {
+		log.Fatalf("error joining consumer group %s: %s", group, err.Error())
+	}
+
+	// Stop consuming when the process is asked to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	log.Printf("consuming payment requests from %s as %s", topic, group)
+
+	// Consume is called again after every rebalance of the consumer group
+	for ctx.Err() == nil {
+		if err := consumerGroup.Consume(ctx, []string{topic}, c); err != nil {
+			log.Printf("error consuming %s: %s", topic, err.Error())
+			time.Sleep(time.Second)
+		}
+	}
+
+	if err := consumerGroup.Close(); err != nil {
+		log.Printf("error leaving consumer group %s: %s", group, err.Error())
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/creditcard"
+)
+
+const topic = "payment-requests"
+
+// journal records what happens to the messages, in order.
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) add(format string, args ...interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = append(j.entries, fmt.Sprintf(format, args...))
+}
+
+func (j *journal) String() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return strings.Join(j.entries, ", ")
+}
+
+// recorder is an EventEmitter that records the events it sends in the journal.
+// It fails the first failures events, or every event when failures is negative.
+type recorder struct {
+	journal  *journal
+	name     string
+	failures int
+	sent     []string
+}
+
+func (r *recorder) Send(ctx context.Context, e emitter.Event) error {
+	if r.failures != 0 {
+		r.failures--
+		r.journal.add("%s failed", r.name)
+		return errors.New("send failed")
+	}
+
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	r.sent = append(r.sent, string(payload))
+	r.journal.add("%s", r.name)
+
+	return nil
+}
+
+func (r *recorder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
+
+// session is a ConsumerGroupSession that records the offsets it marks and
+// commits in the journal.
+type session struct {
+	ctx     context.Context
+	journal *journal
+}
+
+func (s *session) Claims() map[string][]int32 { return map[string][]int32{topic: {0}} }
+func (s *session) MemberID() string           { return "member" }
+func (s *session) GenerationID() int32        { return 1 }
+func (s *session) Context() context.Context   { return s.ctx }
+func (s *session) Commit()                    { s.journal.add("commit") }
+
+func (s *session) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.journal.add("mark %d", offset)
+}
+
+func (s *session) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *session) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+// claim is a ConsumerGroupClaim of a partition with the messages.
+type claim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+// newClaim returns a claim with a message for every body.
+func newClaim(bodies ...[]byte) *claim {
+	c := &claim{messages: make(chan *sarama.ConsumerMessage, len(bodies))}
+	for i, body := range bodies {
+		c.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: 0, Offset: int64(i), Value: body}
+	}
+	close(c.messages)
+
+	return c
+}
+
+func (c *claim) Topic() string                            { return topic }
+func (c *claim) Partition() int32                         { return 0 }
+func (c *claim) InitialOffset() int64                     { return 0 }
+func (c *claim) HighWaterMarkOffset() int64               { return int64(len(c.messages)) }
+func (c *claim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// newConsumer returns a consumer that sends the events of the payment service
+// with the emitter, and moves requests to the dead-letter queue with the router.
+func newConsumer(em emitter.EventEmitter, router *deadletter.Router, maxAttempts int) *consumer {
+	return &consumer{
+		svc:         payment.New(validator.New(validator.DefaultRules()...), em),
+		router:      router,
+		maxAttempts: maxAttempts,
+		backoff:     time.Millisecond,
+	}
+}
+
+// request returns a request for a valid payment for the order.
+func request(t *testing.T, orderID string) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(events.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{Type: "PaymentRequestedEvent"},
+		Data: events.PaymentRequestDetails{
+			PaymentRequestDetails: acmeserverless.PaymentRequestDetails{
+				OrderID: orderID,
+				Total:   "10.00",
+				Card: creditcard.Card{
+					Type:        "Visa",
+					Number:      "4111111111111111",
+					ExpiryMonth: 12,
+					ExpiryYear:  2099,
+					CVV:         "123",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func TestCommitAfterEmit(t *testing.T) {
+	j := &journal{}
+	c := newConsumer(&recorder{journal: j, name: "send", failures: 1}, nil, 5)
+
+	s := &session{ctx: context.Background(), journal: j}
+	if err := c.ConsumeClaim(s, newClaim(request(t, "order-1"), request(t, "order-2"))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "send failed, send, mark 1, commit, send, mark 2, commit"
+	if j.String() != want {
+		t.Errorf("ConsumeClaim() did %s, want %s", j, want)
+	}
+}
+
+func TestMalformedMessagesAreSkipped(t *testing.T) {
+	j := &journal{}
+	c := newConsumer(&recorder{journal: j, name: "send"}, nil, 5)
+
+	s := &session{ctx: context.Background(), journal: j}
+	if err := c.ConsumeClaim(s, newClaim([]byte("not a payment request"), request(t, "order-1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "mark 1, commit, send, mark 2, commit"
+	if j.String() != want {
+		t.Errorf("ConsumeClaim() did %s, want %s", j, want)
+	}
+}
+
+func TestMaxAttemptsWithoutDeadLetterQueue(t *testing.T) {
+	j := &journal{}
+	c := newConsumer(&recorder{journal: j, name: "send", failures: 3}, nil, 3)
+
+	s := &session{ctx: context.Background(), journal: j}
+	if err := c.ConsumeClaim(s, newClaim(request(t, "order-1"), request(t, "order-2"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first message is skipped after three attempts, so the next one is processed
+	want := "send failed, send failed, send failed, mark 1, commit, send, mark 2, commit"
+	if j.String() != want {
+		t.Errorf("ConsumeClaim() did %s, want %s", j, want)
+	}
+}
+
+func TestMaxAttemptsWithDeadLetterQueue(t *testing.T) {
+	j := &journal{}
+	dlq := &recorder{journal: j, name: "dead-letter"}
+	router := deadletter.NewRouter(dlq, nil, deadletter.DefaultMaxAttempts)
+	c := newConsumer(&recorder{journal: j, name: "send", failures: -1}, router, 2)
+
+	s := &session{ctx: context.Background(), journal: j}
+	if err := c.ConsumeClaim(s, newClaim(request(t, "order-1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "send failed, send failed, dead-letter, mark 1, commit"
+	if j.String() != want {
+		t.Fatalf("ConsumeClaim() did %s, want %s", j, want)
+	}
+
+	m, err := deadletter.Unmarshal([]byte(dlq.sent[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Data.Class != deadletter.Exhausted || m.Data.Attempts != 2 || m.Data.OrderID != "order-1" || m.Data.Source.MessageID != topic+"/0/0" {
+		t.Errorf("dead-letter queue has a %s message %s for %q after %d attempts, want exhausted %s/0/0 for order-1 after 2", m.Data.Class, m.Data.Source.MessageID, m.Data.OrderID, m.Data.Attempts, topic)
+	}
+}
+
+func TestSessionEndWithoutCommit(t *testing.T) {
+	j := &journal{}
+	c := newConsumer(&recorder{journal: j, name: "send", failures: -1}, nil, 5)
+	c.backoff = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	s := &session{ctx: ctx, journal: j}
+	if err := c.ConsumeClaim(s, newClaim(request(t, "order-1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is consumed again in the next session
+	if j.String() != "send failed" {
+		t.Errorf("ConsumeClaim() did %s, want send failed", j)
+	}
+}
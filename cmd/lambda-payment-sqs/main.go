@@ -6,111 +6,120 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/getsentry/sentry-go"
-	"github.com/gofrs/uuid"
-	acmeserverless "github.com/retgits/acme-serverless"
-	"github.com/retgits/acme-serverless-payment/internal/emitter/sqs"
-	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/acme-serverless-payment/internal/config"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
 	wflambda "github.com/wavefronthq/wavefront-lambda-go"
 )
 
-// handler handles the SQS events and returns an error if anything goes wrong.
-// The resulting event, if no error is thrown, is sent to an SQS queue.
-func handler(request events.SQSEvent) error {
+// svc is the payment service. It is created once, so the emitter and the
+// stores are shared across invocations.
+var svc *config.Service
+
+// reportBatchItemFailures is true when the event source mapping has ReportBatchItemFailures
+// enabled as a function response type. Without it, Lambda ignores the partial batch response
+// and deletes every message of a batch that didn't return an error.
+var reportBatchItemFailures bool
+
+// errBatchItemFailures is returned when records of a batch could not be processed and the
+// event source mapping doesn't report batch item failures, so the batch is received again.
+var errBatchItemFailures = errors.New("not every record in the batch could be processed")
+
+// handler handles the SQS events and validates every record in the batch. The resulting events
+// are sent to an SQS queue. Records that could not be processed are reported back to Lambda as
+// a partial batch response, so only those messages are made visible on the queue again. When
+// the event source mapping doesn't report batch item failures, an error is returned instead,
+// so the whole batch is received again and the records that were processed are replayed.
+func handler(ctx context.Context, request events.SQSEvent) (events.SQSEventResponse, error) {
 	// Initiialize a connection to Sentry to capture errors and traces
 	sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
 		Transport: &sentry.HTTPSyncTransport{
 			Timeout: time.Second * 3,
 		},
-		ServerName:  os.Getenv("FUNCTION_NAME"),
-		Release:     os.Getenv("VERSION"),
-		Environment: os.Getenv("STAGE"),
+		ServerName:       os.Getenv("FUNCTION_NAME"),
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       redact.BeforeSend,
+		BeforeBreadcrumb: redact.BeforeBreadcrumb,
 	})
 
-	// Unmarshal the PaymentRequested event to a struct
-	req, err := acmeserverless.UnmarshalPaymentRequestedEvent([]byte(request.Records[0].Body))
-	if err != nil {
-		return handleError("unmarshaling payment", err)
+	res := events.SQSEventResponse{
+		BatchItemFailures: make([]events.SQSBatchItemFailure, 0),
 	}
 
-	// Send a breadcrumb to Sentry with the validation request
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.PaymentRequestedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(req.Data),
-	})
+	for _, record := range request.Records {
+		if err := processRecord(ctx, record); err != nil {
+			res.BatchItemFailures = append(res.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: record.MessageId,
+			})
+		}
+	}
 
-	// Generate the event to emit
-	evt := acmeserverless.CreditCardValidatedEvent{
-		Metadata: acmeserverless.Metadata{
-			Domain: acmeserverless.PaymentDomain,
-			Source: "ValidateCreditCard",
-			Type:   acmeserverless.CreditCardValidatedEventName,
-			Status: "success",
-		},
-		Data: acmeserverless.CreditCardValidationDetails{
-			Success:       true,
-			Status:        http.StatusOK,
-			Message:       acmeserverless.DefaultSuccessStatus,
-			Amount:        req.Data.Total,
-			OrderID:       req.Data.OrderID,
-			TransactionID: uuid.Must(uuid.NewV4()).String(),
-		},
+	// Send the events in the outbox. When that fails, all messages are made visible
+	// on the queue again, so the outbox is drained again when they are redelivered
+	if svc.Relay != nil {
+		if _, err := svc.Relay.Drain(ctx); err != nil {
+			log.Printf("error draining outbox: %s", redact.String(err.Error()))
+			res.BatchItemFailures = make([]events.SQSBatchItemFailure, len(request.Records))
+			for i, record := range request.Records {
+				res.BatchItemFailures[i] = events.SQSBatchItemFailure{
+					ItemIdentifier: record.MessageId,
+				}
+			}
+		}
 	}
 
-	// Check the creditcard is valid.
-	// If the creditcard is not valid, update the event to emit
-	// with new information
-	check := validator.New()
-	err = check.Creditcard(req.Data.Card)
-	if err != nil {
-		evt.Metadata.Status = "error"
-		evt.Data.Success = false
-		evt.Data.Status = http.StatusBadRequest
-		evt.Data.Message = acmeserverless.DefaultErrorStatus
-		evt.Data.TransactionID = "-1"
-		handleError("validating creditcard", err)
+	if len(res.BatchItemFailures) > 0 && !reportBatchItemFailures {
+		return res, errBatchItemFailures
 	}
 
-	// Send a breadcrumb to Sentry with the validation result
-	sentry.AddBreadcrumb(&sentry.Breadcrumb{
-		Category:  acmeserverless.CreditCardValidatedEventName,
-		Timestamp: time.Now(),
-		Level:     sentry.LevelInfo,
-		Data:      acmeserverless.ToSentryMap(evt.Data),
-	})
+	return res, nil
+}
 
-	// Create a new SQS EventEmitter and send the event
-	em := sqs.New()
-	err = em.Send(evt)
-	if err != nil {
-		return handleError("sending event", err)
+// processRecord passes the event in a single SQS message to the payment service.
+// An error is returned when the message could not be processed and should be retried.
+// Messages that can't be processed, because they are malformed or failed too often,
+// are moved to the dead-letter queue instead, when one is configured.
+func processRecord(ctx context.Context, record events.SQSMessage) error {
+	err := svc.Payment.Handle(ctx, []byte(record.Body))
+	if err == nil || svc.Router == nil {
+		return err
 	}
 
-	sentry.CaptureMessage(fmt.Sprintf("validation successful for order %s", req.Data.OrderID))
+	attempts, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
 
-	return nil
-}
-
-// handleError takes the activity where the error occured and the error object and sends a message to sentry.
-// The original error is returned so it can be thrown.
-func handleError(activity string, err error) error {
-	log.Printf("error %s: %s", activity, err.Error())
-	sentry.CaptureException(fmt.Errorf("error %s: %s", activity, err.Error()))
-	return err
+	return svc.Router.Route(ctx, []byte(record.Body), err, attempts, deadletter.Source{
+		Transport:   "sqs",
+		MessageID:   record.MessageId,
+		EventSource: record.EventSourceARN,
+	})
 }
 
 // The main method is executed by AWS Lambda and points to the handler
 func main() {
+	// Create the payment service with the configuration in the environment.
+	// Events are sent to SQS when no emitter is configured
+	var err error
+	svc, err = config.FromEnv(config.Platform{
+		Emitter:   "sqs",
+		Ephemeral: true,
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	reportBatchItemFailures = os.Getenv("REPORT_BATCH_ITEM_FAILURES") == "true"
+
 	lambda.Start(wflambda.Wrapper(handler))
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/config"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/creditcard"
+)
+
+// recorder is an EventEmitter that records the events it sends, and fails
+// while fail is set.
+type recorder struct {
+	sent []emitter.Event
+	fail bool
+}
+
+func (r *recorder) Send(ctx context.Context, e emitter.Event) error {
+	if r.fail {
+		return errors.New("send failed")
+	}
+	r.sent = append(r.sent, e)
+	return nil
+}
+
+func (r *recorder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
+
+// request returns an SQS message with a request for a valid payment for the order.
+func request(t *testing.T, orderID string) events.SQSMessage {
+	t.Helper()
+
+	body, err := json.Marshal(acmeserverless.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{Type: acmeserverless.PaymentRequestedEventName},
+		Data: acmeserverless.PaymentRequestDetails{
+			OrderID: orderID,
+			Total:   "10.00",
+			Card: creditcard.Card{
+				Type:        "Visa",
+				Number:      "4111111111111111",
+				ExpiryMonth: 12,
+				ExpiryYear:  2099,
+				CVV:         "123",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events.SQSMessage{MessageId: "msg-" + orderID, Body: string(body)}
+}
+
+func TestProcessRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  events.SQSMessage
+		fail    bool
+		wantErr bool
+		sent    int
+	}{
+		{"valid payment", request(t, "order-1"), false, false, 1},
+		{"malformed message", events.SQSMessage{MessageId: "msg-2", Body: "not a payment request"}, false, true, 0},
+		{"event can't be sent", request(t, "order-3"), true, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			em := &recorder{fail: tt.fail}
+			svc = &config.Service{Payment: payment.New(validator.New(), em)}
+
+			// Records that fail are reported, so only they are delivered again
+			err := processRecord(context.Background(), tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processRecord() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if len(em.sent) != tt.sent {
+				t.Errorf("processRecord() sent %d events, want %d", len(em.sent), tt.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Package main is a payment service, because nothing in life is really free...
+//
+// The Payment service is part of the [ACME Fitness Serverless Shop](https://github.com/retgits/acme-serverless).
+// The goal of this specific service is to validate credit card payments. This worker reads the
+// "PaymentRequested" events from a NATS JetStream stream with a durable pull consumer, and sends
+// the resulting "CreditCardValidated" events using the configured emitter. A message is acked only
+// after its result was sent, so a request is never lost when the worker stops.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/nats-io/nats.go"
+	"github.com/retgits/acme-serverless-payment/internal/config"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	natsemitter "github.com/retgits/acme-serverless-payment/internal/emitter/nats"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+)
+
+const (
+	// batchSize is the number of messages the worker fetches at once. A fetch only
+	// returns when the batch is full or the wait has passed, and the ack wait of the
+	// messages runs in the meantime, so the worker fetches a single message. Run more
+	// workers to process more messages at once.
+	batchSize = 1
+
+	// fetchWait is how long the worker waits for messages, before it fetches again.
+	fetchWait = 5 * time.Second
+
+	// nakDelay is how long the worker waits before it naks a message that failed
+	// the first time. It doubles for every delivery after that.
+	nakDelay = time.Second
+)
+
+// worker processes the messages of the durable consumer.
+type worker struct {
+	svc        *payment.Service
+	router     *deadletter.Router
+	relay      *outbox.Relay
+	maxDeliver int
+	ackWait    time.Duration
+	nakDelay   time.Duration
+}
+
+// process passes the message to the payment service, and sends the events in the
+// outbox, after which the message is acked. Messages that can't be processed are
+// moved to the dead-letter queue, when one is configured, and acked as well. On the
+// last delivery, a message that failed is moved to the dead-letter queue whatever
+// the failure, because JetStream doesn't deliver it again. Without a dead-letter
+// queue, malformed messages are terminated, so they are not delivered again. Other
+// failures are nacked after a backoff, so JetStream delivers the message again,
+// until it was delivered the maximum number of times.
+func (w *worker) process(ctx context.Context, msg *nats.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		log.Printf("error reading metadata of message on %s: %s", msg.Subject, err.Error())
+		return
+	}
+
+	id := fmt.Sprintf("%s/%d", meta.Stream, meta.Sequence.Stream)
+	attempts := int(meta.NumDelivered)
+
+	err = w.svc.Handle(ctx, msg.Data)
+
+	src := deadletter.Source{
+		Transport:   "nats",
+		MessageID:   id,
+		EventSource: msg.Subject,
+	}
+
+	switch {
+	case err == nil:
+	case w.router != nil && attempts >= w.maxDeliver:
+		err = w.router.RouteLast(ctx, msg.Data, err, attempts, src)
+	case w.router != nil:
+		err = w.router.Route(ctx, msg.Data, err, attempts, src)
+	case errors.Is(err, payment.ErrMalformedRequest):
+		log.Printf("terminating malformed message %s: %s", id, redact.String(err.Error()))
+		if err := msg.Term(); err != nil {
+			log.Printf("error terminating message %s: %s", id, err.Error())
+		}
+		return
+	}
+
+	// Send the events in the outbox, so the message is only acked when
+	// the result was sent
+	if err == nil && w.relay != nil {
+		_, err = w.relay.Drain(ctx)
+	}
+
+	if err != nil {
+		log.Printf("error processing message %s, delivery %d of %d: %s", id, attempts, w.maxDeliver, redact.String(err.Error()))
+		if attempts >= w.maxDeliver {
+			log.Printf("message %s was delivered %d times and is not delivered again", id, attempts)
+			return
+		}
+		w.nakAfter(msg, id, attempts)
+		return
+	}
+
+	if err := msg.AckSync(nats.Context(ctx)); err != nil {
+		log.Printf("error acking message %s: %s", id, err.Error())
+	}
+}
+
+// nakAfter naks the message once the backoff of the delivery has passed, so JetStream
+// delivers it again without waiting for the ack wait to pass, but doesn't deliver it
+// right away to a worker that fails in the same way. The backoff doubles with every
+// delivery, and stays below half of the ack wait. The worker goes on with other
+// messages in the meantime.
+func (w *worker) nakAfter(msg *nats.Msg, id string, attempts int) {
+	delay := w.nakDelay << uint(attempts-1)
+	if max := w.ackWait / 2; delay > max || delay <= 0 {
+		delay = max
+	}
+
+	time.AfterFunc(delay, func() {
+		if err := msg.Nak(); err != nil {
+			log.Printf("error nacking message %s: %s", id, err.Error())
+		}
+	})
+}
+
+func main() {
+	// Initialize a connection to Sentry to capture errors and traces
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:              os.Getenv("SENTRY_DSN"),
+		ServerName:       "nats-payment-worker",
+		Release:          os.Getenv("VERSION"),
+		Environment:      os.Getenv("STAGE"),
+		BeforeSend:       redact.BeforeSend,
+		BeforeBreadcrumb: redact.BeforeBreadcrumb,
+	}); err != nil {
+		log.Fatalf("error configuring sentry: %s", err.Error())
+	}
+
+	// Get the subject with the payment requests, the stream that captures it,
+	// and the durable consumer
+	subject := os.Getenv("NATS_REQUEST_SUBJECT")
+	if subject == "" {
+		log.Fatal("the subject with the payment requests must be set with NATS_REQUEST_SUBJECT")
+	}
+
+	stream := os.Getenv("NATS_STREAM")
+	if stream == "" {
+		stream = "PAYMENT_REQUESTS"
+	}
+
+	durable := os.Getenv("NATS_DURABLE")
+	if durable == "" {
+		durable = "payment"
+	}
+
+	maxDeliver := 5
+	if v := os.Getenv("NATS_MAX_DELIVER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("error parsing NATS_MAX_DELIVER %q", v)
+		}
+		maxDeliver = n
+	}
+
+	ackWait := 30 * time.Second
+	if v := os.Getenv("NATS_ACK_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("error parsing NATS_ACK_WAIT %q", v)
+		}
+		ackWait = d
+	}
+
+	// Create the payment service with the configuration in the environment.
+	// Events are sent to NATS when no emitter is configured
+	svc, err := config.FromEnv(config.Platform{
+		Emitter: "nats",
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	w := &worker{
+		svc:        svc.Payment,
+		router:     svc.Router,
+		relay:      svc.Relay,
+		maxDeliver: maxDeliver,
+		ackWait:    ackWait,
+		nakDelay:   nakDelay,
+	}
+
+	// Connect to NATS and create the stream for the payment requests, when it
+	// doesn't exist yet
+	nc, err := natsemitter.Connect()
+	if err != nil {
+		log.Fatalf("error connecting to NATS: %s", err.Error())
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("error connecting to JetStream: %s", err.Error())
+	}
+
+	if _, err := js.StreamInfo(stream); errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subject},
+		})
+		if err != nil {
+			log.Fatalf("error creating stream %s: %s", stream, err.Error())
+		}
+		log.Printf("created stream %s for %s", stream, subject)
+	} else if err != nil {
+		log.Fatalf("error reading stream %s: %s", stream, err.Error())
+	}
+
+	// Every worker fetches from the same durable consumer, so the messages are
+	// spread over the workers, and the consumer keeps track of the acks when
+	// all workers stop
+	sub, err := js.PullSubscribe(subject, durable,
+		nats.BindStream(stream),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.MaxDeliver(maxDeliver),
+		nats.AckWait(ackWait),
+	)
+	if err != nil {
+		log.Fatalf("error subscribing to %s: %s", subject, err.Error())
+	}
+
+	// Stop fetching when the process is asked to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	log.Printf("processing payment requests from %s as %s", subject, durable)
+
+	for ctx.Err() == nil {
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, fetchWait)
+		msgs, err := sub.Fetch(batchSize, nats.Context(fetchCtx))
+		fetchCancel()
+
+		if err != nil && ctx.Err() == nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("error fetching from %s: %s", subject, err.Error())
+			time.Sleep(time.Second)
+		}
+
+		for _, msg := range msgs {
+			w.process(ctx, msg)
+		}
+	}
+
+	if err := nc.Drain(); err != nil {
+		log.Printf("error closing connection: %s", err.Error())
+	}
+}
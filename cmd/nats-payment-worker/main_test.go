@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/creditcard"
+)
+
+const (
+	stream  = "PAYMENT_REQUESTS"
+	subject = "payment.requested"
+)
+
+// recorder is an EventEmitter that records the events it sends, and fails
+// while fail is set.
+type recorder struct {
+	mu   sync.Mutex
+	sent []string
+	fail bool
+}
+
+func (r *recorder) Send(ctx context.Context, e emitter.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fail {
+		return errors.New("send failed")
+	}
+
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	r.sent = append(r.sent, string(payload))
+
+	return nil
+}
+
+func (r *recorder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
+
+// count returns the number of events the recorder sent.
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sent)
+}
+
+// consumer starts a NATS server with JetStream, which is stopped when the test
+// ends, and returns a connection to it and a durable pull consumer of the stream
+// with the payment requests, which delivers a message up to maxDeliver times.
+func consumer(t *testing.T, maxDeliver int) (nats.JetStreamContext, *nats.Subscription) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "jetstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{subject}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := js.PullSubscribe(subject, "payment",
+		nats.BindStream(stream),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.MaxDeliver(maxDeliver),
+		nats.AckWait(10*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return js, sub
+}
+
+// newWorker returns a worker that sends the events of the payment service with
+// the emitter, and moves requests to the dead-letter queue with the router.
+func newWorker(em emitter.EventEmitter, router *deadletter.Router, maxDeliver int) *worker {
+	return &worker{
+		svc:        payment.New(validator.New(validator.DefaultRules()...), em),
+		router:     router,
+		maxDeliver: maxDeliver,
+		ackWait:    10 * time.Second,
+		nakDelay:   10 * time.Millisecond,
+	}
+}
+
+// publish publishes the payment request for the order.
+func publish(t *testing.T, js nats.JetStreamContext, body []byte) {
+	t.Helper()
+
+	if _, err := js.Publish(subject, body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// request returns a request for a valid payment for the order.
+func request(t *testing.T, orderID string) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(events.PaymentRequestedEvent{
+		Metadata: acmeserverless.Metadata{Type: "PaymentRequestedEvent"},
+		Data: events.PaymentRequestDetails{
+			PaymentRequestDetails: acmeserverless.PaymentRequestDetails{
+				OrderID: orderID,
+				Total:   "10.00",
+				Card: creditcard.Card{
+					Type:        "Visa",
+					Number:      "4111111111111111",
+					ExpiryMonth: 12,
+					ExpiryYear:  2099,
+					CVV:         "123",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// fetch returns the next message of the consumer, or nil when there is none
+// within the wait.
+func fetch(t *testing.T, sub *nats.Subscription, wait time.Duration) *nats.Msg {
+	t.Helper()
+
+	msgs, err := sub.Fetch(1, nats.MaxWait(wait))
+	if errors.Is(err, nats.ErrTimeout) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msgs[0]
+}
+
+// pending returns the number of messages that were delivered, but not acked.
+func pending(t *testing.T, sub *nats.Subscription) int {
+	t.Helper()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.NumAckPending
+}
+
+func TestAckAfterEmit(t *testing.T) {
+	js, sub := consumer(t, 5)
+	em := &recorder{fail: true}
+	w := newWorker(em, nil, 5)
+
+	publish(t, js, request(t, "order-1"))
+
+	// The event can't be sent, so the message isn't acked
+	w.process(context.Background(), fetch(t, sub, time.Second))
+
+	if em.count() != 0 || pending(t, sub) != 1 {
+		t.Fatalf("process() sent %d events and left %d messages pending, want 0 and 1", em.count(), pending(t, sub))
+	}
+
+	// The message is delivered again, and acked once the event was sent
+	em.mu.Lock()
+	em.fail = false
+	em.mu.Unlock()
+
+	msg := fetch(t, sub, time.Second)
+	if msg == nil {
+		t.Fatal("the message that failed wasn't delivered again")
+	}
+
+	w.process(context.Background(), msg)
+
+	if em.count() != 1 || pending(t, sub) != 0 {
+		t.Errorf("process() sent %d events and left %d messages pending, want 1 and 0", em.count(), pending(t, sub))
+	}
+}
+
+func TestMalformedMessagesAreTerminated(t *testing.T) {
+	js, sub := consumer(t, 5)
+	em := &recorder{}
+	w := newWorker(em, nil, 5)
+
+	publish(t, js, []byte("not a payment request"))
+
+	w.process(context.Background(), fetch(t, sub, time.Second))
+
+	if pending(t, sub) != 0 {
+		t.Errorf("process() left the malformed message pending")
+	}
+
+	if msg := fetch(t, sub, 200*time.Millisecond); msg != nil {
+		t.Errorf("the malformed message was delivered again")
+	}
+
+	if em.count() != 0 {
+		t.Errorf("process() sent %d events, want 0", em.count())
+	}
+}
+
+func TestRedeliveryLimit(t *testing.T) {
+	const maxDeliver = 3
+
+	js, sub := consumer(t, maxDeliver)
+	dlq := &recorder{}
+	w := newWorker(&recorder{fail: true}, deadletter.NewRouter(dlq, nil, deadletter.DefaultMaxAttempts), maxDeliver)
+
+	publish(t, js, request(t, "order-1"))
+
+	deliveries := 0
+	for msg := fetch(t, sub, time.Second); msg != nil; msg = fetch(t, sub, 200*time.Millisecond) {
+		deliveries++
+		w.process(context.Background(), msg)
+	}
+
+	if deliveries != maxDeliver {
+		t.Errorf("the message was delivered %d times, want %d", deliveries, maxDeliver)
+	}
+
+	// The last delivery moves the message to the dead-letter queue, even
+	// though it failed fewer than the maximum attempts of the router
+	if dlq.count() != 1 {
+		t.Fatalf("process() moved %d messages to the dead-letter queue, want 1", dlq.count())
+	}
+
+	m, err := deadletter.Unmarshal([]byte(dlq.sent[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Data.Class != deadletter.Exhausted || m.Data.Attempts != maxDeliver || m.Data.OrderID != "order-1" {
+		t.Errorf("dead-letter queue has a %s message for %q after %d attempts, want exhausted for order-1 after %d", m.Data.Class, m.Data.OrderID, m.Data.Attempts, maxDeliver)
+	}
+
+	if pending(t, sub) != 0 {
+		t.Errorf("process() left the message pending after moving it to the dead-letter queue")
+	}
+}
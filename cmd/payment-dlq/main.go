@@ -0,0 +1,346 @@
+// Package main is a command to inspect and redrive the dead-letter queue of the payment service.
+//
+// Payment requests that the Payment service can't process are moved to a dead-letter queue
+// in SQS. This command lists the messages in that queue, shows them without creditcard data,
+// and sends the original requests to the payment service again once the cause is fixed.
+//
+// Usage:
+//
+//	payment-dlq list    [flags] [message ID...]
+//	payment-dlq show    [flags] [message ID...]
+//	payment-dlq redrive [flags] (-queue ARN | -bus name | -emitter name) [message ID...]
+//
+// The messages can be selected by message ID, and with -class and -order. The dead-letter
+// queue is the SQS queue with the ARN or URL in -dlq, which defaults to DEADLETTER_QUEUE.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	deadlettersqs "github.com/retgits/acme-serverless-payment/internal/deadletter/sqs"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/all"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/eventbridge"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/sqs"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+)
+
+const usage = `Usage: payment-dlq <command> [flags] [message ID...]
+
+Commands:
+  list     List the messages in the dead-letter queue
+  show     Show the messages in the dead-letter queue, without creditcard data
+  redrive  Send the original requests to the payment service again, and remove
+           them from the dead-letter queue
+
+Flags:
+`
+
+// config contains the flags of the command.
+type config struct {
+	dlq        string
+	class      string
+	order      string
+	max        int
+	visibility time.Duration
+
+	queue   string
+	bus     string
+	emitter string
+	all     bool
+	dryRun  bool
+
+	ids map[string]bool
+}
+
+// item is a message read from the dead-letter queue. The receipt of the
+// entry is cleared when the message is deleted.
+type item struct {
+	entry   deadletter.Entry
+	message deadletter.Message
+	err     error
+}
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command := os.Args[1]
+
+	var cfg config
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&cfg.dlq, "dlq", os.Getenv("DEADLETTER_QUEUE"), "the ARN or URL of the dead-letter queue")
+	fs.StringVar(&cfg.class, "class", "", "select the messages with this class of failure, like malformed or exhausted")
+	fs.StringVar(&cfg.order, "order", "", "select the messages for this order ID")
+	fs.IntVar(&cfg.max, "max", 100, "the maximum number of messages to read from the dead-letter queue")
+	fs.DurationVar(&cfg.visibility, "visibility", 30*time.Second, "how long the messages are hidden from other readers while they are read")
+	fs.StringVar(&cfg.queue, "queue", "", "redrive to the SQS queue with this ARN or URL")
+	fs.StringVar(&cfg.bus, "bus", "", "redrive to the EventBridge bus with this name")
+	fs.StringVar(&cfg.emitter, "emitter", "", "redrive with the emitter with this name, like stdout")
+	fs.BoolVar(&cfg.all, "all", false, "redrive all messages when none are selected")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "show which messages would be redriven, without sending or removing them")
+	fs.Parse(os.Args[2:])
+
+	cfg.ids = make(map[string]bool)
+	for _, id := range fs.Args() {
+		cfg.ids[id] = true
+	}
+
+	if len(cfg.dlq) == 0 {
+		log.Fatal("the dead-letter queue must be set with -dlq or DEADLETTER_QUEUE")
+	}
+
+	var run func(context.Context, io.Writer, deadletter.Queue, []*item, config) error
+	switch command {
+	case "list":
+		run = list
+	case "show":
+		run = show
+	case "redrive":
+		run = redrive
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	q, err := deadlettersqs.New(cfg.dlq)
+	if err != nil {
+		log.Fatalf("error configuring dead-letter queue: %s", err.Error())
+	}
+
+	ctx := context.Background()
+
+	items, err := receive(ctx, q, cfg)
+	if err != nil {
+		err = fmt.Errorf("error reading dead-letter queue: %s", err.Error())
+	} else {
+		err = run(ctx, os.Stdout, q, filter(items, cfg), cfg)
+	}
+
+	// Make the messages that are left visible again, so they don't stay hidden
+	// until the visibility timeout passes
+	release(ctx, q, items)
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// receive reads up to max messages from the dead-letter queue. The messages are hidden
+// from other readers until they are released, so every message is read once.
+func receive(ctx context.Context, q deadletter.Queue, cfg config) ([]*item, error) {
+	items := make([]*item, 0)
+	seen := make(map[string]bool)
+
+	for len(items) < cfg.max {
+		entries, err := q.Receive(ctx, cfg.max-len(items), cfg.visibility)
+		if err != nil {
+			return items, err
+		}
+
+		if len(entries) == 0 {
+			return items, nil
+		}
+
+		for _, e := range entries {
+			if seen[e.ID] {
+				continue
+			}
+			seen[e.ID] = true
+
+			m, err := deadletter.Unmarshal(e.Body)
+			items = append(items, &item{entry: e, message: m, err: err})
+		}
+	}
+
+	return items, nil
+}
+
+// release makes the messages that were read, and not deleted, visible again.
+func release(ctx context.Context, q deadletter.Queue, items []*item) {
+	for _, i := range items {
+		if len(i.entry.Receipt) == 0 {
+			continue
+		}
+
+		if err := q.Release(ctx, i.entry); err != nil {
+			log.Printf("error releasing message %s: %s", i.entry.ID, err.Error())
+		}
+	}
+}
+
+// filter returns the messages that are selected by message ID, class, and order ID.
+// Messages that could not be parsed only match when no class or order ID is set.
+func filter(items []*item, cfg config) []*item {
+	selected := make([]*item, 0, len(items))
+
+	for _, i := range items {
+		switch {
+		case len(cfg.ids) > 0 && !cfg.ids[i.entry.ID]:
+		case len(cfg.class) > 0 && (i.err != nil || string(i.message.Data.Class) != cfg.class):
+		case len(cfg.order) > 0 && (i.err != nil || i.message.Data.OrderID != cfg.order):
+		default:
+			selected = append(selected, i)
+		}
+	}
+
+	return selected
+}
+
+// list prints a line for every message.
+func list(ctx context.Context, out io.Writer, q deadletter.Queue, items []*item, cfg config) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLASS\tATTEMPTS\tORDER\tFAILED AT\tERROR")
+
+	for _, i := range items {
+		if i.err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\tcan't parse message: %s\n", i.entry.ID, redact.String(i.err.Error()))
+			continue
+		}
+
+		d := i.message.Data
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", i.entry.ID, d.Class, d.Attempts, d.OrderID, d.FailedAt.Format(time.RFC3339), redact.String(d.Error))
+	}
+
+	return w.Flush()
+}
+
+// show prints every message as JSON, with the creditcard data redacted from
+// the original request.
+func show(ctx context.Context, out io.Writer, q deadletter.Queue, items []*item, cfg config) error {
+	for _, i := range items {
+		shown := struct {
+			ID      string          `json:"id"`
+			Message json.RawMessage `json:"message,omitempty"`
+			Body    string          `json:"body,omitempty"`
+			Error   string          `json:"error,omitempty"`
+		}{
+			ID: i.entry.ID,
+		}
+
+		// Messages that can't be parsed are shown as text
+		if i.err != nil {
+			shown.Body = redact.String(string(i.entry.Body))
+			shown.Error = fmt.Sprintf("can't parse message: %s", redact.String(i.err.Error()))
+		} else {
+			m := i.message
+			m.Data.Body = string(redact.JSON([]byte(m.Data.Body)))
+			m.Data.Error = redact.String(m.Data.Error)
+
+			payload, err := m.Marshal()
+			if err != nil {
+				return err
+			}
+			shown.Message = payload
+		}
+
+		payload, err := json.MarshalIndent(shown, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(payload))
+	}
+
+	return nil
+}
+
+// redrive sends the original requests of the messages with the emitter selected
+// by the flags, and deletes the messages that were sent from the dead-letter queue.
+func redrive(ctx context.Context, out io.Writer, q deadletter.Queue, items []*item, cfg config) error {
+	if len(cfg.ids) == 0 && len(cfg.class) == 0 && len(cfg.order) == 0 && !cfg.all {
+		return errors.New("select the messages to redrive with message IDs, -class, or -order, or pass -all")
+	}
+
+	em, target, err := redriveEmitter(cfg)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, i := range items {
+		if i.err != nil {
+			log.Printf("skipping message %s, can't parse message: %s", i.entry.ID, redact.String(i.err.Error()))
+			failed++
+			continue
+		}
+
+		req, err := i.message.Request()
+		if err != nil {
+			log.Printf("skipping message %s: %s", i.entry.ID, err.Error())
+			failed++
+			continue
+		}
+
+		if cfg.dryRun {
+			fmt.Fprintf(out, "would redrive %s (order %s) to %s\n", i.entry.ID, i.message.Data.OrderID, target)
+			continue
+		}
+
+		if err := em.Send(ctx, req); err != nil {
+			log.Printf("error redriving message %s: %s", i.entry.ID, redact.String(err.Error()))
+			failed++
+			continue
+		}
+
+		if err := q.Delete(ctx, i.entry); err != nil {
+			log.Printf("message %s was redriven, but could not be removed from the dead-letter queue: %s", i.entry.ID, err.Error())
+			failed++
+			continue
+		}
+
+		// The message is gone, so it doesn't need to be released
+		i.entry.Receipt = ""
+		fmt.Fprintf(out, "redrove %s (order %s) to %s\n", i.entry.ID, i.message.Data.OrderID, target)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages were not redriven", failed, len(items))
+	}
+
+	return nil
+}
+
+// redriveEmitter returns the EventEmitter selected by the flags, and a description
+// of where it sends the requests.
+func redriveEmitter(cfg config) (emitter.EventEmitter, string, error) {
+	var em emitter.EventEmitter
+	var target string
+	var err error
+
+	switch {
+	case len(cfg.queue) > 0:
+		em, err = sqs.NewQueue(cfg.queue)
+		target = cfg.queue
+	case len(cfg.bus) > 0:
+		em, err = eventbridge.NewBus(cfg.bus)
+		target = cfg.bus
+	case len(cfg.emitter) > 0:
+		em, err = emitter.New(cfg.emitter)
+		target = cfg.emitter
+	default:
+		return nil, "", errors.New("the target must be set with -queue, -bus, or -emitter")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error configuring %s: %s", target, err.Error())
+	}
+
+	return em, target, nil
+}
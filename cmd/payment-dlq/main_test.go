@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+// queue is a dead-letter queue that records which messages were deleted
+// and released.
+type queue struct {
+	deleted  []string
+	released []string
+}
+
+func (q *queue) Receive(ctx context.Context, max int, visibility time.Duration) ([]deadletter.Entry, error) {
+	return nil, nil
+}
+
+func (q *queue) Delete(ctx context.Context, e deadletter.Entry) error {
+	q.deleted = append(q.deleted, e.ID)
+	return nil
+}
+
+func (q *queue) Release(ctx context.Context, e deadletter.Entry) error {
+	q.released = append(q.released, e.ID)
+	return nil
+}
+
+// recorder is an EventEmitter that records the events it sends, and fails
+// for the events of the orders in fail.
+type recorder struct {
+	mu   sync.Mutex
+	sent []string
+	fail map[string]bool
+}
+
+func (r *recorder) Send(ctx context.Context, e emitter.Event) error {
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if r.fail[deadletter.OrderID(payload)] {
+		return errors.New("send failed")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, string(payload))
+
+	return nil
+}
+
+func (r *recorder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
+
+// sent is the recorder that the test emitter is created with.
+var sent *recorder
+
+func init() {
+	emitter.Register("test", func() (emitter.EventEmitter, error) {
+		return sent, nil
+	})
+}
+
+// newItem returns a message in the dead-letter queue with the class, for the order.
+func newItem(t *testing.T, id string, class deadletter.Class, orderID string) *item {
+	t.Helper()
+
+	m := deadletter.Message{
+		Data: deadletter.Details{
+			Body:     `{"metadata":{"type":"PaymentRequestedEvent"},"data":{"orderID":"` + orderID + `"}}`,
+			Class:    class,
+			Attempts: 1,
+			OrderID:  orderID,
+		},
+	}
+
+	payload, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &item{
+		entry:   deadletter.Entry{ID: id, Receipt: "receipt-" + id, Body: payload},
+		message: m,
+	}
+}
+
+// unparseable returns a message in the dead-letter queue that can't be parsed.
+func unparseable(id string, body string) *item {
+	return &item{
+		entry: deadletter.Entry{ID: id, Receipt: "receipt-" + id, Body: []byte(body)},
+		err:   errors.New("invalid character"),
+	}
+}
+
+// ids returns the message IDs of the items.
+func ids(items []*item) []string {
+	r := make([]string, len(items))
+	for i := range items {
+		r[i] = items[i].entry.ID
+	}
+	return r
+}
+
+func TestFilter(t *testing.T) {
+	items := []*item{
+		newItem(t, "1", deadletter.Malformed, "order-1"),
+		newItem(t, "2", deadletter.Exhausted, "order-1"),
+		newItem(t, "3", deadletter.Malformed, "order-2"),
+		unparseable("4", "not a message"),
+	}
+
+	tests := []struct {
+		name string
+		cfg  config
+		want []string
+	}{
+		{"everything", config{}, []string{"1", "2", "3", "4"}},
+		{"message IDs", config{ids: map[string]bool{"2": true, "4": true}}, []string{"2", "4"}},
+		{"class", config{class: "malformed"}, []string{"1", "3"}},
+		{"order", config{order: "order-1"}, []string{"1", "2"}},
+		{"class and order", config{class: "malformed", order: "order-1"}, []string{"1"}},
+		{"message IDs and class", config{ids: map[string]bool{"1": true, "2": true}, class: "exhausted"}, []string{"2"}},
+		{"nothing matches", config{order: "order-3"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(filter(items, tt.cfg))
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config
+		items    func(t *testing.T) []*item
+		fail     map[string]bool
+		wantErr  bool
+		sent     int
+		deleted  []string
+		receipts []string
+	}{
+		{
+			name:     "no selection",
+			cfg:      config{emitter: "test"},
+			items:    func(t *testing.T) []*item { return []*item{newItem(t, "1", deadletter.Malformed, "order-1")} },
+			wantErr:  true,
+			receipts: []string{"receipt-1"},
+		},
+		{
+			name:     "no target",
+			cfg:      config{all: true},
+			items:    func(t *testing.T) []*item { return []*item{newItem(t, "1", deadletter.Malformed, "order-1")} },
+			wantErr:  true,
+			receipts: []string{"receipt-1"},
+		},
+		{
+			name: "dry run",
+			cfg:  config{emitter: "test", all: true, dryRun: true},
+			items: func(t *testing.T) []*item {
+				return []*item{newItem(t, "1", deadletter.Malformed, "order-1"), newItem(t, "2", deadletter.Exhausted, "order-2")}
+			},
+			receipts: []string{"receipt-1", "receipt-2"},
+		},
+		{
+			name: "all",
+			cfg:  config{emitter: "test", all: true},
+			items: func(t *testing.T) []*item {
+				return []*item{newItem(t, "1", deadletter.Malformed, "order-1"), newItem(t, "2", deadletter.Exhausted, "order-2")}
+			},
+			sent:     2,
+			deleted:  []string{"1", "2"},
+			receipts: []string{"", ""},
+		},
+		{
+			name: "send fails",
+			cfg:  config{emitter: "test", class: "malformed"},
+			items: func(t *testing.T) []*item {
+				return []*item{newItem(t, "1", deadletter.Malformed, "order-1"), newItem(t, "2", deadletter.Malformed, "order-2")}
+			},
+			fail:     map[string]bool{"order-1": true},
+			wantErr:  true,
+			sent:     1,
+			deleted:  []string{"2"},
+			receipts: []string{"receipt-1", ""},
+		},
+		{
+			name: "unparseable message",
+			cfg:  config{emitter: "test", all: true},
+			items: func(t *testing.T) []*item {
+				return []*item{unparseable("1", "not a message"), newItem(t, "2", deadletter.Malformed, "order-2")}
+			},
+			wantErr:  true,
+			sent:     1,
+			deleted:  []string{"2"},
+			receipts: []string{"receipt-1", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = &recorder{fail: tt.fail}
+			q := &queue{}
+			items := tt.items(t)
+
+			var out bytes.Buffer
+			err := redrive(context.Background(), &out, q, items, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("redrive() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if len(sent.sent) != tt.sent {
+				t.Errorf("redrive() sent %d requests, want %d", len(sent.sent), tt.sent)
+			}
+
+			if strings.Join(q.deleted, ",") != strings.Join(tt.deleted, ",") {
+				t.Errorf("redrive() deleted %v, want %v", q.deleted, tt.deleted)
+			}
+
+			if len(q.released) > 0 {
+				t.Errorf("redrive() released %v, want none", q.released)
+			}
+
+			for i, receipt := range tt.receipts {
+				if items[i].entry.Receipt != receipt {
+					t.Errorf("receipt of message %s = %q, want %q", items[i].entry.ID, items[i].entry.Receipt, receipt)
+				}
+			}
+
+			if tt.cfg.dryRun && strings.Count(out.String(), "would redrive") != len(items) {
+				t.Errorf("redrive() printed %q, want a line for every message", out.String())
+			}
+		})
+	}
+}
+
+func TestRedriveSendsOriginalRequest(t *testing.T) {
+	sent = &recorder{}
+	i := newItem(t, "1", deadletter.Malformed, "order-1")
+
+	if err := redrive(context.Background(), &bytes.Buffer{}, &queue{}, []*item{i}, config{emitter: "test", all: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent.sent) != 1 || sent.sent[0] != i.message.Data.Body {
+		t.Errorf("redrive() sent %v, want %s", sent.sent, i.message.Data.Body)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	items := []*item{
+		newItem(t, "1", deadletter.Malformed, "order-1"),
+		newItem(t, "2", deadletter.Malformed, "order-2"),
+	}
+	items[0].entry.Receipt = ""
+
+	q := &queue{}
+	release(context.Background(), q, items)
+
+	if strings.Join(q.released, ",") != "2" {
+		t.Errorf("release() released %v, want [2]", q.released)
+	}
+}
+
+func TestShowRedactsCreditcardData(t *testing.T) {
+	parsed := newItem(t, "1", deadletter.Malformed, "order-1")
+	parsed.message.Data.Body = `{"data":{"orderID":"order-1","card":{"Number":4111111111111111,"CVV":"123","ExpiryYear":2030}}}`
+	parsed.message.Data.Error = "can't charge 4111111111111111"
+
+	items := []*item{
+		parsed,
+		unparseable("2", `{"data":{"card":{"number":"4111111111111111","cvv":"987"`),
+	}
+
+	var out bytes.Buffer
+	if err := show(context.Background(), &out, &queue{}, items, config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"4111111111111111", "123", "987", "2030"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("show() printed %q:\n%s", secret, out.String())
+		}
+	}
+
+	if !strings.Contains(out.String(), "411111******1111") {
+		t.Errorf("show() didn't print the masked card number:\n%s", out.String())
+	}
+}
+
+func TestRedriveSkipsCreditcardRequests(t *testing.T) {
+	// The order of a request with creditcard data was rejected when it was
+	// moved, and only the redacted request was kept
+	redacted := newItem(t, "1", deadletter.Malformed, "order-1")
+	redacted.message.Data.Redacted = true
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	sent = &recorder{}
+	q := &queue{}
+	err := redrive(context.Background(), &bytes.Buffer{}, q, []*item{redacted, newItem(t, "2", deadletter.Malformed, "order-2")}, config{emitter: "test", all: true})
+	if err == nil {
+		t.Errorf("redrive() of a request with creditcard data returned no error")
+	}
+
+	if len(sent.sent) != 1 || strings.Join(q.deleted, ",") != "2" {
+		t.Errorf("redrive() sent %v and deleted %v, want only the request of order-2", sent.sent, q.deleted)
+	}
+
+	if !strings.Contains(logged.String(), "order-1") {
+		t.Errorf("redrive() logged %q, want the order of the skipped request", logged.String())
+	}
+}
@@ -5,17 +5,34 @@ replace github.com/wavefronthq/wavefront-lambda-go => github.com/retgits/wavefro
 go 1.14
 
 require (
-	github.com/aws/aws-lambda-go v1.16.0
+	cloud.google.com/go/pubsub v1.3.1
+	github.com/Shopify/sarama v1.30.0
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/aws/aws-lambda-go v1.28.0
 	github.com/aws/aws-sdk-go v1.30.7
 	github.com/fasthttp/router v1.0.2
 	github.com/getsentry/sentry-go v0.6.0
+	github.com/go-redis/redis/v7 v7.4.1
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/gomodule/redigo v1.8.2 // indirect
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/nats-io/nats-server/v2 v2.5.0
+	github.com/nats-io/nats.go v1.12.3
 	github.com/pulumi/pulumi-aws/sdk/v2 v2.0.0
 	github.com/pulumi/pulumi/sdk/v2 v2.0.0
+	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/retgits/acme-serverless v0.3.0
 	github.com/retgits/creditcard v0.6.0
 	github.com/retgits/gcr-wavefront v0.3.0
 	github.com/retgits/pulumi-helpers/v2 v2.0.0
 	github.com/valyala/fasthttp v1.10.0
 	github.com/wavefronthq/wavefront-lambda-go v0.0.0-20190812171804-d9475d6695cc
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
+	go.etcd.io/bbolt v1.3.4
+	google.golang.org/api v0.20.0
+	google.golang.org/genproto v0.0.0-20200312145019-da6875a35672
+	google.golang.org/grpc v1.28.0
+	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -0,0 +1,318 @@
+// Package config creates the Payment service and everything around it from the
+// environment: the emitter, the dead-letter queue, the outbox, and the stores the
+// service uses. Every entrypoint is configured in the same way, so it only has to
+// pass the requests that arrive over its transport to the service.
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/all"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/retry"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+	idempotencydynamodb "github.com/retgits/acme-serverless-payment/internal/idempotency/dynamodb"
+	idempotencymemory "github.com/retgits/acme-serverless-payment/internal/idempotency/memory"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	ledgerbolt "github.com/retgits/acme-serverless-payment/internal/ledger/bolt"
+	ledgerdynamodb "github.com/retgits/acme-serverless-payment/internal/ledger/dynamodb"
+	ledgermemory "github.com/retgits/acme-serverless-payment/internal/ledger/memory"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	outboxbolt "github.com/retgits/acme-serverless-payment/internal/outbox/bolt"
+	outboxdynamodb "github.com/retgits/acme-serverless-payment/internal/outbox/dynamodb"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/risk"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/acme-serverless-payment/internal/vault"
+	vaultdynamodb "github.com/retgits/acme-serverless-payment/internal/vault/dynamodb"
+	vaultfile "github.com/retgits/acme-serverless-payment/internal/vault/file"
+	"github.com/retgits/acme-serverless-payment/internal/velocity"
+	velocitymemory "github.com/retgits/acme-serverless-payment/internal/velocity/memory"
+	velocityredis "github.com/retgits/acme-serverless-payment/internal/velocity/redis"
+)
+
+// Platform describes where an entrypoint runs, which determines the defaults
+// and the backends that can be used.
+type Platform struct {
+	// Emitter is the name of the EventEmitter that is used when EMITTER isn't
+	// set. When both are empty, events are not sent, but only returned to the
+	// caller.
+	Emitter string
+
+	// Ephemeral means the service runs in short-lived instances that don't share
+	// their memory or disk, like AWS Lambda functions, so backends that keep
+	// their data in a local file can't be used.
+	Ephemeral bool
+
+	// Ledger means the service always keeps a ledger, in memory when neither
+	// LEDGER_TABLE nor LEDGER_FILE is set.
+	Ledger bool
+}
+
+// Service is the payment service together with the dependencies that the
+// entrypoints use next to it.
+type Service struct {
+	// Payment is the payment service.
+	Payment *payment.Service
+
+	// Emitter sends the events of the service, or is nil when events are
+	// only returned to the caller.
+	Emitter emitter.EventEmitter
+
+	// Router moves the requests that can't be processed to the dead-letter
+	// queue, or is nil when no dead-letter queue is configured.
+	Router *deadletter.Router
+
+	// Relay sends the events in the outbox, or is nil when the service
+	// doesn't have an outbox.
+	Relay *outbox.Relay
+
+	// Ledger is the ledger of the service, or is nil when the service
+	// doesn't keep one.
+	Ledger ledger.Store
+}
+
+// FromEnv creates the payment service for the platform with the configuration in
+// the environment. It returns an error if anything is configured incorrectly, or
+// a store could not be opened.
+func FromEnv(p Platform) (*Service, error) {
+	s := &Service{}
+	var opts []payment.Option
+	var err error
+
+	// Send the events using the EventEmitter configured in the environment,
+	// or the default of the platform when none is configured
+	s.Emitter, err = emitter.FromEnv(p.Emitter)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring emitter: %s", err.Error())
+	}
+
+	// Send events again when sending fails with a transient error, and stop
+	// sending while the messaging service keeps failing
+	if s.Emitter != nil {
+		s.Emitter, err = retry.FromEnv(s.Emitter)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring emitter retries: %s", err.Error())
+		}
+	}
+
+	// Move the requests that can't be processed to the dead-letter queue
+	// configured in the environment
+	s.Router, err = deadletter.FromEnv(s.Emitter)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring dead-letter queue: %s", err.Error())
+	}
+
+	// Write the events to the outbox when one is configured, and have the
+	// entrypoint send them from there, so an event is never lost
+	if s.Emitter != nil {
+		store, err := outboxFromEnv(p)
+		if err != nil {
+			return nil, err
+		}
+		if store != nil {
+			opts = append(opts, payment.WithOutbox(store))
+			s.Relay = outbox.NewRelay(store, s.Emitter)
+		}
+	}
+
+	// Create the validator with the rules configured in the environment
+	check, err := validator.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error configuring validator: %s", err.Error())
+	}
+
+	// Keep track of processed payment requests in DynamoDB when a table
+	// is configured, otherwise keep them in memory
+	store, secret, err := idempotencyFromEnv(p)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, payment.WithIdempotencyStore(store, idempotency.DefaultTTL, secret))
+
+	// Record every validation attempt in the ledger when one is configured
+	s.Ledger, err = ledgerFromEnv(p)
+	if err != nil {
+		return nil, err
+	}
+	if s.Ledger != nil {
+		opts = append(opts, payment.WithLedger(s.Ledger))
+	}
+
+	// Assess the risk of payments with the thresholds configured in the environment.
+	// The history of the scorer is kept in memory, so it uses a random secret to
+	// fingerprint creditcards when none is set
+	riskSecret, err := risk.KeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error configuring risk scoring: %s", err.Error())
+	}
+	if riskSecret == nil {
+		if riskSecret, err = risk.NewKey(); err != nil {
+			return nil, fmt.Errorf("error configuring risk scoring: %s", err.Error())
+		}
+	}
+	scorer, err := risk.FromEnv(riskSecret)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring risk scoring: %s", err.Error())
+	}
+	opts = append(opts, payment.WithRiskScorer(scorer))
+
+	// Limit payment attempts, counted in Redis when a server is configured,
+	// otherwise in memory
+	counter, secret, err := velocityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := velocity.FromEnv(counter, secret)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring velocity limits: %s", err.Error())
+	}
+	opts = append(opts, payment.WithVelocityLimiter(limiter))
+
+	// Exchange creditcards for tokens when a vault is configured
+	v, err := vaultFromEnv(p)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		opts = append(opts, payment.WithVault(v))
+	}
+
+	s.Payment = payment.New(check, s.Emitter, opts...)
+
+	return s, nil
+}
+
+// outboxFromEnv returns the outbox in the DynamoDB table in OUTBOX_TABLE, or in
+// the BoltDB file in OUTBOX_FILE. When neither is set, it returns nil.
+func outboxFromEnv(p Platform) (outbox.Store, error) {
+	switch {
+	case os.Getenv("OUTBOX_TABLE") != "":
+		return outboxdynamodb.New(), nil
+	case os.Getenv("OUTBOX_FILE") != "":
+		if p.Ephemeral {
+			return nil, fmt.Errorf("OUTBOX_FILE can't be used on this platform, set OUTBOX_TABLE instead")
+		}
+		store, err := outboxbolt.New()
+		if err != nil {
+			return nil, fmt.Errorf("error opening outbox: %s", err.Error())
+		}
+		return store, nil
+	default:
+		return nil, nil
+	}
+}
+
+// idempotencyFromEnv returns the idempotency store in the DynamoDB table in
+// IDEMPOTENCY_TABLE, or in memory when it isn't set, together with the secret
+// the keys of the records are derived with. A table is shared between instances,
+// so it needs the secret in IDEMPOTENCY_KEY. The records in memory don't outlive
+// the instance, so they use a random secret when none is set. On platforms with
+// short-lived instances, records in memory hardly ever catch a redelivery, which
+// is logged as a warning.
+func idempotencyFromEnv(p Platform) (idempotency.Store, []byte, error) {
+	secret, err := idempotency.KeyFromEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring idempotency: %s", err.Error())
+	}
+
+	if os.Getenv("IDEMPOTENCY_TABLE") != "" {
+		if secret == nil {
+			return nil, nil, fmt.Errorf("error configuring idempotency: IDEMPOTENCY_KEY must be set together with IDEMPOTENCY_TABLE")
+		}
+		return idempotencydynamodb.New(), secret, nil
+	}
+
+	if p.Ephemeral {
+		log.Printf("warning: IDEMPOTENCY_TABLE is not set, so redelivered payment requests that reach another instance are processed again")
+	}
+
+	if secret == nil {
+		if secret, err = idempotency.NewKey(); err != nil {
+			return nil, nil, fmt.Errorf("error configuring idempotency: %s", err.Error())
+		}
+	}
+
+	return idempotencymemory.New(), secret, nil
+}
+
+// velocityFromEnv returns the counter in the Redis server in REDIS_ADDR, or in
+// memory when it isn't set, together with the secret the keys of the counters
+// are derived with. A Redis server is shared between instances, so it needs the
+// secret in VELOCITY_KEY. The counters in memory don't outlive the instance, so
+// they use a random secret when none is set.
+func velocityFromEnv() (velocity.Counter, []byte, error) {
+	secret, err := velocity.KeyFromEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring velocity limits: %s", err.Error())
+	}
+
+	if os.Getenv("REDIS_ADDR") != "" {
+		if secret == nil {
+			return nil, nil, fmt.Errorf("error configuring velocity limits: VELOCITY_KEY must be set together with REDIS_ADDR")
+		}
+		return velocityredis.New(), secret, nil
+	}
+
+	if secret == nil {
+		if secret, err = velocity.NewKey(); err != nil {
+			return nil, nil, fmt.Errorf("error configuring velocity limits: %s", err.Error())
+		}
+	}
+
+	return velocitymemory.New(), secret, nil
+}
+
+// ledgerFromEnv returns the ledger in the DynamoDB table in LEDGER_TABLE, or in
+// the BoltDB file in LEDGER_FILE. When neither is set, it returns a ledger in
+// memory when the platform always keeps a ledger, and nil otherwise. A ledger in
+// memory isn't shared between instances and only keeps the last transactions,
+// which is logged as a warning.
+func ledgerFromEnv(p Platform) (ledger.Store, error) {
+	switch {
+	case os.Getenv("LEDGER_TABLE") != "":
+		return ledgerdynamodb.New(), nil
+	case os.Getenv("LEDGER_FILE") != "":
+		if p.Ephemeral {
+			return nil, fmt.Errorf("LEDGER_FILE can't be used on this platform, set LEDGER_TABLE instead")
+		}
+		l, err := ledgerbolt.New()
+		if err != nil {
+			return nil, fmt.Errorf("error opening ledger: %s", err.Error())
+		}
+		return l, nil
+	case p.Ledger:
+		log.Printf("warning: neither LEDGER_TABLE nor LEDGER_FILE is set, so the ledger is kept in memory, isn't shared between instances, and only keeps the last %d transactions", ledgermemory.MaxEntries)
+		return ledgermemory.New(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// vaultFromEnv returns the vault in the DynamoDB table in VAULT_TABLE, or in the
+// file in VAULT_FILE. When neither is set, it returns nil.
+func vaultFromEnv(p Platform) (vault.Vault, error) {
+	var v vault.Vault
+	var err error
+
+	switch {
+	case os.Getenv("VAULT_TABLE") != "":
+		v, err = vaultdynamodb.New()
+	case os.Getenv("VAULT_FILE") != "":
+		if p.Ephemeral {
+			return nil, fmt.Errorf("VAULT_FILE can't be used on this platform, set VAULT_TABLE instead")
+		}
+		v, err = vaultfile.New()
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening vault: %s", err.Error())
+	}
+
+	return v, nil
+}
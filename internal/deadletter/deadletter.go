@@ -0,0 +1,301 @@
+// Package deadletter moves payment requests that the Payment service can't process
+// to a dead-letter queue, instead of having the platform deliver them again until
+// the redrive policy of the queue, if any, gives up. Every message in the dead-letter
+// queue carries the request, the error, the number of attempts, and where the request
+// came from, so it can be looked into and sent again once the cause is fixed. Creditcard
+// data is never stored, so requests with a creditcard can't be sent again.
+// The order service is told with a PaymentRequestRejected event, so it can fail the
+// order instead of waiting for a CreditCardValidated event that never comes.
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/eventbridge"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/retry"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/sqs"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+)
+
+// MessageEventName is the name used for the messages in the dead-letter queue.
+const MessageEventName = "PaymentRequestFailedEvent"
+
+// DefaultMaxAttempts is the number of attempts after which a request that keeps
+// failing is moved to the dead-letter queue.
+const DefaultMaxAttempts = 5
+
+// Class is the class of a failure.
+type Class string
+
+const (
+	// Malformed means the request could not be parsed, so it fails on
+	// every attempt.
+	Malformed Class = "malformed"
+
+	// Exhausted means processing the request failed on every attempt,
+	// until the attempts ran out.
+	Exhausted Class = "exhausted"
+
+	// Transient means processing the request failed, but might succeed
+	// when the request is delivered again.
+	Transient Class = "transient"
+)
+
+// Source describes where a request came from.
+type Source struct {
+	// Transport is how the request arrived, like sqs or eventbridge.
+	Transport string `json:"transport"`
+
+	// MessageID is the ID of the SQS message or Lambda invocation.
+	MessageID string `json:"messageID,omitempty"`
+
+	// EventSource is the ARN of the queue, or the source of the event.
+	EventSource string `json:"eventSource,omitempty"`
+}
+
+// Message is a request in the dead-letter queue.
+type Message struct {
+	// Metadata for the message.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the details of the failed request.
+	Data Details `json:"data"`
+}
+
+// Details contains the details of a request that could not be processed.
+type Details struct {
+	// Body is the original request, without creditcard data: card numbers
+	// are masked, and cvv codes and expiry dates are dropped.
+	Body string `json:"body"`
+
+	// Redacted means creditcard data was removed from Body, so it is not the
+	// original request anymore and can't be sent again.
+	Redacted bool `json:"redacted,omitempty"`
+
+	// Error is the error of the last attempt, without creditcard data.
+	Error string `json:"error"`
+
+	// Class is the class of the failure.
+	Class Class `json:"class"`
+
+	// Attempts is the number of times processing the request was attempted.
+	Attempts int `json:"attempts"`
+
+	// OrderID is the unique identifier of the order, if it could be read
+	// from the request.
+	OrderID string `json:"orderID,omitempty"`
+
+	// Source describes where the request came from.
+	Source Source `json:"source"`
+
+	// FailedAt is the time the request was moved to the dead-letter queue.
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// Unmarshal parses the JSON-encoded data and stores the result in a Message.
+func Unmarshal(data []byte) (Message, error) {
+	var m Message
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
+
+// Meta returns the Metadata of the Message.
+func (m *Message) Meta() acmeserverless.Metadata {
+	return m.Metadata
+}
+
+// Marshal returns the JSON encoding of the Message.
+func (m *Message) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Classify returns the class of the error of processing a request, after the
+// number of attempts. Requests that are malformed, or that failed maxAttempts
+// times, should be moved to the dead-letter queue.
+func Classify(err error, attempts int, maxAttempts int) Class {
+	switch {
+	case errors.Is(err, payment.ErrMalformedRequest):
+		return Malformed
+	case maxAttempts > 0 && attempts >= maxAttempts:
+		return Exhausted
+	default:
+		return Transient
+	}
+}
+
+// Router moves the requests that can't be processed to the dead-letter queue.
+type Router struct {
+	deadLetter  emitter.EventEmitter
+	events      emitter.EventEmitter
+	maxAttempts int
+}
+
+// NewRouter creates a new Router that sends the requests that can't be processed
+// to the dead-letter EventEmitter, and the PaymentRequestRejected events to the
+// events EventEmitter. When the events EventEmitter is nil, no events are sent.
+// Requests that keep failing are moved after maxAttempts attempts; zero means
+// only malformed requests are moved.
+func NewRouter(deadLetter emitter.EventEmitter, events emitter.EventEmitter, maxAttempts int) *Router {
+	return &Router{
+		deadLetter:  deadLetter,
+		events:      events,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// FromEnv creates a new Router with the dead-letter queue configured in the
+// environment, which sends the PaymentRequestRejected events to the events
+// EventEmitter. The dead-letter queue is the SQS queue with the ARN or URL in
+// DEADLETTER_QUEUE, the EventBridge bus in DEADLETTER_BUS, or the EventEmitter
+// with the name in DEADLETTER_EMITTER. DEADLETTER_MAX_ATTEMPTS is the number of
+// attempts after which a request that keeps failing is moved. When no dead-letter
+// queue is configured, it returns nil, which means requests are never moved. It
+// returns an error if the dead-letter queue could not be created.
+func FromEnv(events emitter.EventEmitter) (*Router, error) {
+	var deadLetter emitter.EventEmitter
+	var err error
+
+	switch {
+	case os.Getenv("DEADLETTER_QUEUE") != "":
+		deadLetter, err = sqs.NewQueue(os.Getenv("DEADLETTER_QUEUE"))
+	case os.Getenv("DEADLETTER_BUS") != "":
+		deadLetter, err = eventbridge.NewBus(os.Getenv("DEADLETTER_BUS"))
+	case os.Getenv("DEADLETTER_EMITTER") != "":
+		deadLetter, err = emitter.New(os.Getenv("DEADLETTER_EMITTER"))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter, err = retry.FromEnv(deadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := DefaultMaxAttempts
+	if v := os.Getenv("DEADLETTER_MAX_ATTEMPTS"); v != "" {
+		maxAttempts, err = strconv.Atoi(v)
+		if err != nil || maxAttempts < 0 {
+			return nil, fmt.Errorf("DEADLETTER_MAX_ATTEMPTS must be a number of at least 0, got %q", v)
+		}
+	}
+
+	return NewRouter(deadLetter, events, maxAttempts), nil
+}
+
+// Route decides what happens to a request that failed with the error after the number
+// of attempts. Requests that can't be processed are moved to the dead-letter queue and
+// a PaymentRequestRejected event is sent, after which Route returns nil, so the request
+// is not delivered again. Otherwise, or when the request could not be moved, it returns
+// the error, so the request is delivered again.
+func (r *Router) Route(ctx context.Context, body []byte, err error, attempts int, src Source) error {
+	return r.route(ctx, body, err, attempts, src, Classify(err, attempts, r.maxAttempts))
+}
+
+// RouteLast is like Route, for the last delivery of a request, after which the
+// transport doesn't deliver it again. The request is moved to the dead-letter queue
+// even when it failed fewer than maxAttempts times, so it isn't lost.
+func (r *Router) RouteLast(ctx context.Context, body []byte, err error, attempts int, src Source) error {
+	return r.route(ctx, body, err, attempts, src, Classify(err, attempts, attempts))
+}
+
+// route moves the request to the dead-letter queue, unless its class is Transient.
+func (r *Router) route(ctx context.Context, body []byte, err error, attempts int, src Source, class Class) error {
+	if class == Transient {
+		return err
+	}
+
+	// Only a request without creditcard data is kept as is. The request is
+	// rejected below, so one with a creditcard is never sent again, and
+	// nothing is lost by dropping its creditcard data.
+	redacted := redact.JSON(body)
+	sanitized := string(body)
+	if string(redacted) != string(redact.CVV(body)) {
+		sanitized = string(redacted)
+	}
+
+	msg := Message{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "PaymentDeadLetter",
+			Type:   MessageEventName,
+			Status: acmeserverless.DefaultErrorStatus,
+		},
+		Data: Details{
+			Body:     sanitized,
+			Redacted: sanitized != string(body),
+			Error:    redact.String(err.Error()),
+			Class:    class,
+			Attempts: attempts,
+			OrderID:  OrderID(body),
+			Source:   src,
+			FailedAt: time.Now(),
+		},
+	}
+
+	if sendErr := r.deadLetter.Send(ctx, &msg); sendErr != nil {
+		log.Printf("error moving request %s to the dead-letter queue: %s", src.MessageID, redact.String(sendErr.Error()))
+		return err
+	}
+
+	log.Printf("moved %s request %s for order %s to the dead-letter queue after %d attempts: %s", class, src.MessageID, msg.Data.OrderID, attempts, msg.Data.Error)
+
+	// The request is in the dead-letter queue, so failing to send the event
+	// doesn't make the request be delivered again
+	if r.events != nil && len(msg.Data.OrderID) > 0 {
+		evt := events.PaymentRequestRejectedEvent{
+			Metadata: acmeserverless.Metadata{
+				Domain: acmeserverless.PaymentDomain,
+				Source: "RejectPaymentRequest",
+				Type:   events.PaymentRequestRejectedEventName,
+				Status: acmeserverless.DefaultErrorStatus,
+			},
+			Data: events.RejectionDetails{
+				OrderID: msg.Data.OrderID,
+				Reason:  string(class),
+				Message: msg.Data.Error,
+			},
+		}
+
+		if sendErr := r.events.Send(ctx, &evt); sendErr != nil {
+			log.Printf("error sending PaymentRequestRejected event for order %s: %s", msg.Data.OrderID, redact.String(sendErr.Error()))
+		}
+	}
+
+	return nil
+}
+
+// OrderID returns the order ID of the request, or an empty string when it can't be
+// read. Only the order ID is read, so it can be found in requests that are malformed
+// in other places.
+func OrderID(body []byte) string {
+	var req struct {
+		Data struct {
+			OrderID json.RawMessage `json:"orderID"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
+	}
+
+	var orderID string
+	if err := json.Unmarshal(req.Data.OrderID, &orderID); err != nil {
+		return ""
+	}
+
+	return orderID
+}
@@ -0,0 +1,258 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/payment"
+)
+
+// queue is an EventEmitter that keeps the messages it sends, like a
+// dead-letter queue.
+type queue struct {
+	messages []string
+}
+
+func (q *queue) Send(ctx context.Context, e emitter.Event) error {
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	q.messages = append(q.messages, string(payload))
+	return nil
+}
+
+func (q *queue) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, q, events)
+}
+
+const cardRequest = `{"metadata":{"type":"PaymentRequestedEvent"},"data":{"orderID":"order-1","card":{"number":"4111111111111111","cvv":"123","expiryMonth":1,"expiryYear":2030},"total":"10.00"}}`
+
+// route moves the request to a dead-letter queue, and returns the message as it
+// is stored.
+func route(t *testing.T, body string) (string, Message) {
+	t.Helper()
+
+	q := &queue{}
+	r := NewRouter(q, nil, 0)
+	err := fmt.Errorf("%w: bad request", payment.ErrMalformedRequest)
+	if err := r.Route(context.Background(), []byte(body), err, 1, Source{Transport: "test"}); err != nil {
+		t.Fatalf("Route() = %s, want nil", err.Error())
+	}
+
+	if len(q.messages) != 1 {
+		t.Fatalf("Route() sent %d messages, want 1", len(q.messages))
+	}
+
+	m, err := Unmarshal([]byte(q.messages[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q.messages[0], m
+}
+
+func TestRouteNeverStoresCreditcardData(t *testing.T) {
+	stored, m := route(t, cardRequest)
+
+	for _, secret := range []string{"4111111111111111", `"123"`, "2030"} {
+		if strings.Contains(stored, secret) {
+			t.Errorf("Route() stored %s: %s", secret, stored)
+		}
+	}
+
+	if !m.Data.Redacted || !strings.Contains(m.Data.Body, "411111******1111") {
+		t.Errorf("Route() stored body %s, want the redacted request", m.Data.Body)
+	}
+
+	if m.Data.OrderID != "order-1" {
+		t.Errorf("Route() stored order ID %q, want order-1", m.Data.OrderID)
+	}
+}
+
+func TestRequestWithCreditcardData(t *testing.T) {
+	_, m := route(t, cardRequest)
+
+	// The order was rejected, and the request has no cvv code anymore, so
+	// sending it again would only decline the payment
+	_, err := m.Request()
+	if err == nil {
+		t.Fatal("Request() of a request with creditcard data returned no error")
+	}
+
+	if !strings.Contains(err.Error(), "order-1") {
+		t.Errorf("Request() error = %q, want the order ID", err.Error())
+	}
+}
+
+func TestRequestWithoutCreditcardData(t *testing.T) {
+	body := `{"metadata":{"type":"PaymentRequestedEvent"},"data":{"orderID":"order-1","cardToken":"tok_abc"}}`
+	_, m := route(t, body)
+
+	if m.Data.Redacted || m.Data.Body != body {
+		t.Errorf("Route() stored %+v, want the request as is", m.Data)
+	}
+
+	req, err := m.Request()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, _ := req.Marshal(); string(payload) != body {
+		t.Errorf("Request() = %s, want %s", payload, body)
+	}
+}
+
+const requestBody = `{"metadata":{"type":"PaymentRequestedEvent"},"data":{"orderID":"order-1","total":"ten"}}`
+
+var (
+	malformed = fmt.Errorf("%w: bad request", payment.ErrMalformedRequest)
+	failed    = errors.New("database unavailable")
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		max      int
+		want     Class
+	}{
+		{"malformed", malformed, 1, 5, Malformed},
+		{"failed once", failed, 1, 5, Transient},
+		{"failed too often", failed, 5, 5, Exhausted},
+		{"no maximum", failed, 100, 0, Transient},
+	}
+
+	for _, tt := range tests {
+		if got := Classify(tt.err, tt.attempts, tt.max); got != tt.want {
+			t.Errorf("Classify(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		attempts  int
+		wantClass Class
+	}{
+		{"malformed", malformed, 1, Malformed},
+		{"failed once", failed, 1, Transient},
+		{"failed too often", failed, 3, Exhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlq, evts := &queue{}, &queue{}
+			r := NewRouter(dlq, evts, 3)
+
+			err := r.Route(context.Background(), []byte(requestBody), tt.err, tt.attempts, Source{Transport: "test", MessageID: "msg-1"})
+
+			// Requests that stay in the queue are delivered again
+			if tt.wantClass == Transient {
+				if err != tt.err {
+					t.Errorf("Route() = %v, want %v", err, tt.err)
+				}
+				if len(dlq.messages) != 0 || len(evts.messages) != 0 {
+					t.Errorf("Route() sent %d messages and %d events, want none", len(dlq.messages), len(evts.messages))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Route() = %v, want nil", err)
+			}
+
+			if len(dlq.messages) != 1 {
+				t.Fatalf("Route() sent %d messages, want 1", len(dlq.messages))
+			}
+
+			m, err := Unmarshal([]byte(dlq.messages[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.Data.Class != tt.wantClass || m.Data.Body != requestBody || m.Data.OrderID != "order-1" || m.Data.Attempts != tt.attempts || m.Data.Source.MessageID != "msg-1" {
+				t.Errorf("Route() sent %+v, want the %s request for order-1", m.Data, tt.wantClass)
+			}
+
+			if len(evts.messages) != 1 {
+				t.Fatalf("Route() sent %d events, want 1", len(evts.messages))
+			}
+
+			evt, err := events.UnmarshalPaymentRequestRejectedEvent([]byte(evts.messages[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if evt.Data.OrderID != "order-1" || evt.Data.Reason != string(tt.wantClass) {
+				t.Errorf("Route() sent %+v, want a rejection of order-1 because it is %s", evt.Data, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestRouteWithoutOrderID(t *testing.T) {
+	dlq, evts := &queue{}, &queue{}
+	r := NewRouter(dlq, evts, 3)
+
+	if err := r.Route(context.Background(), []byte("not json"), malformed, 1, Source{Transport: "test"}); err != nil {
+		t.Fatalf("Route() = %v, want nil", err)
+	}
+
+	if len(dlq.messages) != 1 || len(evts.messages) != 0 {
+		t.Errorf("Route() sent %d messages and %d events, want 1 and none", len(dlq.messages), len(evts.messages))
+	}
+}
+
+func TestOrderID(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{requestBody, "order-1"},
+		{`{"data":{"orderID":"order-2","card":"not a card"}}`, "order-2"},
+		{`{"data":{"orderID":12}}`, ""},
+		{`not json`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := OrderID([]byte(tt.body)); got != tt.want {
+			t.Errorf("OrderID(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRouteLast(t *testing.T) {
+	q := &queue{}
+	r := NewRouter(q, nil, DefaultMaxAttempts)
+	failure := fmt.Errorf("emitter unavailable")
+
+	if err := r.Route(context.Background(), []byte(cardRequest), failure, 2, Source{Transport: "test"}); err != failure {
+		t.Fatalf("Route() = %v, want %v", err, failure)
+	}
+
+	if err := r.RouteLast(context.Background(), []byte(cardRequest), failure, 2, Source{Transport: "test"}); err != nil {
+		t.Fatalf("RouteLast() = %s, want nil", err.Error())
+	}
+
+	if len(q.messages) != 1 {
+		t.Fatalf("RouteLast() sent %d messages, want 1", len(q.messages))
+	}
+
+	m, err := Unmarshal([]byte(q.messages[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Data.Class != Exhausted || m.Data.Attempts != 2 {
+		t.Errorf("RouteLast() stored a %s request after %d attempts, want exhausted after 2", m.Data.Class, m.Data.Attempts)
+	}
+}
@@ -0,0 +1,73 @@
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+)
+
+// Entry is a message read from the dead-letter queue.
+type Entry struct {
+	// ID is the ID of the message in the dead-letter queue.
+	ID string
+
+	// Receipt is the handle needed to delete or release the message.
+	Receipt string
+
+	// Body is the message as it is stored in the dead-letter queue.
+	Body []byte
+}
+
+// Queue is the interface that describes the methods a dead-letter queue needs
+// to implement to be inspected and redriven. Messages that are received are
+// hidden from other readers until they are deleted or released, or until the
+// visibility timeout of the queue passes.
+type Queue interface {
+	// Receive returns up to max messages, hidden for the visibility timeout.
+	Receive(ctx context.Context, max int, visibility time.Duration) ([]Entry, error)
+
+	// Delete removes the message from the queue.
+	Delete(ctx context.Context, e Entry) error
+
+	// Release makes the message visible to other readers again.
+	Release(ctx context.Context, e Entry) error
+}
+
+// Request returns the original request of the message as an event, so it can be
+// sent to the payment service again with any EventEmitter. It returns an error for
+// a request with creditcard data, which isn't kept: the order of the request was
+// rejected when it was moved, so the order service has to ask for the payment again.
+func (m *Message) Request() (emitter.Event, error) {
+	body := []byte(m.Data.Body)
+
+	if m.Data.Redacted {
+		return nil, fmt.Errorf("the request for order %q has creditcard data, which isn't kept, so it can't be sent again; the order was rejected, so the order service has to ask for the payment again", m.Data.OrderID)
+	}
+
+	meta, _ := events.UnmarshalMetadata(body)
+	return &request{
+		metadata: meta,
+		body:     body,
+	}, nil
+}
+
+// request is an original request that is sent again as is.
+type request struct {
+	metadata acmeserverless.Metadata
+	body     []byte
+}
+
+// Meta returns the Metadata of the request, or empty Metadata when
+// the request has none.
+func (r *request) Meta() acmeserverless.Metadata {
+	return r.metadata
+}
+
+// Marshal returns the original request.
+func (r *request) Marshal() ([]byte, error) {
+	return r.body, nil
+}
@@ -0,0 +1,112 @@
+// Package sqs reads the dead-letter queue of the Payment service from Amazon Simple
+// Queue Service (SQS), so the messages in it can be inspected and redriven.
+package sqs
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/retgits/acme-serverless-payment/internal/deadletter"
+	emittersqs "github.com/retgits/acme-serverless-payment/internal/emitter/sqs"
+)
+
+// maxReceive is the maximum number of messages in a ReceiveMessage call.
+const maxReceive = 10
+
+// waitTime is how long a ReceiveMessage call waits for messages. Waiting makes SQS
+// look at all of its servers, so an empty response means the queue is empty.
+const waitTime = 1
+
+// queue contains the SQS client and the URL of the queue, and implements
+// the methods of the Queue interface.
+type queue struct {
+	svc *sqs.SQS
+	url string
+}
+
+// New creates a new instance of the Queue with SQS as the messaging layer, which
+// reads the queue with the ARN or URL. The AWS region this code looks in to find
+// the queue is determined by the environment variable REGION. To use a local
+// stand-in, like ElasticMQ, set SQS_ENDPOINT to its URL and pass the URL of the
+// queue. The configs are applied after that, so they can override the endpoint,
+// credentials, or retryer. The method returns an error if the queue is not valid.
+func New(address string, configs ...*aws.Config) (deadletter.Queue, error) {
+	url, err := emittersqs.QueueURL(address)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("SQS_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession, err := session.NewSession(append([]*aws.Config{cfg}, configs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queue{
+		svc: sqs.New(awsSession),
+		url: url,
+	}, nil
+}
+
+// Receive returns up to max messages, and at most ten, hidden for the visibility
+// timeout. It returns no messages when the queue is empty, or all its messages are
+// hidden.
+func (q *queue) Receive(ctx context.Context, max int, visibility time.Duration) ([]deadletter.Entry, error) {
+	if max > maxReceive {
+		max = maxReceive
+	}
+
+	out, err := q.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.url),
+		MaxNumberOfMessages: aws.Int64(int64(max)),
+		VisibilityTimeout:   aws.Int64(int64(visibility / time.Second)),
+		WaitTimeSeconds:     aws.Int64(waitTime),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]deadletter.Entry, len(out.Messages))
+	for i, m := range out.Messages {
+		entries[i] = deadletter.Entry{
+			ID:      aws.StringValue(m.MessageId),
+			Receipt: aws.StringValue(m.ReceiptHandle),
+			Body:    []byte(aws.StringValue(m.Body)),
+		}
+	}
+
+	return entries, nil
+}
+
+// Delete removes the message from the queue.
+func (q *queue) Delete(ctx context.Context, e deadletter.Entry) error {
+	_, err := q.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.url),
+		ReceiptHandle: aws.String(e.Receipt),
+	})
+
+	return err
+}
+
+// Release makes the message visible to other readers right away, instead of
+// after the visibility timeout.
+func (q *queue) Release(ctx context.Context, e deadletter.Entry) error {
+	_, err := q.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     aws.String(e.Receipt),
+		VisibilityTimeout: aws.Int64(0),
+	})
+
+	return err
+}
@@ -0,0 +1,14 @@
+// Package all registers every EventEmitter of the Payment service, so any
+// entrypoint can select one by name with the EMITTER environment variable.
+package all
+
+import (
+	// Register the EventEmitters
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/eventbridge"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/kafka"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/mock"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/nats"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/pubsub"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/sqs"
+	_ "github.com/retgits/acme-serverless-payment/internal/emitter/stdout"
+)
@@ -1,14 +1,70 @@
 // Package emitter contains the interfaces that the Payment service
 // in the ACME Serverless Fitness Shop needs to send events to other
 // services. In order to add a new service, the EventEmitter interface
-// needs to be implemented.
+// needs to be implemented and registered with Register, so it can be
+// selected with the EMITTER environment variable.
 package emitter
 
-import acmeserverless "github.com/retgits/acme-serverless"
+import (
+	"context"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// Event is the interface that describes the methods an event needs
+// to implement to be sent by an EventEmitter.
+type Event interface {
+	// Meta returns the metadata of the event.
+	Meta() acmeserverless.Metadata
+
+	// Marshal returns the JSON encoding of the event.
+	Marshal() ([]byte, error)
+}
+
+// Identified is implemented by events that carry an ID, like the messages
+// of the outbox. Emitters that can pass the ID on to consumers, so they can
+// drop events they received before, do so.
+type Identified interface {
+	// MessageID returns the ID of the event.
+	MessageID() string
+}
+
+// Retrying is implemented by EventEmitters that send events again themselves
+// when the messaging service fails to accept them. EventEmitters that wrap them
+// and retry on their own, like the retry emitter, wrap the EventEmitter that
+// SingleAttempt returns instead, so the attempts don't multiply.
+type Retrying interface {
+	// SingleAttempt returns an EventEmitter that sends to the same destination,
+	// but sends every event just once.
+	SingleAttempt() EventEmitter
+}
 
 // EventEmitter is the interface that describes the methods the
 // eventing service needs to implement to be able to work with
-// the ACME Serverless Fitness Shop.
+// the ACME Serverless Fitness Shop. Implementations must stop
+// sending when the context is canceled or its deadline passes.
 type EventEmitter interface {
-	Send(e acmeserverless.CreditCardValidatedEvent) error
+	// Send sends a single event.
+	Send(ctx context.Context, e Event) error
+
+	// SendBatch sends all events, in order. It returns an error if any
+	// of the events could not be sent.
+	SendBatch(ctx context.Context, events []Event) error
+}
+
+// SendEach sends the events one at a time using the EventEmitter. It stops at
+// the first event that could not be sent, or when the context is done. It can
+// be used by EventEmitters that have no way to send multiple events at once.
+func SendEach(ctx context.Context, em EventEmitter, events []Event) error {
+	for _, e := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := em.Send(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,59 @@
+package emitter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// event is an Event with only metadata.
+type event acmeserverless.Metadata
+
+func (e event) Meta() acmeserverless.Metadata { return acmeserverless.Metadata(e) }
+
+func (e event) Marshal() ([]byte, error) { return []byte(`{}`), nil }
+
+// counter is an EventEmitter that counts the events it sends, and fails to
+// send the event with the type in fail.
+type counter struct {
+	sent int
+	fail string
+}
+
+func (c *counter) Send(ctx context.Context, e Event) error {
+	if e.Meta().Type == c.fail {
+		return errors.New("send failed")
+	}
+	c.sent++
+	return nil
+}
+
+func (c *counter) SendBatch(ctx context.Context, events []Event) error {
+	return SendEach(ctx, c, events)
+}
+
+func TestSendEach(t *testing.T) {
+	events := []Event{event{Type: "first"}, event{Type: "second"}, event{Type: "third"}}
+
+	c := &counter{}
+	if err := SendEach(context.Background(), c, events); err != nil || c.sent != 3 {
+		t.Errorf("SendEach() sent %d events, error = %v, want 3", c.sent, err)
+	}
+
+	// Sending stops at the first event that can't be sent
+	c = &counter{fail: "second"}
+	if err := SendEach(context.Background(), c, events); err == nil || c.sent != 1 {
+		t.Errorf("SendEach() sent %d events, error = %v, want 1 and an error", c.sent, err)
+	}
+
+	// Nothing is sent once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c = &counter{}
+	if err := SendEach(ctx, c, events); err != context.Canceled || c.sent != 0 {
+		t.Errorf("SendEach() sent %d events, error = %v, want none and %v", c.sent, err, context.Canceled)
+	}
+}
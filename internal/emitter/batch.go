@@ -0,0 +1,103 @@
+package emitter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CodeTooLarge is the error code of events that are too large for the messaging
+// service, so they are not sent at all.
+const CodeTooLarge = "EntryTooLarge"
+
+// coder is implemented by errors that carry the error code of the messaging
+// service, like the errors of the AWS SDK.
+type coder interface {
+	Code() string
+	Message() string
+}
+
+// EntryError describes an event in a batch that the messaging service
+// did not accept.
+type EntryError struct {
+	// Index is the position of the event in the batch.
+	Index int
+
+	// Code is the error code of the messaging service, like ThrottlingException.
+	Code string
+
+	// Message is the error message of the messaging service.
+	Message string
+
+	// Err is the error of the request the event was part of, when the
+	// whole request failed rather than just this event.
+	Err error
+}
+
+// Error returns the error code and message of the event.
+func (e *EntryError) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("event %d: %s", e.Index, e.Message)
+	}
+
+	return fmt.Sprintf("event %d: %s: %s", e.Index, e.Code, e.Message)
+}
+
+// Unwrap returns the error of the request the event was part of, if any.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// RequestFailed returns an EntryError for every index, for events that were
+// part of a request that failed as a whole. Errors that carry an error code,
+// like the errors of the AWS SDK, keep their code.
+func RequestFailed(indexes []int, err error) []*EntryError {
+	code, message := "", err.Error()
+	if aerr, ok := err.(coder); ok {
+		code, message = aerr.Code(), aerr.Message()
+	}
+
+	failed := make([]*EntryError, len(indexes))
+	for i, index := range indexes {
+		failed[i] = &EntryError{
+			Index:   index,
+			Code:    code,
+			Message: message,
+			Err:     err,
+		}
+	}
+
+	return failed
+}
+
+// BatchError is returned by SendBatch when some of the events in the
+// batch were not sent. The other events were sent, so only the failed
+// events should be sent again.
+type BatchError struct {
+	// Failed contains the events that were not sent, in order.
+	Failed []*EntryError
+}
+
+// Error returns the number of events that were not sent and their errors.
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+
+	return fmt.Sprintf("%d events were not sent: %s", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// Failed returns nil when no events failed, or a BatchError with the
+// failed events sorted by their position in the batch.
+func Failed(failed []*EntryError) error {
+	if len(failed) == 0 {
+		return nil
+	}
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Index < failed[j].Index
+	})
+
+	return &BatchError{Failed: failed}
+}
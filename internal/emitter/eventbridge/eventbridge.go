@@ -4,57 +4,290 @@
 package eventbridge
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/eventbridge"
-	acmeserverless "github.com/retgits/acme-serverless"
 	"github.com/retgits/acme-serverless-payment/internal/emitter"
 )
 
-// responder is an empty struct that implements the methods of the
-// EventEmitter interface
-type responder struct{}
+const (
+	// maxBatchEntries is the maximum number of events in a PutEvents call.
+	maxBatchEntries = 10
 
-// New creates a new instance of the EventEmitter with EventBridge
-// as the messaging layer.
-func New() emitter.EventEmitter {
-	return responder{}
+	// maxBatchSize is the maximum size, in bytes, of an event and of all
+	// events in a PutEvents call together.
+	maxBatchSize = 256 * 1024
+
+	// maxAttempts is the number of times an event that failed with a retriable
+	// error is sent.
+	maxAttempts = 4
+
+	// baseDelay is the backoff before the second attempt, which doubles for
+	// every attempt after that.
+	baseDelay = 100 * time.Millisecond
+
+	// maxDelay is the maximum backoff between two attempts.
+	maxDelay = 2 * time.Second
+)
+
+// retriable contains the error codes of entries that EventBridge may accept
+// when they are sent again.
+var retriable = map[string]bool{
+	"ThrottlingException":         true,
+	"InternalFailure":             true,
+	"InternalException":           true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
 }
 
-// Send sends the event to an EventBridge bus. The bus is determined
-// by the environment variable EVENTBUS. The AWS region this code
-// looks in to find the queue is determined by the environment
-// variable REGION. The method returns an error if anything goes wrong.
-func (r responder) Send(e acmeserverless.CreditCardValidatedEvent) error {
-	payload, err := e.Marshal()
+func init() {
+	emitter.Register("eventbridge", func() (emitter.EventEmitter, error) {
+		return New()
+	})
+}
+
+// responder contains the EventBridge client and the name of the bus,
+// and implements the methods of the EventEmitter interface.
+type responder struct {
+	svc      *eventbridge.EventBridge
+	session  *session.Session
+	bus      string
+	attempts int
+}
+
+// New creates a new instance of the EventEmitter with EventBridge as the
+// messaging layer. The bus is determined by the environment variable EVENTBUS.
+// The AWS region this code looks in to find the bus is determined by the
+// environment variable REGION. To use a local stand-in, like LocalStack, set
+// EVENTBRIDGE_ENDPOINT to its URL. The configs are applied after that, so they
+// can override the endpoint, credentials, or retryer. The client is created once
+// and shared by every event. The method returns an error if the client could not
+// be created.
+func New(configs ...*aws.Config) (emitter.EventEmitter, error) {
+	return NewBus(os.Getenv("EVENTBUS"), configs...)
+}
+
+// NewBus creates a new instance of the EventEmitter with EventBridge as the
+// messaging layer, which sends to the bus instead of EVENTBUS. It is configured
+// like New otherwise.
+func NewBus(bus string, configs ...*aws.Config) (emitter.EventEmitter, error) {
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("EVENTBRIDGE_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession, err := session.NewSession(append([]*aws.Config{cfg}, configs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responder{
+		svc:      eventbridge.New(awsSession),
+		session:  awsSession,
+		bus:      bus,
+		attempts: maxAttempts,
+	}, nil
+}
+
+// SingleAttempt returns an EventEmitter that sends to the same bus, but sends
+// every event just once: the client doesn't retry failed requests, and events
+// that EventBridge failed to accept are not sent again.
+func (r *responder) SingleAttempt() emitter.EventEmitter {
+	return &responder{
+		svc:      eventbridge.New(r.session, aws.NewConfig().WithMaxRetries(0)),
+		session:  r.session,
+		bus:      r.bus,
+		attempts: 1,
+	}
+}
+
+// Send sends the event to the EventBridge bus. An event that EventBridge didn't
+// accept because of a retriable error, like throttling, is sent again with
+// backoff. The method returns an error if anything goes wrong, or the context
+// is done before the event is sent. When EventBridge ultimately doesn't accept
+// the event, the error is an EntryError with the error code and message of
+// EventBridge.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	entry, err := r.entry(e)
 	if err != nil {
 		return err
 	}
 
-	awsSession := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	failed := r.putEvents(ctx, []*eventbridge.PutEventsRequestEntry{entry}, []int{0})
+	if len(failed) == 0 {
+		return nil
+	}
+
+	// Return the error of the request itself when the whole request failed
+	if failed[0].Err != nil {
+		return failed[0].Err
+	}
 
-	svc := eventbridge.New(awsSession)
+	return failed[0]
+}
 
-	entries := make([]*eventbridge.PutEventsRequestEntry, 1)
+// SendBatch sends the events to the EventBridge bus using PutEvents, with up to
+// ten events per call. Events that EventBridge didn't accept because of a retriable
+// error are sent again with backoff. When some events could not be sent, the method returns a
+// BatchError with just those events, carrying the error code and message of
+// EventBridge; the others were sent.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	var failed []*emitter.EntryError
+	var batch []*eventbridge.PutEventsRequestEntry
+	var indexes []int
+	size := 0
 
-	entries[0] = &eventbridge.PutEventsRequestEntry{
-		Detail:       aws.String(string(payload)),
-		EventBusName: aws.String(os.Getenv("EVENTBUS")),
-		Source:       aws.String(e.Metadata.Source),
+	for i, e := range events {
+		entry, err := r.entry(e)
+		if err != nil {
+			failed = append(failed, &emitter.EntryError{Index: i, Message: err.Error(), Err: err})
+			continue
+		}
+
+		entrySize := entrySize(entry)
+		if entrySize > maxBatchSize {
+			failed = append(failed, &emitter.EntryError{
+				Index:   i,
+				Code:    emitter.CodeTooLarge,
+				Message: fmt.Sprintf("event of %d bytes exceeds the limit of %d bytes", entrySize, maxBatchSize),
+			})
+			continue
+		}
+
+		// Start a new call when this event doesn't fit in the current one
+		if len(batch) == maxBatchEntries || size+entrySize > maxBatchSize {
+			failed = append(failed, r.putEvents(ctx, batch, indexes)...)
+			batch, indexes, size = nil, nil, 0
+		}
+
+		batch = append(batch, entry)
+		indexes = append(indexes, i)
+		size += entrySize
 	}
 
-	event := &eventbridge.PutEventsInput{
-		Entries: entries,
+	if len(batch) > 0 {
+		failed = append(failed, r.putEvents(ctx, batch, indexes)...)
 	}
 
-	_, err = svc.PutEvents(event)
+	return emitter.Failed(failed)
+}
+
+// putEvents sends the entries in a PutEvents call and returns the entries that
+// could not be sent. Entries that failed with a retriable error are sent again,
+// up to maxAttempts times in total, with exponential backoff between attempts,
+// unless the emitter was created with SingleAttempt.
+// The indexes contain the position of each entry in the batch that was passed
+// to SendBatch.
+func (r *responder) putEvents(ctx context.Context, entries []*eventbridge.PutEventsRequestEntry, indexes []int) []*emitter.EntryError {
+	var failed []*emitter.EntryError
+
+	for attempt := 1; len(entries) > 0; attempt++ {
+		if attempt > 1 {
+			if err := wait(ctx, attempt); err != nil {
+				return append(failed, emitter.RequestFailed(indexes, err)...)
+			}
+		}
+
+		output, err := r.svc.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+			Entries: entries,
+		})
+		if err != nil {
+			return append(failed, emitter.RequestFailed(indexes, err)...)
+		}
+
+		if aws.Int64Value(output.FailedEntryCount) == 0 {
+			break
+		}
+
+		// The result entries are in the same order as the request entries
+		var retry []*eventbridge.PutEventsRequestEntry
+		var retryIndexes []int
+		for i, res := range output.Entries {
+			if res.ErrorCode == nil || i >= len(indexes) {
+				continue
+			}
+
+			code := aws.StringValue(res.ErrorCode)
+			if retriable[code] && attempt < r.attempts {
+				retry = append(retry, entries[i])
+				retryIndexes = append(retryIndexes, indexes[i])
+				continue
+			}
+
+			failed = append(failed, &emitter.EntryError{
+				Index:   indexes[i],
+				Code:    code,
+				Message: aws.StringValue(res.ErrorMessage),
+			})
+		}
+
+		entries, indexes = retry, retryIndexes
+	}
+
+	return failed
+}
+
+// wait sleeps before the attempt, for a random duration up to the exponential
+// backoff of the attempt. It returns an error if the context is done first.
+func wait(ctx context.Context, attempt int) error {
+	backoff := baseDelay << uint(attempt-2)
+	if backoff > maxDelay || backoff <= 0 {
+		backoff = maxDelay
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))) + 1)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// entry returns the PutEvents entry for the event. Events that carry an ID pass
+// it on as the resource of the event, so consumers can drop duplicates.
+func (r *responder) entry(e emitter.Event) (*eventbridge.PutEventsRequestEntry, error) {
+	payload, err := e.Marshal()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	entry := &eventbridge.PutEventsRequestEntry{
+		Detail:       aws.String(string(payload)),
+		DetailType:   aws.String(e.Meta().Type),
+		EventBusName: aws.String(r.bus),
+		Source:       aws.String(e.Meta().Source),
+	}
+
+	if id, ok := e.(emitter.Identified); ok && len(id.MessageID()) > 0 {
+		entry.Resources = []*string{aws.String(id.MessageID())}
+	}
+
+	return entry, nil
+}
+
+// entrySize returns the size of the entry, in bytes, the way EventBridge
+// calculates it for the limit of PutEvents.
+func entrySize(entry *eventbridge.PutEventsRequestEntry) int {
+	size := len(aws.StringValue(entry.Source)) + len(aws.StringValue(entry.DetailType)) + len(aws.StringValue(entry.Detail))
+	for _, resource := range entry.Resources {
+		size += len(aws.StringValue(resource))
+	}
+
+	if entry.Time != nil {
+		size += 14
 	}
 
-	return nil
+	return size
 }
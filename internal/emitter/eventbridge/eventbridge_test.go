@@ -0,0 +1,355 @@
+package eventbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+// event is an event with a fixed payload.
+type event string
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e), nil
+}
+
+// unencodable is an event that fails to encode.
+type unencodable struct {
+	event
+}
+
+// errUnencodable is the error of an unencodable event.
+var errUnencodable = errors.New("event can't be encoded")
+
+func (e unencodable) Marshal() ([]byte, error) {
+	return nil, errUnencodable
+}
+
+// identified is an event with an ID, like the messages of the outbox.
+type identified struct {
+	event
+	id string
+}
+
+func (e identified) MessageID() string {
+	return e.id
+}
+
+// payload is the body of the events, which is about the size of a CreditCardValidated event.
+var payload = event(`{"metadata":{"domain":"Payment","source":"ValidateCreditCard","type":"CreditCardValidated","status":"success"},"data":{"success":true,"status":200,"message":"transaction successful","amount":"85.23","transactionID":"3f846704-af12-4ea9-a98c-8d7b37e10b54","orderID":"12345","card":"411111******1111"}}`)
+
+// standIn is a stand-in for EventBridge that accepts every event, and counts the
+// requests and events it received, and keeps the resources of the events. When
+// failCode is set, it fails every entry with that error code. When fail is set,
+// it fails every request with an error on the side of EventBridge.
+type standIn struct {
+	server    *httptest.Server
+	requests  int64
+	events    int64
+	failCode  string
+	fail      bool
+	mu        sync.Mutex
+	resources [][]string
+}
+
+// newStandIn starts a stand-in for EventBridge. It is closed when the test ends.
+func newStandIn(tb testing.TB) *standIn {
+	s := &standIn{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	tb.Cleanup(s.server.Close)
+
+	return s
+}
+
+// putEventsEntry is an entry in the response to a PutEvents request.
+type putEventsEntry struct {
+	EventID      string `json:"EventId,omitempty"`
+	ErrorCode    string `json:",omitempty"`
+	ErrorMessage string `json:",omitempty"`
+}
+
+// handle answers PutEvents requests.
+func (s *standIn) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Target") != "AWSEvents.PutEvents" {
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	atomic.AddInt64(&s.requests, 1)
+
+	if s.fail {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"__type":"InternalException","message":"internal error"}`))
+		return
+	}
+
+	var req struct {
+		Entries []struct {
+			Resources []string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := struct {
+		FailedEntryCount int
+		Entries          []putEventsEntry
+	}{}
+	for _, entry := range req.Entries {
+		s.mu.Lock()
+		s.resources = append(s.resources, entry.Resources)
+		s.mu.Unlock()
+
+		if s.failCode != "" {
+			res.FailedEntryCount++
+			res.Entries = append(res.Entries, putEventsEntry{ErrorCode: s.failCode, ErrorMessage: "entry failed"})
+			continue
+		}
+		res.Entries = append(res.Entries, putEventsEntry{EventID: fmt.Sprintf("%d", atomic.AddInt64(&s.events, 1))})
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(res)
+}
+
+// emitter returns an EventEmitter that sends to a bus of the stand-in.
+func (s *standIn) emitter(tb testing.TB) emitter.EventEmitter {
+	tb.Helper()
+
+	os.Setenv("EVENTBUS", "acmeserverless")
+	tb.Cleanup(func() { os.Unsetenv("EVENTBUS") })
+
+	em, err := New(&aws.Config{
+		Endpoint:    aws.String(s.server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return em
+}
+
+// batch returns a batch of n events.
+func batch(n int) []emitter.Event {
+	events := make([]emitter.Event, n)
+	for i := range events {
+		events[i] = payload
+	}
+
+	return events
+}
+
+func TestSend(t *testing.T) {
+	s := newStandIn(t)
+
+	if err := s.emitter(t).Send(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.events != 1 {
+		t.Errorf("Send() sent %d events, want 1", s.events)
+	}
+}
+
+func TestSendReportsFailedEntry(t *testing.T) {
+	s := newStandIn(t)
+	s.failCode = "InvalidArgument"
+
+	err := s.emitter(t).Send(context.Background(), payload)
+
+	var eerr *emitter.EntryError
+	if !errors.As(err, &eerr) || eerr.Code != "InvalidArgument" {
+		t.Fatalf("Send() error = %v, want an EntryError with code InvalidArgument", err)
+	}
+
+	if s.requests != 1 {
+		t.Errorf("Send() made %d requests, want 1", s.requests)
+	}
+}
+
+func TestSendRetriesThrottledEntry(t *testing.T) {
+	s := newStandIn(t)
+	s.failCode = "ThrottlingException"
+
+	err := s.emitter(t).Send(context.Background(), payload)
+
+	var eerr *emitter.EntryError
+	if !errors.As(err, &eerr) || eerr.Code != "ThrottlingException" {
+		t.Fatalf("Send() error = %v, want an EntryError with code ThrottlingException", err)
+	}
+
+	if s.requests != maxAttempts {
+		t.Errorf("Send() made %d requests, want %d", s.requests, maxAttempts)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	s := newStandIn(t)
+
+	if err := s.emitter(t).SendBatch(context.Background(), batch(25)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.requests != 3 || s.events != 25 {
+		t.Errorf("SendBatch() made %d requests with %d events, want 3 with 25", s.requests, s.events)
+	}
+}
+
+func TestSendBatchReportsFailedEntries(t *testing.T) {
+	s := newStandIn(t)
+	s.failCode = "InvalidArgument"
+
+	err := s.emitter(t).SendBatch(context.Background(), batch(12))
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 12 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 12 events", err)
+	}
+
+	for i, f := range berr.Failed {
+		if f.Index != i || f.Code != "InvalidArgument" {
+			t.Errorf("Failed[%d] = %v, want event %d with code InvalidArgument", i, f, i)
+		}
+	}
+}
+
+func TestSendBatchSkipsLargeEvents(t *testing.T) {
+	s := newStandIn(t)
+
+	events := batch(3)
+	events[1] = event(strings.Repeat("x", maxBatchSize+1))
+
+	err := s.emitter(t).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 || berr.Failed[0].Index != 1 || berr.Failed[0].Code != emitter.CodeTooLarge {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with event 1", err)
+	}
+
+	if s.events != 2 {
+		t.Errorf("SendBatch() sent %d events, want 2", s.events)
+	}
+}
+
+func TestSendBatchPassesMessageIDs(t *testing.T) {
+	s := newStandIn(t)
+
+	events := []emitter.Event{identified{payload, "msg-1"}, payload, identified{payload, "msg-3"}}
+	if err := s.emitter(t).SendBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := fmt.Sprint([][]string{{"msg-1"}, nil, {"msg-3"}})
+	if got := fmt.Sprint(s.resources); got != want {
+		t.Errorf("SendBatch() sent events with resources %s, want %s", got, want)
+	}
+}
+
+func TestSendBatchReportsUnencodableEvents(t *testing.T) {
+	s := newStandIn(t)
+
+	// The events before and after the one that fails to encode are still sent
+	events := batch(25)
+	events[15] = unencodable{payload}
+
+	err := s.emitter(t).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 1 event", err)
+	}
+
+	if berr.Failed[0].Index != 15 || !errors.Is(berr.Failed[0], errUnencodable) {
+		t.Errorf("SendBatch() failed event %d with %v, want event 15 with %v", berr.Failed[0].Index, berr.Failed[0].Err, errUnencodable)
+	}
+
+	if s.events != 24 {
+		t.Errorf("SendBatch() sent %d events, want 24", s.events)
+	}
+}
+
+func TestSingleAttempt(t *testing.T) {
+	s := newStandIn(t)
+	s.fail = true
+
+	em := s.emitter(t).(emitter.Retrying).SingleAttempt()
+
+	if err := em.Send(context.Background(), payload); err == nil {
+		t.Fatal("Send() returned no error")
+	}
+
+	if s.requests != 1 {
+		t.Errorf("Send() made %d requests, want 1", s.requests)
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := em.Send(ctx, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendParallel(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := em.Send(ctx, payload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+	events := batch(10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := em.SendBatch(ctx, events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
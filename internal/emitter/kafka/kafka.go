@@ -0,0 +1,258 @@
+// Package kafka uses Apache Kafka, a distributed event streaming platform, to send the
+// events of the Payment service to the other services of the shop when it runs outside
+// of AWS. Events are keyed by their order ID, so all events of an order end up in the
+// same partition and are consumed in the order they were sent.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+func init() {
+	emitter.Register("kafka", func() (emitter.EventEmitter, error) {
+		return New()
+	})
+}
+
+// responder contains the Kafka producer and the topic, and implements the
+// methods of the EventEmitter interface.
+type responder struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// New creates a new instance of the EventEmitter with Kafka as the messaging layer.
+// The brokers are determined by the environment variable KAFKA_BROKERS, a comma
+// separated list of addresses, and the topic by KAFKA_TOPIC. The producer is
+// configured with Config. The producer is created once and shared by every message.
+// The method returns an error if the configuration is not valid, or none of the
+// brokers could be reached.
+func New() (emitter.EventEmitter, error) {
+	cfg, err := Config()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTopic(Brokers(), os.Getenv("KAFKA_TOPIC"), cfg)
+}
+
+// NewTopic creates a new instance of the EventEmitter with Kafka as the messaging
+// layer, which sends to the topic on the brokers with the configuration instead of
+// the environment. The configuration must have Producer.Return.Successes set.
+func NewTopic(brokers []string, topic string, cfg *sarama.Config) (emitter.EventEmitter, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("at least one Kafka broker is needed, set KAFKA_BROKERS")
+	}
+
+	if len(topic) == 0 {
+		return nil, errors.New("the topic must be the name of a Kafka topic, set KAFKA_TOPIC")
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responder{
+		producer: producer,
+		topic:    topic,
+	}, nil
+}
+
+// Brokers returns the addresses of the brokers in the environment variable
+// KAFKA_BROKERS, a comma separated list like kafka-0:9092,kafka-1:9092.
+func Brokers() []string {
+	brokers := make([]string, 0)
+	for _, b := range strings.Split(os.Getenv("KAFKA_BROKERS"), ",") {
+		if b = strings.TrimSpace(b); len(b) > 0 {
+			brokers = append(brokers, b)
+		}
+	}
+
+	return brokers
+}
+
+// Config returns the configuration of the Kafka client in the environment. The
+// version of the brokers is determined by KAFKA_VERSION, like 2.4.0, and defaults
+// to 2.1.0. KAFKA_ACKS determines which replicas must store an event before it is
+// sent: all (the default), leader, or none. The producer is idempotent, so events
+// that are sent again after a failure are stored once, unless KAFKA_IDEMPOTENT is
+// false; an idempotent producer needs all replicas to store the event. The client
+// ID is determined by KAFKA_CLIENT_ID, and defaults to payment. It returns an error
+// if the configuration is not valid.
+func Config() (*sarama.Config, error) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_1_0_0
+	cfg.ClientID = "payment"
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Idempotent = true
+
+	if v := os.Getenv("KAFKA_VERSION"); v != "" {
+		version, err := sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing KAFKA_VERSION: %s", err.Error())
+		}
+		cfg.Version = version
+	}
+
+	if v := os.Getenv("KAFKA_CLIENT_ID"); v != "" {
+		cfg.ClientID = v
+	}
+
+	switch v := os.Getenv("KAFKA_ACKS"); v {
+	case "", "all":
+	case "leader":
+		cfg.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		cfg.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("KAFKA_ACKS must be all, leader, or none, got %q", v)
+	}
+
+	if v := os.Getenv("KAFKA_IDEMPOTENT"); v != "" {
+		idempotent, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_IDEMPOTENT must be true or false, got %q", v)
+		}
+		cfg.Producer.Idempotent = idempotent
+	}
+
+	// An idempotent producer can only have a single request in flight per broker,
+	// so the events can't be reordered
+	if cfg.Producer.Idempotent {
+		cfg.Net.MaxOpenRequests = 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Send sends the event to the Kafka topic and waits until the brokers stored it.
+// The method returns an error if anything goes wrong, or the context is done before
+// the event is stored. The producer may still send the event after that.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	msg, err := r.message(e)
+	if err != nil {
+		return err
+	}
+
+	return r.wait(ctx, func() error {
+		_, _, err := r.producer.SendMessage(msg)
+		return err
+	})
+}
+
+// SendBatch sends the events to the Kafka topic, which the producer bundles into as
+// few requests as possible, and waits until the brokers stored all of them. When some
+// events could not be sent, the method returns a BatchError with just those events;
+// the others were sent.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	msgs := make([]*sarama.ProducerMessage, len(events))
+	for i, e := range events {
+		msg, err := r.message(e)
+		if err != nil {
+			return err
+		}
+
+		msg.Metadata = i
+		msgs[i] = msg
+	}
+
+	err := r.wait(ctx, func() error {
+		return r.producer.SendMessages(msgs)
+	})
+
+	perr, ok := err.(sarama.ProducerErrors)
+	if !ok {
+		return err
+	}
+
+	failed := make([]*emitter.EntryError, len(perr))
+	for i, f := range perr {
+		failed[i] = &emitter.EntryError{
+			Index:   f.Msg.Metadata.(int),
+			Message: f.Err.Error(),
+			Err:     f.Err,
+		}
+	}
+
+	return emitter.Failed(failed)
+}
+
+// wait calls send and returns its error, or the error of the context when it is
+// done first.
+func (r *responder) wait(ctx context.Context, send func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- send()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// message returns the Kafka message for the event. The message is keyed by the
+// order ID of the event, if it has one. The type of the event is passed on in the
+// Type header, and the ID of events that carry one in the MessageID header.
+func (r *responder) message(e emitter.Event) (*sarama.ProducerMessage, error) {
+	payload, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: r.topic,
+		Value: sarama.ByteEncoder(payload),
+	}
+
+	if orderID := orderID(payload); len(orderID) > 0 {
+		msg.Key = sarama.StringEncoder(orderID)
+	}
+
+	if t := e.Meta().Type; len(t) > 0 {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte("Type"), Value: []byte(t)})
+	}
+
+	if id, ok := e.(emitter.Identified); ok && len(id.MessageID()) > 0 {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte("MessageID"), Value: []byte(id.MessageID())})
+	}
+
+	return msg, nil
+}
+
+// orderID returns the order ID of the event, or an empty string when it has none.
+// Every event of the shop carries the order ID it belongs to in data.orderID.
+func orderID(payload []byte) string {
+	var evt struct {
+		Data struct {
+			OrderID string `json:"orderID"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		return ""
+	}
+
+	return evt.Data.OrderID
+}
@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// event is an event with a fixed payload and an optional ID.
+type event struct {
+	payload string
+	id      string
+}
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e.payload), nil
+}
+
+func (e event) MessageID() string {
+	return e.id
+}
+
+func TestBrokers(t *testing.T) {
+	os.Setenv("KAFKA_BROKERS", " kafka-0:9092,,kafka-1:9092 ")
+	defer os.Unsetenv("KAFKA_BROKERS")
+
+	want := []string{"kafka-0:9092", "kafka-1:9092"}
+	if got := Brokers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Brokers() = %v, want %v", got, want)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		acks       sarama.RequiredAcks
+		idempotent bool
+		wantErr    bool
+	}{
+		{"default", nil, sarama.WaitForAll, true, false},
+		{"leader acks", map[string]string{"KAFKA_ACKS": "leader", "KAFKA_IDEMPOTENT": "false"}, sarama.WaitForLocal, false, false},
+		{"idempotent without all acks", map[string]string{"KAFKA_ACKS": "leader"}, 0, false, true},
+		{"unknown acks", map[string]string{"KAFKA_ACKS": "some"}, 0, false, true},
+		{"invalid version", map[string]string{"KAFKA_VERSION": "latest"}, 0, false, true},
+		{"invalid idempotent", map[string]string{"KAFKA_IDEMPOTENT": "maybe"}, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			cfg, err := Config()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Config() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if err == nil && (cfg.Producer.RequiredAcks != tt.acks || cfg.Producer.Idempotent != tt.idempotent) {
+				t.Errorf("Config() acks = %v and idempotent = %v, want %v and %v", cfg.Producer.RequiredAcks, cfg.Producer.Idempotent, tt.acks, tt.idempotent)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	r := &responder{topic: "payment"}
+
+	msg, err := r.message(event{payload: `{"data":{"orderID":"order-1"}}`, id: "msg-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Topic != "payment" || msg.Key != sarama.StringEncoder("order-1") {
+		t.Errorf("message() = topic %s and key %v, want payment and order-1", msg.Topic, msg.Key)
+	}
+
+	want := []sarama.RecordHeader{
+		{Key: []byte("Type"), Value: []byte("CreditCardValidated")},
+		{Key: []byte("MessageID"), Value: []byte("msg-1")},
+	}
+	if !reflect.DeepEqual(msg.Headers, want) {
+		t.Errorf("message() headers = %v, want %v", msg.Headers, want)
+	}
+
+	// Events without an order ID or ID have no key and no MessageID header
+	msg, err = r.message(event{payload: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Key != nil || len(msg.Headers) != 1 {
+		t.Errorf("message() = key %v and headers %v, want no key and just the Type header", msg.Key, msg.Headers)
+	}
+}
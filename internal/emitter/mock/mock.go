@@ -5,12 +5,19 @@
 package mock
 
 import (
+	"context"
 	"log"
 
-	acmeserverless "github.com/retgits/acme-serverless"
 	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
 )
 
+func init() {
+	emitter.Register("mock", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
+
 // responder is an empty struct that implements the methods of the
 // EventEmitter interface.
 type responder struct{}
@@ -21,15 +28,25 @@ func New() emitter.EventEmitter {
 	return responder{}
 }
 
-// Send logs the message to the log file of the service
-// and returns an error if anything goes wrong.
-func (r responder) Send(e acmeserverless.CreditCardValidatedEvent) error {
+// Send logs the message, without creditcard data, to the log file
+// of the service and returns an error if anything goes wrong, or the context
+// is done.
+func (r responder) Send(ctx context.Context, e emitter.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	payload, err := e.Marshal()
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Payload: %s", string(payload))
+	log.Printf("Payload: %s", string(redact.JSON(payload)))
 
 	return nil
 }
+
+// SendBatch logs the events, one at a time.
+func (r responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
@@ -0,0 +1,147 @@
+// Package nats uses NATS JetStream, a messaging system with persistent streams, to send
+// the events of the Payment service to the other services of the shop when it runs in a
+// Kubernetes cluster without AWS. Events are published to a subject that a JetStream
+// stream captures, and are only sent when the stream stored them.
+package nats
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/nats-io/nats.go"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+func init() {
+	emitter.Register("nats", func() (emitter.EventEmitter, error) {
+		return New()
+	})
+}
+
+// responder contains the JetStream context and the subject, and implements
+// the methods of the EventEmitter interface.
+type responder struct {
+	js      nats.JetStreamContext
+	subject string
+}
+
+// New creates a new instance of the EventEmitter with NATS JetStream as the messaging
+// layer. The subject is determined by the environment variable NATS_SUBJECT, and a
+// JetStream stream must capture it. The connection is made with Connect. The method
+// returns an error if the subject is not set, or the server could not be reached.
+func New() (emitter.EventEmitter, error) {
+	return NewSubject(os.Getenv("NATS_SUBJECT"))
+}
+
+// NewSubject creates a new instance of the EventEmitter with NATS JetStream as the
+// messaging layer, which publishes to the subject instead of NATS_SUBJECT. The options
+// are applied when the connection is made, so they can override the credentials or
+// the reconnect behavior. It is configured like New otherwise.
+func NewSubject(subject string, opts ...nats.Option) (emitter.EventEmitter, error) {
+	if len(subject) == 0 {
+		return nil, errors.New("the subject must be the name of a NATS subject, set NATS_SUBJECT")
+	}
+
+	nc, err := Connect(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return &responder{
+		js:      js,
+		subject: subject,
+	}, nil
+}
+
+// Connect connects to the NATS server in the environment variable NATS_URL, or
+// nats://127.0.0.1:4222 when it isn't set. The client reconnects when the connection
+// is lost, for as long as the service runs. The options are applied after that.
+func Connect(opts ...nats.Option) (*nats.Conn, error) {
+	url := os.Getenv("NATS_URL")
+	if len(url) == 0 {
+		url = nats.DefaultURL
+	}
+
+	return nats.Connect(url, append([]nats.Option{nats.Name("payment"), nats.MaxReconnects(-1)}, opts...)...)
+}
+
+// Send publishes the event to the subject and waits until the stream stored it. The
+// method returns an error if anything goes wrong, or the context is done before the
+// event is stored.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	msg, opts, err := r.message(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.js.PublishMsg(msg, append(opts, nats.Context(ctx))...)
+	return err
+}
+
+// SendBatch publishes the events to the subject without waiting for each of them, and
+// then waits until the stream stored all of them. When some events could not be sent,
+// the method returns a BatchError with just those events; the others were sent.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	futures := make([]nats.PubAckFuture, len(events))
+	var failed []*emitter.EntryError
+
+	for i, e := range events {
+		msg, opts, err := r.message(e)
+		if err != nil {
+			return err
+		}
+
+		futures[i], err = r.js.PublishMsgAsync(msg, opts...)
+		if err != nil {
+			failed = append(failed, &emitter.EntryError{Index: i, Message: err.Error(), Err: err})
+		}
+	}
+
+	for i, f := range futures {
+		if f == nil {
+			continue
+		}
+
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			failed = append(failed, &emitter.EntryError{Index: i, Message: err.Error(), Err: err})
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return emitter.Failed(failed)
+}
+
+// message returns the NATS message for the event, and the options to publish it. The
+// type of the event is passed on in the Type header. The ID of events that carry one is
+// passed on as the message ID, so the stream stores the event once when it is published
+// again within the duplicate window of the stream.
+func (r *responder) message(e emitter.Event) (*nats.Msg, []nats.PubOpt, error) {
+	payload, err := e.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := nats.NewMsg(r.subject)
+	msg.Data = payload
+
+	if t := e.Meta().Type; len(t) > 0 {
+		msg.Header.Set("Type", t)
+	}
+
+	var opts []nats.PubOpt
+	if id, ok := e.(emitter.Identified); ok && len(id.MessageID()) > 0 {
+		opts = append(opts, nats.MsgId(id.MessageID()))
+	}
+
+	return msg, opts, nil
+}
@@ -0,0 +1,131 @@
+package nats
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+const subject = "payment.validated"
+
+// event is an event with a fixed payload and an optional ID.
+type event struct {
+	payload string
+	id      string
+}
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e.payload), nil
+}
+
+func (e event) MessageID() string {
+	return e.id
+}
+
+// newStream starts a NATS server with JetStream and a stream for the subject, which
+// is stopped when the test ends. It returns the emitter and the JetStream context.
+func newStream(t *testing.T) (emitter.EventEmitter, nats.JetStreamContext) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "jetstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = dir
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+
+	os.Setenv("NATS_URL", s.ClientURL())
+	defer os.Unsetenv("NATS_URL")
+
+	nc, err := Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "PAYMENTS", Subjects: []string{subject}}); err != nil {
+		t.Fatal(err)
+	}
+
+	em, err := NewSubject(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return em, js
+}
+
+// stored returns the number of messages in the stream.
+func stored(t *testing.T, js nats.JetStreamContext) uint64 {
+	t.Helper()
+
+	info, err := js.StreamInfo("PAYMENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.State.Msgs
+}
+
+func TestSend(t *testing.T) {
+	em, js := newStream(t)
+
+	if err := em.Send(context.Background(), event{payload: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := js.GetMsg("PAYMENTS", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg.Data) != "{}" || msg.Header.Get("Type") != "CreditCardValidated" {
+		t.Errorf("Send() stored %s with type %q, want {} with type CreditCardValidated", msg.Data, msg.Header.Get("Type"))
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	em, js := newStream(t)
+
+	events := []emitter.Event{
+		event{payload: "{}", id: "msg-1"},
+		event{payload: "{}", id: "msg-2"},
+		event{payload: "{}", id: "msg-1"},
+	}
+
+	if err := em.SendBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	// The event that was published again with the same ID is stored once
+	if n := stored(t, js); n != 2 {
+		t.Errorf("SendBatch() stored %d events, want 2", n)
+	}
+}
+
+func TestNewSubjectWithoutSubject(t *testing.T) {
+	if _, err := NewSubject(""); err == nil {
+		t.Error("NewSubject() returned no error")
+	}
+}
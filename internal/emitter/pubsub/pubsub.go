@@ -0,0 +1,152 @@
+// Package pubsub uses Google Cloud Pub/Sub, a fully managed real-time messaging service,
+// to send the events of the Payment service to the other services of the shop when it
+// runs on Google Cloud Run.
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	emitter.Register("pubsub", func() (emitter.EventEmitter, error) {
+		return New()
+	})
+}
+
+// responder contains the Pub/Sub topic and implements the methods
+// of the EventEmitter interface.
+type responder struct {
+	topic *pubsub.Topic
+}
+
+// New creates a new instance of the EventEmitter with Pub/Sub as the messaging
+// layer. The topic is determined by the environment variable PUBSUB_TOPIC, which
+// contains either the ID of the topic or its name, like projects/acme/topics/payment.
+// The project of a topic ID is determined by the environment variable PUBSUB_PROJECT,
+// or GOOGLE_CLOUD_PROJECT when it isn't set. To use the Pub/Sub emulator, set
+// PUBSUB_EMULATOR_HOST to its address. The options are applied when the client is
+// created, so they can override the endpoint or credentials. The client is created
+// once and shared by every message. The method returns an error if the topic is not
+// valid or the client could not be created.
+func New(opts ...option.ClientOption) (emitter.EventEmitter, error) {
+	return NewTopic(os.Getenv("PUBSUB_TOPIC"), opts...)
+}
+
+// NewTopic creates a new instance of the EventEmitter with Pub/Sub as the messaging
+// layer, which sends to the topic with the ID or name instead of PUBSUB_TOPIC. It is
+// configured like New otherwise.
+func NewTopic(topic string, opts ...option.ClientOption) (emitter.EventEmitter, error) {
+	project, id, err := topicName(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := pubsub.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responder{
+		topic: client.Topic(id),
+	}, nil
+}
+
+// topicName returns the project and ID of the topic. The topic can be a name, like
+// projects/acme/topics/payment, or an ID, which is used with the project in the
+// environment.
+func topicName(topic string) (string, string, error) {
+	if strings.HasPrefix(topic, "projects/") {
+		nameParts := strings.Split(topic, "/")
+		if len(nameParts) != 4 || nameParts[2] != "topics" || len(nameParts[1]) == 0 || len(nameParts[3]) == 0 {
+			return "", "", fmt.Errorf("the topic must be the ID or name of a Pub/Sub topic, got %q", topic)
+		}
+		return nameParts[1], nameParts[3], nil
+	}
+
+	project := os.Getenv("PUBSUB_PROJECT")
+	if len(project) == 0 {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+
+	if len(topic) == 0 || len(project) == 0 {
+		return "", "", fmt.Errorf("the topic must be the ID of a Pub/Sub topic in PUBSUB_PROJECT, or the name of a Pub/Sub topic, got %q", topic)
+	}
+
+	return project, topic, nil
+}
+
+// Send publishes the event to the Pub/Sub topic and waits until Pub/Sub accepted it.
+// The method returns an error if anything goes wrong, or the context is done before
+// the message is accepted. The client may still publish the message after that.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	msg, err := message(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.topic.Publish(ctx, msg).Get(ctx)
+	return err
+}
+
+// SendBatch publishes the events to the Pub/Sub topic, which the client bundles into
+// as few requests as possible, and waits until Pub/Sub accepted all of them. When some
+// messages could not be published, the method returns a BatchError with just those
+// messages; the others were published.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	results := make([]*pubsub.PublishResult, len(events))
+	for i, e := range events {
+		msg, err := message(e)
+		if err != nil {
+			return err
+		}
+
+		results[i] = r.topic.Publish(ctx, msg)
+	}
+
+	var failed []*emitter.EntryError
+	for i, res := range results {
+		if _, err := res.Get(ctx); err != nil {
+			failed = append(failed, &emitter.EntryError{
+				Index:   i,
+				Code:    status.Code(err).String(),
+				Message: status.Convert(err).Message(),
+				Err:     err,
+			})
+		}
+	}
+
+	return emitter.Failed(failed)
+}
+
+// message returns the Pub/Sub message for the event. The type of the event is passed
+// on in the Type attribute, so subscriptions can filter on it, and the ID of events
+// that carry one in the MessageID attribute.
+func message(e emitter.Event) (*pubsub.Message, error) {
+	payload, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string]string)
+
+	if t := e.Meta().Type; len(t) > 0 {
+		attributes["Type"] = t
+	}
+
+	if id, ok := e.(emitter.Identified); ok && len(id.MessageID()) > 0 {
+		attributes["MessageID"] = id.MessageID()
+	}
+
+	return &pubsub.Message{
+		Data:       payload,
+		Attributes: attributes,
+	}, nil
+}
@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const topic = "projects/acme/topics/payment"
+
+// event is an event with a fixed payload.
+type event string
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e), nil
+}
+
+// identified is an event with an ID, like the messages of the outbox.
+type identified struct {
+	event
+	id string
+}
+
+func (e identified) MessageID() string {
+	return e.id
+}
+
+// payload is the body of the events, which is about the size of a CreditCardValidated event.
+var payload = event(`{"metadata":{"domain":"Payment","source":"ValidateCreditCard","type":"CreditCardValidated","status":"success"},"data":{"success":true,"status":200,"message":"transaction successful","amount":"85.23","transactionID":"3f846704-af12-4ea9-a98c-8d7b37e10b54","orderID":"12345","card":"411111******1111"}}`)
+
+// newServer starts a fake Pub/Sub server, which is closed when the test ends, and
+// returns it together with the options that connect a client to it. When create is
+// set, the topic is created.
+func newServer(t *testing.T, create bool) (*pstest.Server, []option.ClientOption) {
+	t.Helper()
+
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	opts := []option.ClientOption{
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
+
+	if create {
+		client, err := pubsub.NewClient(context.Background(), "acme", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if _, err := client.CreateTopic(context.Background(), "payment"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return srv, opts
+}
+
+// newEmitter returns an EventEmitter that publishes to the topic of the fake server.
+func newEmitter(t *testing.T, opts []option.ClientOption) emitter.EventEmitter {
+	t.Helper()
+
+	em, err := NewTopic(topic, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return em
+}
+
+func TestSend(t *testing.T) {
+	srv, opts := newServer(t, true)
+
+	if err := newEmitter(t, opts).Send(context.Background(), identified{payload, "msg-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Send() published %d messages, want 1", len(msgs))
+	}
+
+	if string(msgs[0].Data) != string(payload) {
+		t.Errorf("Send() published %s, want %s", msgs[0].Data, payload)
+	}
+
+	if msgs[0].Attributes["Type"] != "CreditCardValidated" || msgs[0].Attributes["MessageID"] != "msg-1" {
+		t.Errorf("Send() published attributes %v, want the type and the message ID", msgs[0].Attributes)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	srv, opts := newServer(t, true)
+
+	events := []emitter.Event{identified{payload, "msg-1"}, payload, identified{payload, "msg-3"}}
+	if err := newEmitter(t, opts).SendBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("SendBatch() published %d messages, want 3", len(msgs))
+	}
+
+	ids := map[string]bool{}
+	for _, m := range msgs {
+		if m.Attributes["Type"] != "CreditCardValidated" {
+			t.Errorf("SendBatch() published attributes %v, want the type", m.Attributes)
+		}
+		if id, ok := m.Attributes["MessageID"]; ok {
+			ids[id] = true
+		}
+	}
+
+	if len(ids) != 2 || !ids["msg-1"] || !ids["msg-3"] {
+		t.Errorf("SendBatch() published message IDs %v, want msg-1 and msg-3", ids)
+	}
+}
+
+func TestSendBatchReportsFailedMessages(t *testing.T) {
+	srv, opts := newServer(t, true)
+
+	// The second message is larger than a Publish request can be, so the
+	// client fails just that message
+	large := event(strings.Repeat("x", pubsub.MaxPublishRequestBytes+1))
+	events := []emitter.Event{payload, large, payload}
+
+	err := newEmitter(t, opts).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 1 message", err)
+	}
+
+	if berr.Failed[0].Index != 1 || !errors.Is(berr.Failed[0], pubsub.ErrOversizedMessage) {
+		t.Errorf("SendBatch() failed message %d with %v, want message 1 with %v", berr.Failed[0].Index, berr.Failed[0].Err, pubsub.ErrOversizedMessage)
+	}
+
+	if msgs := srv.Messages(); len(msgs) != 2 {
+		t.Errorf("SendBatch() published %d messages, want 2", len(msgs))
+	}
+}
+
+func TestSendToMissingTopic(t *testing.T) {
+	_, opts := newServer(t, false)
+	em := newEmitter(t, opts)
+
+	if err := em.Send(context.Background(), payload); status.Code(err) != codes.NotFound {
+		t.Errorf("Send() error = %v, want %s", err, codes.NotFound)
+	}
+
+	err := em.SendBatch(context.Background(), []emitter.Event{payload, payload})
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 2 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 2 messages", err)
+	}
+
+	for _, f := range berr.Failed {
+		if f.Code != codes.NotFound.String() {
+			t.Errorf("SendBatch() failed message %d with code %q, want %q", f.Index, f.Code, codes.NotFound.String())
+		}
+	}
+}
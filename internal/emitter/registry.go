@@ -0,0 +1,72 @@
+package emitter
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates an EventEmitter.
+type Factory func() (EventEmitter, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes an EventEmitter available under the name. Backends register
+// themselves when their package is imported. If an EventEmitter with the name
+// already exists, it is replaced.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	factories[name] = f
+}
+
+// Registered returns the names of the registered EventEmitters, sorted.
+func Registered() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// New creates the EventEmitter that is registered under the name. It returns an
+// error if no EventEmitter is registered under the name, or it could not be created.
+func New(name string) (EventEmitter, error) {
+	mu.RLock()
+	f, ok := factories[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown emitter %q, registered emitters are %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return f()
+}
+
+// FromEnv creates the EventEmitter that is selected by the environment variable
+// EMITTER. When it isn't set, the fallback is used. When neither is set, it returns
+// nil, which means events are not sent. It returns an error if the EventEmitter could
+// not be created.
+func FromEnv(fallback string) (EventEmitter, error) {
+	name := os.Getenv("EMITTER")
+	if len(name) == 0 {
+		name = fallback
+	}
+
+	if len(name) == 0 {
+		return nil, nil
+	}
+
+	return New(name)
+}
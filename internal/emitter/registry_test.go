@@ -0,0 +1,66 @@
+package emitter
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// named is an EventEmitter that only knows its name.
+type named string
+
+func (n named) Send(ctx context.Context, e Event) error {
+	return nil
+}
+
+func (n named) SendBatch(ctx context.Context, events []Event) error {
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	Register("first", func() (EventEmitter, error) { return named("first"), nil })
+	Register("second", func() (EventEmitter, error) { return named("second"), nil })
+
+	em, err := New("second")
+	if err != nil || em != named("second") {
+		t.Errorf("New(\"second\") = %v, %v, want the second emitter", em, err)
+	}
+
+	// The error lists the emitters that can be used instead
+	_, err = New("third")
+	if err == nil || !strings.Contains(err.Error(), "first, second") {
+		t.Errorf("New(\"third\") error = %v, want the registered emitters", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	Register("first", func() (EventEmitter, error) { return named("first"), nil })
+	Register("second", func() (EventEmitter, error) { return named("second"), nil })
+
+	tests := []struct {
+		name     string
+		env      string
+		fallback string
+		want     EventEmitter
+	}{
+		{"nothing selected", "", "", nil},
+		{"fallback", "", "first", named("first")},
+		{"selected", "second", "first", named("second")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("EMITTER", tt.env)
+			defer os.Unsetenv("EMITTER")
+
+			em, err := FromEnv(tt.fallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if em != tt.want {
+				t.Errorf("FromEnv(%q) = %v, want %v", tt.fallback, em, tt.want)
+			}
+		})
+	}
+}
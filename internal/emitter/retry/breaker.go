@@ -0,0 +1,153 @@
+package retry
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// State is the state of the circuit breaker.
+type State int
+
+const (
+	// Closed means events are sent.
+	Closed State = iota
+
+	// HalfOpen means a single attempt is let through to check whether the
+	// messaging service recovered.
+	HalfOpen
+
+	// Open means events are not sent, because the messaging service has been failing.
+	Open
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker that opens after a number of consecutive failures.
+type breaker struct {
+	mu        sync.Mutex
+	state     State
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	threshold int
+	timeout   time.Duration
+}
+
+// newBreaker creates a closed circuit breaker that opens after threshold consecutive
+// failures and lets a single attempt through after it was open for the timeout. A
+// threshold of zero means it never opens.
+func newBreaker(threshold int, timeout time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// allow returns whether an attempt may be made. When the circuit breaker has been
+// open for the timeout, it becomes half-open and allows a single attempt.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	gauge("emitter.circuit.state").Update(int64(b.state))
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.transition(HalfOpen)
+		b.trial = true
+		return true
+	case HalfOpen:
+		// Only the trial attempt is let through
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success records a successful attempt, which closes the circuit breaker.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != Closed {
+		b.transition(Closed)
+	}
+}
+
+// failure records a failed attempt. The circuit breaker opens when the trial attempt
+// fails, or when the number of consecutive failures reaches the threshold.
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.transition(Open)
+	}
+}
+
+// release records an attempt that says nothing about the messaging service, like
+// one that was canceled or failed with a permanent error. It doesn't change the
+// state, but lets another attempt through when it was the trial attempt.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// transition changes the state, and logs and counts the change. The caller must hold the lock.
+func (b *breaker) transition(to State) {
+	if to == Open {
+		log.Printf("emitter circuit breaker changed from %s to %s after %d consecutive failures", b.state, to, b.failures)
+	} else {
+		log.Printf("emitter circuit breaker changed from %s to %s", b.state, to)
+	}
+
+	b.state = to
+	gauge("emitter.circuit.state").Update(int64(to))
+	counter("emitter.circuit." + to.String()).Inc(1)
+}
+
+// counter returns the counter with the name from the default registry. Metrics are
+// looked up every time, because the Wavefront Lambda wrapper clears the registry
+// after every invocation.
+func counter(name string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(name, metrics.DefaultRegistry)
+}
+
+// gauge returns the gauge with the name from the default registry.
+func gauge(name string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry)
+}
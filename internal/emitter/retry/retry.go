@@ -0,0 +1,386 @@
+// Package retry wraps an EventEmitter so that events which fail to send because of
+// a transient error, like throttling or a network failure, are sent again with
+// exponential backoff and jitter. A circuit breaker stops sending, and fails fast,
+// while the messaging service keeps failing, so the Payment service doesn't spend
+// the remaining time of an invocation waiting on a service that is down. State
+// changes of the circuit breaker are logged, and the emitter reports its metrics
+// to the default go-metrics registry, which the Wavefront Lambda wrapper sends to
+// Wavefront.
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned when the circuit breaker is open, which means the
+// event was not sent because the messaging service has been failing.
+var ErrCircuitOpen = errors.New("circuit breaker is open, the messaging service is failing")
+
+// Config contains the settings for retrying and the circuit breaker.
+type Config struct {
+	// MaxAttempts is the maximum number of times an event is sent.
+	MaxAttempts int
+
+	// MaxElapsed is the maximum time spent on sending an event, including
+	// the backoff between attempts. Zero means there is no limit besides
+	// the deadline of the context.
+	MaxElapsed time.Duration
+
+	// BaseDelay is the backoff before the second attempt, which doubles for
+	// every attempt after that.
+	BaseDelay time.Duration
+
+	// MaxDelay is the maximum backoff between two attempts.
+	MaxDelay time.Duration
+
+	// FailureThreshold is the number of consecutive failed attempts that opens
+	// the circuit breaker. Zero disables the circuit breaker.
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit breaker stays open before a single
+	// attempt is let through to check whether the messaging service recovered.
+	OpenTimeout time.Duration
+}
+
+// DefaultConfig contains the settings that are used when nothing is configured.
+var DefaultConfig = Config{
+	MaxAttempts:      3,
+	MaxElapsed:       5 * time.Second,
+	BaseDelay:        100 * time.Millisecond,
+	MaxDelay:         time.Second,
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+}
+
+// retriableCodes contains the error codes of events that the messaging service
+// may accept when they are sent again.
+var retriableCodes = map[string]bool{
+	"Throttling":                  true,
+	"ThrottlingException":         true,
+	"RequestThrottled":            true,
+	"InternalFailure":             true,
+	"InternalError":               true,
+	"InternalException":           true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
+
+	// gRPC status codes, used by Google Cloud Pub/Sub
+	"Unavailable":       true,
+	"ResourceExhausted": true,
+	"Aborted":           true,
+	"Internal":          true,
+}
+
+// Emitter wraps an EventEmitter and implements the methods of the
+// EventEmitter interface.
+type Emitter struct {
+	next    emitter.EventEmitter
+	config  Config
+	breaker *breaker
+}
+
+// New wraps the EventEmitter, so events are sent again when sending fails with
+// a retriable error, with the settings in the config. When the EventEmitter sends
+// events again itself, the Emitter wraps the EventEmitter that sends every event
+// just once instead, so the settings in the config are the only retries.
+func New(next emitter.EventEmitter, c Config) *Emitter {
+	if c.MaxAttempts < 1 {
+		c.MaxAttempts = 1
+	}
+
+	if r, ok := next.(emitter.Retrying); ok {
+		next = r.SingleAttempt()
+	}
+
+	return &Emitter{
+		next:    next,
+		config:  c,
+		breaker: newBreaker(c.FailureThreshold, c.OpenTimeout),
+	}
+}
+
+// config is the JSON representation of the Config.
+type config struct {
+	MaxAttempts      *int   `json:"maxAttempts"`
+	MaxElapsed       string `json:"maxElapsed"`
+	BaseDelay        string `json:"baseDelay"`
+	MaxDelay         string `json:"maxDelay"`
+	FailureThreshold *int   `json:"failureThreshold"`
+	OpenTimeout      string `json:"openTimeout"`
+}
+
+// FromEnv wraps the EventEmitter with the settings configured in the environment.
+// The environment variable EMITTER_RETRY can contain the JSON encoded settings,
+// with durations like 100ms. Settings that aren't set keep their default. It
+// returns an error if a setting is not valid.
+func FromEnv(next emitter.EventEmitter) (*Emitter, error) {
+	c := DefaultConfig
+
+	payload := os.Getenv("EMITTER_RETRY")
+	if len(payload) == 0 {
+		return New(next, c), nil
+	}
+
+	var cfg config
+	if err := json.Unmarshal([]byte(payload), &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing emitter retry settings: %s", err.Error())
+	}
+
+	if cfg.MaxAttempts != nil {
+		if *cfg.MaxAttempts < 1 {
+			return nil, fmt.Errorf("emitter retry needs maxAttempts of at least 1")
+		}
+		c.MaxAttempts = *cfg.MaxAttempts
+	}
+
+	if cfg.FailureThreshold != nil {
+		if *cfg.FailureThreshold < 0 {
+			return nil, fmt.Errorf("emitter retry needs a failureThreshold of at least 0")
+		}
+		c.FailureThreshold = *cfg.FailureThreshold
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"maxElapsed", cfg.MaxElapsed, &c.MaxElapsed},
+		{"baseDelay", cfg.BaseDelay, &c.BaseDelay},
+		{"maxDelay", cfg.MaxDelay, &c.MaxDelay},
+		{"openTimeout", cfg.OpenTimeout, &c.OpenTimeout},
+	}
+
+	for _, d := range durations {
+		if len(d.value) == 0 {
+			continue
+		}
+
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("emitter retry has an invalid %s %q", d.name, d.value)
+		}
+		*d.field = v
+	}
+
+	return New(next, c), nil
+}
+
+// Send sends the event using the wrapped EventEmitter. When sending fails with
+// a retriable error, the event is sent again after a backoff, until it is sent,
+// the attempts or time run out, or the context is done. It returns ErrCircuitOpen
+// without sending when the circuit breaker is open, or an error that wraps it
+// when the circuit breaker opened while the event was sent again.
+func (r *Emitter) Send(ctx context.Context, e emitter.Event) error {
+	return r.do(ctx, func() error {
+		return r.next.Send(ctx, e)
+	})
+}
+
+// SendBatch sends the events using the wrapped EventEmitter. When some events
+// fail with a retriable error, just those events are sent again, like Send does.
+// Events that failed with a permanent error are not sent again. When some events
+// could not be sent, it returns a BatchError with just those events.
+func (r *Emitter) SendBatch(ctx context.Context, events []emitter.Event) error {
+	pending := events
+	indexes := make([]int, len(events))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	var permanent []*emitter.EntryError
+
+	err := r.do(ctx, func() error {
+		err := r.next.SendBatch(ctx, pending)
+
+		var berr *emitter.BatchError
+		if !errors.As(err, &berr) {
+			return err
+		}
+
+		// Keep the events that can be sent again, and their position in the batch
+		var retry []emitter.Event
+		var retryIndexes []int
+		var failed []*emitter.EntryError
+		for _, f := range berr.Failed {
+			pos := f.Index
+			f.Index = indexes[pos]
+
+			if !Retriable(f) {
+				permanent = append(permanent, f)
+				continue
+			}
+
+			retry = append(retry, pending[pos])
+			retryIndexes = append(retryIndexes, f.Index)
+			failed = append(failed, f)
+		}
+
+		pending, indexes = retry, retryIndexes
+		if len(failed) == 0 {
+			return nil
+		}
+
+		return &emitter.BatchError{Failed: failed}
+	})
+
+	// Report the events that were not sent, unless none of them were
+	if err == nil {
+		return emitter.Failed(permanent)
+	}
+
+	var berr *emitter.BatchError
+	if errors.As(err, &berr) {
+		return emitter.Failed(append(permanent, berr.Failed...))
+	}
+
+	if len(permanent) == 0 && len(pending) == len(events) {
+		return err
+	}
+
+	return emitter.Failed(append(permanent, emitter.RequestFailed(indexes, err)...))
+}
+
+// do calls send until it succeeds, it fails with an error that isn't retriable, the
+// attempts or time run out, or the context is done. It returns the last error.
+func (r *Emitter) do(ctx context.Context, send func() error) error {
+	start := time.Now()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if !r.breaker.allow() {
+			counter("emitter.circuit.rejected").Inc(1)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrCircuitOpen, err)
+			}
+			return ErrCircuitOpen
+		}
+
+		counter("emitter.attempts").Inc(1)
+		err = send()
+		retriable := Retriable(err)
+
+		// Only failures that point to a problem with the messaging service count
+		// towards opening the circuit breaker, and only a sent event shows that it
+		// works. An attempt that failed with a permanent error, or stopped because
+		// the context is done, doesn't show either.
+		switch {
+		case err == nil:
+			r.breaker.success()
+		case retriable:
+			r.breaker.failure()
+		default:
+			r.breaker.release()
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if !retriable {
+			counter("emitter.failures.permanent").Inc(1)
+			return err
+		}
+
+		if attempt >= r.config.MaxAttempts {
+			counter("emitter.failures.exhausted").Inc(1)
+			return err
+		}
+
+		delay := r.backoff(attempt)
+		if r.config.MaxElapsed > 0 && time.Since(start)+delay > r.config.MaxElapsed {
+			counter("emitter.failures.exhausted").Inc(1)
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			counter("emitter.failures.exhausted").Inc(1)
+			return err
+		}
+
+		counter("emitter.retries").Inc(1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random duration up to the exponential backoff after the attempt.
+func (r *Emitter) backoff(attempt int) time.Duration {
+	backoff := r.config.BaseDelay << uint(attempt-1)
+	if backoff > r.config.MaxDelay || backoff <= 0 {
+		backoff = r.config.MaxDelay
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// Retriable returns whether sending the event again might succeed. Throttling,
+// server errors, and network errors are retriable. Errors in the event itself,
+// like a validation error, a canceled context, or an open circuit breaker are not.
+// A BatchError is retriable when any of its events is.
+func Retriable(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var berr *emitter.BatchError
+	if errors.As(err, &berr) {
+		for _, f := range berr.Failed {
+			if Retriable(f) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var eerr *emitter.EntryError
+	if errors.As(err, &eerr) {
+		if eerr.Err != nil {
+			return Retriable(eerr.Err)
+		}
+		return retriableCodes[eerr.Code]
+	}
+
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) && (rerr.StatusCode() >= 500 || rerr.StatusCode() == 429) {
+		return true
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return retriableCodes[aerr.Code()] || request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr)
+	}
+
+	var gerr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &gerr) {
+		return retriableCodes[gerr.GRPCStatus().Code().String()]
+	}
+
+	var terr interface{ Temporary() bool }
+	if errors.As(err, &terr) {
+		return terr.Temporary()
+	}
+
+	return false
+}
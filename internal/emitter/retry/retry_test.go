@@ -0,0 +1,325 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+// event is an event with a fixed payload.
+type event string
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e), nil
+}
+
+// fake is an EventEmitter that returns the errors in order, one for every call,
+// and succeeds once they run out.
+type fake struct {
+	errs  []error
+	calls int
+}
+
+func (f *fake) Send(ctx context.Context, e emitter.Event) error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *fake) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, f, events)
+}
+
+// batcher is an EventEmitter that records the batches it was asked to send,
+// and returns the errors in order, one for every batch.
+type batcher struct {
+	errs    []error
+	batches [][]emitter.Event
+}
+
+func (b *batcher) Send(ctx context.Context, e emitter.Event) error {
+	return b.SendBatch(ctx, []emitter.Event{e})
+}
+
+func (b *batcher) SendBatch(ctx context.Context, events []emitter.Event) error {
+	b.batches = append(b.batches, events)
+	if len(b.errs) == 0 {
+		return nil
+	}
+
+	err := b.errs[0]
+	b.errs = b.errs[1:]
+	return err
+}
+
+var (
+	throttled = &emitter.EntryError{Code: "ThrottlingException", Message: "rate exceeded"}
+	invalid   = &emitter.EntryError{Code: "InvalidArgument", Message: "invalid event"}
+)
+
+// quick retries quickly and has no circuit breaker.
+var quick = Config{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    time.Millisecond,
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"sent", nil, 1, false},
+		{"sent after retriable errors", []error{throttled, throttled}, 3, false},
+		{"permanent error", []error{invalid}, 1, true},
+		{"attempts run out", []error{throttled, throttled, throttled}, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &fake{errs: tt.errs}
+
+			err := New(next, quick).Send(context.Background(), event("{}"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if next.calls != tt.wantCalls {
+				t.Errorf("Send() made %d attempts, want %d", next.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSendBatchResendsFailedEvents(t *testing.T) {
+	events := []emitter.Event{event("a"), event("b"), event("c")}
+	next := &batcher{errs: []error{
+		&emitter.BatchError{Failed: []*emitter.EntryError{
+			{Index: 1, Code: throttled.Code},
+			{Index: 2, Code: invalid.Code},
+		}},
+	}}
+
+	err := New(next, quick).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 || berr.Failed[0].Index != 2 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with event 2", err)
+	}
+
+	want := [][]emitter.Event{events, {event("b")}}
+	if !reflect.DeepEqual(next.batches, want) {
+		t.Errorf("SendBatch() sent %v, want %v", next.batches, want)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	next := &fake{errs: []error{throttled, throttled}}
+	em := New(next, Config{
+		MaxAttempts:      1,
+		FailureThreshold: 2,
+		OpenTimeout:      10 * time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := em.Send(context.Background(), event("{}")); err == nil {
+			t.Fatal("Send() returned no error")
+		}
+	}
+
+	if err := em.Send(context.Background(), event("{}")); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Send() error = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	if next.calls != 2 {
+		t.Errorf("Send() made %d attempts while the circuit breaker was open, want 0", next.calls-2)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The trial attempt succeeds, which closes the circuit breaker
+	if err := em.Send(context.Background(), event("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := em.Send(context.Background(), event("{}")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"throttled", throttled, true},
+		{"invalid", invalid, false},
+		{"canceled", context.Canceled, false},
+		{"circuit open", ErrCircuitOpen, false},
+		{"batch with a throttled event", &emitter.BatchError{Failed: []*emitter.EntryError{invalid, throttled}}, true},
+		{"batch with invalid events", &emitter.BatchError{Failed: []*emitter.EntryError{invalid}}, false},
+		{"failed request", &emitter.EntryError{Err: throttled}, true},
+		{"other error", errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		if got := Retriable(tt.err); got != tt.want {
+			t.Errorf("Retriable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    Config
+		wantErr bool
+	}{
+		{"default", "", DefaultConfig, false},
+		{"attempts and delay", `{"maxAttempts":5,"baseDelay":"10ms"}`, Config{
+			MaxAttempts:      5,
+			MaxElapsed:       DefaultConfig.MaxElapsed,
+			BaseDelay:        10 * time.Millisecond,
+			MaxDelay:         DefaultConfig.MaxDelay,
+			FailureThreshold: DefaultConfig.FailureThreshold,
+			OpenTimeout:      DefaultConfig.OpenTimeout,
+		}, false},
+		{"no attempts", `{"maxAttempts":0}`, Config{}, true},
+		{"negative threshold", `{"failureThreshold":-1}`, Config{}, true},
+		{"invalid duration", `{"maxDelay":"soon"}`, Config{}, true},
+		{"not json", `maxAttempts=5`, Config{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("EMITTER_RETRY", tt.env)
+			defer os.Unsetenv("EMITTER_RETRY")
+
+			r, err := FromEnv(&fake{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if err == nil && r.config != tt.want {
+				t.Errorf("FromEnv() config = %+v, want %+v", r.config, tt.want)
+			}
+		})
+	}
+}
+
+// retrying is an EventEmitter that sends events again itself.
+type retrying struct {
+	fake
+	single *fake
+}
+
+func (r *retrying) SingleAttempt() emitter.EventEmitter {
+	return r.single
+}
+
+func TestNewWrapsSingleAttempt(t *testing.T) {
+	next := &retrying{single: &fake{}}
+
+	if err := New(next, DefaultConfig).Send(context.Background(), event("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if next.calls != 0 || next.single.calls != 1 {
+		t.Errorf("Send() sent %d events with the emitter and %d with its single attempt, want 0 and 1", next.calls, next.single.calls)
+	}
+}
+
+func TestCircuitOpensWhileRetrying(t *testing.T) {
+	next := &fake{errs: []error{throttled, throttled}}
+	r := New(next, Config{MaxAttempts: 3, FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	err := r.Send(context.Background(), event("{}"))
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Send() error = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	if next.calls != 1 {
+		t.Errorf("Send() sent the event %d times after the circuit breaker opened, want 1", next.calls)
+	}
+
+	if Retriable(err) {
+		t.Errorf("Retriable() = true for %v, want false", err)
+	}
+}
+
+func TestContextErrorsDontResetFailures(t *testing.T) {
+	next := &fake{errs: []error{throttled, context.DeadlineExceeded, throttled}}
+	r := New(next, Config{MaxAttempts: 1, FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		r.Send(context.Background(), event("{}"))
+	}
+
+	if r.breaker.state != Open {
+		t.Errorf("circuit breaker is %s after two failures around a context error, want open", r.breaker.state)
+	}
+}
+
+func TestPermanentErrorsDontResetFailures(t *testing.T) {
+	invalid := &emitter.EntryError{Code: "ValidationError"}
+	next := &fake{errs: []error{throttled, invalid, throttled}}
+	r := New(next, Config{MaxAttempts: 1, FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		r.Send(context.Background(), event("{}"))
+	}
+
+	if r.breaker.state != Open {
+		t.Errorf("circuit breaker is %s after two failures around a permanent error, want open", r.breaker.state)
+	}
+}
+
+func TestContextErrorsDontCloseBreaker(t *testing.T) {
+	next := &fake{errs: []error{throttled}}
+	r := New(next, Config{MaxAttempts: 1, FailureThreshold: 1, OpenTimeout: time.Millisecond})
+
+	r.Send(context.Background(), event("{}"))
+	time.Sleep(2 * time.Millisecond)
+
+	// The trial attempt is canceled, which leaves the circuit breaker half-open
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	next.errs = []error{context.Canceled}
+
+	if err := r.Send(ctx, event("{}")); err != context.Canceled {
+		t.Fatalf("Send() error = %v, want %v", err, context.Canceled)
+	}
+
+	if r.breaker.state != HalfOpen {
+		t.Fatalf("circuit breaker is %s after a canceled trial attempt, want half-open", r.breaker.state)
+	}
+
+	// Another trial attempt is let through, and closes the circuit breaker
+	if err := r.Send(context.Background(), event("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.breaker.state != Closed {
+		t.Errorf("circuit breaker is %s after a successful trial attempt, want closed", r.breaker.state)
+	}
+}
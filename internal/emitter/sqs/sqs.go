@@ -4,55 +4,289 @@
 package sqs
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	acmeserverless "github.com/retgits/acme-serverless"
 	"github.com/retgits/acme-serverless-payment/internal/emitter"
 )
 
-// responder is an empty struct that implements the methods of the
-// EventEmitter interface.
-type responder struct{}
+const (
+	// maxBatchEntries is the maximum number of messages in a SendMessageBatch call.
+	maxBatchEntries = 10
 
-// New creates a new instance of the EventEmitter with SQS
-// as the messaging layer.
-func New() emitter.EventEmitter {
-	return responder{}
+	// maxBatchSize is the maximum size, in bytes, of a message and of all
+	// messages in a SendMessageBatch call together.
+	maxBatchSize = 256 * 1024
+
+	// maxAttempts is the number of times a message that SQS failed to accept
+	// is sent, when SQS and not the message caused the failure.
+	maxAttempts = 3
+
+	// baseDelay is the backoff before the second attempt, which doubles for
+	// every attempt after that.
+	baseDelay = 100 * time.Millisecond
+
+	// maxDelay is the maximum backoff between two attempts.
+	maxDelay = 2 * time.Second
+)
+
+func init() {
+	emitter.Register("sqs", func() (emitter.EventEmitter, error) {
+		return New()
+	})
 }
 
-// Send sends the event to an SQS queue. The SQS queue is determined
-// by the environment variable RESPONSEQUEUE. The AWS region this code
-// looks in to find the queue is determined by the environment
-// variable REGION. The method returns an error if anything goes wrong.
-func (r responder) Send(e acmeserverless.CreditCardValidatedEvent) error {
-	payload, err := e.Marshal()
+// responder contains the SQS client and the URL of the queue, and
+// implements the methods of the EventEmitter interface.
+type responder struct {
+	svc      *sqs.SQS
+	session  *session.Session
+	queue    string
+	attempts int
+}
+
+// New creates a new instance of the EventEmitter with SQS as the messaging
+// layer. The SQS queue is determined by the environment variable RESPONSEQUEUE,
+// which contains either the ARN or the URL of the queue. The AWS region this code
+// looks in to find the queue is determined by the environment variable REGION. To
+// use a local stand-in, like ElasticMQ, set SQS_ENDPOINT to its URL and RESPONSEQUEUE
+// to the URL of the queue. The configs are applied after that, so they can override
+// the endpoint, credentials, or retryer. The client is created once and shared by
+// every message. The method returns an error if the queue is not valid.
+func New(configs ...*aws.Config) (emitter.EventEmitter, error) {
+	return NewQueue(os.Getenv("RESPONSEQUEUE"), configs...)
+}
+
+// NewQueue creates a new instance of the EventEmitter with SQS as the messaging
+// layer, which sends to the queue with the ARN or URL instead of RESPONSEQUEUE. It
+// is configured like New otherwise.
+func NewQueue(queue string, configs ...*aws.Config) (emitter.EventEmitter, error) {
+	queue, err := QueueURL(queue)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	awsSession := session.Must(session.NewSession(&aws.Config{
+	cfg := &aws.Config{
 		Region: aws.String(os.Getenv("REGION")),
-	}))
+	}
+
+	if endpoint := os.Getenv("SQS_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession, err := session.NewSession(append([]*aws.Config{cfg}, configs...)...)
+	if err != nil {
+		return nil, err
+	}
 
-	svc := sqs.New(awsSession)
+	return &responder{
+		svc:      sqs.New(awsSession),
+		session:  awsSession,
+		queue:    queue,
+		attempts: maxAttempts,
+	}, nil
+}
 
-	urlParts := strings.Split(os.Getenv("RESPONSEQUEUE"), ":")
-	queue := fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", urlParts[3], urlParts[4], urlParts[5])
+// SingleAttempt returns an EventEmitter that sends to the same queue, but sends
+// every message just once: the client doesn't retry failed requests, and messages
+// that SQS failed to accept are not sent again.
+func (r *responder) SingleAttempt() emitter.EventEmitter {
+	return &responder{
+		svc:      sqs.New(r.session, aws.NewConfig().WithMaxRetries(0)),
+		session:  r.session,
+		queue:    r.queue,
+		attempts: 1,
+	}
+}
+
+// QueueURL returns the URL of the queue. The queue can be an ARN, like
+// arn:aws:sqs:us-west-2:123456789012:payment, or a URL, which is used as is.
+func QueueURL(queue string) (string, error) {
+	if strings.HasPrefix(queue, "https://") || strings.HasPrefix(queue, "http://") {
+		return queue, nil
+	}
+
+	urlParts := strings.Split(queue, ":")
+	if len(urlParts) != 6 || urlParts[0] != "arn" || urlParts[2] != "sqs" {
+		return "", fmt.Errorf("the queue must be the ARN or URL of an SQS queue, got %q", queue)
+	}
+
+	return fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", urlParts[3], urlParts[4], urlParts[5]), nil
+}
+
+// Send sends the event to the SQS queue. The method returns an error if
+// anything goes wrong, or the context is done before the message is sent.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
 
 	sendMessageInput := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(queue),
-		MessageBody: aws.String(string(payload)),
+		QueueUrl:          aws.String(r.queue),
+		MessageBody:       aws.String(string(payload)),
+		MessageAttributes: attributes(e),
 	}
 
-	_, err = svc.SendMessage(sendMessageInput)
+	_, err = r.svc.SendMessageWithContext(ctx, sendMessageInput)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// SendBatch sends the events to the SQS queue using SendMessageBatch, with up to
+// ten messages per call. Messages that SQS failed to accept, but not because of
+// the message itself, are sent again with backoff, up to maxAttempts times in total,
+// unless the emitter was created with SingleAttempt. When some messages could not be sent,
+// the method returns a BatchError with just those messages; the others were sent.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	var failed []*emitter.EntryError
+	var batch []*sqs.SendMessageBatchRequestEntry
+	size := 0
+
+	for i, e := range events {
+		payload, err := e.Marshal()
+		if err != nil {
+			failed = append(failed, &emitter.EntryError{Index: i, Message: err.Error(), Err: err})
+			continue
+		}
+
+		if len(payload) > maxBatchSize {
+			failed = append(failed, &emitter.EntryError{
+				Index:   i,
+				Code:    emitter.CodeTooLarge,
+				Message: fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", len(payload), maxBatchSize),
+			})
+			continue
+		}
+
+		// Start a new call when this message doesn't fit in the current one
+		if len(batch) == maxBatchEntries || size+len(payload) > maxBatchSize {
+			failed = append(failed, r.sendBatch(ctx, batch)...)
+			batch, size = nil, 0
+		}
+
+		batch = append(batch, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(string(payload)),
+			MessageAttributes: attributes(e),
+		})
+		size += len(payload)
+	}
+
+	if len(batch) > 0 {
+		failed = append(failed, r.sendBatch(ctx, batch)...)
+	}
+
+	return emitter.Failed(failed)
+}
+
+// sendBatch sends the messages in a SendMessageBatch call and returns the messages
+// that could not be sent. Messages that failed because of SQS itself are sent
+// again, with exponential backoff between attempts. The ID of each message is its
+// position in the batch that was passed to SendBatch.
+func (r *responder) sendBatch(ctx context.Context, entries []*sqs.SendMessageBatchRequestEntry) []*emitter.EntryError {
+	var failed []*emitter.EntryError
+
+	for attempt := 1; len(entries) > 0; attempt++ {
+		if attempt > 1 {
+			if err := wait(ctx, attempt); err != nil {
+				return append(failed, emitter.RequestFailed(indexes(entries), err)...)
+			}
+		}
+
+		output, err := r.svc.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(r.queue),
+			Entries:  entries,
+		})
+		if err != nil {
+			return append(failed, emitter.RequestFailed(indexes(entries), err)...)
+		}
+
+		byID := make(map[string]*sqs.SendMessageBatchRequestEntry, len(entries))
+		for _, entry := range entries {
+			byID[aws.StringValue(entry.Id)] = entry
+		}
+
+		var retry []*sqs.SendMessageBatchRequestEntry
+		for _, f := range output.Failed {
+			// Skip results for messages that weren't part of the call
+			entry, ok := byID[aws.StringValue(f.Id)]
+			if !ok {
+				continue
+			}
+
+			// Messages that failed because of SQS itself can be sent again
+			if !aws.BoolValue(f.SenderFault) && attempt < r.attempts {
+				retry = append(retry, entry)
+				continue
+			}
+
+			index, _ := strconv.Atoi(aws.StringValue(f.Id))
+			failed = append(failed, &emitter.EntryError{
+				Index:   index,
+				Code:    aws.StringValue(f.Code),
+				Message: aws.StringValue(f.Message),
+			})
+		}
+
+		entries = retry
+	}
+
+	return failed
+}
+
+// wait sleeps before the attempt, for a random duration up to the exponential
+// backoff of the attempt. It returns an error if the context is done first.
+func wait(ctx context.Context, attempt int) error {
+	backoff := baseDelay << uint(attempt-2)
+	if backoff > maxDelay || backoff <= 0 {
+		backoff = maxDelay
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))) + 1)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// attributes returns the message attributes for the event. Events that carry
+// an ID pass it on in the MessageID attribute, so consumers can drop duplicates.
+func attributes(e emitter.Event) map[string]*sqs.MessageAttributeValue {
+	id, ok := e.(emitter.Identified)
+	if !ok || len(id.MessageID()) == 0 {
+		return nil
+	}
+
+	return map[string]*sqs.MessageAttributeValue{
+		"MessageID": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(id.MessageID()),
+		},
+	}
+}
+
+// indexes returns the positions in the batch of the messages.
+func indexes(entries []*sqs.SendMessageBatchRequestEntry) []int {
+	idx := make([]int, len(entries))
+	for i, entry := range entries {
+		idx[i], _ = strconv.Atoi(aws.StringValue(entry.Id))
+	}
+
+	return idx
+}
@@ -0,0 +1,388 @@
+package sqs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+// event is an event with a fixed payload.
+type event string
+
+func (e event) Meta() acmeserverless.Metadata {
+	return acmeserverless.Metadata{Domain: "Payment", Source: "ValidateCreditCard", Type: "CreditCardValidated"}
+}
+
+func (e event) Marshal() ([]byte, error) {
+	return []byte(e), nil
+}
+
+// unencodable is an event that fails to encode.
+type unencodable struct {
+	event
+}
+
+// errUnencodable is the error of an unencodable event.
+var errUnencodable = errors.New("event can't be encoded")
+
+func (e unencodable) Marshal() ([]byte, error) {
+	return nil, errUnencodable
+}
+
+// payload is the body of the events, which is about the size of a CreditCardValidated event.
+var payload = event(`{"metadata":{"domain":"Payment","source":"ValidateCreditCard","type":"CreditCardValidated","status":"success"},"data":{"success":true,"status":200,"message":"transaction successful","amount":"85.23","transactionID":"3f846704-af12-4ea9-a98c-8d7b37e10b54","orderID":"12345","card":"411111******1111"}}`)
+
+// standIn is a stand-in for SQS that accepts every message, and counts the
+// requests and messages it received. When fail is set, it fails every request
+// to send a single message, and every message of a batch, with an error on
+// the side of SQS. When unknown is set, it also reports a failed message that
+// wasn't part of the batch. The MessageID attributes of the messages are kept
+// in ids.
+type standIn struct {
+	server   *httptest.Server
+	requests int64
+	messages int64
+	fail     bool
+	unknown  bool
+	mu       sync.Mutex
+	ids      []string
+}
+
+// newStandIn starts a stand-in for SQS. It is closed when the test ends.
+func newStandIn(tb testing.TB) *standIn {
+	s := &standIn{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	tb.Cleanup(s.server.Close)
+
+	return s
+}
+
+// handle answers SendMessage and SendMessageBatch requests.
+func (s *standIn) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	atomic.AddInt64(&s.requests, 1)
+
+	var res strings.Builder
+	switch r.Form.Get("Action") {
+	case "SendMessage":
+		if s.fail {
+			w.Header().Set("Content-Type", "text/xml")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<ErrorResponse><Error><Type>Receiver</Type><Code>InternalError</Code><Message>internal error</Message></Error><RequestId>1</RequestId></ErrorResponse>"))
+			return
+		}
+		s.keepID(r.Form, "")
+		fmt.Fprintf(&res, "<SendMessageResponse><SendMessageResult><MD5OfMessageBody>%s</MD5OfMessageBody><MessageId>%d</MessageId></SendMessageResult></SendMessageResponse>", digest(r.Form.Get("MessageBody")), atomic.AddInt64(&s.messages, 1))
+	case "SendMessageBatch":
+		res.WriteString("<SendMessageBatchResponse><SendMessageBatchResult>")
+		for i := 1; r.Form.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+			entry := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i)
+			if s.fail {
+				fmt.Fprintf(&res, "<BatchResultErrorEntry><Id>%s</Id><SenderFault>false</SenderFault><Code>InternalError</Code><Message>internal error</Message></BatchResultErrorEntry>", r.Form.Get(entry+"Id"))
+				continue
+			}
+			s.keepID(r.Form, entry)
+			fmt.Fprintf(&res, "<SendMessageBatchResultEntry><Id>%s</Id><MD5OfMessageBody>%s</MD5OfMessageBody><MessageId>%d</MessageId></SendMessageBatchResultEntry>", r.Form.Get(entry+"Id"), digest(r.Form.Get(entry+"MessageBody")), atomic.AddInt64(&s.messages, 1))
+		}
+		if s.unknown {
+			res.WriteString("<BatchResultErrorEntry><Id>unknown</Id><SenderFault>false</SenderFault><Code>InternalError</Code><Message>internal error</Message></BatchResultErrorEntry>")
+		}
+		res.WriteString("</SendMessageBatchResult></SendMessageBatchResponse>")
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(res.String()))
+}
+
+// keepID keeps the MessageID attribute of the message whose parameters start
+// with the prefix, if it has one.
+func (s *standIn) keepID(form url.Values, prefix string) {
+	for i := 1; form.Get(fmt.Sprintf("%sMessageAttribute.%d.Name", prefix, i)) != ""; i++ {
+		if form.Get(fmt.Sprintf("%sMessageAttribute.%d.Name", prefix, i)) == "MessageID" {
+			s.mu.Lock()
+			s.ids = append(s.ids, form.Get(fmt.Sprintf("%sMessageAttribute.%d.Value.StringValue", prefix, i)))
+			s.mu.Unlock()
+		}
+	}
+}
+
+// emitter returns an EventEmitter that sends to a queue of the stand-in.
+func (s *standIn) emitter(tb testing.TB) emitter.EventEmitter {
+	tb.Helper()
+
+	os.Setenv("RESPONSEQUEUE", s.server.URL+"/123456789012/payment")
+	tb.Cleanup(func() { os.Unsetenv("RESPONSEQUEUE") })
+
+	em, err := New(&aws.Config{
+		Endpoint:    aws.String(s.server.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return em
+}
+
+// digest returns the MD5 digest of the message body, which SQS returns so the
+// client can verify the message wasn't changed.
+func digest(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// batch returns a batch of n events.
+func batch(n int) []emitter.Event {
+	events := make([]emitter.Event, n)
+	for i := range events {
+		events[i] = payload
+	}
+
+	return events
+}
+
+func TestSend(t *testing.T) {
+	s := newStandIn(t)
+
+	if err := s.emitter(t).Send(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.messages != 1 {
+		t.Errorf("Send() sent %d messages, want 1", s.messages)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	s := newStandIn(t)
+
+	if err := s.emitter(t).SendBatch(context.Background(), batch(25)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.requests != 3 || s.messages != 25 {
+		t.Errorf("SendBatch() made %d requests with %d messages, want 3 with 25", s.requests, s.messages)
+	}
+}
+
+// identified is an event with an ID.
+type identified struct {
+	event
+	id string
+}
+
+func (e identified) MessageID() string {
+	return e.id
+}
+
+func TestSendPassesMessageID(t *testing.T) {
+	s := newStandIn(t)
+	em := s.emitter(t)
+
+	if err := em.Send(context.Background(), identified{payload, "msg-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := em.SendBatch(context.Background(), []emitter.Event{identified{payload, "msg-2"}, payload, identified{payload, "msg-3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"msg-1", "msg-2", "msg-3"}
+	if !reflect.DeepEqual(s.ids, want) {
+		t.Errorf("MessageID attributes = %v, want %v", s.ids, want)
+	}
+}
+
+func TestSendBatchRetriesFailedMessages(t *testing.T) {
+	s := newStandIn(t)
+	s.fail = true
+
+	err := s.emitter(t).SendBatch(context.Background(), batch(3))
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 3 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 3 messages", err)
+	}
+
+	if s.requests != maxAttempts {
+		t.Errorf("SendBatch() made %d requests, want %d", s.requests, maxAttempts)
+	}
+}
+
+func TestSendBatchSkipsLargeMessages(t *testing.T) {
+	s := newStandIn(t)
+
+	events := batch(3)
+	events[1] = event(strings.Repeat("x", maxBatchSize+1))
+
+	err := s.emitter(t).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 || berr.Failed[0].Index != 1 || berr.Failed[0].Code != emitter.CodeTooLarge {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with message 1", err)
+	}
+
+	if s.messages != 2 {
+		t.Errorf("SendBatch() sent %d messages, want 2", s.messages)
+	}
+}
+
+func TestSendBatchStopsWhenContextIsDone(t *testing.T) {
+	s := newStandIn(t)
+	s.fail = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	em := s.emitter(t)
+
+	// Cancel the context while the emitter waits before the second attempt
+	go func() {
+		for atomic.LoadInt64(&s.requests) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	err := em.SendBatch(ctx, batch(3))
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 3 || berr.Failed[0].Err == nil {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with the error of the context", err)
+	}
+
+	if s.requests != 1 {
+		t.Errorf("SendBatch() made %d requests, want 1", s.requests)
+	}
+}
+
+func TestSendBatchSkipsUnknownMessages(t *testing.T) {
+	s := newStandIn(t)
+	s.unknown = true
+
+	if err := s.emitter(t).SendBatch(context.Background(), batch(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.requests != 1 || s.messages != 3 {
+		t.Errorf("SendBatch() made %d requests with %d messages, want 1 with 3", s.requests, s.messages)
+	}
+}
+
+func TestSendBatchReportsUnencodableEvents(t *testing.T) {
+	s := newStandIn(t)
+
+	// The messages before and after the one that fails to encode are still sent
+	events := batch(25)
+	events[15] = unencodable{payload}
+
+	err := s.emitter(t).SendBatch(context.Background(), events)
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 1 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 1 message", err)
+	}
+
+	if berr.Failed[0].Index != 15 || !errors.Is(berr.Failed[0], errUnencodable) {
+		t.Errorf("SendBatch() failed message %d with %v, want message 15 with %v", berr.Failed[0].Index, berr.Failed[0].Err, errUnencodable)
+	}
+
+	if s.messages != 24 {
+		t.Errorf("SendBatch() sent %d messages, want 24", s.messages)
+	}
+}
+
+func TestSingleAttempt(t *testing.T) {
+	s := newStandIn(t)
+	s.fail = true
+
+	em := s.emitter(t).(emitter.Retrying).SingleAttempt()
+
+	if err := em.Send(context.Background(), payload); err == nil {
+		t.Fatal("Send() returned no error")
+	}
+
+	if s.requests != 1 {
+		t.Errorf("Send() made %d requests, want 1", s.requests)
+	}
+
+	err := em.SendBatch(context.Background(), batch(3))
+
+	var berr *emitter.BatchError
+	if !errors.As(err, &berr) || len(berr.Failed) != 3 {
+		t.Fatalf("SendBatch() error = %v, want a BatchError with 3 messages", err)
+	}
+
+	if s.requests != 2 {
+		t.Errorf("SendBatch() made %d requests, want 1", s.requests-1)
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := em.Send(ctx, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendParallel(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := em.Send(ctx, payload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	em := newStandIn(b).emitter(b)
+	ctx := context.Background()
+	events := batch(10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := em.SendBatch(ctx, events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
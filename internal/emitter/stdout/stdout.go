@@ -0,0 +1,56 @@
+// Package stdout writes all events to the standard output of the service,
+// one JSON document per line. This is useful for running the service locally
+// and piping the events into other tools, but doesn't send any events to
+// other services.
+package stdout
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+)
+
+func init() {
+	emitter.Register("stdout", func() (emitter.EventEmitter, error) {
+		return New(), nil
+	})
+}
+
+// responder makes sure events are written one at a time and implements the
+// methods of the EventEmitter interface.
+type responder struct {
+	mu sync.Mutex
+}
+
+// New creates a new instance of the EventEmitter with the standard
+// output as the messaging layer.
+func New() emitter.EventEmitter {
+	return &responder{}
+}
+
+// Send writes the event to the standard output of the service and returns an
+// error if anything goes wrong, or the context is done.
+func (r *responder) Send(ctx context.Context, e emitter.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", payload)
+	return err
+}
+
+// SendBatch writes the events, one at a time.
+func (r *responder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
@@ -0,0 +1,162 @@
+// Package events contains the events of the Payment service that extend, or are
+// not part of, the events shared by the services of the ACME Serverless Fitness
+// Shop in github.com/retgits/acme-serverless. All events implement the Event
+// interface of the emitter package, so they can be sent by any EventEmitter.
+package events
+
+import (
+	"encoding/json"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// UnmarshalMetadata parses the JSON-encoded event and returns its Metadata, so the
+// type of event can be determined before parsing the entire event.
+func UnmarshalMetadata(data []byte) (acmeserverless.Metadata, error) {
+	var r struct {
+		Metadata acmeserverless.Metadata `json:"metadata"`
+	}
+	err := json.Unmarshal(data, &r)
+	return r.Metadata, err
+}
+
+// Decline is a single reason why a payment was declined.
+type Decline struct {
+	// Code is a stable, machine-readable reason, like card_expired.
+	Code string `json:"code"`
+
+	// Field is the field of the payment that caused the decline, like cvv.
+	Field string `json:"field,omitempty"`
+
+	// Message is a human-readable reason.
+	Message string `json:"message,omitempty"`
+}
+
+// CreditCardValidatedEvent is sent by the payment service when the creditcard has been validated.
+type CreditCardValidatedEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data CreditCardValidationDetails `json:"data"`
+}
+
+// UnmarshalCreditCardValidatedEvent parses the JSON-encoded data and stores the result in a
+// CreditCardValidatedEvent.
+func UnmarshalCreditCardValidatedEvent(data []byte) (CreditCardValidatedEvent, error) {
+	var r CreditCardValidatedEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of CreditCardValidatedEvent.
+func (e *CreditCardValidatedEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of CreditCardValidatedEvent.
+func (e *CreditCardValidatedEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// CreditCardValidationDetails contain the details of the validation by the payment service. It
+// extends the details shared by the services of the ACME Serverless Fitness Shop with the currency,
+// the masked creditcard and its token, the card network, the reasons why a payment was declined,
+// and the risk assessment. The JSON encoding is compatible with the shared details.
+type CreditCardValidationDetails struct {
+	acmeserverless.CreditCardValidationDetails
+
+	// Currency is the ISO 4217 code of the currency of the amount.
+	Currency string `json:"currency,omitempty"`
+
+	// Card is the masked creditcard number.
+	Card string `json:"card,omitempty"`
+
+	// CardToken is the token of the creditcard, which can be used for later payments.
+	CardToken string `json:"cardToken,omitempty"`
+
+	// Brand is the card network the creditcard belongs to, like Visa.
+	Brand string `json:"brand,omitempty"`
+
+	// Declines contains every reason why the payment was declined.
+	Declines []Decline `json:"declines,omitempty"`
+
+	// Risk contains the risk assessment of the payment, if it was assessed.
+	Risk *Risk `json:"risk,omitempty"`
+}
+
+// Marshal returns the JSON encoding of CreditCardValidationDetails.
+func (e *CreditCardValidationDetails) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// PaymentRequestedEvent is sent by the Order service when the creditcard for the order should be
+// validated and charged. It extends the PaymentRequested event shared by the services of the
+// ACME Serverless Fitness Shop with details about the customer, so the risk of the payment can
+// be assessed. The JSON encoding is compatible with the shared event.
+type PaymentRequestedEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data PaymentRequestDetails `json:"data"`
+}
+
+// UnmarshalPaymentRequestedEvent parses the JSON-encoded data and stores the result in a
+// PaymentRequestedEvent.
+func UnmarshalPaymentRequestedEvent(data []byte) (PaymentRequestedEvent, error) {
+	var r PaymentRequestedEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of PaymentRequestedEvent.
+func (e *PaymentRequestedEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of PaymentRequestedEvent.
+func (e *PaymentRequestedEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// PaymentRequestDetails contain the details of the payment that should be validated. It extends
+// the details shared by the services of the ACME Serverless Fitness Shop with optional details
+// about the customer. The JSON encoding is compatible with the shared details.
+type PaymentRequestDetails struct {
+	acmeserverless.PaymentRequestDetails
+
+	// CustomerID is the unique identifier of the customer that placed the order.
+	CustomerID string `json:"customerID,omitempty"`
+
+	// Cardholder is the name on the creditcard.
+	Cardholder string `json:"cardholder,omitempty"`
+
+	// BillingName is the name in the billing address of the order.
+	BillingName string `json:"billingName,omitempty"`
+
+	// ClientIP is the IP address of the client that placed the order.
+	ClientIP string `json:"clientIP,omitempty"`
+
+	// CardToken is the token of a creditcard that the customer used before. When it
+	// is set, the creditcard is taken from the vault and only the cvv code of Card is
+	// used. Tokens can only be used together with the CustomerID they belong to.
+	CardToken string `json:"cardToken,omitempty"`
+}
+
+// Marshal returns the JSON encoding of PaymentRequestDetails.
+func (e *PaymentRequestDetails) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Risk is the assessment of the risk that a payment is fraudulent.
+type Risk struct {
+	// Score is the risk score of the payment, from 0 to 100.
+	Score int `json:"score"`
+
+	// Decision is the outcome of the assessment, like approved or review.
+	Decision string `json:"decision"`
+
+	// Signals contains the names of the signals that added to the score.
+	Signals []string `json:"signals,omitempty"`
+}
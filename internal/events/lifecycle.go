@@ -0,0 +1,168 @@
+package events
+
+import (
+	"encoding/json"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+const (
+	// PaymentAuthorizationRequestedEventName is the name used for the PaymentAuthorizationRequested event
+	PaymentAuthorizationRequestedEventName = "PaymentAuthorizationRequestedEvent"
+
+	// PaymentCaptureRequestedEventName is the name used for the PaymentCaptureRequested event
+	PaymentCaptureRequestedEventName = "PaymentCaptureRequestedEvent"
+
+	// PaymentVoidRequestedEventName is the name used for the PaymentVoidRequested event
+	PaymentVoidRequestedEventName = "PaymentVoidRequestedEvent"
+
+	// PaymentRefundRequestedEventName is the name used for the PaymentRefundRequested event
+	PaymentRefundRequestedEventName = "PaymentRefundRequestedEvent"
+
+	// PaymentApproveRequestedEventName is the name used for the PaymentApproveRequested event
+	PaymentApproveRequestedEventName = "PaymentApproveRequestedEvent"
+
+	// PaymentRejectRequestedEventName is the name used for the PaymentRejectRequested event
+	PaymentRejectRequestedEventName = "PaymentRejectRequestedEvent"
+
+	// PaymentAuthorizedEventName is the name used for the PaymentAuthorized event
+	PaymentAuthorizedEventName = "PaymentAuthorizedEvent"
+
+	// PaymentCapturedEventName is the name used for the PaymentCaptured event
+	PaymentCapturedEventName = "PaymentCapturedEvent"
+
+	// PaymentVoidedEventName is the name used for the PaymentVoided event
+	PaymentVoidedEventName = "PaymentVoidedEvent"
+
+	// PaymentRefundedEventName is the name used for the PaymentRefunded event
+	PaymentRefundedEventName = "PaymentRefundedEvent"
+
+	// PaymentApprovedEventName is the name used for the PaymentApproved event
+	PaymentApprovedEventName = "PaymentApprovedEvent"
+
+	// PaymentRejectedEventName is the name used for the PaymentRejected event
+	PaymentRejectedEventName = "PaymentRejectedEvent"
+)
+
+// PaymentActionRequestedEvent is sent by the Order service to capture, void, or refund
+// a payment that was authorized before, or by the operations team to approve or reject a
+// payment that was held for review. The Type in the Metadata determines the action.
+type PaymentActionRequestedEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data PaymentActionDetails `json:"data"`
+}
+
+// UnmarshalPaymentActionRequestedEvent parses the JSON-encoded data and stores the result in a
+// PaymentActionRequestedEvent.
+func UnmarshalPaymentActionRequestedEvent(data []byte) (PaymentActionRequestedEvent, error) {
+	var r PaymentActionRequestedEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of PaymentActionRequestedEvent.
+func (e *PaymentActionRequestedEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of PaymentActionRequestedEvent.
+func (e *PaymentActionRequestedEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// PaymentActionDetails contains the data that is needed to perform an action on a payment.
+type PaymentActionDetails struct {
+	// The unique identifier of the transaction.
+	TransactionID string `json:"transactionID"`
+
+	// The unique identifier of the order.
+	OrderID string `json:"orderID,omitempty"`
+
+	// The monetary amount to capture or refund. When empty, the
+	// entire remaining amount is captured or refunded.
+	Amount string `json:"amount,omitempty"`
+
+	// The unique identifier of the request, which stays the same when
+	// the request is sent again, so the action is performed only once.
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// PaymentEvent is sent by the payment service when a payment has been authorized,
+// captured, voided, refunded, approved, or rejected. The Type in the Metadata determines which of those
+// happened.
+type PaymentEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data PaymentDetails `json:"data"`
+}
+
+// UnmarshalPaymentEvent parses the JSON-encoded data and stores the result in a
+// PaymentEvent.
+func UnmarshalPaymentEvent(data []byte) (PaymentEvent, error) {
+	var r PaymentEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of PaymentEvent.
+func (e *PaymentEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of PaymentEvent.
+func (e *PaymentEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// PaymentDetails contain the details of a payment after an action by the payment service.
+type PaymentDetails struct {
+	// Indicates whether the action was a success or not.
+	Success bool `json:"success"`
+
+	// The HTTP statuscode of the event.
+	Status int `json:"status"`
+
+	// A string containing the result of the service.
+	Message string `json:"message"`
+
+	// The unique identifier of the transaction.
+	TransactionID string `json:"transactionID"`
+
+	// The unique identifier of the order.
+	OrderID string `json:"orderID"`
+
+	// The monetary amount of the action.
+	Amount string `json:"amount,omitempty"`
+
+	// The ISO 4217 code of the currency of the amounts.
+	Currency string `json:"currency,omitempty"`
+
+	// The masked creditcard number.
+	Card string `json:"card,omitempty"`
+
+	// The token of the creditcard.
+	CardToken string `json:"cardToken,omitempty"`
+
+	// The state of the payment after the action.
+	State string `json:"state,omitempty"`
+
+	// The monetary amount that has been authorized.
+	AuthorizedAmount string `json:"authorizedAmount,omitempty"`
+
+	// The monetary amount that has been captured.
+	CapturedAmount string `json:"capturedAmount,omitempty"`
+
+	// The monetary amount that has been refunded.
+	RefundedAmount string `json:"refundedAmount,omitempty"`
+
+	// Declines contains every reason why the payment was declined.
+	Declines []Decline `json:"declines,omitempty"`
+
+	// Risk contains the risk assessment of the payment, if it was assessed.
+	Risk *Risk `json:"risk,omitempty"`
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"encoding/json"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// PaymentRequestRejectedEventName is the name used for the PaymentRequestRejected event
+const PaymentRequestRejectedEventName = "PaymentRequestRejectedEvent"
+
+// PaymentRequestRejectedEvent is sent by the payment service when a payment request
+// could not be processed at all, for example because it is malformed, and has been
+// moved to the dead-letter queue. No CreditCardValidated event follows, so the order
+// service can fail the order instead of waiting for one.
+type PaymentRequestRejectedEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data RejectionDetails `json:"data"`
+}
+
+// UnmarshalPaymentRequestRejectedEvent parses the JSON-encoded data and stores the result in a
+// PaymentRequestRejectedEvent.
+func UnmarshalPaymentRequestRejectedEvent(data []byte) (PaymentRequestRejectedEvent, error) {
+	var r PaymentRequestRejectedEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of PaymentRequestRejectedEvent.
+func (e *PaymentRequestRejectedEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of PaymentRequestRejectedEvent.
+func (e *PaymentRequestRejectedEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// RejectionDetails contains the details of a payment request that was rejected.
+type RejectionDetails struct {
+	// The unique identifier of the order, if it could be read from the request.
+	OrderID string `json:"orderID,omitempty"`
+
+	// The class of the failure, like malformed or exhausted.
+	Reason string `json:"reason"`
+
+	// The error that caused the rejection, without creditcard data.
+	Message string `json:"message"`
+}
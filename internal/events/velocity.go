@@ -0,0 +1,70 @@
+package events
+
+import (
+	"encoding/json"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// PaymentVelocityExceededEventName is the name used for the PaymentVelocityExceeded event
+const PaymentVelocityExceededEventName = "PaymentVelocityExceededEvent"
+
+// PaymentVelocityExceededEvent is sent by the payment service when a payment attempt
+// exceeds the limit of attempts with the same creditcard, for the same order, or from
+// the same client. It is sent next to the CreditCardValidated event, so suspected
+// card-testing attacks can be monitored.
+type PaymentVelocityExceededEvent struct {
+	// Metadata for the event.
+	Metadata acmeserverless.Metadata `json:"metadata"`
+
+	// Data contains the payload data for the event.
+	Data VelocityDetails `json:"data"`
+}
+
+// UnmarshalPaymentVelocityExceededEvent parses the JSON-encoded data and stores the result in a
+// PaymentVelocityExceededEvent.
+func UnmarshalPaymentVelocityExceededEvent(data []byte) (PaymentVelocityExceededEvent, error) {
+	var r PaymentVelocityExceededEvent
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Meta returns the Metadata of PaymentVelocityExceededEvent.
+func (e *PaymentVelocityExceededEvent) Meta() acmeserverless.Metadata {
+	return e.Metadata
+}
+
+// Marshal returns the JSON encoding of PaymentVelocityExceededEvent.
+func (e *PaymentVelocityExceededEvent) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// VelocityDetails contains the details of a payment attempt that exceeded a velocity limit.
+type VelocityDetails struct {
+	// The unique identifier of the order.
+	OrderID string `json:"orderID"`
+
+	// The masked number of the creditcard.
+	Card string `json:"card"`
+
+	// The IP address of the client that sent the request, if known.
+	ClientIP string `json:"clientIP,omitempty"`
+
+	// The limits that were exceeded.
+	Limits []VelocityLimit `json:"limits"`
+}
+
+// VelocityLimit is a single velocity limit that was exceeded.
+type VelocityLimit struct {
+	// Dimension is what the attempts were counted by: card, order, or client.
+	Dimension string `json:"dimension"`
+
+	// Count is the number of attempts in the window.
+	Count int64 `json:"count"`
+
+	// Max is the maximum number of attempts in the window.
+	Max int64 `json:"max"`
+
+	// Window is the duration of the sliding window, like 10m0s.
+	Window string `json:"window"`
+}
@@ -0,0 +1,148 @@
+// Package idempotency contains the interfaces that the Payment service
+// in the ACME Serverless Fitness Shop needs to remember which payment
+// requests have already been processed. Redelivered requests get the
+// original result, rather than a new transaction. In order to add a new
+// storage service, the Store interface needs to be implemented.
+package idempotency
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/events"
+)
+
+// DefaultTTL is the time a record is kept before the request is
+// considered to be a new request again.
+const DefaultTTL = 24 * time.Hour
+
+// DefaultLease is the time the delivery that saved a record has to send its
+// event, before another delivery of the same request may send it. It is longer
+// than sending an event takes, including the retries of the emitter.
+const DefaultLease = time.Minute
+
+// ErrRecordExists is returned by Save when a record for the key
+// has already been stored.
+var ErrRecordExists = errors.New("idempotency record already exists")
+
+// Record is the result of a processed payment request.
+type Record struct {
+	// Key uniquely identifies the payment request.
+	Key string
+
+	// Event is the JSON encoded event that was generated
+	// for the payment request.
+	Event []byte
+
+	// Entry is the JSON encoded ledger entry of the payment request, if
+	// any, so it can still be recorded when recording it failed before.
+	Entry []byte
+
+	// Sent indicates whether the event has been sent.
+	Sent bool
+
+	// LeasedUntil is the time until which a delivery of the request is
+	// sending the event. Other deliveries don't send it before then.
+	LeasedUntil time.Time
+
+	// CreatedAt is the time the record was stored.
+	CreatedAt time.Time
+
+	// ExpiresAt is the time after which the record is no longer used.
+	ExpiresAt time.Time
+}
+
+// Store is the interface that describes the methods the storage
+// service needs to implement to keep track of processed payment
+// requests.
+type Store interface {
+	// Lookup returns the record for the key. The boolean is false
+	// when no record exists, or the record has expired.
+	Lookup(key string) (Record, bool, error)
+
+	// Save stores the record if no record exists for the key yet.
+	// It returns ErrRecordExists otherwise.
+	Save(r Record) error
+
+	// MarkSent updates the record for the key to indicate the event
+	// has been sent.
+	MarkSent(key string) error
+
+	// Lease sets LeasedUntil of the record for the key to until, when the
+	// event has not been sent and no lease is held. The boolean is false
+	// when the lease was not taken.
+	Lease(key string, until time.Time) (bool, error)
+
+	// Release clears LeasedUntil of the record for the key, after sending
+	// the event failed, so another delivery can send it right away.
+	Release(key string) error
+}
+
+// Key returns the idempotency key for the payment request. The key starts with
+// the order ID and ends with a digest of the payment details, so a redelivered
+// request maps to the same key while a new attempt with different payment
+// details for the same order does not. The digest is keyed with the secret, so
+// the creditcard details can't be recovered from the key by trying every
+// possible card number and cvv code. The client IP address is not part of the
+// key, as a retry can come from a different address.
+func Key(secret []byte, req events.PaymentRequestedEvent) (string, error) {
+	req.Data.ClientIP = ""
+	payload, err := req.Data.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return fmt.Sprintf("%s:%s", req.Data.OrderID, hex.EncodeToString(mac.Sum(nil)[:16])), nil
+}
+
+// KeyFromEnv returns the secret in IDEMPOTENCY_KEY, which the idempotency keys
+// are derived with, or nil when it isn't set. It returns an error if the secret
+// is not a base64 encoded 32 byte key.
+func KeyFromEnv() ([]byte, error) {
+	v := os.Getenv("IDEMPOTENCY_KEY")
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("IDEMPOTENCY_KEY must contain a base64 encoded 32 byte key")
+	}
+
+	return key, nil
+}
+
+// NewKey returns a random 32 byte secret to derive idempotency keys with. Keys
+// derived with it only match within the same process, so it can only be used
+// with a store that doesn't outlive the process.
+func NewKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ActionKey returns the idempotency key for the action, like capture or refund, on the
+// payment in the request. The key consists of the action, the order ID, and the request
+// ID, so a request that is sent again maps to the same key, while another request for
+// the same action, like a second partial refund, does not. Requests without a request
+// ID can't be matched, so it returns an empty string for those.
+func ActionKey(action string, req events.PaymentActionRequestedEvent) string {
+	if len(req.Data.RequestID) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%s:%s", action, req.Data.OrderID, req.Data.RequestID)
+}
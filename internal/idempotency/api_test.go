@@ -0,0 +1,104 @@
+package idempotency
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/creditcard"
+)
+
+// request returns a payment request for the order with the creditcard.
+func request(orderID string, number string, cvv string) events.PaymentRequestedEvent {
+	return events.PaymentRequestedEvent{
+		Data: events.PaymentRequestDetails{
+			PaymentRequestDetails: acmeserverless.PaymentRequestDetails{
+				OrderID: orderID,
+				Total:   "10.00",
+				Card: creditcard.Card{
+					Type:        "Visa",
+					Number:      number,
+					ExpiryYear:  2030,
+					ExpiryMonth: 1,
+					CVV:         cvv,
+				},
+			},
+		},
+	}
+}
+
+func TestKey(t *testing.T) {
+	secret := make([]byte, 32)
+
+	key := func(secret []byte, req events.PaymentRequestedEvent) string {
+		t.Helper()
+		k, err := Key(secret, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	req := request("order-1", "4111111111111111", "123")
+	k := key(secret, req)
+
+	if !strings.HasPrefix(k, "order-1:") {
+		t.Errorf("Key() = %q, want the order ID as prefix", k)
+	}
+
+	// A redelivered request, even from another address, maps to the same key
+	retry := request("order-1", "4111111111111111", "123")
+	retry.Data.ClientIP = "203.0.113.7"
+	if got := key(secret, retry); got != k {
+		t.Errorf("Key() of a redelivered request = %q, want %q", got, k)
+	}
+
+	// Another attempt or order doesn't
+	for _, other := range []events.PaymentRequestedEvent{
+		request("order-1", "4111111111111111", "456"),
+		request("order-1", "5555555555554444", "123"),
+		request("order-2", "4111111111111111", "123"),
+	} {
+		if got := key(secret, other); got == k {
+			t.Errorf("Key() of %s = %q, want another key", other.Data.OrderID, got)
+		}
+	}
+
+	// The digest depends on the secret, so it can't be computed without it
+	other := make([]byte, 32)
+	other[0] = 1
+	if got := key(other, req); got == k {
+		t.Errorf("Key() with another secret = %q, want another key", got)
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"not set", "", 0, false},
+		{"valid", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", 32, false},
+		{"too short", "AAAAAAAAAAAAAAAAAAAAAA==", 0, true},
+		{"not base64", "not a key", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("IDEMPOTENCY_KEY", tt.value)
+			defer os.Unsetenv("IDEMPOTENCY_KEY")
+
+			key, err := KeyFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("KeyFromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(key) != tt.want {
+				t.Errorf("KeyFromEnv() returned a key of %d bytes, want %d", len(key), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Package dynamodb uses Amazon DynamoDB, a fully managed NoSQL database service, to keep
+// track of the payment requests the Payment service has processed. The table needs a
+// string partition key called "ID" and should have Time To Live enabled on the attribute
+// "ExpiresAt" so expired records are removed.
+package dynamodb
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+)
+
+// item is the representation of an idempotency record in DynamoDB.
+type item struct {
+	ID        string `dynamodbav:"ID"`
+	Event     []byte `dynamodbav:"Event"`
+	Entry     []byte `dynamodbav:"Entry,omitempty"`
+	Sent      bool   `dynamodbav:"Sent"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+	ExpiresAt int64  `dynamodbav:"ExpiresAt"`
+
+	// LeasedUntil is in nanoseconds since the epoch, so it can be compared
+	// in a condition expression.
+	LeasedUntil int64 `dynamodbav:"LeasedUntil,omitempty"`
+}
+
+// store contains the DynamoDB client and implements the methods
+// of the Store interface.
+type store struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// New creates a new instance of the Store with DynamoDB as the storage
+// layer. The table is determined by the environment variable IDEMPOTENCY_TABLE.
+// The AWS region is determined by the environment variable REGION. To use a
+// local stand-in, like DynamoDB Local, set DYNAMODB_ENDPOINT to its URL.
+func New() idempotency.Store {
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession := session.Must(session.NewSession(cfg))
+
+	return &store{
+		svc:   dynamodb.New(awsSession),
+		table: os.Getenv("IDEMPOTENCY_TABLE"),
+	}
+}
+
+// Lookup returns the record for the key. The boolean is false
+// when no record exists, or the record has expired.
+func (s *store) Lookup(key string) (idempotency.Record, bool, error) {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return idempotency.Record{}, false, err
+	}
+
+	if out.Item == nil {
+		return idempotency.Record{}, false, nil
+	}
+
+	var i item
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &i); err != nil {
+		return idempotency.Record{}, false, err
+	}
+
+	// Records that have expired might not have been removed by
+	// DynamoDB yet, so they are ignored here
+	if i.ExpiresAt > 0 && time.Now().Unix() > i.ExpiresAt {
+		return idempotency.Record{}, false, nil
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339Nano, i.CreatedAt)
+
+	r := idempotency.Record{
+		Key:       i.ID,
+		Event:     i.Event,
+		Entry:     i.Entry,
+		Sent:      i.Sent,
+		CreatedAt: createdAt,
+		ExpiresAt: time.Unix(i.ExpiresAt, 0),
+	}
+
+	if i.LeasedUntil > 0 {
+		r.LeasedUntil = time.Unix(0, i.LeasedUntil)
+	}
+
+	return r, true, nil
+}
+
+// Save stores the record if no record exists for the key yet.
+// It returns ErrRecordExists otherwise.
+func (s *store) Save(r idempotency.Record) error {
+	i := item{
+		ID:        r.Key,
+		Event:     r.Event,
+		Entry:     r.Entry,
+		Sent:      r.Sent,
+		CreatedAt: r.CreatedAt.Format(time.RFC3339Nano),
+	}
+
+	if !r.ExpiresAt.IsZero() {
+		i.ExpiresAt = r.ExpiresAt.Unix()
+	}
+
+	if !r.LeasedUntil.IsZero() {
+		i.LeasedUntil = r.LeasedUntil.UnixNano()
+	}
+
+	av, err := dynamodbattribute.MarshalMap(i)
+	if err != nil {
+		return err
+	}
+
+	// Only write the record if there is no record for the key, or
+	// when the existing record has expired
+	_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(ID) OR (ExpiresAt > :zero AND ExpiresAt < :now)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero": {N: aws.String("0")},
+			":now":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return idempotency.ErrRecordExists
+	}
+
+	return err
+}
+
+// MarkSent updates the record for the key to indicate the event
+// has been sent.
+func (s *store) MarkSent(key string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(key)},
+		},
+		UpdateExpression:    aws.String("SET Sent = :sent"),
+		ConditionExpression: aws.String("attribute_exists(ID)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sent": {BOOL: aws.Bool(true)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+
+	return err
+}
+
+// Lease sets LeasedUntil of the record for the key to until, when the
+// event has not been sent and no lease is held. The boolean is false
+// when the lease was not taken.
+func (s *store) Lease(key string, until time.Time) (bool, error) {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(key)},
+		},
+		UpdateExpression:    aws.String("SET LeasedUntil = :until"),
+		ConditionExpression: aws.String("attribute_exists(ID) AND Sent = :unsent AND (attribute_not_exists(LeasedUntil) OR LeasedUntil < :now)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":until":  {N: aws.String(strconv.FormatInt(until.UnixNano(), 10))},
+			":unsent": {BOOL: aws.Bool(false)},
+			":now":    {N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Release clears LeasedUntil of the record for the key, so another
+// delivery can send the event right away.
+func (s *store) Release(key string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(key)},
+		},
+		UpdateExpression:    aws.String("REMOVE LeasedUntil"),
+		ConditionExpression: aws.String("attribute_exists(ID)"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,182 @@
+package dynamodb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+)
+
+// newStore creates a table in the DynamoDB stand-in at DYNAMODB_ENDPOINT, like
+// DynamoDB Local or LocalStack, which is deleted when the test ends, and returns
+// a store that keeps its records in it. The test is skipped when DYNAMODB_ENDPOINT
+// isn't set.
+func newStore(t *testing.T) *store {
+	t.Helper()
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+
+	region := os.Getenv("REGION")
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(1),
+	}))
+	svc := dynamodb.New(awsSession)
+
+	table := fmt.Sprintf("idempotency-%d", time.Now().UnixNano())
+	_, err := svc.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		svc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	})
+
+	if err := svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &store{svc: svc, table: table}
+}
+
+func TestSave(t *testing.T) {
+	s := newStore(t)
+	now := time.Now()
+
+	r := idempotency.Record{
+		Key:         "order-1",
+		Event:       []byte(`{"data":{}}`),
+		Entry:       []byte(`{"orderID":"order-1"}`),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+		LeasedUntil: now.Add(time.Minute),
+	}
+
+	if err := s.Save(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record is only saved once
+	if err := s.Save(idempotency.Record{Key: "order-1", ExpiresAt: now.Add(time.Hour)}); err != idempotency.ErrRecordExists {
+		t.Errorf("Save() of an existing record error = %v, want %v", err, idempotency.ErrRecordExists)
+	}
+
+	got, found, err := s.Lookup("order-1")
+	if err != nil || !found {
+		t.Fatalf("Lookup() = %v, %v, want the record", found, err)
+	}
+
+	if string(got.Event) != string(r.Event) || string(got.Entry) != string(r.Entry) || got.Sent {
+		t.Errorf("Lookup() = %+v, want %+v", got, r)
+	}
+
+	if !got.CreatedAt.Equal(r.CreatedAt) || got.ExpiresAt.Unix() != r.ExpiresAt.Unix() || !got.LeasedUntil.Equal(r.LeasedUntil) {
+		t.Errorf("Lookup() returned the times %s, %s, and %s, want %s, %s, and %s", got.CreatedAt, got.ExpiresAt, got.LeasedUntil, r.CreatedAt, r.ExpiresAt, r.LeasedUntil)
+	}
+}
+
+func TestSaveReplacesExpiredRecord(t *testing.T) {
+	s := newStore(t)
+	now := time.Now()
+
+	if err := s.Save(idempotency.Record{Key: "order-1", Event: []byte("expired"), ExpiresAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// DynamoDB may not have removed the record yet, but it isn't used anymore
+	if _, found, err := s.Lookup("order-1"); err != nil || found {
+		t.Errorf("Lookup() of an expired record = %v, %v, want no record", found, err)
+	}
+
+	if err := s.Save(idempotency.Record{Key: "order-1", Event: []byte("new"), ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Save() of an expired record error = %v, want nil", err)
+	}
+
+	if got, _, _ := s.Lookup("order-1"); string(got.Event) != "new" {
+		t.Errorf("Lookup() returned event %q, want the event of the new record", got.Event)
+	}
+}
+
+func TestMarkSent(t *testing.T) {
+	s := newStore(t)
+
+	if err := s.Save(idempotency.Record{Key: "order-1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.MarkSent("order-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _, _ := s.Lookup("order-1"); !got.Sent {
+		t.Errorf("Lookup() = %+v, want a record that was sent", got)
+	}
+
+	// Marking a record that doesn't exist doesn't create it
+	if err := s.MarkSent("order-2"); err != nil {
+		t.Errorf("MarkSent() of a missing record error = %v, want nil", err)
+	}
+
+	if _, found, _ := s.Lookup("order-2"); found {
+		t.Errorf("MarkSent() of a missing record created it")
+	}
+}
+
+func TestLease(t *testing.T) {
+	s := newStore(t)
+	now := time.Now()
+
+	if err := s.Save(idempotency.Record{Key: "order-1", ExpiresAt: now.Add(time.Hour), LeasedUntil: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.Lease("order-1", now.Add(time.Minute)); err != nil || ok {
+		t.Errorf("Lease() of a record that is leased = %v, %v, want false", ok, err)
+	}
+
+	// The lease is released after sending failed
+	if err := s.Release("order-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.Lease("order-1", now.Add(time.Minute)); err != nil || !ok {
+		t.Errorf("Lease() of a record that was released = %v, %v, want true", ok, err)
+	}
+
+	// The event of a record that is marked as sent is not sent again
+	s.Release("order-1")
+	s.MarkSent("order-1")
+
+	if ok, err := s.Lease("order-1", now.Add(time.Minute)); err != nil || ok {
+		t.Errorf("Lease() of a record that was sent = %v, %v, want false", ok, err)
+	}
+
+	if ok, err := s.Lease("order-2", now.Add(time.Minute)); err != nil || ok {
+		t.Errorf("Lease() of a missing record = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package memory keeps the idempotency records in memory. Records are
+// lost when the process stops, so this is only useful for testing and
+// for services that run as a single long-lived instance.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+)
+
+// sweepInterval is how often expired records are removed.
+const sweepInterval = time.Minute
+
+// store is an in-memory map that implements the methods of the
+// Store interface.
+type store struct {
+	mu        sync.Mutex
+	records   map[string]idempotency.Record
+	lastSweep time.Time
+}
+
+// New creates a new instance of the Store with memory
+// as the storage layer.
+func New() idempotency.Store {
+	return &store{
+		records:   make(map[string]idempotency.Record),
+		lastSweep: time.Now(),
+	}
+}
+
+// Lookup returns the record for the key. The boolean is false
+// when no record exists, or the record has expired.
+func (s *store) Lookup(key string) (idempotency.Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maybeSweep(time.Now())
+
+	r, ok := s.records[key]
+	if !ok || expired(r) {
+		return idempotency.Record{}, false, nil
+	}
+
+	return r, true, nil
+}
+
+// Save stores the record if no record exists for the key yet.
+// It returns ErrRecordExists otherwise.
+func (s *store) Save(r idempotency.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maybeSweep(time.Now())
+
+	if current, ok := s.records[r.Key]; ok && !expired(current) {
+		return idempotency.ErrRecordExists
+	}
+
+	s.records[r.Key] = r
+
+	return nil
+}
+
+// MarkSent updates the record for the key to indicate the event
+// has been sent.
+func (s *store) MarkSent(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		r.Sent = true
+		s.records[key] = r
+	}
+
+	return nil
+}
+
+// Lease sets LeasedUntil of the record for the key to until, when the
+// event has not been sent and no lease is held. The boolean is false
+// when the lease was not taken.
+func (s *store) Lease(key string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok || r.Sent || time.Now().Before(r.LeasedUntil) {
+		return false, nil
+	}
+
+	r.LeasedUntil = until
+	s.records[key] = r
+
+	return true, nil
+}
+
+// Release clears LeasedUntil of the record for the key, so another
+// delivery can send the event right away.
+func (s *store) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		r.LeasedUntil = time.Time{}
+		s.records[key] = r
+	}
+
+	return nil
+}
+
+// maybeSweep removes the expired records, when the last sweep was more than
+// the sweep interval ago. The caller must hold the lock.
+func (s *store) maybeSweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+
+	for key, r := range s.records {
+		if expired(r) {
+			delete(s.records, key)
+		}
+	}
+
+	s.lastSweep = now
+}
+
+// expired returns true when the record should no longer be used.
+func expired(r idempotency.Record) bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+)
+
+func TestSave(t *testing.T) {
+	s := New()
+
+	if err := s.Save(idempotency.Record{Key: "order-1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save(idempotency.Record{Key: "order-1"}); err != idempotency.ErrRecordExists {
+		t.Errorf("Save() of an existing record error = %v, want %v", err, idempotency.ErrRecordExists)
+	}
+
+	// A record that has expired is replaced
+	if err := s.Save(idempotency.Record{Key: "order-2", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save(idempotency.Record{Key: "order-2"}); err != nil {
+		t.Errorf("Save() of an expired record error = %v, want nil", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := New()
+
+	if err := s.Save(idempotency.Record{Key: "order-1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(idempotency.Record{Key: "order-2", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found, _ := s.Lookup("order-1"); !found {
+		t.Errorf("Lookup() of a stored record found = false, want true")
+	}
+
+	// Records that have expired or were never stored aren't found
+	for _, key := range []string{"order-2", "order-3"} {
+		if _, found, _ := s.Lookup(key); found {
+			t.Errorf("Lookup(%q) found = true, want false", key)
+		}
+	}
+
+	if err := s.MarkSent("order-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, _, _ := s.Lookup("order-1"); !r.Sent {
+		t.Errorf("Lookup() of a record that was marked as sent = %+v, want it sent", r)
+	}
+}
+
+func TestLease(t *testing.T) {
+	s := New()
+	now := time.Now()
+
+	if err := s.Save(idempotency.Record{Key: "order-1", LeasedUntil: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := s.Lease("order-1", now.Add(time.Minute)); ok {
+		t.Errorf("Lease() of a record that is leased = true, want false")
+	}
+
+	// The lease is released after sending failed
+	s.Release("order-1")
+
+	if ok, _ := s.Lease("order-1", now.Add(time.Minute)); !ok {
+		t.Errorf("Lease() of a record that was released = false, want true")
+	}
+
+	// The event of a record that is marked as sent is not sent again
+	s.Release("order-1")
+	s.MarkSent("order-1")
+
+	if ok, _ := s.Lease("order-1", now.Add(time.Minute)); ok {
+		t.Errorf("Lease() of a record that was sent = true, want false")
+	}
+}
+
+func TestSweepRemovesExpiredRecords(t *testing.T) {
+	s := New().(*store)
+
+	s.Save(idempotency.Record{Key: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+	s.Save(idempotency.Record{Key: "recent", ExpiresAt: time.Now().Add(time.Hour)})
+
+	// The next lookup after the sweep interval removes the expired records
+	s.lastSweep = time.Now().Add(-sweepInterval - time.Second)
+	s.Lookup("other")
+
+	if _, ok := s.records["expired"]; ok {
+		t.Errorf("store kept a record that has expired")
+	}
+	if _, ok := s.records["recent"]; !ok {
+		t.Errorf("store removed a record that hasn't expired")
+	}
+}
@@ -0,0 +1,143 @@
+// Package ledger contains the interfaces that the Payment service in the
+// ACME Serverless Fitness Shop needs to keep a record of every payment it
+// has validated. In order to add a new storage service, the Store interface
+// needs to be implemented.
+package ledger
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when there is no entry for the
+	// transaction in the ledger.
+	ErrNotFound = errors.New("transaction not found")
+
+	// ErrConflict is returned by Record when the entry was changed
+	// since it was read, or already exists when a new entry is recorded.
+	ErrConflict = errors.New("transaction was changed by someone else")
+)
+
+// State is the state of a payment in its lifecycle.
+type State string
+
+const (
+	// StateDeclined is the state of a payment that didn't pass validation.
+	StateDeclined State = "declined"
+
+	// StateAuthorized is the state of a payment that has been authorized,
+	// but not captured yet.
+	StateAuthorized State = "authorized"
+
+	// StateCaptured is the state of a payment that has been captured.
+	StateCaptured State = "captured"
+
+	// StatePartiallyRefunded is the state of a captured payment of which
+	// part of the captured amount has been refunded.
+	StatePartiallyRefunded State = "partially_refunded"
+
+	// StateRefunded is the state of a captured payment of which the entire
+	// captured amount has been refunded.
+	StateRefunded State = "refunded"
+
+	// StateVoided is the state of an authorized payment that has been
+	// voided before it was captured.
+	StateVoided State = "voided"
+
+	// StateReview is the state of a payment that passed validation, but
+	// is held until it has been reviewed because of its risk score.
+	StateReview State = "review"
+)
+
+// Entry is the record of a single payment validation attempt and
+// keeps track of the state of the payment afterwards.
+type Entry struct {
+	// The unique identifier of the transaction. Attempts that didn't
+	// pass validation get a unique identifier as well, so they can be
+	// looked up.
+	TransactionID string `json:"transactionID"`
+
+	// The unique identifier of the order.
+	OrderID string `json:"orderID"`
+
+	// The monetary amount of the transaction.
+	Amount string `json:"amount"`
+
+	// The ISO 4217 code of the currency of the amounts.
+	Currency string `json:"currency,omitempty"`
+
+	// The masked number of the creditcard used for the transaction.
+	Card string `json:"card"`
+
+	// The token of the creditcard used for the transaction, if it has one.
+	CardToken string `json:"cardToken,omitempty"`
+
+	// The card network the creditcard belongs to.
+	Brand string `json:"brand,omitempty"`
+
+	// Indicates whether the transaction was a success or not.
+	Success bool `json:"success"`
+
+	// The outcome of the validation, like success or error.
+	Status string `json:"status"`
+
+	// The reason the validation didn't succeed.
+	Reason string `json:"reason,omitempty"`
+
+	// The machine-readable reasons the validation didn't succeed.
+	DeclineCodes []string `json:"declineCodes,omitempty"`
+
+	// The risk score of the payment, from 0 to 100.
+	RiskScore int `json:"riskScore,omitempty"`
+
+	// The outcome of the risk assessment, like approved or review.
+	RiskDecision string `json:"riskDecision,omitempty"`
+
+	// The signals that added to the risk score.
+	RiskSignals []string `json:"riskSignals,omitempty"`
+
+	// The state of the payment in its lifecycle.
+	State State `json:"state,omitempty"`
+
+	// The monetary amount that has been authorized.
+	AuthorizedAmount string `json:"authorizedAmount,omitempty"`
+
+	// The monetary amount that has been captured.
+	CapturedAmount string `json:"capturedAmount,omitempty"`
+
+	// The monetary amount that has been refunded.
+	RefundedAmount string `json:"refundedAmount,omitempty"`
+
+	// The amounts of the actions performed on the payment, keyed by the
+	// idempotency key of their request, so an action that is requested
+	// again isn't performed twice.
+	Actions map[string]string `json:"actions,omitempty"`
+
+	// The time the entry was created.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// The time the entry was last updated.
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// The version of the entry, which goes up every time the entry is
+	// recorded. New entries have version 0 until they are recorded.
+	Version int `json:"version"`
+}
+
+// Store is the interface that describes the methods the storage
+// service needs to implement to be able to keep the ledger.
+type Store interface {
+	// Record stores the entry with the next version, if the stored entry
+	// with the same transaction ID still has the version of the entry, or
+	// if there is none and the entry has version 0. Otherwise it returns
+	// ErrConflict, so changes are never lost when an entry is updated by
+	// two requests at the same time.
+	Record(e Entry) error
+
+	// Get returns the entry for the transaction ID, or ErrNotFound.
+	Get(transactionID string) (Entry, error)
+
+	// ListByOrder returns all entries for the order ID, oldest first.
+	ListByOrder(orderID string) ([]Entry, error)
+}
@@ -0,0 +1,142 @@
+// Package bolt uses BoltDB, an embedded key/value database, to keep the ledger
+// in a single file. This is useful for services that run on a single machine
+// with a persistent disk.
+package bolt
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// entriesBucket contains the entries keyed by transaction ID.
+	entriesBucket = []byte("entries")
+
+	// ordersBucket contains a key for every order ID and transaction ID
+	// combination, so the entries of an order can be found.
+	ordersBucket = []byte("orders")
+)
+
+// store contains the BoltDB database and implements the methods
+// of the Store interface.
+type store struct {
+	db *bolt.DB
+}
+
+// New creates a new instance of the Store with BoltDB as the storage
+// layer. The file is determined by the environment variable LEDGER_FILE
+// and is created if it doesn't exist. The method returns an error if the
+// database could not be opened.
+func New() (ledger.Store, error) {
+	db, err := bolt.Open(os.Getenv("LEDGER_FILE"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(entriesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(ordersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &store{db: db}, nil
+}
+
+// Record stores the entry with the next version, if the stored entry
+// still has the version of the entry, or returns ErrConflict.
+func (s *store) Record(e ledger.Entry) error {
+	version := e.Version
+	e.Version++
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+
+		var stored ledger.Entry
+		if current := b.Get([]byte(e.TransactionID)); current != nil {
+			if err := json.Unmarshal(current, &stored); err != nil {
+				return err
+			}
+		}
+		if stored.Version != version {
+			return ledger.ErrConflict
+		}
+
+		if err := b.Put([]byte(e.TransactionID), payload); err != nil {
+			return err
+		}
+		return tx.Bucket(ordersBucket).Put(orderKey(e.OrderID, e.TransactionID), []byte(e.TransactionID))
+	})
+}
+
+// Get returns the entry for the transaction ID, or ErrNotFound.
+func (s *store) Get(transactionID string) (ledger.Entry, error) {
+	var e ledger.Entry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		payload := tx.Bucket(entriesBucket).Get([]byte(transactionID))
+		if payload == nil {
+			return ledger.ErrNotFound
+		}
+		return json.Unmarshal(payload, &e)
+	})
+
+	return e, err
+}
+
+// ListByOrder returns all entries for the order ID, oldest first.
+func (s *store) ListByOrder(orderID string) ([]ledger.Entry, error) {
+	entries := make([]ledger.Entry, 0)
+	prefix := orderKey(orderID, "")
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		c := tx.Bucket(ordersBucket).Cursor()
+
+		for k, v := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = c.Next() {
+			payload := b.Get(v)
+			if payload == nil {
+				continue
+			}
+
+			var e ledger.Entry
+			if err := json.Unmarshal(payload, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, err
+}
+
+// orderKey returns the key in the orders bucket for the order ID and
+// transaction ID combination.
+func orderKey(orderID string, transactionID string) []byte {
+	return []byte(orderID + "\x00" + transactionID)
+}
+
+// hasPrefix returns true when the key starts with the prefix.
+func hasPrefix(key []byte, prefix []byte) bool {
+	return len(key) >= len(prefix) && string(key[:len(prefix)]) == string(prefix)
+}
@@ -0,0 +1,104 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+)
+
+func TestListByOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LEDGER_FILE", filepath.Join(dir, "ledger.db"))
+	defer os.Unsetenv("LEDGER_FILE")
+
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, e := range []ledger.Entry{
+		{TransactionID: "2", OrderID: "order-1", CreatedAt: now.Add(time.Minute)},
+		{TransactionID: "1", OrderID: "order-1", CreatedAt: now},
+		{TransactionID: "3", OrderID: "order-10", CreatedAt: now},
+	} {
+		if err := s.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The entries of order-10 don't match the prefix of order-1
+	entries, err := s.ListByOrder("order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].TransactionID != "1" || entries[1].TransactionID != "2" {
+		t.Errorf("ListByOrder() = %+v, want transactions 1 and 2, oldest first", entries)
+	}
+
+	if e, err := s.Get("3"); err != nil || e.OrderID != "order-10" {
+		t.Errorf("Get() = %+v, %v, want the entry of order-10", e, err)
+	}
+
+	if _, err := s.Get("4"); err != ledger.ErrNotFound {
+		t.Errorf("Get() of an unknown transaction error = %v, want %v", err, ledger.ErrNotFound)
+	}
+}
+
+func TestRecordChecksVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LEDGER_FILE", filepath.Join(dir, "ledger.db"))
+	defer os.Unsetenv("LEDGER_FILE")
+
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := ledger.Entry{TransactionID: "1", OrderID: "order-1", State: ledger.StateAuthorized}
+	if err := s.Record(e); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recording the new entry again conflicts with the stored entry
+	if err := s.Record(e); err != ledger.ErrConflict {
+		t.Errorf("Record() of an existing entry = %v, want ErrConflict", err)
+	}
+
+	stored, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored.State = ledger.StateCaptured
+	if err := s.Record(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry that was read before the update is out of date
+	if err := s.Record(stored); err != ledger.ErrConflict {
+		t.Errorf("Record() of an outdated entry = %v, want ErrConflict", err)
+	}
+
+	entries, err := s.ListByOrder("order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Version != 2 || entries[0].State != ledger.StateCaptured {
+		t.Errorf("ListByOrder() = %+v, want the captured entry with version 2", entries)
+	}
+}
@@ -0,0 +1,143 @@
+// Package dynamodb uses Amazon DynamoDB, a fully managed NoSQL database service, to keep
+// the ledger of the Payment service. The table needs a string partition key called
+// "transactionID" and a global secondary index called "orderID-index" with a string
+// partition key called "orderID".
+package dynamodb
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+)
+
+// orderIndex is the name of the global secondary index on orderID.
+const orderIndex = "orderID-index"
+
+// store contains the DynamoDB client and implements the methods
+// of the Store interface.
+type store struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// New creates a new instance of the Store with DynamoDB as the storage
+// layer. The table is determined by the environment variable LEDGER_TABLE.
+// The AWS region is determined by the environment variable REGION. To use a
+// local stand-in, like DynamoDB Local, set DYNAMODB_ENDPOINT to its URL.
+func New() ledger.Store {
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession := session.Must(session.NewSession(cfg))
+
+	return &store{
+		svc:   dynamodb.New(awsSession),
+		table: os.Getenv("LEDGER_TABLE"),
+	}
+}
+
+// Record stores the entry with the next version, if the stored entry
+// still has the version of the entry, or returns ErrConflict.
+func (s *store) Record(e ledger.Entry) error {
+	version := e.Version
+	e.Version++
+
+	av, err := dynamodbattribute.MarshalMap(e)
+	if err != nil {
+		return err
+	}
+
+	// A new entry must not exist yet, or have been recorded before
+	// entries had a version
+	condition := "#version = :version"
+	if version == 0 {
+		condition = "attribute_not_exists(#version) OR " + condition
+	}
+
+	_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                av,
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{
+			"#version": aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.Itoa(version))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ledger.ErrConflict
+	}
+
+	return err
+}
+
+// Get returns the entry for the transaction ID, or ErrNotFound.
+func (s *store) Get(transactionID string) (ledger.Entry, error) {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"transactionID": {S: aws.String(transactionID)},
+		},
+	})
+	if err != nil {
+		return ledger.Entry{}, err
+	}
+
+	if out.Item == nil {
+		return ledger.Entry{}, ledger.ErrNotFound
+	}
+
+	var e ledger.Entry
+	err = dynamodbattribute.UnmarshalMap(out.Item, &e)
+
+	return e, err
+}
+
+// ListByOrder returns all entries for the order ID, oldest first.
+func (s *store) ListByOrder(orderID string) ([]ledger.Entry, error) {
+	entries := make([]ledger.Entry, 0)
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(orderIndex),
+		KeyConditionExpression: aws.String("orderID = :orderID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":orderID": {S: aws.String(orderID)},
+		},
+	}
+
+	var unmarshalErr error
+	err := s.svc.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items := make([]ledger.Entry, 0, len(page.Items))
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		entries = append(entries, items...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, nil
+}
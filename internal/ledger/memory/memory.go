@@ -0,0 +1,97 @@
+// Package memory keeps the ledger in memory. Entries are lost when the
+// process stops, and only the last MaxEntries transactions are kept, so this
+// is only useful for testing and local runs.
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+)
+
+// MaxEntries is the number of transactions the ledger keeps. When a new
+// transaction is recorded after that, the oldest one is removed.
+const MaxEntries = 10000
+
+// store is an in-memory map that implements the methods of the
+// Store interface.
+type store struct {
+	mu      sync.RWMutex
+	entries map[string]ledger.Entry
+
+	// order contains the transaction IDs in the order they were first
+	// recorded, so the oldest can be removed
+	order []string
+	max   int
+}
+
+// New creates a new instance of the Store with memory
+// as the storage layer.
+func New() ledger.Store {
+	return newStore(MaxEntries)
+}
+
+// newStore creates a store that keeps up to max transactions.
+func newStore(max int) *store {
+	return &store{
+		entries: make(map[string]ledger.Entry),
+		max:     max,
+	}
+}
+
+// Record stores the entry with the next version, if the stored entry
+// still has the version of the entry, or returns ErrConflict.
+func (s *store) Record(e ledger.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries[e.TransactionID].Version != e.Version {
+		return ledger.ErrConflict
+	}
+
+	if e.Version == 0 {
+		for len(s.order) >= s.max {
+			delete(s.entries, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.order = append(s.order, e.TransactionID)
+	}
+
+	e.Version++
+	s.entries[e.TransactionID] = e
+
+	return nil
+}
+
+// Get returns the entry for the transaction ID, or ErrNotFound.
+func (s *store) Get(transactionID string) (ledger.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[transactionID]
+	if !ok {
+		return ledger.Entry{}, ledger.ErrNotFound
+	}
+
+	return e, nil
+}
+
+// ListByOrder returns all entries for the order ID, oldest first.
+func (s *store) ListByOrder(orderID string) ([]ledger.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]ledger.Entry, 0)
+	for _, e := range s.entries {
+		if e.OrderID == orderID {
+			entries = append(entries, e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, nil
+}
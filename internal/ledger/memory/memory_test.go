@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+)
+
+func TestListByOrder(t *testing.T) {
+	s := New()
+	now := time.Now()
+
+	for _, e := range []ledger.Entry{
+		{TransactionID: "2", OrderID: "order-1", CreatedAt: now.Add(time.Minute)},
+		{TransactionID: "1", OrderID: "order-1", CreatedAt: now},
+		{TransactionID: "3", OrderID: "order-2", CreatedAt: now},
+	} {
+		if err := s.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := s.ListByOrder("order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].TransactionID != "1" || entries[1].TransactionID != "2" {
+		t.Errorf("ListByOrder() = %+v, want transactions 1 and 2, oldest first", entries)
+	}
+
+	if e, err := s.Get("3"); err != nil || e.OrderID != "order-2" {
+		t.Errorf("Get() = %+v, %v, want the entry of order-2", e, err)
+	}
+
+	if _, err := s.Get("4"); err != ledger.ErrNotFound {
+		t.Errorf("Get() of an unknown transaction error = %v, want %v", err, ledger.ErrNotFound)
+	}
+}
+
+func TestRecordChecksVersion(t *testing.T) {
+	s := New()
+
+	e := ledger.Entry{TransactionID: "1", OrderID: "order-1", State: ledger.StateAuthorized}
+	if err := s.Record(e); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recording the new entry again conflicts with the stored entry
+	if err := s.Record(e); err != ledger.ErrConflict {
+		t.Errorf("Record() of an existing entry = %v, want ErrConflict", err)
+	}
+
+	stored, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != 1 {
+		t.Errorf("Get() returned version %d, want 1", stored.Version)
+	}
+
+	stored.State = ledger.StateCaptured
+	if err := s.Record(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry that was read before the update is out of date
+	if err := s.Record(stored); err != ledger.ErrConflict {
+		t.Errorf("Record() of an outdated entry = %v, want ErrConflict", err)
+	}
+
+	if stored, _ := s.Get("1"); stored.Version != 2 || stored.State != ledger.StateCaptured {
+		t.Errorf("Get() = version %d in state %s, want version 2 in state captured", stored.Version, stored.State)
+	}
+
+	if err := s.Record(ledger.Entry{TransactionID: "2", Version: 1}); err != ledger.ErrConflict {
+		t.Errorf("Record() of an unknown entry with a version = %v, want ErrConflict", err)
+	}
+}
+
+func TestOldestEntriesAreRemoved(t *testing.T) {
+	s := newStore(2)
+
+	for _, id := range []string{"1", "2"} {
+		if err := s.Record(ledger.Entry{TransactionID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Updating an entry doesn't make room for another one
+	stored, _ := s.Get("1")
+	stored.State = ledger.StateCaptured
+	if err := s.Record(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Record(ledger.Entry{TransactionID: "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("1"); err != ledger.ErrNotFound {
+		t.Errorf("Get() of the oldest entry = %v, want ErrNotFound", err)
+	}
+
+	for _, id := range []string{"2", "3"} {
+		if _, err := s.Get(id); err != nil {
+			t.Errorf("Get() of entry %s = %v, want the entry", id, err)
+		}
+	}
+
+	if len(s.entries) != 2 || len(s.order) != 2 {
+		t.Errorf("store has %d entries and %d in order, want 2", len(s.entries), len(s.order))
+	}
+}
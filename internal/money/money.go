@@ -0,0 +1,216 @@
+// Package money parses and formats the monetary amounts used in payments. Amounts
+// are kept as an integer number of minor units, like cents, of an ISO 4217 currency.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts that don't specify one.
+const DefaultCurrency = "USD"
+
+// MaxMinorUnits is the largest number of minor units an amount can have.
+const MaxMinorUnits int64 = 1e15
+
+var (
+	// ErrMalformed is returned when the amount is not a number.
+	ErrMalformed = errors.New("amount is not a valid number")
+
+	// ErrNegative is returned when the amount is negative.
+	ErrNegative = errors.New("amount is negative")
+
+	// ErrPrecision is returned when the amount has more decimals than
+	// the minor units of the currency.
+	ErrPrecision = errors.New("amount has more decimals than the currency allows")
+
+	// ErrUnknownCurrency is returned when the currency is not a known
+	// ISO 4217 currency.
+	ErrUnknownCurrency = errors.New("currency is not a known ISO 4217 currency")
+
+	// ErrTooLarge is returned when the amount is larger than MaxMinorUnits.
+	ErrTooLarge = errors.New("amount is too large")
+
+	// ErrCurrencyMismatch is returned when two amounts with a different
+	// currency are combined.
+	ErrCurrencyMismatch = errors.New("amounts have a different currency")
+)
+
+// minorUnits contains the number of decimals of the supported ISO 4217 currencies.
+var minorUnits = map[string]int{
+	"AED": 2, "ARS": 2, "AUD": 2, "BGN": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "COP": 2, "CZK": 2, "DKK": 2, "EGP": 2, "EUR": 2, "GBP": 2,
+	"HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "ISK": 0, "JOD": 3, "JPY": 0,
+	"KRW": 0, "KWD": 3, "MXN": 2, "MYR": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2,
+	"PLN": 2, "RON": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TND": 3, "TRY": 2,
+	"TWD": 2, "UAH": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+// Money is a monetary amount in a currency.
+type Money struct {
+	// Minor is the amount in minor units of the currency, like cents.
+	Minor int64
+
+	// Currency is the ISO 4217 code of the currency, like USD.
+	Currency string
+}
+
+// Parse parses a monetary amount, like "12.50", "12.50 EUR", or "EUR 12.50". Amounts
+// without a currency use the given currency, or DefaultCurrency when that is empty.
+// The amount can't have more decimals than the minor units of the currency.
+func Parse(s string, currency string) (Money, error) {
+	fields := strings.Fields(strings.TrimSpace(s))
+
+	var amount string
+	switch len(fields) {
+	case 1:
+		amount = fields[0]
+	case 2:
+		if isCurrencyCode(fields[0]) {
+			currency, amount = fields[0], fields[1]
+		} else {
+			amount, currency = fields[0], fields[1]
+		}
+	default:
+		return Money{}, ErrMalformed
+	}
+
+	if len(currency) == 0 {
+		currency = DefaultCurrency
+	}
+	currency = strings.ToUpper(currency)
+
+	units, ok := minorUnits[currency]
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+
+	if strings.HasPrefix(amount, "-") {
+		if _, err := strconv.ParseFloat(amount, 64); err == nil {
+			return Money{}, ErrNegative
+		}
+		return Money{}, ErrMalformed
+	}
+
+	parts := strings.SplitN(amount, ".", 2)
+	if len(parts[0]) == 0 || !digitsOnly(parts[0]) {
+		return Money{}, ErrMalformed
+	}
+
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+		if len(fraction) == 0 || !digitsOnly(fraction) {
+			return Money{}, ErrMalformed
+		}
+		// Trailing zeros don't add precision
+		fraction = strings.TrimRight(fraction, "0")
+		if len(fraction) > units {
+			return Money{}, ErrPrecision
+		}
+	}
+	fraction += strings.Repeat("0", units-len(fraction))
+
+	// Both parts only contain digits, so the only way parsing fails
+	// is when the amount doesn't fit
+	minor, err := strconv.ParseInt(parts[0]+fraction, 10, 64)
+	if err != nil || minor > MaxMinorUnits {
+		return Money{}, ErrTooLarge
+	}
+
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// IsZero returns true when the amount is zero.
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+// Add returns the sum of both amounts. It returns an error if the
+// currencies don't match.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Minor: m.Minor + o.Minor, Currency: m.Currency}, nil
+}
+
+// Sub returns the difference of both amounts. It returns an error if the
+// currencies don't match.
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Minor: m.Minor - o.Minor, Currency: m.Currency}, nil
+}
+
+// Cmp compares both amounts and returns -1 when m is less than o, 0 when they
+// are equal, and +1 when m is more than o. It returns an error if the currencies
+// don't match.
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	switch {
+	case m.Minor < o.Minor:
+		return -1, nil
+	case m.Minor > o.Minor:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// String formats the amount with exactly the number of decimals of the
+// currency, and without the currency, like "12.50".
+func (m Money) String() string {
+	units := minorUnits[m.Currency]
+	if units == 0 {
+		return strconv.FormatInt(m.Minor, 10)
+	}
+
+	pow := int64(1)
+	for i := 0; i < units; i++ {
+		pow *= 10
+	}
+
+	sign := ""
+	minor := m.Minor
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/pow, units, minor%pow)
+}
+
+// KnownCurrency returns true when the code is a supported ISO 4217 currency.
+func KnownCurrency(code string) bool {
+	_, ok := minorUnits[strings.ToUpper(code)]
+	return ok
+}
+
+// isCurrencyCode returns true when the string looks like an ISO 4217 code.
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// digitsOnly returns true when the string only contains digits.
+func digitsOnly(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
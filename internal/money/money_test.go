@@ -0,0 +1,168 @@
+package money
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		currency string
+		want     Money
+		wantErr  error
+	}{
+		// Precision per currency
+		{"default currency", "12.50", "", Money{1250, "USD"}, nil},
+		{"no decimals", "12", "", Money{1200, "USD"}, nil},
+		{"one decimal", "12.5", "", Money{1250, "USD"}, nil},
+		{"given currency", "12.50", "eur", Money{1250, "EUR"}, nil},
+		{"currency after the amount", "12.50 EUR", "USD", Money{1250, "EUR"}, nil},
+		{"currency before the amount", "EUR 12.50", "USD", Money{1250, "EUR"}, nil},
+		{"lower case currency", "gbp 12.50", "", Money{1250, "GBP"}, nil},
+		{"currency without minor units", "1500 JPY", "", Money{1500, "JPY"}, nil},
+		{"currency with three decimals", "1.234 BHD", "", Money{1234, "BHD"}, nil},
+		{"three decimals, given as one", "1.2 KWD", "", Money{1200, "KWD"}, nil},
+		{"zero", "0.00", "", Money{0, "USD"}, nil},
+		{"leading zeros", "007.50", "", Money{750, "USD"}, nil},
+		{"unknown currency", "12.50 XXX", "", Money{}, ErrUnknownCurrency},
+		{"unknown given currency", "12.50", "ABC", Money{}, ErrUnknownCurrency},
+
+		// Too many decimals
+		{"three decimals", "12.345", "", Money{}, ErrPrecision},
+		{"trailing zeros", "12.3400", "", Money{1234, "USD"}, nil},
+		{"decimals without minor units", "1500.5 JPY", "", Money{}, ErrPrecision},
+		{"zero decimal without minor units", "1500.0 JPY", "", Money{1500, "JPY"}, nil},
+		{"four decimals", "1.2345 BHD", "", Money{}, ErrPrecision},
+
+		// Negative values
+		{"negative", "-12.50", "", Money{}, ErrNegative},
+		{"negative zero", "-0", "", Money{}, ErrNegative},
+		{"negative with currency", "EUR -1", "", Money{}, ErrNegative},
+		{"minus sign only", "-", "", Money{}, ErrMalformed},
+		{"negative text", "-abc", "", Money{}, ErrMalformed},
+
+		// Amounts that are too large
+		{"largest amount", "10000000000000.00", "", Money{MaxMinorUnits, "USD"}, nil},
+		{"just too large", "10000000000000.01", "", Money{}, ErrTooLarge},
+		{"largest amount without minor units", "1000000000000000 JPY", "", Money{MaxMinorUnits, "JPY"}, nil},
+		{"just too large without minor units", "1000000000000001 JPY", "", Money{}, ErrTooLarge},
+		{"overflows int64", "99999999999999999999", "", Money{}, ErrTooLarge},
+		{"overflows int64 with minor units", "92233720368547758.07", "", Money{}, ErrTooLarge},
+
+		// Whitespace and exponents
+		{"surrounding whitespace", " \t12.50\n", "", Money{1250, "USD"}, nil},
+		{"whitespace between currency and amount", "EUR   12.50", "", Money{1250, "EUR"}, nil},
+		{"whitespace inside the amount", "12 .50", "", Money{}, ErrUnknownCurrency},
+		{"three fields", "EUR 12.50 USD", "", Money{}, ErrMalformed},
+		{"empty", "", "", Money{}, ErrMalformed},
+		{"whitespace only", "  ", "", Money{}, ErrMalformed},
+		{"exponent", "1e3", "", Money{}, ErrMalformed},
+		{"upper case exponent", "1E3", "", Money{}, ErrMalformed},
+		{"exponent with decimals", "1.5e2", "", Money{}, ErrMalformed},
+		{"negative exponent", "125e-2", "", Money{}, ErrMalformed},
+
+		// Other malformed amounts
+		{"plus sign", "+12.50", "", Money{}, ErrMalformed},
+		{"no integer part", ".50", "", Money{}, ErrMalformed},
+		{"no fraction", "12.", "", Money{}, ErrMalformed},
+		{"two points", "1.2.3", "", Money{}, ErrMalformed},
+		{"thousands separator", "1,000.00", "", Money{}, ErrMalformed},
+		{"decimal comma", "12,50", "", Money{}, ErrMalformed},
+		{"hexadecimal", "0x10", "", Money{}, ErrMalformed},
+		{"not a number", "NaN", "", Money{}, ErrMalformed},
+		{"infinity", "Inf", "", Money{}, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input, tt.currency)
+			if err != tt.wantErr {
+				t.Fatalf("Parse(%q, %q) error = %v, want %v", tt.input, tt.currency, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q, %q) = %+v, want %+v", tt.input, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Money{1250, "USD"}, "12.50"},
+		{Money{5, "USD"}, "0.05"},
+		{Money{0, "EUR"}, "0.00"},
+		{Money{-1250, "USD"}, "-12.50"},
+		{Money{-5, "USD"}, "-0.05"},
+		{Money{1500, "JPY"}, "1500"},
+		{Money{1234, "BHD"}, "1.234"},
+		{Money{MaxMinorUnits, "USD"}, "10000000000000.00"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.money, got, tt.want)
+		}
+	}
+}
+
+func TestStringRoundTrips(t *testing.T) {
+	for _, s := range []string{"12.50 USD", "1500 JPY", "1.234 BHD", "0.01 EUR"} {
+		m, err := Parse(s, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := Parse(m.String(), m.Currency); err != nil || got != m {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", m.String(), got, err, m)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a := Money{1250, "USD"}
+	b := Money{250, "USD"}
+
+	if got, err := a.Add(b); err != nil || got != (Money{1500, "USD"}) {
+		t.Errorf("Add() = %+v, %v, want 15.00 USD", got, err)
+	}
+
+	if got, err := a.Sub(b); err != nil || got != (Money{1000, "USD"}) {
+		t.Errorf("Sub() = %+v, %v, want 10.00 USD", got, err)
+	}
+
+	for _, tt := range []struct {
+		a, b Money
+		want int
+	}{
+		{a, b, 1},
+		{b, a, -1},
+		{a, a, 0},
+	} {
+		if got, err := tt.a.Cmp(tt.b); err != nil || got != tt.want {
+			t.Errorf("%+v.Cmp(%+v) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+
+	eur := Money{1250, "EUR"}
+	if _, err := a.Add(eur); err != ErrCurrencyMismatch {
+		t.Errorf("Add() of another currency error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	if _, err := a.Sub(eur); err != ErrCurrencyMismatch {
+		t.Errorf("Sub() of another currency error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	if _, err := a.Cmp(eur); err != ErrCurrencyMismatch {
+		t.Errorf("Cmp() of another currency error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+}
+
+func TestKnownCurrency(t *testing.T) {
+	for code, want := range map[string]bool{"USD": true, "eur": true, "JPY": true, "XXX": false, "US": false, "": false} {
+		if got := KnownCurrency(code); got != want {
+			t.Errorf("KnownCurrency(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package outbox contains the interfaces that the Payment service in the ACME
+// Serverless Fitness Shop needs to make sure every event it generates is sent.
+// Events are written to the outbox before they are sent, and a Relay drains the
+// outbox to the EventEmitter. An event that could not be sent, because sending
+// failed or the service stopped, stays in the outbox until it is sent. Events
+// are sent at least once, and carry an ID so consumers can drop duplicates. In
+// order to add a new storage service, the Store interface needs to be implemented.
+package outbox
+
+import (
+	"errors"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+)
+
+// Status is the delivery status of a message.
+type Status string
+
+const (
+	// Pending means the event has not been sent yet.
+	Pending Status = "pending"
+
+	// Sent means the event has been sent.
+	Sent Status = "sent"
+
+	// Failed means sending the event failed too often, so the relay stopped
+	// trying. The message needs to be looked at.
+	Failed Status = "failed"
+)
+
+// DefaultRetention is the time a message is kept after its event has been
+// sent, so an event that is added again in that time is not sent twice.
+const DefaultRetention = 24 * time.Hour
+
+var (
+	// ErrMessageExists is returned by Add when a message with the
+	// same ID has already been stored.
+	ErrMessageExists = errors.New("outbox message already exists")
+
+	// ErrNotFound is returned when no message exists for the ID.
+	ErrNotFound = errors.New("outbox message not found")
+)
+
+// Message is an event in the outbox, with its delivery status. It implements
+// the Event interface of the emitter package, so it can be sent as is.
+type Message struct {
+	// ID uniquely identifies the event, so it is only added once and
+	// consumers can drop duplicates.
+	ID string
+
+	// Metadata is the metadata of the event.
+	Metadata acmeserverless.Metadata
+
+	// Event is the JSON encoded event.
+	Event []byte
+
+	// Status is the delivery status of the event.
+	Status Status
+
+	// Attempts is the number of times sending the event failed.
+	Attempts int
+
+	// LastError is the error of the last failed attempt, without creditcard data.
+	LastError string
+
+	// CreatedAt is the time the event was added.
+	CreatedAt time.Time
+
+	// UpdatedAt is the time the status was last changed.
+	UpdatedAt time.Time
+
+	// ExpiresAt is the time after which a sent message can be removed.
+	ExpiresAt time.Time
+}
+
+// Meta returns the metadata of the event.
+func (m Message) Meta() acmeserverless.Metadata {
+	return m.Metadata
+}
+
+// Marshal returns the JSON encoded event.
+func (m Message) Marshal() ([]byte, error) {
+	return m.Event, nil
+}
+
+// MessageID returns the ID of the event, which consumers can use to drop duplicates.
+func (m Message) MessageID() string {
+	return m.ID
+}
+
+// Store is the interface that describes the methods the storage
+// service needs to implement to keep the outbox.
+type Store interface {
+	// Add stores the message if no message exists for its ID yet.
+	// It returns ErrMessageExists otherwise.
+	Add(m Message) error
+
+	// Pending returns up to limit messages that haven't been sent,
+	// oldest first.
+	Pending(limit int) ([]Message, error)
+
+	// Update replaces the message with the same ID, to change its status.
+	Update(m Message) error
+
+	// Get returns the message for the ID, or ErrNotFound.
+	Get(id string) (Message, error)
+}
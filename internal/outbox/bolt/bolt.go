@@ -0,0 +1,208 @@
+// Package bolt uses BoltDB, an embedded key/value database, to keep the outbox
+// in a single file. This is useful for services that run on a single machine
+// with a persistent disk, as the messages survive a restart of the service.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// messagesBucket contains the messages keyed by ID.
+	messagesBucket = []byte("messages")
+
+	// pendingBucket contains a key for every message that hasn't been sent,
+	// ordered by the time it was added, so the oldest messages are found first.
+	pendingBucket = []byte("pending")
+
+	// expiryBucket contains a key for every sent message, ordered by the time
+	// it expires, so expired messages can be removed.
+	expiryBucket = []byte("expiry")
+)
+
+// store contains the BoltDB database and implements the methods
+// of the Store interface.
+type store struct {
+	db *bolt.DB
+}
+
+// New creates a new instance of the Store with BoltDB as the storage
+// layer. The file is determined by the environment variable OUTBOX_FILE
+// and is created if it doesn't exist. The method returns an error if the
+// database could not be opened.
+func New() (outbox.Store, error) {
+	db, err := bolt.Open(os.Getenv("OUTBOX_FILE"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{messagesBucket, pendingBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &store{db: db}, nil
+}
+
+// Add stores the message if no message exists for its ID yet.
+// It returns ErrMessageExists otherwise.
+func (s *store) Add(m outbox.Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := get(tx, m.ID)
+		if err == nil && !expired(current) {
+			return outbox.ErrMessageExists
+		}
+		if err != nil && err != outbox.ErrNotFound {
+			return err
+		}
+
+		if err == nil {
+			if err := remove(tx, current); err != nil {
+				return err
+			}
+		}
+
+		return put(tx, m)
+	})
+}
+
+// Pending returns up to limit messages that haven't been sent, oldest first.
+// Sent messages that have expired are removed.
+func (s *store) Pending(limit int) ([]outbox.Message, error) {
+	msgs := make([]outbox.Message, 0)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Remove the sent messages that have expired
+		now := timeKey(time.Now(), "")
+		c := tx.Bucket(expiryBucket).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, now) < 0; k, v = c.First() {
+			if err := tx.Bucket(messagesBucket).Delete(v); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket(messagesBucket)
+		c = tx.Bucket(pendingBucket).Cursor()
+		for k, v := c.First(); k != nil && len(msgs) < limit; k, v = c.Next() {
+			payload := b.Get(v)
+			if payload == nil {
+				continue
+			}
+
+			var m outbox.Message
+			if err := json.Unmarshal(payload, &m); err != nil {
+				return err
+			}
+			msgs = append(msgs, m)
+		}
+
+		return nil
+	})
+
+	return msgs, err
+}
+
+// Update replaces the message with the same ID, to change its status.
+func (s *store) Update(m outbox.Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current, err := get(tx, m.ID)
+		if err != nil && err != outbox.ErrNotFound {
+			return err
+		}
+
+		if err == nil {
+			if err := remove(tx, current); err != nil {
+				return err
+			}
+		}
+
+		return put(tx, m)
+	})
+}
+
+// Get returns the message for the ID, or ErrNotFound.
+func (s *store) Get(id string) (outbox.Message, error) {
+	var m outbox.Message
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = get(tx, id)
+		return err
+	})
+
+	return m, err
+}
+
+// get returns the message for the ID in the transaction, or ErrNotFound.
+func get(tx *bolt.Tx, id string) (outbox.Message, error) {
+	var m outbox.Message
+
+	payload := tx.Bucket(messagesBucket).Get([]byte(id))
+	if payload == nil {
+		return m, outbox.ErrNotFound
+	}
+
+	err := json.Unmarshal(payload, &m)
+	return m, err
+}
+
+// put stores the message and adds it to the index for its status.
+func put(tx *bolt.Tx, m outbox.Message) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(messagesBucket).Put([]byte(m.ID), payload); err != nil {
+		return err
+	}
+
+	switch {
+	case m.Status == outbox.Pending:
+		return tx.Bucket(pendingBucket).Put(timeKey(m.CreatedAt, m.ID), []byte(m.ID))
+	case m.Status == outbox.Sent && !m.ExpiresAt.IsZero():
+		return tx.Bucket(expiryBucket).Put(timeKey(m.ExpiresAt, m.ID), []byte(m.ID))
+	default:
+		return nil
+	}
+}
+
+// remove removes the message from the indexes. The message itself is
+// replaced by put.
+func remove(tx *bolt.Tx, m outbox.Message) error {
+	if err := tx.Bucket(pendingBucket).Delete(timeKey(m.CreatedAt, m.ID)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(expiryBucket).Delete(timeKey(m.ExpiresAt, m.ID))
+}
+
+// timeKey returns an index key that sorts by the time, and then by the ID.
+func timeKey(t time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, id...)
+}
+
+// expired returns true when the message has been sent and can be removed.
+func expired(m outbox.Message) bool {
+	return m.Status == outbox.Sent && !m.ExpiresAt.IsZero() && time.Now().After(m.ExpiresAt)
+}
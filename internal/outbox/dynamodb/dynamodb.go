@@ -0,0 +1,200 @@
+// Package dynamodb uses Amazon DynamoDB, a fully managed NoSQL database service, to keep
+// the outbox of the Payment service. The table needs a string partition key called "ID"
+// and a global secondary index called "Status-index" with a string partition key called
+// "Status" and a string sort key called "CreatedAt". Enable Time To Live on the attribute
+// "ExpiresAt" so sent messages are removed.
+package dynamodb
+
+import (
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+)
+
+// statusIndex is the name of the global secondary index on Status.
+const statusIndex = "Status-index"
+
+// item is the representation of an outbox message in DynamoDB. The time the
+// message was added is stored in UTC, so the sort key sorts by time.
+type item struct {
+	ID        string                  `dynamodbav:"ID"`
+	Metadata  acmeserverless.Metadata `dynamodbav:"Metadata"`
+	Event     []byte                  `dynamodbav:"Event"`
+	Status    string                  `dynamodbav:"Status"`
+	Attempts  int                     `dynamodbav:"Attempts"`
+	LastError string                  `dynamodbav:"LastError,omitempty"`
+	CreatedAt string                  `dynamodbav:"CreatedAt"`
+	UpdatedAt string                  `dynamodbav:"UpdatedAt,omitempty"`
+	ExpiresAt int64                   `dynamodbav:"ExpiresAt,omitempty"`
+}
+
+// store contains the DynamoDB client and implements the methods
+// of the Store interface.
+type store struct {
+	svc   *dynamodb.DynamoDB
+	table string
+}
+
+// New creates a new instance of the Store with DynamoDB as the storage
+// layer. The table is determined by the environment variable OUTBOX_TABLE.
+// The AWS region is determined by the environment variable REGION. To use a
+// local stand-in, like DynamoDB Local, set DYNAMODB_ENDPOINT to its URL.
+func New() outbox.Store {
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession := session.Must(session.NewSession(cfg))
+
+	return &store{
+		svc:   dynamodb.New(awsSession),
+		table: os.Getenv("OUTBOX_TABLE"),
+	}
+}
+
+// Add stores the message if no message exists for its ID yet.
+// It returns ErrMessageExists otherwise.
+func (s *store) Add(m outbox.Message) error {
+	av, err := dynamodbattribute.MarshalMap(toItem(m))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(ID)"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return outbox.ErrMessageExists
+	}
+
+	return err
+}
+
+// Pending returns up to limit messages that haven't been sent, oldest first.
+func (s *store) Pending(limit int) ([]outbox.Message, error) {
+	out, err := s.svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(statusIndex),
+		KeyConditionExpression: aws.String("#status = :status"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {S: aws.String(string(outbox.Pending))},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var items []item
+	if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]outbox.Message, len(items))
+	for i := range items {
+		msgs[i] = fromItem(items[i])
+	}
+
+	return msgs, nil
+}
+
+// Update replaces the message with the same ID, to change its status.
+func (s *store) Update(m outbox.Message) error {
+	av, err := dynamodbattribute.MarshalMap(toItem(m))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	})
+
+	return err
+}
+
+// Get returns the message for the ID, or ErrNotFound.
+func (s *store) Get(id string) (outbox.Message, error) {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return outbox.Message{}, err
+	}
+
+	if out.Item == nil {
+		return outbox.Message{}, outbox.ErrNotFound
+	}
+
+	var i item
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &i); err != nil {
+		return outbox.Message{}, err
+	}
+
+	return fromItem(i), nil
+}
+
+// toItem returns the DynamoDB representation of the message.
+func toItem(m outbox.Message) item {
+	i := item{
+		ID:        m.ID,
+		Metadata:  m.Metadata,
+		Event:     m.Event,
+		Status:    string(m.Status),
+		Attempts:  m.Attempts,
+		LastError: m.LastError,
+		CreatedAt: m.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+
+	if !m.UpdatedAt.IsZero() {
+		i.UpdatedAt = m.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	if !m.ExpiresAt.IsZero() {
+		i.ExpiresAt = m.ExpiresAt.Unix()
+	}
+
+	return i
+}
+
+// fromItem returns the message for the DynamoDB representation.
+func fromItem(i item) outbox.Message {
+	m := outbox.Message{
+		ID:        i.ID,
+		Metadata:  i.Metadata,
+		Event:     i.Event,
+		Status:    outbox.Status(i.Status),
+		Attempts:  i.Attempts,
+		LastError: i.LastError,
+	}
+
+	m.CreatedAt, _ = time.Parse(time.RFC3339Nano, i.CreatedAt)
+	m.UpdatedAt, _ = time.Parse(time.RFC3339Nano, i.UpdatedAt)
+
+	if i.ExpiresAt > 0 {
+		m.ExpiresAt = time.Unix(i.ExpiresAt, 0)
+	}
+
+	return m
+}
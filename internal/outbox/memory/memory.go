@@ -0,0 +1,99 @@
+// Package memory keeps the outbox in memory. Messages are lost when the
+// process stops, so this is only useful for testing and for services that
+// run as a single long-lived instance.
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+)
+
+// store is an in-memory map that implements the methods of the
+// Store interface.
+type store struct {
+	mu       sync.Mutex
+	messages map[string]outbox.Message
+}
+
+// New creates a new instance of the Store with memory
+// as the storage layer.
+func New() outbox.Store {
+	return &store{
+		messages: make(map[string]outbox.Message),
+	}
+}
+
+// Add stores the message if no message exists for its ID yet.
+// It returns ErrMessageExists otherwise.
+func (s *store) Add(m outbox.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.messages[m.ID]; ok && !expired(current) {
+		return outbox.ErrMessageExists
+	}
+
+	s.messages[m.ID] = m
+
+	return nil
+}
+
+// Pending returns up to limit messages that haven't been sent, oldest first.
+// Sent messages that have expired are removed.
+func (s *store) Pending(limit int) ([]outbox.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]outbox.Message, 0)
+	for id, m := range s.messages {
+		if expired(m) {
+			delete(s.messages, id)
+			continue
+		}
+
+		if m.Status == outbox.Pending {
+			msgs = append(msgs, m)
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+	})
+
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	return msgs, nil
+}
+
+// Update replaces the message with the same ID, to change its status.
+func (s *store) Update(m outbox.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages[m.ID] = m
+
+	return nil
+}
+
+// Get returns the message for the ID, or ErrNotFound.
+func (s *store) Get(id string) (outbox.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.messages[id]
+	if !ok {
+		return outbox.Message{}, outbox.ErrNotFound
+	}
+
+	return m, nil
+}
+
+// expired returns true when the message has been sent and can be removed.
+func expired(m outbox.Message) bool {
+	return m.Status == outbox.Sent && !m.ExpiresAt.IsZero() && time.Now().After(m.ExpiresAt)
+}
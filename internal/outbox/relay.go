@@ -0,0 +1,157 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/retry"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+)
+
+const (
+	// DefaultBatchSize is the number of messages the relay sends at once.
+	DefaultBatchSize = 10
+
+	// DefaultMaxAttempts is the number of attempts that failed with a permanent
+	// error, after which the relay stops sending a message and marks it as failed.
+	// Messages that fail with a transient error are sent until they are accepted.
+	DefaultMaxAttempts = 5
+)
+
+// Relay sends the messages in the outbox using the EventEmitter, and keeps
+// track of their delivery status.
+type Relay struct {
+	store       Store
+	emitter     emitter.EventEmitter
+	batchSize   int
+	maxAttempts int
+	retention   time.Duration
+}
+
+// NewRelay creates a new Relay that drains the outbox in the store to the EventEmitter.
+func NewRelay(s Store, em emitter.EventEmitter) *Relay {
+	return &Relay{
+		store:       s,
+		emitter:     em,
+		batchSize:   DefaultBatchSize,
+		maxAttempts: DefaultMaxAttempts,
+		retention:   DefaultRetention,
+	}
+}
+
+// Drain sends the pending messages, oldest first, until none are left or the
+// context is done. It returns the number of messages that were sent. When some
+// messages could not be sent, they stay pending for the next time the outbox is
+// drained and Drain returns an error. A message is marked as sent only after the
+// EventEmitter accepted it, so a message can be sent more than once when the
+// service stops in between; consumers use its ID to drop the duplicate.
+func (r *Relay) Drain(ctx context.Context) (int, error) {
+	sent := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+
+		msgs, err := r.store.Pending(r.batchSize)
+		if err != nil {
+			return sent, fmt.Errorf("error reading outbox: %s", err.Error())
+		}
+
+		if len(msgs) == 0 {
+			return sent, nil
+		}
+
+		n, err := r.send(ctx, msgs)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// Run drains the outbox every interval, until the context is done. Errors are
+// logged, except while the circuit breaker is open as it logs its own changes,
+// and the messages are sent again the next time.
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Drain(ctx); err != nil && ctx.Err() == nil && !errors.Is(err, retry.ErrCircuitOpen) {
+			log.Printf("error draining outbox: %s", redact.String(err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends the messages in a single batch and updates their status. It returns
+// the number of messages that were sent, and an error if any of them was not.
+func (r *Relay) send(ctx context.Context, msgs []Message) (int, error) {
+	events := make([]emitter.Event, len(msgs))
+	for i := range msgs {
+		events[i] = msgs[i]
+	}
+
+	sendErr := r.emitter.SendBatch(ctx, events)
+
+	// Nothing was attempted while the circuit breaker is open, so the
+	// messages stay as they are. When it opened after a failed attempt,
+	// the error wraps ErrCircuitOpen and the attempt counts.
+	if sendErr == retry.ErrCircuitOpen {
+		return 0, sendErr
+	}
+
+	// Find out which messages were not sent
+	failed := make(map[int]error)
+	var berr *emitter.BatchError
+	switch {
+	case sendErr == nil:
+	case errors.As(sendErr, &berr):
+		for _, f := range berr.Failed {
+			failed[f.Index] = f
+		}
+	default:
+		for i := range msgs {
+			failed[i] = sendErr
+		}
+	}
+
+	now := time.Now()
+	sent := 0
+	for i, m := range msgs {
+		m.UpdatedAt = now
+
+		if reason, ok := failed[i]; ok {
+			m.Attempts++
+			m.LastError = redact.String(reason.Error())
+			if m.Attempts >= r.maxAttempts && !retry.Retriable(reason) && !errors.Is(reason, retry.ErrCircuitOpen) {
+				m.Status = Failed
+				log.Printf("outbox message %s failed %d times and is not sent again: %s", redact.String(m.ID), m.Attempts, m.LastError)
+			}
+		} else {
+			m.Status = Sent
+			m.ExpiresAt = now.Add(r.retention)
+			sent++
+		}
+
+		if err := r.store.Update(m); err != nil {
+			return sent, fmt.Errorf("error updating outbox message %s: %s", m.ID, err.Error())
+		}
+	}
+
+	if sendErr != nil {
+		return sent, fmt.Errorf("error sending %d outbox messages: %s", len(failed), redact.String(sendErr.Error()))
+	}
+
+	return sent, nil
+}
@@ -0,0 +1,204 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/emitter/retry"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	"github.com/retgits/acme-serverless-payment/internal/outbox/memory"
+)
+
+// fake is an EventEmitter that returns the errors in order, one for every
+// batch, and accepts every batch once they run out.
+type fake struct {
+	errs    []error
+	batches int
+}
+
+func (f *fake) Send(ctx context.Context, e emitter.Event) error {
+	return f.SendBatch(ctx, []emitter.Event{e})
+}
+
+func (f *fake) SendBatch(ctx context.Context, events []emitter.Event) error {
+	f.batches++
+	if len(f.errs) == 0 {
+		return nil
+	}
+
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+// throttled is an error that is retriable.
+var throttled = &emitter.EntryError{Code: "ThrottlingException"}
+
+// newStore returns a store with n pending messages, the oldest first.
+func newStore(t *testing.T, n int) outbox.Store {
+	t.Helper()
+
+	s := memory.New()
+	for i := 0; i < n; i++ {
+		err := s.Add(outbox.Message{
+			ID:        fmt.Sprintf("msg-%d", i),
+			Event:     []byte("{}"),
+			Status:    outbox.Pending,
+			CreatedAt: time.Now().Add(time.Duration(i) * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+// get returns the message for the ID from the store.
+func get(t *testing.T, s outbox.Store, id string) outbox.Message {
+	t.Helper()
+
+	m, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestDrain(t *testing.T) {
+	s := newStore(t, 25)
+	em := &fake{}
+
+	sent, err := outbox.NewRelay(s, em).Drain(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 25 || em.batches != 3 {
+		t.Errorf("Drain() sent %d messages in %d batches, want 25 in 3", sent, em.batches)
+	}
+
+	if m := get(t, s, "msg-24"); m.Status != outbox.Sent || m.ExpiresAt.IsZero() {
+		t.Errorf("message is %s and expires at %s after it was sent, want sent with an expiry", m.Status, m.ExpiresAt)
+	}
+}
+
+func TestDrainPartialFailure(t *testing.T) {
+	s := newStore(t, 3)
+	em := &fake{errs: []error{&emitter.BatchError{Failed: []*emitter.EntryError{{Index: 1, Code: "ValidationError"}}}}}
+
+	sent, err := outbox.NewRelay(s, em).Drain(context.Background())
+	if err == nil {
+		t.Fatal("Drain() returned no error")
+	}
+
+	if sent != 2 {
+		t.Errorf("Drain() sent %d messages, want 2", sent)
+	}
+
+	for id, want := range map[string]outbox.Status{"msg-0": outbox.Sent, "msg-1": outbox.Pending, "msg-2": outbox.Sent} {
+		if m := get(t, s, id); m.Status != want {
+			t.Errorf("message %s is %s, want %s", id, m.Status, want)
+		}
+	}
+
+	if m := get(t, s, "msg-1"); m.Attempts != 1 || len(m.LastError) == 0 {
+		t.Errorf("failed message has %d attempts and error %q, want 1 attempt with its error", m.Attempts, m.LastError)
+	}
+}
+
+func TestDrainFailure(t *testing.T) {
+	s := newStore(t, 3)
+	em := &fake{errs: []error{errors.New("connection refused")}}
+
+	sent, err := outbox.NewRelay(s, em).Drain(context.Background())
+	if err == nil {
+		t.Fatal("Drain() returned no error")
+	}
+
+	if sent != 0 {
+		t.Errorf("Drain() sent %d messages, want 0", sent)
+	}
+
+	for _, id := range []string{"msg-0", "msg-1", "msg-2"} {
+		if m := get(t, s, id); m.Status != outbox.Pending || m.Attempts != 1 {
+			t.Errorf("message %s is %s after %d attempts, want pending after 1", id, m.Status, m.Attempts)
+		}
+	}
+
+	// The messages are sent the next time the outbox is drained
+	if sent, err := outbox.NewRelay(s, em).Drain(context.Background()); err != nil || sent != 3 {
+		t.Errorf("Drain() = %d, %v, want 3 messages sent", sent, err)
+	}
+}
+
+func TestDrainWhileCircuitIsOpen(t *testing.T) {
+	s := newStore(t, 1)
+	em := retry.New(&fake{errs: []error{throttled}}, retry.Config{MaxAttempts: 3, FailureThreshold: 1, OpenTimeout: time.Minute})
+	r := outbox.NewRelay(s, em)
+
+	// The circuit breaker opens after the first attempt, which counts
+	if _, err := r.Drain(context.Background()); err == nil {
+		t.Fatal("Drain() returned no error")
+	}
+
+	if m := get(t, s, "msg-0"); m.Status != outbox.Pending || m.Attempts != 1 {
+		t.Fatalf("message is %s after %d attempts, want pending after 1", m.Status, m.Attempts)
+	}
+
+	// Nothing is sent while the circuit breaker is open, so nothing changes
+	if _, err := r.Drain(context.Background()); !errors.Is(err, retry.ErrCircuitOpen) {
+		t.Fatalf("Drain() error = %v, want %v", err, retry.ErrCircuitOpen)
+	}
+
+	if m := get(t, s, "msg-0"); m.Status != outbox.Pending || m.Attempts != 1 {
+		t.Errorf("message is %s after %d attempts while the circuit breaker is open, want pending after 1", m.Status, m.Attempts)
+	}
+}
+
+func TestDrainMaxAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want outbox.Status
+	}{
+		{"permanent", "ValidationError", outbox.Failed},
+		{"transient", "ThrottlingException", outbox.Pending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t, 1)
+
+			em := &fake{}
+			for i := 0; i < outbox.DefaultMaxAttempts+1; i++ {
+				em.errs = append(em.errs, &emitter.BatchError{Failed: []*emitter.EntryError{{Index: 0, Code: tt.code}}})
+			}
+
+			r := outbox.NewRelay(s, em)
+			for i := 0; i < outbox.DefaultMaxAttempts+1; i++ {
+				r.Drain(context.Background())
+			}
+
+			// Failed messages are not sent again
+			m := get(t, s, "msg-0")
+			if m.Status != tt.want {
+				t.Errorf("message is %s after %d attempts, want %s", m.Status, m.Attempts, tt.want)
+			}
+
+			want := outbox.DefaultMaxAttempts + 1
+			if tt.want == outbox.Failed {
+				want = outbox.DefaultMaxAttempts
+			}
+
+			if m.Attempts != want {
+				t.Errorf("message was attempted %d times, want %d", m.Attempts, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	"github.com/retgits/acme-serverless-payment/internal/money"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+)
+
+var (
+	// ErrIllegalTransition is returned when an action isn't allowed in
+	// the current state of the payment, like a refund before capture.
+	ErrIllegalTransition = errors.New("action is not allowed in the current state of the payment")
+
+	// ErrAmountExceeded is returned when the amount to capture or refund
+	// is more than what is available.
+	ErrAmountExceeded = errors.New("amount exceeds the available amount")
+
+	// ErrOrderMismatch is returned when the transaction doesn't belong to
+	// the order in the request.
+	ErrOrderMismatch = errors.New("transaction does not belong to the order")
+)
+
+// maxTransitionAttempts is the number of times an action is attempted when the
+// payment keeps being changed by other requests at the same time.
+const maxTransitionAttempts = 5
+
+// action describes a single step in the lifecycle of a payment.
+type action struct {
+	// name is the name of the action in its idempotency keys.
+	name string
+
+	// source is the function the resulting event comes from.
+	source string
+
+	// eventName is the type of the resulting event.
+	eventName string
+
+	// from contains the states the payment must be in to allow the action.
+	from []ledger.State
+
+	// apply updates the entry for the requested amount. The amount is nil
+	// when no amount was requested. It returns the amount of the action.
+	apply func(e *ledger.Entry, amount *money.Money) (money.Money, error)
+}
+
+var (
+	// capture moves authorized funds to captured.
+	capture = action{
+		name:      "capture",
+		source:    "CapturePayment",
+		eventName: events.PaymentCapturedEventName,
+		from:      []ledger.State{ledger.StateAuthorized},
+		apply: func(e *ledger.Entry, amount *money.Money) (money.Money, error) {
+			authorized, err := money.Parse(e.AuthorizedAmount, e.Currency)
+			if err != nil {
+				return money.Money{}, err
+			}
+			if amount == nil {
+				amount = &authorized
+			}
+			cmp, err := amount.Cmp(authorized)
+			if err != nil {
+				return money.Money{}, err
+			}
+			if cmp > 0 {
+				return money.Money{}, ErrAmountExceeded
+			}
+			e.CapturedAmount = amount.String()
+			e.State = ledger.StateCaptured
+			return *amount, nil
+		},
+	}
+
+	// void releases authorized funds that haven't been captured.
+	void = action{
+		name:      "void",
+		source:    "VoidPayment",
+		eventName: events.PaymentVoidedEventName,
+		from:      []ledger.State{ledger.StateAuthorized},
+		apply: func(e *ledger.Entry, amount *money.Money) (money.Money, error) {
+			e.State = ledger.StateVoided
+			return money.Money{Currency: e.Currency}, nil
+		},
+	}
+
+	// refund returns captured funds, in one or more parts.
+	refund = action{
+		name:      "refund",
+		source:    "RefundPayment",
+		eventName: events.PaymentRefundedEventName,
+		from:      []ledger.State{ledger.StateCaptured, ledger.StatePartiallyRefunded},
+		apply: func(e *ledger.Entry, amount *money.Money) (money.Money, error) {
+			captured, err := money.Parse(e.CapturedAmount, e.Currency)
+			if err != nil {
+				return money.Money{}, err
+			}
+			refunded := money.Money{Currency: captured.Currency}
+			if len(e.RefundedAmount) > 0 {
+				if refunded, err = money.Parse(e.RefundedAmount, e.Currency); err != nil {
+					return money.Money{}, err
+				}
+			}
+			remaining, _ := captured.Sub(refunded)
+			if amount == nil {
+				amount = &remaining
+			}
+			cmp, err := amount.Cmp(remaining)
+			if err != nil {
+				return money.Money{}, err
+			}
+			if cmp > 0 {
+				return money.Money{}, ErrAmountExceeded
+			}
+			total, _ := refunded.Add(*amount)
+			e.RefundedAmount = total.String()
+			e.State = ledger.StatePartiallyRefunded
+			if cmp, _ := total.Cmp(captured); cmp == 0 {
+				e.State = ledger.StateRefunded
+			}
+			return *amount, nil
+		},
+	}
+
+	// approveReview authorizes a payment that was held for review. Payments
+	// are authorized regardless of how they were requested, so they are
+	// captured, or voided, like any other authorized payment.
+	approveReview = action{
+		name:      "approve",
+		source:    "ApprovePayment",
+		eventName: events.PaymentApprovedEventName,
+		from:      []ledger.State{ledger.StateReview},
+		apply: func(e *ledger.Entry, amount *money.Money) (money.Money, error) {
+			authorized, err := money.Parse(e.Amount, e.Currency)
+			if err != nil {
+				return money.Money{}, err
+			}
+			e.Success = true
+			e.Status = acmeserverless.DefaultSuccessStatus
+			e.AuthorizedAmount = authorized.String()
+			e.State = ledger.StateAuthorized
+			return authorized, nil
+		},
+	}
+
+	// rejectReview declines a payment that was held for review.
+	rejectReview = action{
+		name:      "reject",
+		source:    "RejectPayment",
+		eventName: events.PaymentRejectedEventName,
+		from:      []ledger.State{ledger.StateReview},
+		apply: func(e *ledger.Entry, amount *money.Money) (money.Money, error) {
+			e.Status = acmeserverless.DefaultErrorStatus
+			e.Reason = "payment was rejected in review"
+			e.DeclineCodes = append(e.DeclineCodes, string(validator.CodeRiskDeclined))
+			e.State = ledger.StateDeclined
+			return money.Money{Currency: e.Currency}, nil
+		},
+	}
+)
+
+// Authorize validates the creditcard in the request and, when it passes validation, holds
+// the total amount so it can be captured later. The resulting PaymentAuthorized event is
+// sent and returned. A creditcard that doesn't pass validation is not an error, it results
+// in a PaymentAuthorized event that isn't successful. The method returns an error if the
+// event could not be sent.
+func (s *Service) Authorize(ctx context.Context, req events.PaymentRequestedEvent) (events.PaymentEvent, error) {
+	if s.ledger == nil {
+		return events.PaymentEvent{}, handleError("authorizing payment", ErrNoLedger)
+	}
+
+	var evt events.PaymentEvent
+	var entry ledger.Entry
+
+	generate := func() error {
+		validated, res := s.validate(ctx, req)
+
+		entry = s.entry(validated, res)
+		if entry.Success {
+			entry.AuthorizedAmount = entry.Amount
+			entry.State = ledger.StateAuthorized
+		}
+
+		evt = events.PaymentEvent{
+			Metadata: acmeserverless.Metadata{
+				Domain: acmeserverless.PaymentDomain,
+				Source: "AuthorizePayment",
+				Type:   events.PaymentAuthorizedEventName,
+				Status: validated.Metadata.Status,
+			},
+			Data: events.PaymentDetails{
+				Success:       validated.Data.Success,
+				Status:        validated.Data.Status,
+				Message:       validated.Data.Message,
+				TransactionID: validated.Data.TransactionID,
+				OrderID:       entry.OrderID,
+				Amount:        entry.Amount,
+				Currency:      entry.Currency,
+				Card:          entry.Card,
+				CardToken:     entry.CardToken,
+				State:         string(entry.State),
+				Declines:      validated.Data.Declines,
+				Risk:          validated.Data.Risk,
+			},
+		}
+		if entry.Success {
+			evt.Data.AuthorizedAmount = entry.AuthorizedAmount
+		}
+		return nil
+	}
+
+	key, err := s.requestKey(req, "authorize/")
+	if err != nil {
+		return evt, err
+	}
+
+	err = s.processOnce(ctx, key, &evt, generate, &entry)
+
+	return evt, err
+}
+
+// Capture captures the amount in the request, or the entire authorized amount if no amount
+// is given, of an authorized payment. The resulting PaymentCaptured event is sent and returned.
+func (s *Service) Capture(ctx context.Context, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	return s.transition(ctx, capture, req)
+}
+
+// Void releases an authorized payment that hasn't been captured. The resulting PaymentVoided
+// event is sent and returned.
+func (s *Service) Void(ctx context.Context, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	return s.transition(ctx, void, req)
+}
+
+// Refund refunds the amount in the request, or the entire remaining captured amount if no
+// amount is given, of a captured payment. The resulting PaymentRefunded event is sent and
+// returned.
+func (s *Service) Refund(ctx context.Context, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	return s.transition(ctx, refund, req)
+}
+
+// Approve authorizes a payment that was held for review, so it can be captured. The
+// resulting PaymentApproved event is sent and returned.
+func (s *Service) Approve(ctx context.Context, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	return s.transition(ctx, approveReview, req)
+}
+
+// Reject declines a payment that was held for review. The resulting PaymentRejected
+// event is sent and returned.
+func (s *Service) Reject(ctx context.Context, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	return s.transition(ctx, rejectReview, req)
+}
+
+// transition performs the action on the payment in the request. An action that isn't
+// allowed is not an error, it results in an event that isn't successful and carries the
+// reason in its message. A request with a request ID is performed once: when it arrives
+// again, the original event is returned. The method returns an error if the ledger could
+// not be used or the event could not be sent.
+func (s *Service) transition(ctx context.Context, a action, req events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+	evt := events.PaymentEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: a.source,
+			Type:   a.eventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: events.PaymentDetails{
+			Success:       true,
+			Status:        http.StatusOK,
+			Message:       acmeserverless.DefaultSuccessStatus,
+			TransactionID: req.Data.TransactionID,
+			OrderID:       req.Data.OrderID,
+		},
+	}
+
+	if s.ledger == nil {
+		return evt, handleError(fmt.Sprintf("performing %s", a.source), ErrNoLedger)
+	}
+
+	key := idempotency.ActionKey(a.name, req)
+
+	generate := func() error {
+		return s.perform(a, req, key, &evt)
+	}
+
+	err := s.processOnce(ctx, key, &evt, generate, nil)
+
+	return evt, err
+}
+
+// perform performs the action on the payment in the ledger and updates the event with
+// the outcome. The idempotency key of the request, if any, is recorded in the entry with
+// the action, so an action that was performed before isn't performed again. When the
+// payment is changed by another request while the action is performed, the action is
+// performed again in the new state of the payment. The method returns an error if the
+// ledger could not be used.
+func (s *Service) perform(a action, req events.PaymentActionRequestedEvent, key string, evt *events.PaymentEvent) error {
+	var entry ledger.Entry
+	for attempt := 1; ; attempt++ {
+		var err error
+		entry, err = s.ledger.Get(req.Data.TransactionID)
+		if err == ledger.ErrNotFound {
+			reject(evt, http.StatusNotFound, err)
+			return nil
+		}
+		if err != nil {
+			return handleError("looking up ledger entry", err)
+		}
+
+		// The action was performed by an earlier delivery of the request
+		if performed, ok := entry.Actions[key]; ok && len(key) > 0 {
+			evt.Data.Amount = performed
+			break
+		}
+
+		amount, err := s.apply(a, &entry, req)
+		if err != nil {
+			reject(evt, statusFor(err), err)
+			break
+		}
+
+		var performed string
+		if !amount.IsZero() {
+			performed = amount.String()
+		}
+		// The map is copied, so the entry that was read is left as it is
+		if len(key) > 0 {
+			actions := make(map[string]string, len(entry.Actions)+1)
+			for k, v := range entry.Actions {
+				actions[k] = v
+			}
+			actions[key] = performed
+			entry.Actions = actions
+		}
+
+		entry.UpdatedAt = time.Now()
+		err = s.ledger.Record(entry)
+		if err == ledger.ErrConflict && attempt < maxTransitionAttempts {
+			// The payment was changed since it was read, so the action
+			// is checked again in its new state
+			continue
+		}
+		if err != nil {
+			return handleError("recording ledger entry", err)
+		}
+
+		evt.Data.Amount = performed
+		break
+	}
+
+	evt.Data.OrderID = entry.OrderID
+	evt.Data.Currency = entry.Currency
+	evt.Data.State = string(entry.State)
+	evt.Data.AuthorizedAmount = entry.AuthorizedAmount
+	evt.Data.CapturedAmount = entry.CapturedAmount
+	evt.Data.RefundedAmount = entry.RefundedAmount
+
+	return nil
+}
+
+// apply checks whether the action is allowed for the entry and the request,
+// and updates the entry accordingly. It returns the amount of the action.
+func (s *Service) apply(a action, entry *ledger.Entry, req events.PaymentActionRequestedEvent) (money.Money, error) {
+	if len(req.Data.OrderID) > 0 && req.Data.OrderID != entry.OrderID {
+		return money.Money{}, ErrOrderMismatch
+	}
+
+	allowed := false
+	for _, state := range a.from {
+		if entry.State == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return money.Money{}, ErrIllegalTransition
+	}
+
+	var amount *money.Money
+	if len(req.Data.Amount) > 0 {
+		m, err := money.Parse(req.Data.Amount, entry.Currency)
+		if err != nil {
+			return money.Money{}, fmt.Errorf("amount %q is not valid: %s", req.Data.Amount, err.Error())
+		}
+		if m.IsZero() {
+			return money.Money{}, fmt.Errorf("amount %q is not valid: amount must be more than zero", req.Data.Amount)
+		}
+		amount = &m
+	}
+
+	return a.apply(entry, amount)
+}
+
+// reject updates the event to indicate the action didn't succeed.
+func reject(evt *events.PaymentEvent, status int, err error) {
+	evt.Metadata.Status = acmeserverless.DefaultErrorStatus
+	evt.Data.Success = false
+	evt.Data.Status = status
+	evt.Data.Message = err.Error()
+}
+
+// statusFor returns the HTTP statuscode that matches the reason an action didn't succeed.
+func statusFor(err error) int {
+	switch err {
+	case ErrIllegalTransition:
+		return http.StatusConflict
+	case ledger.ErrNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,336 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+	idempotencymemory "github.com/retgits/acme-serverless-payment/internal/idempotency/memory"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	ledgermemory "github.com/retgits/acme-serverless-payment/internal/ledger/memory"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+)
+
+// newLedger returns a ledger with a payment in the state, of which the amount
+// was authorized when it's authorized, and captured when it's captured.
+func newLedger(t *testing.T, state ledger.State, amount string) ledger.Store {
+	t.Helper()
+
+	e := ledger.Entry{
+		TransactionID: "txn-1",
+		OrderID:       "order-1",
+		Amount:        amount,
+		Currency:      "USD",
+		Success:       state != ledger.StateReview,
+		State:         state,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	switch state {
+	case ledger.StateAuthorized:
+		e.AuthorizedAmount = amount
+	case ledger.StateCaptured:
+		e.AuthorizedAmount = amount
+		e.CapturedAmount = amount
+	}
+
+	l := ledgermemory.New()
+	if err := l.Record(e); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+// actionRequest returns the request for an action on the payment in the
+// ledger of newLedger.
+func actionRequest(amount string) events.PaymentActionRequestedEvent {
+	return events.PaymentActionRequestedEvent{
+		Data: events.PaymentActionDetails{
+			TransactionID: "txn-1",
+			OrderID:       "order-1",
+			Amount:        amount,
+		},
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	em := &recorder{}
+	s := New(validator.New(), em, WithLedger(ledgermemory.New()))
+
+	authorized, err := s.Authorize(context.Background(), paymentRequest("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !authorized.Data.Success || authorized.Data.State != string(ledger.StateAuthorized) || authorized.Data.AuthorizedAmount != "10.00" {
+		t.Fatalf("Authorize() = %+v, want 10.00 authorized", authorized.Data)
+	}
+
+	req := func(amount string) events.PaymentActionRequestedEvent {
+		r := actionRequest(amount)
+		r.Data.TransactionID = authorized.Data.TransactionID
+		return r
+	}
+
+	steps := []struct {
+		name   string
+		action func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error)
+		amount string
+		state  ledger.State
+	}{
+		{"capture part", s.Capture, "6.00", ledger.StateCaptured},
+		{"refund part", s.Refund, "2.50", ledger.StatePartiallyRefunded},
+		{"refund the rest", s.Refund, "", ledger.StateRefunded},
+	}
+
+	for _, step := range steps {
+		evt, err := step.action(context.Background(), req(step.amount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !evt.Data.Success || evt.Data.State != string(step.state) {
+			t.Errorf("%s = %+v, want state %s", step.name, evt.Data, step.state)
+		}
+	}
+
+	if evt, _ := s.Refund(context.Background(), req("")); evt.Data.Success {
+		t.Errorf("refund of a refunded payment = %+v, want it declined", evt.Data)
+	}
+
+	// Every action results in an event, including the one that was declined
+	if len(em.sent) != 5 {
+		t.Errorf("sent %d events, want 5", len(em.sent))
+	}
+}
+
+func TestDeclinedActions(t *testing.T) {
+	capture := func(s *Service) func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+		return s.Capture
+	}
+	void := func(s *Service) func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+		return s.Void
+	}
+	refund := func(s *Service) func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error) {
+		return s.Refund
+	}
+
+	otherOrder := actionRequest("")
+	otherOrder.Data.OrderID = "order-2"
+
+	unknown := actionRequest("")
+	unknown.Data.TransactionID = "txn-2"
+
+	tests := []struct {
+		name   string
+		state  ledger.State
+		action func(*Service) func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error)
+		req    events.PaymentActionRequestedEvent
+		status int
+	}{
+		{"capture more than authorized", ledger.StateAuthorized, capture, actionRequest("100.01"), http.StatusBadRequest},
+		{"capture a captured payment", ledger.StateCaptured, capture, actionRequest(""), http.StatusConflict},
+		{"void a captured payment", ledger.StateCaptured, void, actionRequest(""), http.StatusConflict},
+		{"refund an authorized payment", ledger.StateAuthorized, refund, actionRequest(""), http.StatusConflict},
+		{"refund more than captured", ledger.StateCaptured, refund, actionRequest("100.01"), http.StatusBadRequest},
+		{"refund a malformed amount", ledger.StateCaptured, refund, actionRequest("1.234"), http.StatusBadRequest},
+		{"refund the payment of another order", ledger.StateCaptured, refund, otherOrder, http.StatusBadRequest},
+		{"refund an unknown payment", ledger.StateCaptured, refund, unknown, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger(t, tt.state, "100.00")
+			s := New(validator.New(), nil, WithLedger(l))
+
+			evt, err := tt.action(s)(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evt.Data.Success || evt.Data.Status != tt.status {
+				t.Errorf("%s = %+v, want declined with status %d", tt.name, evt.Data, tt.status)
+			}
+
+			// The payment is left as it was
+			if e, _ := l.Get("txn-1"); e.State != tt.state {
+				t.Errorf("ledger entry is in state %s, want %s", e.State, tt.state)
+			}
+		})
+	}
+}
+
+func TestConcurrentRefundsDontExceedCapturedAmount(t *testing.T) {
+	l := newLedger(t, ledger.StateCaptured, "100.00")
+	s := New(validator.New(), nil, WithLedger(l))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	refunded := 0
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			evt, err := s.Refund(context.Background(), actionRequest("20.00"))
+			if err == nil && evt.Data.Success {
+				mu.Lock()
+				refunded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	e, err := l.Get("txn-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refunded == 0 || refunded > 5 {
+		t.Errorf("%d refunds of 20.00 succeeded for a payment of 100.00", refunded)
+	}
+	if want := fmt.Sprintf("%d.00", 20*refunded); e.RefundedAmount != want {
+		t.Errorf("ledger has %s refunded after %d refunds of 20.00", e.RefundedAmount, refunded)
+	}
+}
+
+func TestRefundWithRequestIDIsPerformedOnce(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"idempotency store", []Option{WithIdempotencyStore(idempotencymemory.New(), idempotency.DefaultTTL, secret)}},
+		// The ledger entry keeps track of the request when the idempotency
+		// record is lost, or was never saved
+		{"ledger only", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger(t, ledger.StateCaptured, "100.00")
+			s := New(validator.New(), nil, append(tt.opts, WithLedger(l))...)
+
+			req := actionRequest("20.00")
+			req.Data.RequestID = "refund-1"
+
+			first, err := s.Refund(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			again, err := s.Refund(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !again.Data.Success || again.Data.Amount != first.Data.Amount || again.Data.Amount != "20.00" {
+				t.Errorf("Refund() of the same request = %+v, want %+v", again.Data, first.Data)
+			}
+
+			// Another request refunds again
+			req.Data.RequestID = "refund-2"
+			if _, err := s.Refund(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			if e, _ := l.Get("txn-1"); e.RefundedAmount != "40.00" {
+				t.Errorf("ledger has %s refunded, want 40.00", e.RefundedAmount)
+			}
+		})
+	}
+}
+
+func TestRejectedActionIsReplayed(t *testing.T) {
+	l := newLedger(t, ledger.StateAuthorized, "100.00")
+	s := New(validator.New(), nil, WithLedger(l), WithIdempotencyStore(idempotencymemory.New(), idempotency.DefaultTTL, secret))
+
+	req := actionRequest("")
+	req.Data.RequestID = "refund-1"
+
+	evt, err := s.Refund(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Data.Success {
+		t.Fatalf("Refund() of an authorized payment succeeded")
+	}
+
+	// The payment is captured, but the same request still gets its original result
+	if _, err := s.Capture(context.Background(), actionRequest("")); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := s.Refund(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Data.Success || again.Data.Message != evt.Data.Message {
+		t.Errorf("Refund() of the same request = %+v, want %+v", again.Data, evt.Data)
+	}
+}
+
+func TestReview(t *testing.T) {
+	t.Run("approve", func(t *testing.T) {
+		l := newLedger(t, ledger.StateReview, "100.00")
+		s := New(validator.New(), nil, WithLedger(l))
+
+		evt, err := s.Approve(context.Background(), actionRequest(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !evt.Data.Success || evt.Data.State != string(ledger.StateAuthorized) || evt.Data.AuthorizedAmount != "100.00" {
+			t.Errorf("Approve() = %+v, want an authorized payment of 100.00", evt.Data)
+		}
+
+		evt, err = s.Capture(context.Background(), actionRequest(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !evt.Data.Success || evt.Data.CapturedAmount != "100.00" {
+			t.Errorf("Capture() of an approved payment = %+v, want 100.00 captured", evt.Data)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		l := newLedger(t, ledger.StateReview, "100.00")
+		s := New(validator.New(), nil, WithLedger(l))
+
+		evt, err := s.Reject(context.Background(), actionRequest(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !evt.Data.Success || evt.Data.State != string(ledger.StateDeclined) {
+			t.Errorf("Reject() = %+v, want a declined payment", evt.Data)
+		}
+
+		evt, err = s.Capture(context.Background(), actionRequest(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evt.Data.Success {
+			t.Errorf("Capture() of a rejected payment succeeded")
+		}
+	})
+
+	t.Run("not held", func(t *testing.T) {
+		l := newLedger(t, ledger.StateAuthorized, "100.00")
+		s := New(validator.New(), nil, WithLedger(l))
+
+		for name, action := range map[string]func(context.Context, events.PaymentActionRequestedEvent) (events.PaymentEvent, error){
+			"Approve": s.Approve,
+			"Reject":  s.Reject,
+		} {
+			evt, err := action(context.Background(), actionRequest(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evt.Data.Success {
+				t.Errorf("%s() of an authorized payment succeeded", name)
+			}
+		}
+	})
+}
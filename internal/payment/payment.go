@@ -0,0 +1,735 @@
+// Package payment contains the business logic of the Payment service. It turns
+// PaymentRequested events into CreditCardValidated events, regardless of whether
+// the request arrived over SQS, EventBridge, or HTTP, and manages the lifecycle
+// of payments after that.
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gofrs/uuid"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	"github.com/retgits/acme-serverless-payment/internal/outbox"
+	"github.com/retgits/acme-serverless-payment/internal/redact"
+	"github.com/retgits/acme-serverless-payment/internal/risk"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	"github.com/retgits/acme-serverless-payment/internal/vault"
+	"github.com/retgits/acme-serverless-payment/internal/velocity"
+	"github.com/retgits/creditcard"
+)
+
+var (
+	// ErrNoLedger is returned when an action needs the ledger, but the
+	// service doesn't have one.
+	ErrNoLedger = errors.New("payment service has no ledger")
+
+	// ErrMalformedRequest is returned by Handle when the event could not be
+	// parsed. Handling the same event again fails in the same way.
+	ErrMalformedRequest = errors.New("payment request is malformed")
+
+	// ErrInProgress is returned when another delivery of the same request is
+	// sending its event. The request should be delivered again later, when
+	// the event has been sent, or the other delivery gave up.
+	ErrInProgress = errors.New("payment request is being processed by another delivery")
+)
+
+// Service validates payments and sends the results using an EventEmitter.
+type Service struct {
+	validator validator.Validator
+	emitter   emitter.EventEmitter
+	store     idempotency.Store
+	ttl       time.Duration
+	secret    []byte
+	ledger    ledger.Store
+	scorer    risk.Scorer
+	limiter   *velocity.Limiter
+	vault     vault.Vault
+	outbox    outbox.Store
+}
+
+// Option configures optional dependencies of the payment service.
+type Option func(*Service)
+
+// WithIdempotencyStore configures the service to record the result of every payment
+// request in the store, so a redelivered request returns the original result. Records
+// are kept for the given time to live. The keys of the records are derived with the
+// secret, which must be the same for every instance that shares the store.
+func WithIdempotencyStore(store idempotency.Store, ttl time.Duration, secret []byte) Option {
+	return func(s *Service) {
+		s.store = store
+		s.ttl = ttl
+		s.secret = secret
+	}
+}
+
+// WithLedger configures the service to record every validation attempt in the ledger.
+// The ledger is needed to authorize, capture, void, and refund payments.
+func WithLedger(l ledger.Store) Option {
+	return func(s *Service) {
+		s.ledger = l
+	}
+}
+
+// WithRiskScorer configures the service to assess the risk of every payment that passes
+// validation. Depending on the assessment, payments are approved, held for review, or declined.
+func WithRiskScorer(r risk.Scorer) Option {
+	return func(s *Service) {
+		s.scorer = r
+	}
+}
+
+// WithVelocityLimiter configures the service to count every payment attempt and decline
+// attempts that exceed the limits per creditcard, order, or client.
+func WithVelocityLimiter(l *velocity.Limiter) Option {
+	return func(s *Service) {
+		s.limiter = l
+	}
+}
+
+// WithVault configures the service to exchange the creditcard of every payment of a customer
+// that passes validation for a token, and to accept payments that reference a token of the
+// customer instead of a creditcard.
+func WithVault(v vault.Vault) Option {
+	return func(s *Service) {
+		s.vault = v
+	}
+}
+
+// WithOutbox configures the service to write every event to the outbox instead of
+// sending it. A Relay sends the events in the outbox using the EventEmitter, so an
+// event is never lost when sending fails or the service stops before it is sent.
+func WithOutbox(o outbox.Store) Option {
+	return func(s *Service) {
+		s.outbox = o
+	}
+}
+
+// New creates a new instance of the payment service. The validator is used to check
+// the payment and the EventEmitter to send the resulting event. When the EventEmitter
+// is nil, the event is only returned to the caller.
+func New(v validator.Validator, em emitter.EventEmitter, opts ...Option) *Service {
+	s := &Service{
+		validator: v,
+		emitter:   em,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Handle determines the type of the JSON-encoded event and passes it to the method
+// that handles that type. Events with an unknown type are handled as PaymentRequested
+// events. The method returns an error if the event could not be parsed or handled. When
+// the event could not be parsed, the error wraps ErrMalformedRequest.
+func (s *Service) Handle(ctx context.Context, data []byte) error {
+	meta, err := events.UnmarshalMetadata(data)
+	if err != nil {
+		return malformed(handleError("unmarshaling metadata", err))
+	}
+
+	switch meta.Type {
+	case events.PaymentAuthorizationRequestedEventName:
+		req, err := events.UnmarshalPaymentRequestedEvent(data)
+		if err != nil {
+			return malformed(handleError("unmarshaling authorization", err))
+		}
+		_, err = s.Authorize(ctx, req)
+		return err
+	case events.PaymentCaptureRequestedEventName, events.PaymentVoidRequestedEventName, events.PaymentRefundRequestedEventName,
+		events.PaymentApproveRequestedEventName, events.PaymentRejectRequestedEventName:
+		req, err := events.UnmarshalPaymentActionRequestedEvent(data)
+		if err != nil {
+			return malformed(handleError("unmarshaling payment action", err))
+		}
+		switch meta.Type {
+		case events.PaymentCaptureRequestedEventName:
+			_, err = s.Capture(ctx, req)
+		case events.PaymentVoidRequestedEventName:
+			_, err = s.Void(ctx, req)
+		case events.PaymentApproveRequestedEventName:
+			_, err = s.Approve(ctx, req)
+		case events.PaymentRejectRequestedEventName:
+			_, err = s.Reject(ctx, req)
+		default:
+			_, err = s.Refund(ctx, req)
+		}
+		return err
+	default:
+		req, err := events.UnmarshalPaymentRequestedEvent(data)
+		if err != nil {
+			return malformed(handleError("unmarshaling payment", err))
+		}
+		_, err = s.Process(ctx, req)
+		return err
+	}
+}
+
+// Process validates the creditcard in the PaymentRequested event and sends the resulting
+// CreditCardValidated event. A creditcard that doesn't pass validation is not an error,
+// it results in a CreditCardValidated event that isn't successful. Payments that pass
+// validation are captured right away, unless their risk assessment holds them for review.
+// When the service has an idempotency store, a request for an order that was processed
+// before returns the original event. The method returns an error if the event could not
+// be sent.
+func (s *Service) Process(ctx context.Context, req events.PaymentRequestedEvent) (events.CreditCardValidatedEvent, error) {
+	var evt events.CreditCardValidatedEvent
+	var entry ledger.Entry
+
+	generate := func() error {
+		var res validator.Result
+		evt, res = s.validate(ctx, req)
+
+		entry = s.entry(evt, res)
+		if entry.Success {
+			entry.State = ledger.StateCaptured
+			entry.AuthorizedAmount = evt.Data.Amount
+			entry.CapturedAmount = evt.Data.Amount
+		}
+		return nil
+	}
+
+	key, err := s.requestKey(req, "")
+	if err != nil {
+		return evt, err
+	}
+
+	err = s.processOnce(ctx, key, &evt, generate, &entry)
+	if err != nil {
+		return evt, err
+	}
+
+	if evt.Data.Success {
+		sentry.CaptureMessage(fmt.Sprintf("validation successful for order %s", req.Data.OrderID))
+	}
+
+	return evt, nil
+}
+
+// validate checks the payment, assesses its risk, and generates the CreditCardValidated
+// event. The result contains the reasons the payment didn't pass validation, if any.
+func (s *Service) validate(ctx context.Context, req events.PaymentRequestedEvent) (events.CreditCardValidatedEvent, validator.Result) {
+	// Take the creditcard from the vault when the request references a token
+	stored := len(req.Data.CardToken) > 0
+	var tokenErr error
+	if stored {
+		req.Data.Card, tokenErr = s.detokenize(req.Data.CustomerID, req.Data.CardToken, req.Data.Card.CVV)
+	}
+
+	// Send a breadcrumb to Sentry with the validation request
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  acmeserverless.PaymentRequestedEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data: redact.Map(map[string]interface{}{
+			"OrderID":   req.Data.OrderID,
+			"Total":     req.Data.Total,
+			"Card":      req.Data.Card.Number,
+			"CardToken": req.Data.CardToken,
+		}),
+	})
+
+	// Generate the event to emit
+	evt := events.CreditCardValidatedEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "ValidateCreditCard",
+			Type:   acmeserverless.CreditCardValidatedEventName,
+			Status: acmeserverless.DefaultSuccessStatus,
+		},
+		Data: events.CreditCardValidationDetails{
+			CreditCardValidationDetails: acmeserverless.CreditCardValidationDetails{
+				Success:       true,
+				Status:        http.StatusOK,
+				Message:       acmeserverless.DefaultSuccessStatus,
+				Amount:        req.Data.Total,
+				OrderID:       req.Data.OrderID,
+				TransactionID: uuid.Must(uuid.NewV4()).String(),
+			},
+			Card:      redact.PAN(req.Data.Card.Number),
+			CardToken: req.Data.CardToken,
+		},
+	}
+
+	// Check the creditcard is valid.
+	// If the creditcard is not valid, update the event to emit
+	// with new information
+	var res validator.Result
+	if tokenErr != nil {
+		res.Add(validator.CodeInvalidToken, "cardToken", tokenErr.Error())
+	} else {
+		res = s.validator.Validate(validator.Payment{
+			Card:   req.Data.Card,
+			Amount: req.Data.Total,
+			Stored: stored,
+		})
+	}
+	evt.Data.Brand = string(res.Brand)
+	if res.Amount != nil {
+		evt.Data.Amount = res.Amount.String()
+		evt.Data.Currency = res.Amount.Currency
+	}
+	if s.limiter != nil {
+		s.limit(ctx, req, &res)
+	}
+	if s.scorer != nil {
+		s.assess(req, &evt, &res)
+	}
+	if !res.Valid() {
+		decline(&evt, res)
+	} else if !stored && s.vault != nil && len(req.Data.CustomerID) > 0 {
+		evt.Data.CardToken = s.tokenize(req.Data.CustomerID, req.Data.Card)
+	}
+
+	// Send a breadcrumb to Sentry with the validation result
+	sentry.AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  acmeserverless.CreditCardValidatedEventName,
+		Timestamp: time.Now(),
+		Level:     sentry.LevelInfo,
+		Data:      redact.Map(acmeserverless.ToSentryMap(evt.Data.CreditCardValidationDetails)),
+	})
+
+	return evt, res
+}
+
+// detokenize returns the creditcard of the customer for the token, with the cvv code
+// from the request. Tokens can only be used by the customer they belong to.
+func (s *Service) detokenize(customerID string, token string, cvv string) (creditcard.Card, error) {
+	if s.vault == nil {
+		return creditcard.Card{}, fmt.Errorf("card tokens are not supported")
+	}
+
+	if len(customerID) == 0 {
+		return creditcard.Card{}, fmt.Errorf("card tokens can only be used with a customer ID")
+	}
+
+	card, err := s.vault.Detokenize(customerID, token)
+	if err == vault.ErrNotFound {
+		return creditcard.Card{}, fmt.Errorf("card token is not known")
+	}
+	if err != nil {
+		handleError("detokenizing creditcard", err)
+		return creditcard.Card{}, fmt.Errorf("card token could not be used")
+	}
+
+	card.CVV = cvv
+	return card, nil
+}
+
+// tokenize exchanges the creditcard of the customer for a token. When the creditcard
+// can't be tokenized, the payment continues without a token.
+func (s *Service) tokenize(customerID string, card creditcard.Card) string {
+	token, err := s.vault.Tokenize(customerID, card)
+	if err != nil {
+		handleError("tokenizing creditcard", err)
+		return ""
+	}
+
+	return token
+}
+
+// limit counts the payment attempt and declines the payment when it exceeds a velocity
+// limit. Payments that exceed a limit result in a PaymentVelocityExceeded event as well.
+// When the attempt can't be counted, the payment isn't limited.
+func (s *Service) limit(ctx context.Context, req events.PaymentRequestedEvent, res *validator.Result) {
+	violations, err := s.limiter.Check(velocity.Attempt{
+		Card:     req.Data.Card.Number,
+		OrderID:  req.Data.OrderID,
+		ClientIP: req.Data.ClientIP,
+	})
+	if err != nil {
+		handleError("counting payment attempt", err)
+		return
+	}
+
+	if len(violations) == 0 {
+		return
+	}
+
+	evt := events.PaymentVelocityExceededEvent{
+		Metadata: acmeserverless.Metadata{
+			Domain: acmeserverless.PaymentDomain,
+			Source: "ValidateCreditCard",
+			Type:   events.PaymentVelocityExceededEventName,
+			Status: acmeserverless.DefaultErrorStatus,
+		},
+		Data: events.VelocityDetails{
+			OrderID:  req.Data.OrderID,
+			Card:     redact.PAN(req.Data.Card.Number),
+			ClientIP: req.Data.ClientIP,
+		},
+	}
+
+	fields := map[velocity.Dimension]string{
+		velocity.Card:   "number",
+		velocity.Order:  "orderID",
+		velocity.Client: "clientIP",
+	}
+
+	for _, v := range violations {
+		res.Add(validator.CodeVelocityExceeded, fields[v.Dimension], fmt.Sprintf("too many attempts for the %s: %d in %s, the limit is %d", v.Dimension, v.Count, v.Limit.Window, v.Limit.Max))
+		evt.Data.Limits = append(evt.Data.Limits, events.VelocityLimit{
+			Dimension: string(v.Dimension),
+			Count:     v.Count,
+			Max:       v.Limit.Max,
+			Window:    v.Limit.Window.String(),
+		})
+	}
+
+	// Failing to send the event doesn't change the outcome of the payment
+	s.send(ctx, "", &evt)
+}
+
+// assess scores the risk of a payment that passed validation and adds the assessment to
+// the CreditCardValidated event. Payments with a high risk are declined, and payments that
+// should be reviewed are held, which means they don't succeed but keep their transaction ID.
+// Payments that didn't pass validation aren't scored, but their outcome is still observed.
+func (s *Service) assess(req events.PaymentRequestedEvent, evt *events.CreditCardValidatedEvent, res *validator.Result) {
+	p := risk.Payment{
+		Card:        req.Data.Card.Number,
+		Amount:      res.Amount,
+		CustomerID:  req.Data.CustomerID,
+		Cardholder:  req.Data.Cardholder,
+		BillingName: req.Data.BillingName,
+	}
+
+	o, observe := s.scorer.(risk.Observer)
+
+	if !res.Valid() {
+		if observe {
+			o.Observe(p, risk.Declined)
+		}
+		return
+	}
+
+	a := s.scorer.Score(p)
+
+	evt.Data.Risk = &events.Risk{
+		Score:    a.Score,
+		Decision: string(a.Decision),
+	}
+	for _, signal := range a.Signals {
+		evt.Data.Risk.Signals = append(evt.Data.Risk.Signals, string(signal))
+	}
+
+	switch a.Decision {
+	case risk.Declined:
+		res.Add(validator.CodeRiskDeclined, "", fmt.Sprintf("payment has a risk score of %d", a.Score))
+	case risk.Review:
+		evt.Metadata.Status = string(risk.Review)
+		evt.Data.Success = false
+		evt.Data.Status = http.StatusAccepted
+		evt.Data.Message = "payment is held for review"
+	}
+
+	if observe {
+		o.Observe(p, a.Decision)
+	}
+}
+
+// decline updates the CreditCardValidated event with the reasons the payment didn't
+// pass validation.
+func decline(evt *events.CreditCardValidatedEvent, res validator.Result) {
+	evt.Metadata.Status = acmeserverless.DefaultErrorStatus
+	evt.Data.Success = false
+	evt.Data.Status = http.StatusBadRequest
+	evt.Data.Message = acmeserverless.DefaultErrorStatus
+	evt.Data.TransactionID = "-1"
+	evt.Data.Declines = declines(res)
+	handleError("validating creditcard", res.Err())
+}
+
+// declines converts the failed checks in the result to the declines of an event.
+func declines(res validator.Result) []events.Decline {
+	d := make([]events.Decline, len(res.Failures))
+	for i, f := range res.Failures {
+		d[i] = events.Decline{
+			Code:    string(f.Code),
+			Field:   f.Field,
+			Message: f.Message,
+		}
+	}
+	return d
+}
+
+// entry creates the ledger entry for the validation attempt. Attempts that didn't
+// pass validation don't have a transaction ID, so they get a unique identifier to
+// be stored under.
+func (s *Service) entry(evt events.CreditCardValidatedEvent, res validator.Result) ledger.Entry {
+	now := time.Now()
+
+	e := ledger.Entry{
+		TransactionID: evt.Data.TransactionID,
+		OrderID:       evt.Data.OrderID,
+		Amount:        evt.Data.Amount,
+		Currency:      evt.Data.Currency,
+		Card:          evt.Data.Card,
+		CardToken:     evt.Data.CardToken,
+		Brand:         evt.Data.Brand,
+		Success:       evt.Data.Success,
+		Status:        evt.Metadata.Status,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	if evt.Data.Risk != nil {
+		e.RiskScore = evt.Data.Risk.Score
+		e.RiskDecision = evt.Data.Risk.Decision
+		e.RiskSignals = evt.Data.Risk.Signals
+		if evt.Data.Risk.Decision == string(risk.Review) {
+			e.State = ledger.StateReview
+		}
+	}
+
+	if !res.Valid() {
+		e.TransactionID = uuid.Must(uuid.NewV4()).String()
+		e.Reason = res.Err().Error()
+		e.State = ledger.StateDeclined
+		for _, code := range res.Codes() {
+			e.DeclineCodes = append(e.DeclineCodes, string(code))
+		}
+	}
+
+	return e
+}
+
+// requestKey returns the idempotency key of the payment request, with the prefix that
+// distinguishes between different actions on the same request. Requests can't be matched
+// without an idempotency store or an order ID, so it returns an empty string for those.
+func (s *Service) requestKey(req events.PaymentRequestedEvent, prefix string) (string, error) {
+	if s.store == nil || len(req.Data.OrderID) == 0 {
+		return "", nil
+	}
+
+	key, err := idempotency.Key(s.secret, req)
+	if err != nil {
+		return "", handleError("generating idempotency key", err)
+	}
+
+	return prefix + key, nil
+}
+
+// processOnce makes sure the request with the idempotency key results in a single event.
+// It calls generate to fill in the event and the ledger entry, if any, records the entry
+// in the ledger, and sends the event. When the service has an idempotency store and the
+// request was processed before, the original event is decoded into evt instead. If the
+// entry of that request wasn't recorded, or its event wasn't sent yet, for example because
+// the ledger or sending failed, that is done now. The delivery that saves the record holds
+// a lease to send its event, so a delivery of the same request at the same time doesn't
+// send it as well. Requests without a key are always processed.
+func (s *Service) processOnce(ctx context.Context, key string, evt emitter.Event, generate func() error, entry *ledger.Entry) error {
+	useStore := s.store != nil && len(key) > 0
+
+	// Check whether this request has been processed before
+	if useStore {
+		rec, found, err := s.store.Lookup(key)
+		if err != nil {
+			return handleError("looking up idempotency record", err)
+		}
+
+		if found {
+			return s.replay(ctx, rec, evt)
+		}
+	}
+
+	if err := generate(); err != nil {
+		return err
+	}
+
+	// Record the result before sending it, so a redelivered request
+	// gets the same result even if sending fails
+	if useStore {
+		payload, err := evt.Marshal()
+		if err != nil {
+			return handleError("marshaling event", err)
+		}
+
+		var recorded []byte
+		if s.ledger != nil && entry != nil {
+			if recorded, err = json.Marshal(entry); err != nil {
+				return handleError("marshaling ledger entry", err)
+			}
+		}
+
+		now := time.Now()
+		err = s.store.Save(idempotency.Record{
+			Key:         key,
+			Event:       payload,
+			Entry:       recorded,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(s.ttl),
+			LeasedUntil: now.Add(idempotency.DefaultLease),
+		})
+		if err == idempotency.ErrRecordExists {
+			// Another delivery of the same request won the race
+			rec, found, err := s.store.Lookup(key)
+			if err != nil {
+				return handleError("looking up idempotency record", err)
+			}
+			if found {
+				return s.replay(ctx, rec, evt)
+			}
+		} else if err != nil {
+			return handleError("saving idempotency record", err)
+		}
+	}
+
+	// Record the attempt in the ledger
+	if s.ledger != nil && entry != nil {
+		if err := s.record(*entry); err != nil {
+			s.release(key)
+			return handleError("recording ledger entry", err)
+		}
+	}
+
+	return s.send(ctx, key, evt)
+}
+
+// replay decodes the event of a request that was processed before into evt. If the
+// ledger entry of that request wasn't recorded, or its event wasn't sent yet, for
+// example because the ledger or sending failed, that is done now. An event that
+// another delivery holds the lease for is left to that delivery, and ErrInProgress
+// is returned.
+func (s *Service) replay(ctx context.Context, rec idempotency.Record, evt emitter.Event) error {
+	if err := json.Unmarshal(rec.Event, evt); err != nil {
+		return handleError("unmarshaling idempotency record", err)
+	}
+
+	log.Printf("replaying result of %s", redact.String(rec.Key))
+
+	if s.ledger != nil && len(rec.Entry) > 0 {
+		var entry ledger.Entry
+		if err := json.Unmarshal(rec.Entry, &entry); err != nil {
+			return handleError("unmarshaling ledger entry", err)
+		}
+		if err := s.record(entry); err != nil {
+			return handleError("recording ledger entry", err)
+		}
+	}
+
+	if rec.Sent {
+		return nil
+	}
+
+	leased, err := s.store.Lease(rec.Key, time.Now().Add(idempotency.DefaultLease))
+	if err != nil {
+		return handleError("leasing idempotency record", err)
+	}
+	if !leased {
+		return ErrInProgress
+	}
+
+	return s.send(ctx, rec.Key, evt)
+}
+
+// record adds the new entry to the ledger. An entry that was recorded before, by an
+// earlier delivery of the same request, is left as it is.
+func (s *Service) record(entry ledger.Entry) error {
+	err := s.ledger.Record(entry)
+	if err == ledger.ErrConflict {
+		return nil
+	}
+
+	return err
+}
+
+// send sends the event using the EventEmitter and, when the event belongs to an
+// idempotency record, marks the record for the key as sent. The event is not sent
+// when the context is done, and the record is left unsent so it's sent on redelivery.
+// When sending fails, the lease on the record is released so a redelivery can send
+// the event right away. When the service has an outbox, the event is written to the
+// outbox instead. Without either, there is nothing to send, and the record is marked
+// as sent right away.
+func (s *Service) send(ctx context.Context, key string, evt emitter.Event) error {
+	switch {
+	case s.outbox != nil:
+		// Write the event to the outbox, so the relay sends it
+		if err := s.enqueue(key, evt); err != nil {
+			s.release(key)
+			return handleError("adding event to outbox", err)
+		}
+	case s.emitter != nil:
+		// Send the event using the EventEmitter
+		if err := s.emitter.Send(ctx, evt); err != nil {
+			s.release(key)
+			return handleError("sending event", err)
+		}
+	}
+
+	if s.store != nil && len(key) > 0 {
+		if err := s.store.MarkSent(key); err != nil {
+			handleError("marking idempotency record as sent", err)
+		}
+	}
+
+	return nil
+}
+
+// release releases the lease on the idempotency record for the key, if any. When
+// that fails, a redelivery sends the event once the lease expires.
+func (s *Service) release(key string) {
+	if s.store == nil || len(key) == 0 {
+		return
+	}
+
+	if err := s.store.Release(key); err != nil {
+		handleError("releasing idempotency record", err)
+	}
+}
+
+// enqueue writes the event to the outbox. The event of an idempotency record gets
+// the key as its ID, so the event of a redelivered request is only added once.
+// Other events get a new ID.
+func (s *Service) enqueue(key string, evt emitter.Event) error {
+	payload, err := evt.Marshal()
+	if err != nil {
+		return err
+	}
+
+	id := key
+	if len(id) == 0 {
+		id = uuid.Must(uuid.NewV4()).String()
+	}
+
+	now := time.Now()
+	err = s.outbox.Add(outbox.Message{
+		ID:        id,
+		Metadata:  evt.Meta(),
+		Event:     payload,
+		Status:    outbox.Pending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err == outbox.ErrMessageExists {
+		return nil
+	}
+
+	return err
+}
+
+// malformed wraps the error of parsing an event in ErrMalformedRequest.
+func malformed(err error) error {
+	return fmt.Errorf("%w: %s", ErrMalformedRequest, err.Error())
+}
+
+// handleError takes the activity where the error occured and the error object and sends a message to sentry.
+// Creditcard data is redacted from the message. The original error is returned so it can be thrown.
+func handleError(activity string, err error) error {
+	msg := redact.String(fmt.Sprintf("error %s: %s", activity, err.Error()))
+	log.Print(msg)
+	sentry.CaptureException(errors.New(msg))
+	return err
+}
@@ -0,0 +1,729 @@
+package payment
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	acmeserverless "github.com/retgits/acme-serverless"
+	"github.com/retgits/acme-serverless-payment/internal/emitter"
+	"github.com/retgits/acme-serverless-payment/internal/events"
+	"github.com/retgits/acme-serverless-payment/internal/idempotency"
+	idempotencymemory "github.com/retgits/acme-serverless-payment/internal/idempotency/memory"
+	"github.com/retgits/acme-serverless-payment/internal/ledger"
+	ledgermemory "github.com/retgits/acme-serverless-payment/internal/ledger/memory"
+	outboxmemory "github.com/retgits/acme-serverless-payment/internal/outbox/memory"
+	"github.com/retgits/acme-serverless-payment/internal/risk"
+	"github.com/retgits/acme-serverless-payment/internal/validator"
+	vaultfile "github.com/retgits/acme-serverless-payment/internal/vault/file"
+	"github.com/retgits/acme-serverless-payment/internal/velocity"
+	velocitymemory "github.com/retgits/acme-serverless-payment/internal/velocity/memory"
+	"github.com/retgits/creditcard"
+)
+
+// secret is the secret the idempotency keys of the tests are derived with.
+var secret = make([]byte, 32)
+
+// recorder is an EventEmitter that records the events it sends, and fails
+// while fail is set.
+type recorder struct {
+	sent []emitter.Event
+	fail bool
+}
+
+func (r *recorder) Send(ctx context.Context, e emitter.Event) error {
+	if r.fail {
+		return errors.New("send failed")
+	}
+	r.sent = append(r.sent, e)
+	return nil
+}
+
+func (r *recorder) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, r, events)
+}
+
+// gate is an EventEmitter that counts the events it sends. Every Send signals
+// started, and waits until open is closed. It fails the first failures events.
+type gate struct {
+	mu       sync.Mutex
+	sent     int
+	failures int
+	started  chan struct{}
+	open     chan struct{}
+}
+
+// newGate returns a gate that is closed when open is false.
+func newGate(open bool) *gate {
+	g := &gate{started: make(chan struct{}, 10), open: make(chan struct{})}
+	if open {
+		close(g.open)
+	}
+
+	return g
+}
+
+func (g *gate) Send(ctx context.Context, e emitter.Event) error {
+	g.started <- struct{}{}
+	<-g.open
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.failures > 0 {
+		g.failures--
+		return errors.New("send failed")
+	}
+
+	g.sent++
+	return nil
+}
+
+func (g *gate) SendBatch(ctx context.Context, events []emitter.Event) error {
+	return emitter.SendEach(ctx, g, events)
+}
+
+// count returns the number of events the gate sent.
+func (g *gate) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.sent
+}
+
+// racingStore is an idempotency store of which the first two lookups wait for each
+// other, so two deliveries of the same request both find no record and race to save it.
+type racingStore struct {
+	idempotency.Store
+	mu      sync.Mutex
+	lookups int
+	ready   sync.WaitGroup
+}
+
+func newRacingStore() *racingStore {
+	s := &racingStore{Store: idempotencymemory.New()}
+	s.ready.Add(2)
+
+	return s
+}
+
+func (s *racingStore) Lookup(key string) (idempotency.Record, bool, error) {
+	rec, found, err := s.Store.Lookup(key)
+
+	s.mu.Lock()
+	s.lookups++
+	n := s.lookups
+	s.mu.Unlock()
+
+	if n <= 2 {
+		s.ready.Done()
+		s.ready.Wait()
+	}
+
+	return rec, found, err
+}
+
+// transport is a Sentry transport that keeps the messages it is sent.
+type transport struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (t *transport) Flush(timeout time.Duration) bool       { return true }
+func (t *transport) Configure(options sentry.ClientOptions) {}
+
+func (t *transport) SendEvent(event *sentry.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(event.Message) > 0 {
+		t.messages = append(t.messages, event.Message)
+	}
+}
+
+// paymentRequest returns a request for a valid payment for the order.
+func paymentRequest(orderID string) events.PaymentRequestedEvent {
+	return events.PaymentRequestedEvent{
+		Data: events.PaymentRequestDetails{
+			PaymentRequestDetails: acmeserverless.PaymentRequestDetails{
+				OrderID: orderID,
+				Total:   "10.00",
+				Card: creditcard.Card{
+					Type:        "Visa",
+					Number:      "4111111111111111",
+					ExpiryMonth: 12,
+					ExpiryYear:  2099,
+					CVV:         "123",
+				},
+			},
+		},
+	}
+}
+
+func TestProcess(t *testing.T) {
+	expired := paymentRequest("order-2")
+	expired.Data.Card.ExpiryYear = 2001
+
+	negative := paymentRequest("order-4")
+	negative.Data.Total = "-10.00"
+
+	tests := []struct {
+		name    string
+		req     events.PaymentRequestedEvent
+		fail    bool
+		wantErr bool
+		success bool
+		sent    int
+	}{
+		{"valid creditcard", paymentRequest("order-1"), false, false, true, 1},
+		{"invalid creditcard", expired, false, false, false, 1},
+		{"invalid total", negative, false, false, false, 1},
+		{"event can't be sent", paymentRequest("order-3"), true, true, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			em := &recorder{fail: tt.fail}
+
+			evt, err := New(validator.New(), em).Process(context.Background(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			// A creditcard that doesn't pass validation results in an event
+			// that isn't successful, not in an error
+			if evt.Data.Success != tt.success || evt.Data.OrderID != tt.req.Data.OrderID {
+				t.Errorf("Process() = %+v, want success %v for %s", evt.Data, tt.success, tt.req.Data.OrderID)
+			}
+
+			if len(em.sent) != tt.sent {
+				t.Errorf("Process() sent %d events, want %d", len(em.sent), tt.sent)
+			}
+		})
+	}
+}
+
+func TestProcessWithoutEmitter(t *testing.T) {
+	evt, err := New(validator.New(), nil).Process(context.Background(), paymentRequest("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !evt.Data.Success || len(evt.Data.TransactionID) == 0 {
+		t.Errorf("Process() = %+v, want a successful payment with a transaction ID", evt.Data)
+	}
+}
+
+func TestProcessRedeliveredRequest(t *testing.T) {
+	em := &recorder{fail: true}
+	svc := New(validator.New(), em, WithIdempotencyStore(idempotencymemory.New(), time.Hour, secret))
+	req := paymentRequest("order-1")
+
+	// The result is recorded even though it can't be sent
+	first, err := svc.Process(context.Background(), req)
+	if err == nil {
+		t.Fatalf("Process() error = nil, want an error")
+	}
+
+	// A redelivered request gets the original result, which is sent now
+	em.fail = false
+	for i := 0; i < 2; i++ {
+		evt, err := svc.Process(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if evt.Data.TransactionID != first.Data.TransactionID {
+			t.Errorf("Process() of a redelivered request = %s, want transaction %s", evt.Data.TransactionID, first.Data.TransactionID)
+		}
+	}
+
+	if len(em.sent) != 1 {
+		t.Errorf("Process() sent %d events, want 1", len(em.sent))
+	}
+
+	// Another attempt for the same order is a new payment
+	other := paymentRequest("order-1")
+	other.Data.Card.CVV = "456"
+
+	evt, err := svc.Process(context.Background(), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if evt.Data.TransactionID == first.Data.TransactionID {
+		t.Errorf("Process() of another attempt = %s, want a new transaction", evt.Data.TransactionID)
+	}
+}
+
+func TestProcessWithOutbox(t *testing.T) {
+	em := &recorder{}
+	box := outboxmemory.New()
+	svc := New(validator.New(), em, WithIdempotencyStore(idempotencymemory.New(), time.Hour, secret), WithOutbox(box))
+	req := paymentRequest("order-1")
+
+	// A redelivered request adds its event to the outbox only once
+	for i := 0; i < 2; i++ {
+		if _, err := svc.Process(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(em.sent) != 0 {
+		t.Errorf("Process() sent %d events, want 0", len(em.sent))
+	}
+
+	pending, err := box.Pending(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 || pending[0].Metadata.Type != "CreditCardValidatedEvent" {
+		t.Fatalf("Process() added %d events to the outbox, want a single CreditCardValidatedEvent", len(pending))
+	}
+}
+
+func TestProcessRecordsLedgerEntry(t *testing.T) {
+	l := ledgermemory.New()
+	svc := New(validator.New(), nil, WithLedger(l))
+
+	expired := paymentRequest("order-1")
+	expired.Data.Card.ExpiryYear = 2001
+
+	// Both the rejected and the successful attempt are recorded
+	for _, req := range []events.PaymentRequestedEvent{expired, paymentRequest("order-1")} {
+		if _, err := svc.Process(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := l.ListByOrder("order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ledger has %d entries for order-1, want 2", len(entries))
+	}
+
+	rejected, paid := entries[0], entries[1]
+	if rejected.Success || len(rejected.Reason) == 0 || len(rejected.TransactionID) == 0 {
+		t.Errorf("ledger entry of the expired creditcard = %+v, want a rejected attempt with a reason", rejected)
+	}
+	if !paid.Success || paid.Card != "411111******1111" || paid.Amount != "10.00" {
+		t.Errorf("ledger entry of the valid creditcard = %+v, want a successful payment of 10.00 with a masked card", paid)
+	}
+}
+
+func TestProcessReportsDeclineCodes(t *testing.T) {
+	l := ledgermemory.New()
+	svc := New(validator.New(), nil, WithLedger(l))
+
+	req := paymentRequest("order-1")
+	req.Data.Card.ExpiryYear = 2001
+	req.Data.Card.CVV = "12"
+
+	evt, err := svc.Process(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var codes []string
+	for _, d := range evt.Data.Declines {
+		codes = append(codes, d.Code)
+	}
+	if len(codes) != 2 || codes[0] != string(validator.CodeExpired) || codes[1] != string(validator.CodeInvalidCVV) {
+		t.Errorf("Process() declined with %v, want %s and %s", codes, validator.CodeExpired, validator.CodeInvalidCVV)
+	}
+
+	entries, err := l.ListByOrder("order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || len(entries[0].DeclineCodes) != 2 {
+		t.Errorf("ledger has %+v, want the declined attempt with both codes", entries)
+	}
+}
+
+func TestProcessAssessesRisk(t *testing.T) {
+	h, err := risk.NewHeuristic(risk.DefaultConfig, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := ledgermemory.New()
+	svc := New(validator.New(), nil, WithLedger(l), WithRiskScorer(h))
+
+	high := paymentRequest("order-1")
+	high.Data.Total = "1000.00"
+
+	mismatch := paymentRequest("order-2")
+	mismatch.Data.Total = "1000.00"
+	mismatch.Data.CustomerID = "customer-1"
+	mismatch.Data.Cardholder = "Jane Doe"
+	mismatch.Data.BillingName = "John Smith"
+
+	// A payment held for review keeps its transaction ID, a declined payment doesn't
+	tests := []struct {
+		name     string
+		req      events.PaymentRequestedEvent
+		decision risk.Decision
+		state    ledger.State
+		txn      bool
+	}{
+		{"approved", paymentRequest("order-3"), risk.Approved, ledger.StateCaptured, true},
+		{"held for review", high, risk.Review, ledger.StateReview, true},
+		{"declined", mismatch, risk.Declined, ledger.StateDeclined, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evt, err := svc.Process(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if evt.Data.Risk == nil || evt.Data.Risk.Decision != string(tt.decision) {
+				t.Fatalf("Process() risk = %+v, want decision %s", evt.Data.Risk, tt.decision)
+			}
+			if evt.Data.Success != (tt.decision == risk.Approved) || (evt.Data.TransactionID != "-1") != tt.txn {
+				t.Errorf("Process() = %+v, want success %v", evt.Data, tt.decision == risk.Approved)
+			}
+
+			entries, _ := l.ListByOrder(tt.req.Data.OrderID)
+			if len(entries) != 1 || entries[0].State != tt.state {
+				t.Errorf("ledger has %+v, want an entry in state %s", entries, tt.state)
+			}
+		})
+	}
+}
+
+func TestProcessLimitsAttempts(t *testing.T) {
+	em := &recorder{}
+	l := velocity.New(velocitymemory.New(), map[velocity.Dimension]velocity.Limit{velocity.Card: {Max: 2, Window: time.Minute}}, secret)
+	svc := New(validator.New(), em, WithVelocityLimiter(l))
+
+	for i, order := range []string{"order-1", "order-2", "order-3"} {
+		evt, err := svc.Process(context.Background(), paymentRequest(order))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := i < 2; evt.Data.Success != want {
+			t.Errorf("attempt %d: Process() success = %v, want %v", i+1, evt.Data.Success, want)
+		}
+	}
+
+	// The attempt that exceeded the limit results in a PaymentVelocityExceeded event as well
+	var exceeded int
+	for _, e := range em.sent {
+		if e.Meta().Type == events.PaymentVelocityExceededEventName {
+			exceeded++
+		}
+	}
+	if exceeded != 1 {
+		t.Errorf("Process() sent %d PaymentVelocityExceeded events, want 1", exceeded)
+	}
+}
+
+func TestProcessWithCardToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("VAULT_FILE", filepath.Join(dir, "vault"))
+	os.Setenv("VAULT_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	defer os.Unsetenv("VAULT_FILE")
+	defer os.Unsetenv("VAULT_KEY")
+
+	v, err := vaultfile.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(validator.New(), nil, WithVault(v))
+
+	// The event has the masked creditcard and its token, never the number
+	first := paymentRequest("order-1")
+	first.Data.CustomerID = "customer-1"
+
+	evt, err := s.Process(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := evt.Marshal()
+	if strings.Contains(string(payload), "4111111111111111") || evt.Data.Card != "411111******1111" {
+		t.Errorf("Process() = %s, want only the masked creditcard", payload)
+	}
+	token := evt.Data.CardToken
+	if len(token) == 0 {
+		t.Fatalf("Process() didn't tokenize the creditcard")
+	}
+
+	// Later payments reference the token, with or without the cvv code
+	tests := []struct {
+		name    string
+		token   string
+		cvv     string
+		success bool
+		code    string
+	}{
+		{"token with cvv", token, "123", true, ""},
+		{"token without cvv", token, "", true, ""},
+		{"token with invalid cvv", token, "12", false, string(validator.CodeInvalidCVV)},
+		{"unknown token", "tok_unknown", "123", false, string(validator.CodeInvalidToken)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := paymentRequest("order-2")
+			req.Data.CustomerID = "customer-1"
+			req.Data.Card = creditcard.Card{CVV: tt.cvv}
+			req.Data.CardToken = tt.token
+
+			evt, err := s.Process(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evt.Data.Success != tt.success {
+				t.Errorf("Process() = %+v, want success %v", evt.Data, tt.success)
+			}
+			if !tt.success && (len(evt.Data.Declines) == 0 || evt.Data.Declines[0].Code != tt.code) {
+				t.Errorf("Process() declined with %+v, want %s", evt.Data.Declines, tt.code)
+			}
+		})
+	}
+}
+
+// flakyLedger is a ledger that fails to record the first failures entries.
+type flakyLedger struct {
+	ledger.Store
+	failures int
+}
+
+func (l *flakyLedger) Record(e ledger.Entry) error {
+	if l.failures > 0 {
+		l.failures--
+		return errors.New("ledger is unavailable")
+	}
+	return l.Store.Record(e)
+}
+
+func TestRedeliveryRecordsLedgerEntry(t *testing.T) {
+	l := &flakyLedger{Store: ledgermemory.New(), failures: 1}
+	s := New(validator.New(validator.DefaultRules()...), nil,
+		WithLedger(l),
+		WithIdempotencyStore(idempotencymemory.New(), idempotency.DefaultTTL, secret),
+	)
+
+	req := paymentRequest("order-1")
+
+	if _, err := s.Process(context.Background(), req); err == nil {
+		t.Fatal("Process() didn't fail when the ledger failed")
+	}
+
+	evt, err := s.Process(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !evt.Data.Success {
+		t.Fatalf("Process() = %+v, want a successful payment", evt.Data)
+	}
+
+	e, err := l.Get(evt.Data.TransactionID)
+	if err != nil {
+		t.Fatalf("ledger has no entry for the replayed transaction: %s", err.Error())
+	}
+	if e.State != ledger.StateCaptured || e.OrderID != "order-1" {
+		t.Errorf("ledger entry = %+v, want the captured payment of order-1", e)
+	}
+
+	// Replaying the request again leaves the entry as it is
+	if _, err := s.Process(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := l.ListByOrder("order-1"); len(entries) != 1 || entries[0].Version != 1 {
+		t.Errorf("ledger has %+v, want a single entry", entries)
+	}
+}
+
+func TestCardTokensBelongToCustomer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("VAULT_FILE", filepath.Join(dir, "vault"))
+	os.Setenv("VAULT_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	defer os.Unsetenv("VAULT_FILE")
+	defer os.Unsetenv("VAULT_KEY")
+
+	v, err := vaultfile.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(validator.New(validator.DefaultRules()...), nil, WithVault(v))
+
+	// Creditcards are only tokenized for a customer
+	evt, err := s.Process(context.Background(), paymentRequest("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evt.Data.CardToken) > 0 {
+		t.Errorf("Process() without a customer ID tokenized the creditcard")
+	}
+
+	req := paymentRequest("order-2")
+	req.Data.CustomerID = "customer-1"
+	evt, err = s.Process(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := evt.Data.CardToken
+	if len(token) == 0 {
+		t.Fatalf("Process() with a customer ID didn't tokenize the creditcard")
+	}
+
+	tests := []struct {
+		name       string
+		customerID string
+		success    bool
+	}{
+		{"same customer", "customer-1", true},
+		{"another customer", "customer-2", false},
+		{"no customer", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := paymentRequest("order-" + tt.name)
+			req.Data.Card = creditcard.Card{}
+			req.Data.CardToken = token
+			req.Data.CustomerID = tt.customerID
+
+			evt, err := s.Process(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if evt.Data.Success != tt.success {
+				t.Errorf("Process() = %+v, want success %v", evt.Data, tt.success)
+			}
+			if !tt.success && (len(evt.Data.Declines) != 1 || evt.Data.Declines[0].Code != string(validator.CodeInvalidToken)) {
+				t.Errorf("Process() declined with %+v, want %s", evt.Data.Declines, validator.CodeInvalidToken)
+			}
+		})
+	}
+}
+
+func TestConcurrentDeliveriesSendOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    idempotency.Store
+		together bool
+	}{
+		// The second delivery finds the record of the first one, which is sending the event
+		{"record found", idempotencymemory.New(), false},
+		// Both deliveries find no record, and the second one fails to save its record
+		{"record saved at the same time", newRacingStore(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGate(false)
+			s := New(validator.New(validator.DefaultRules()...), g, WithIdempotencyStore(tt.store, idempotency.DefaultTTL, secret))
+			req := paymentRequest("order-1")
+
+			results := make(chan error, 2)
+			deliver := func() {
+				_, err := s.Process(context.Background(), req)
+				results <- err
+			}
+
+			go deliver()
+			if !tt.together {
+				<-g.started
+			}
+			go deliver()
+
+			// The delivery that doesn't hold the lease returns while the other one is sending
+			if err := <-results; err != ErrInProgress {
+				t.Fatalf("Process() error = %v, want %v", err, ErrInProgress)
+			}
+
+			close(g.open)
+			if err := <-results; err != nil {
+				t.Fatal(err)
+			}
+
+			// The request is delivered again, and gets the result without sending the event again
+			if _, err := s.Process(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			if g.count() != 1 {
+				t.Errorf("Process() sent %d events, want 1", g.count())
+			}
+		})
+	}
+}
+
+func TestFailedSendReleasesLease(t *testing.T) {
+	g := newGate(true)
+	g.failures = 1
+	s := New(validator.New(validator.DefaultRules()...), g, WithIdempotencyStore(idempotencymemory.New(), idempotency.DefaultTTL, secret))
+	req := paymentRequest("order-1")
+
+	first, err := s.Process(context.Background(), req)
+	if err == nil {
+		t.Fatal("Process() didn't fail when sending failed")
+	}
+
+	// The redelivery sends the event right away, rather than waiting for the lease to expire
+	again, err := s.Process(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.count() != 1 || again.Data.TransactionID != first.Data.TransactionID {
+		t.Errorf("Process() sent %d events for transaction %s, want 1 for %s", g.count(), again.Data.TransactionID, first.Data.TransactionID)
+	}
+}
+
+func TestOnlyApprovedPaymentsAreReportedAsSuccessful(t *testing.T) {
+	tr := &transport{}
+	if err := sentry.Init(sentry.ClientOptions{Transport: tr}); err != nil {
+		t.Fatal(err)
+	}
+	defer sentry.Init(sentry.ClientOptions{})
+
+	s := New(validator.New(validator.DefaultRules()...), nil)
+
+	if _, err := s.Process(context.Background(), paymentRequest("order-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	declined := paymentRequest("order-2")
+	declined.Data.Card.Number = "4111111111111112"
+	if _, err := s.Process(context.Background(), declined); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	want := "validation successful for order order-1"
+	if got := strings.Join(tr.messages, ", "); got != want {
+		t.Errorf("Process() reported %q to Sentry, want %q", got, want)
+	}
+}
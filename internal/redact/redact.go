@@ -0,0 +1,263 @@
+// Package redact removes creditcard data from everything the Payment service
+// logs, sends to Sentry, or emits. Creditcard numbers are masked so only the
+// first six and last four digits remain, cvv codes and expiry dates are dropped
+// entirely, and sequences of digits that look like creditcard numbers are masked
+// in free text. Every logging and observability call in the service should go
+// through it.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// panPattern matches sequences of 13 to 19 digits, optionally separated by
+// single spaces or dashes, which is what creditcard numbers look like in text.
+var panPattern = regexp.MustCompile(`\d(?:[ -]?\d){12,18}`)
+
+// secretPattern matches the key-value pairs of cvv codes and expiry dates in text,
+// like "cvv":"123" in JSON, CVV:123 in formatted structs, or cvv=123 in query
+// strings, together with a comma before or after them, so they can be dropped.
+// Keys without quotes must be directly followed by the value, so messages like
+// "cvv: the code is not valid" are left alone.
+var secretPattern = pairPattern(`(?:` + cvvKeyPattern + `|` + expiryKeyPattern + `)`)
+
+// cvvPattern matches the key-value pairs of cvv codes in text, like secretPattern.
+var cvvPattern = pairPattern(cvvKeyPattern)
+
+const (
+	// cvvKeyPattern matches the keys of cvv codes.
+	cvvKeyPattern = `(?:cvv2?|cvc2?|cid|security_?code)`
+
+	// expiryKeyPattern matches the keys of expiry dates.
+	expiryKeyPattern = `(?:expiry(?:_?(?:month|year|date))?|expiration(?:_?date)?|exp_?(?:month|year))`
+)
+
+// pairPattern returns the pattern that matches key-value pairs with a key that
+// matches the key pattern, and the comma before or after them.
+func pairPattern(key string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(,\s*)?(?:["']` + key + `["']\s*:\s*|\b` + key + `[:=])(?:"[^"]*"|'[^']*'|[^\s,;&{}\[\]"']+)(\s*,)?`)
+}
+
+// cvvKeys are the keys, in lowercase, of values that contain a cvv code.
+var cvvKeys = map[string]bool{
+	"cvv":           true,
+	"cvv2":          true,
+	"cvc":           true,
+	"cvc2":          true,
+	"cid":           true,
+	"securitycode":  true,
+	"security_code": true,
+}
+
+// expiryKeys are the keys, in lowercase, of values that contain an expiry date.
+var expiryKeys = map[string]bool{
+	"expiry":          true,
+	"expirymonth":     true,
+	"expiry_month":    true,
+	"expiryyear":      true,
+	"expiry_year":     true,
+	"expirydate":      true,
+	"expiry_date":     true,
+	"expiration":      true,
+	"expirationdate":  true,
+	"expiration_date": true,
+	"expmonth":        true,
+	"exp_month":       true,
+	"expyear":         true,
+	"exp_year":        true,
+}
+
+// panKeys are the keys, in lowercase, of values that contain a creditcard number.
+var panKeys = map[string]bool{
+	"number":     true,
+	"cardnumber": true,
+	"pan":        true,
+	"card":       true,
+}
+
+// PAN masks the creditcard number, so only the first six and the last four
+// digits remain. Numbers that are too short to be a creditcard number only
+// keep the last four digits. Values that aren't numbers are scrubbed like
+// free text.
+func PAN(number string) string {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-':
+			return -1
+		default:
+			return 'x'
+		}
+	}, number)
+
+	if strings.ContainsRune(digits, 'x') {
+		return String(number)
+	}
+
+	switch {
+	case len(digits) >= 13:
+		return digits[:6] + strings.Repeat("*", len(digits)-10) + digits[len(digits)-4:]
+	case len(digits) > 4:
+		return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+	default:
+		return strings.Repeat("*", len(digits))
+	}
+}
+
+// String drops the key-value pairs of cvv codes and expiry dates from the text, and
+// masks every sequence of digits that looks like a creditcard number.
+func String(s string) string {
+	return panPattern.ReplaceAllStringFunc(drop(secretPattern, s), PAN)
+}
+
+// drop removes the key-value pairs that match the pattern from the text.
+func drop(pattern *regexp.Regexp, s string) string {
+	return pattern.ReplaceAllStringFunc(s, func(pair string) string {
+		m := pattern.FindStringSubmatch(pair)
+		// Keep a single comma when the pair was between two others
+		if len(m[1]) > 0 && len(m[2]) > 0 {
+			return ","
+		}
+		return ""
+	})
+}
+
+// Map returns a copy of the map without creditcard data. Values with a cvv or
+// expiry key are dropped, values with a creditcard number key are masked, also
+// when they are numbers, and all other text is scrubbed. Nested maps and slices
+// are redacted as well.
+func Map(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		key := strings.ToLower(k)
+		if cvvKeys[key] || expiryKeys[key] {
+			continue
+		}
+
+		if s, ok := text(v); ok && panKeys[key] {
+			r[k] = PAN(s)
+			continue
+		}
+
+		r[k] = value(v)
+	}
+
+	return r
+}
+
+// JSON returns the JSON document without creditcard data, redacted like Map.
+// Payloads that aren't JSON are scrubbed like free text.
+func JSON(payload []byte) []byte {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil || d.More() {
+		return []byte(String(string(payload)))
+	}
+
+	redacted, err := json.Marshal(value(v))
+	if err != nil {
+		return []byte(String(string(payload)))
+	}
+
+	return redacted
+}
+
+// value redacts a single value of a map or slice. Numbers that look like a
+// creditcard number are masked, which turns them into text.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return String(t)
+	case json.Number, float64, float32, int, int64, uint64:
+		s, _ := text(t)
+		if masked := String(s); masked != s {
+			return masked
+		}
+		return v
+	case map[string]interface{}:
+		return Map(t)
+	case []interface{}:
+		r := make([]interface{}, len(t))
+		for i := range t {
+			r[i] = value(t[i])
+		}
+		return r
+	default:
+		return v
+	}
+}
+
+// text returns the value as text when it is text or a number, like a creditcard
+// number that was sent as a JSON number.
+func text(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), true
+	case int:
+		return strconv.Itoa(t), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case uint64:
+		return strconv.FormatUint(t, 10), true
+	default:
+		return "", false
+	}
+}
+
+// CVV returns the JSON document without cvv codes, which must never be stored, but
+// with all other values as they are, so the document can still be processed. Payloads
+// that aren't JSON have the key-value pairs of cvv codes dropped like String.
+func CVV(payload []byte) []byte {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil || d.More() {
+		return []byte(drop(cvvPattern, string(payload)))
+	}
+
+	stripped, err := json.Marshal(dropCVV(v))
+	if err != nil {
+		return []byte(drop(cvvPattern, string(payload)))
+	}
+
+	return stripped
+}
+
+// dropCVV removes the values with a cvv key from the value, and the maps
+// and slices in it.
+func dropCVV(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		r := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			if !cvvKeys[strings.ToLower(k)] {
+				r[k] = dropCVV(v)
+			}
+		}
+		return r
+	case []interface{}:
+		r := make([]interface{}, len(t))
+		for i := range t {
+			r[i] = dropCVV(t[i])
+		}
+		return r
+	default:
+		return v
+	}
+}
@@ -0,0 +1,216 @@
+package redact
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPAN(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"4111111111111111", "411111******1111"},
+		{"4111 1111 1111 1111", "411111******1111"},
+		{"4111-1111-1111-1111", "411111******1111"},
+		{"4222222222222", "422222***2222"},
+		{"123456", "**3456"},
+		{"123", "***"},
+		{"", ""},
+		{"tok_abc", "tok_abc"},
+	}
+
+	for _, tt := range tests {
+		if got := PAN(tt.number); got != tt.want {
+			t.Errorf("PAN(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "card number in text",
+			in:   "error charging 4111111111111111 for order 12345",
+			want: "error charging 411111******1111 for order 12345",
+		},
+		{
+			name: "card number with spaces",
+			in:   "card 4111 1111 1111 1111 declined",
+			want: "card 411111******1111 declined",
+		},
+		{
+			name: "cvv in JSON",
+			in:   `{"Number":"4111111111111111","CVV":"123"}`,
+			want: `{"Number":"411111******1111"}`,
+		},
+		{
+			name: "cvv between other values",
+			in:   `{"number":"4111111111111111", "cvv": "123", "type":"Visa"}`,
+			want: `{"number":"411111******1111", "type":"Visa"}`,
+		},
+		{
+			name: "cvv first",
+			in:   `{"cvv":123,"total":"10.00"}`,
+			want: `{"total":"10.00"}`,
+		},
+		{
+			name: "expiry in JSON",
+			in:   `{"expiryYear":2030,"expiryMonth":1,"orderID":"1"}`,
+			want: `{"orderID":"1"}`,
+		},
+		{
+			name: "formatted struct",
+			in:   "{Type:Visa Number:4111111111111111 ExpiryMonth:1 ExpiryYear:2030 CVV:123}",
+			want: "{Type:Visa Number:411111******1111   }",
+		},
+		{
+			name: "query string",
+			in:   "card=4111111111111111&cvv=123&exp_month=01",
+			want: "card=411111******1111&&",
+		},
+		{
+			name: "message about a field",
+			in:   "cvv: the code is not valid, expiry: the card has expired",
+			want: "cvv: the code is not valid, expiry: the card has expired",
+		},
+		{
+			name: "words that contain a key",
+			in:   "decided=yes",
+			want: "decided=yes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := String(tt.in); got != tt.want {
+				t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMap(t *testing.T) {
+	in := map[string]interface{}{
+		"Number":      "4111111111111111",
+		"CVV":         "123",
+		"ExpiryMonth": 1,
+		"ExpiryYear":  2030,
+		"OrderID":     "12345",
+		"Card": map[string]interface{}{
+			"number": 4111111111111111.0,
+			"cvc":    "123",
+		},
+		"Notes": []interface{}{"paid with 4111111111111111"},
+	}
+
+	want := map[string]interface{}{
+		"Number":  "411111******1111",
+		"OrderID": "12345",
+		"Card": map[string]interface{}{
+			"number": "411111******1111",
+		},
+		"Notes": []interface{}{"paid with 411111******1111"},
+	}
+
+	if got := Map(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %#v, want %#v", got, want)
+	}
+
+	if Map(nil) != nil {
+		t.Errorf("Map(nil) is not nil")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "card number as text",
+			in:   `{"data":{"card":{"number":"4111111111111111","cvv":"123","expiryYear":2030},"total":"10.00"}}`,
+			want: `{"data":{"card":{"number":"411111******1111"},"total":"10.00"}}`,
+		},
+		{
+			name: "card number as number",
+			in:   `{"Number":4111111111111111,"CVV":"123"}`,
+			want: `{"Number":"411111******1111"}`,
+		},
+		{
+			name: "long card number as number",
+			in:   `{"pan":6011000000000000004}`,
+			want: `{"pan":"601100*********0004"}`,
+		},
+		{
+			name: "card number as number under another key",
+			in:   `{"value":4111111111111111,"amount":12.5,"count":3}`,
+			want: `{"amount":12.5,"count":3,"value":"411111******1111"}`,
+		},
+		{
+			name: "not JSON",
+			in:   `{"number":"4111111111111111","cvv":"123"`,
+			want: `{"number":"411111******1111"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(JSON([]byte(tt.in)))
+			if got != tt.want {
+				t.Errorf("JSON(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+			if strings.Contains(got, "123\"") || strings.Contains(got, "4111111111111111") {
+				t.Errorf("JSON(%s) leaks creditcard data: %s", tt.in, got)
+			}
+		})
+	}
+}
+
+func TestJSONKeepsValidJSON(t *testing.T) {
+	got := JSON([]byte(`{"data":{"card":{"number":4111111111111111,"cvv":123}}}`))
+
+	var v interface{}
+	if err := json.Unmarshal(got, &v); err != nil {
+		t.Fatalf("JSON() returned invalid JSON %s: %s", got, err.Error())
+	}
+}
+
+func TestCVV(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "request",
+			in:   `{"data":{"card":{"number":4111111111111111,"cvv":"123","expiryYear":2030},"total":"10.00"}}`,
+			want: `{"data":{"card":{"expiryYear":2030,"number":4111111111111111},"total":"10.00"}}`,
+		},
+		{
+			name: "nested in a slice",
+			in:   `[{"CVC":123,"a":1}]`,
+			want: `[{"a":1}]`,
+		},
+		{
+			name: "not JSON",
+			in:   `{"number":"4111111111111111","cvv":"123","expiryYear":2030`,
+			want: `{"number":"4111111111111111","expiryYear":2030`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(CVV([]byte(tt.in))); got != tt.want {
+				t.Errorf("CVV(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
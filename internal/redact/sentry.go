@@ -0,0 +1,47 @@
+package redact
+
+import (
+	"github.com/getsentry/sentry-go"
+)
+
+// BeforeSend removes creditcard data from the event before it is sent to Sentry. It
+// can be used as the BeforeSend option of the Sentry client, so events are redacted
+// even when they are captured outside of the Payment service, like by middleware
+// that attaches the request body.
+func BeforeSend(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	event.Message = String(event.Message)
+
+	for i := range event.Exception {
+		event.Exception[i].Value = String(event.Exception[i].Value)
+	}
+
+	for i := range event.Breadcrumbs {
+		event.Breadcrumbs[i] = BeforeBreadcrumb(event.Breadcrumbs[i], nil)
+	}
+
+	event.Extra = Map(event.Extra)
+	event.Contexts = Map(event.Contexts)
+
+	if event.Request != nil {
+		event.Request.URL = String(event.Request.URL)
+		event.Request.QueryString = String(event.Request.QueryString)
+		if len(event.Request.Data) > 0 {
+			event.Request.Data = string(JSON([]byte(event.Request.Data)))
+		}
+	}
+
+	return event
+}
+
+// BeforeBreadcrumb removes creditcard data from the breadcrumb before it is recorded.
+// It can be used as the BeforeBreadcrumb option of the Sentry client.
+func BeforeBreadcrumb(breadcrumb *sentry.Breadcrumb, hint *sentry.BreadcrumbHint) *sentry.Breadcrumb {
+	if breadcrumb == nil {
+		return nil
+	}
+
+	breadcrumb.Message = String(breadcrumb.Message)
+	breadcrumb.Data = Map(breadcrumb.Data)
+
+	return breadcrumb
+}
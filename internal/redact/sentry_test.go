@@ -0,0 +1,35 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+)
+
+func TestBeforeSend(t *testing.T) {
+	event := &sentry.Event{
+		Message:   "error charging 4111111111111111",
+		Exception: []sentry.Exception{{Value: "card 4111111111111111 declined"}},
+		Breadcrumbs: []*sentry.Breadcrumb{{
+			Message: "validating 4111111111111111",
+			Data:    map[string]interface{}{"CVV": "123"},
+		}},
+		Extra: map[string]interface{}{"Number": "4111111111111111"},
+		Request: &sentry.Request{
+			Data: `{"card":{"number":"4111111111111111","cvv":"123"}}`,
+		},
+	}
+
+	got := BeforeSend(event, nil)
+
+	for _, s := range []string{got.Message, got.Exception[0].Value, got.Breadcrumbs[0].Message, got.Request.Data, got.Extra["Number"].(string)} {
+		if strings.Contains(s, "4111111111111111") || strings.Contains(s, "123\"") {
+			t.Errorf("BeforeSend() left creditcard data in %q", s)
+		}
+	}
+
+	if _, ok := got.Breadcrumbs[0].Data["CVV"]; ok {
+		t.Errorf("BeforeSend() left the cvv code in a breadcrumb")
+	}
+}
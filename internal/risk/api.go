@@ -0,0 +1,125 @@
+// Package risk contains the interfaces that the Payment service in the ACME
+// Serverless Fitness Shop uses to assess the risk that a payment is fraudulent.
+// Payments that pass validation are scored, and depending on the score they are
+// approved, held for manual review, or declined. In order to add a new way of
+// scoring payments, the Scorer interface needs to be implemented.
+package risk
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// Decision is the outcome of a risk assessment.
+type Decision string
+
+const (
+	// Approved means the payment can be processed.
+	Approved Decision = "approved"
+
+	// Review means the payment should be held until it has been reviewed
+	// by the operations team.
+	Review Decision = "review"
+
+	// Declined means the payment is too risky to process.
+	Declined Decision = "declined"
+)
+
+// Signal is the name of a reason why a payment is considered risky.
+type Signal string
+
+const (
+	// SignalHighAmount means the amount of the payment is unusually high.
+	SignalHighAmount Signal = "high_amount"
+
+	// SignalNameMismatch means the name on the creditcard doesn't match the
+	// name in the billing address.
+	SignalNameMismatch Signal = "name_mismatch"
+
+	// SignalRepeatedDeclines means payments with the same creditcard have
+	// been declined recently.
+	SignalRepeatedDeclines Signal = "repeated_declines"
+
+	// SignalFirstTimeHighValue means the customer hasn't paid before and
+	// the amount of the payment is high.
+	SignalFirstTimeHighValue Signal = "first_time_high_value"
+)
+
+// Payment contains the details of a payment that are used to assess its risk.
+type Payment struct {
+	// Card is the creditcard number.
+	Card string
+
+	// Amount is the amount of the payment.
+	Amount *money.Money
+
+	// CustomerID is the unique identifier of the customer, if known.
+	CustomerID string
+
+	// Cardholder is the name on the creditcard, if known.
+	Cardholder string
+
+	// BillingName is the name in the billing address, if known.
+	BillingName string
+}
+
+// Assessment is the result of scoring a payment.
+type Assessment struct {
+	// Score is the risk score of the payment, from 0 to 100.
+	Score int
+
+	// Decision is the outcome of the assessment.
+	Decision Decision
+
+	// Signals contains the signals that added to the score.
+	Signals []Signal
+}
+
+// Scorer assesses the risk that a payment is fraudulent.
+type Scorer interface {
+	// Score returns the risk assessment of the payment.
+	Score(p Payment) Assessment
+}
+
+// Observer is implemented by scorers that learn from the outcome of payments,
+// for example to detect repeated declines. The Payment service tells the
+// Scorer about every payment it validates when the Scorer implements it.
+type Observer interface {
+	// Observe records the outcome of the payment. Payments that didn't pass
+	// validation are Declined as well.
+	Observe(p Payment, d Decision)
+}
+
+// KeyFromEnv returns the secret in RISK_KEY, which the creditcard numbers in the
+// history of the scorer are fingerprinted with, or nil when it isn't set. It returns
+// an error if the secret is not a base64 encoded 32 byte key.
+func KeyFromEnv() ([]byte, error) {
+	v := os.Getenv("RISK_KEY")
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("RISK_KEY must contain a base64 encoded 32 byte key")
+	}
+
+	return key, nil
+}
+
+// NewKey returns a random 32 byte secret to fingerprint creditcard numbers with.
+// Fingerprints made with it only match within the same process, which is all a
+// history in memory needs.
+func NewKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,422 @@
+package risk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// The weights of the signals in the risk score.
+var weights = map[Signal]int{
+	SignalHighAmount:         35,
+	SignalNameMismatch:       30,
+	SignalRepeatedDeclines:   45,
+	SignalFirstTimeHighValue: 25,
+}
+
+// Config contains the thresholds of the heuristic scorer. Fields that are
+// not set use the value in DefaultConfig.
+type Config struct {
+	// HighAmount is the amount from which a payment is considered high. An
+	// amount without a currency is in USD. Payments in other currencies are
+	// compared to the thresholds in Currencies.
+	HighAmount string `json:"highAmount,omitempty"`
+
+	// FirstOrderAmount is the amount from which a payment by a customer that
+	// hasn't paid before is considered high.
+	FirstOrderAmount string `json:"firstOrderAmount,omitempty"`
+
+	// Currencies contains the thresholds for payments in other currencies than
+	// the one of HighAmount and FirstOrderAmount, keyed by their ISO 4217 code.
+	// Payments in a currency without thresholds are always considered high.
+	Currencies map[string]Thresholds `json:"currencies,omitempty"`
+
+	// CustomerWindow is the period, like 720h, after which a customer that hasn't
+	// paid again is considered a customer that hasn't paid before.
+	CustomerWindow string `json:"customerWindow,omitempty"`
+
+	// MaxDeclines is the number of declined payments with the same creditcard
+	// from which the declines are considered repeated.
+	MaxDeclines int `json:"maxDeclines,omitempty"`
+
+	// DeclineWindow is the period in which declines are counted, like 24h.
+	DeclineWindow string `json:"declineWindow,omitempty"`
+
+	// ReviewScore is the score from which a payment is held for review.
+	ReviewScore int `json:"reviewScore,omitempty"`
+
+	// DeclineScore is the score from which a payment is declined.
+	DeclineScore int `json:"declineScore,omitempty"`
+}
+
+// Thresholds contains the amounts from which a payment in a currency is
+// considered high.
+type Thresholds struct {
+	// HighAmount is the amount from which a payment is considered high.
+	HighAmount string `json:"highAmount"`
+
+	// FirstOrderAmount is the amount from which a payment by a customer that
+	// hasn't paid before is considered high.
+	FirstOrderAmount string `json:"firstOrderAmount"`
+}
+
+// DefaultConfig contains the thresholds that are used when they are not configured.
+var DefaultConfig = Config{
+	HighAmount:       "1000.00",
+	FirstOrderAmount: "250.00",
+	CustomerWindow:   "720h",
+	MaxDeclines:      2,
+	DeclineWindow:    "24h",
+	ReviewScore:      30,
+	DeclineScore:     70,
+}
+
+// sweepInterval is how often the history of creditcards and customers without
+// recent payments is removed.
+const sweepInterval = time.Minute
+
+// limits are the parsed thresholds of a currency.
+type limits struct {
+	highAmount       money.Money
+	firstOrderAmount money.Money
+}
+
+// Heuristic scores payments using a fixed set of signals: high amounts, a name
+// on the creditcard that doesn't match the billing name, repeated declines of
+// the same creditcard, and high amounts from customers that haven't paid before.
+// The history of payments is kept in memory, so it only covers the payments seen
+// by the current instance of the Payment service. On AWS Lambda, that is a single
+// container, which only sees a part of the payments and loses its history when it
+// is stopped. Declines are kept for the decline window, and customers for the
+// customer window after their last payment.
+type Heuristic struct {
+	limits         map[string]limits
+	customerWindow time.Duration
+	maxDeclines    int
+	window         time.Duration
+	reviewScore    int
+	declineScore   int
+	secret         []byte
+
+	mu        sync.Mutex
+	declines  map[string][]time.Time
+	customers map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewHeuristic creates a new heuristic scorer with the thresholds in the configuration.
+// The creditcard numbers in its history are fingerprinted with the secret. It returns
+// an error if a threshold is not valid.
+func NewHeuristic(c Config, secret []byte) (*Heuristic, error) {
+	if len(c.HighAmount) == 0 {
+		c.HighAmount = DefaultConfig.HighAmount
+	}
+	if len(c.FirstOrderAmount) == 0 {
+		c.FirstOrderAmount = DefaultConfig.FirstOrderAmount
+	}
+	if len(c.CustomerWindow) == 0 {
+		c.CustomerWindow = DefaultConfig.CustomerWindow
+	}
+	if c.MaxDeclines == 0 {
+		c.MaxDeclines = DefaultConfig.MaxDeclines
+	}
+	if len(c.DeclineWindow) == 0 {
+		c.DeclineWindow = DefaultConfig.DeclineWindow
+	}
+	if c.ReviewScore == 0 {
+		c.ReviewScore = DefaultConfig.ReviewScore
+	}
+	if c.DeclineScore == 0 {
+		c.DeclineScore = DefaultConfig.DeclineScore
+	}
+
+	l, err := parseThresholds(Thresholds{HighAmount: c.HighAmount, FirstOrderAmount: c.FirstOrderAmount}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	currencyLimits := map[string]limits{
+		l.highAmount.Currency: l,
+	}
+	for currency, t := range c.Currencies {
+		if !money.KnownCurrency(currency) {
+			return nil, fmt.Errorf("thresholds for %q are not valid: %s", currency, money.ErrUnknownCurrency.Error())
+		}
+		l, err := parseThresholds(t, strings.ToUpper(currency))
+		if err != nil {
+			return nil, fmt.Errorf("thresholds for %s are not valid: %s", currency, err.Error())
+		}
+		currencyLimits[l.highAmount.Currency] = l
+	}
+
+	customerWindow, err := time.ParseDuration(c.CustomerWindow)
+	if err != nil || customerWindow <= 0 {
+		return nil, fmt.Errorf("customer window %q is not valid", c.CustomerWindow)
+	}
+
+	window, err := time.ParseDuration(c.DeclineWindow)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("decline window %q is not valid", c.DeclineWindow)
+	}
+
+	if c.ReviewScore > c.DeclineScore {
+		return nil, fmt.Errorf("review score %d is higher than decline score %d", c.ReviewScore, c.DeclineScore)
+	}
+
+	return &Heuristic{
+		limits:         currencyLimits,
+		customerWindow: customerWindow,
+		maxDeclines:    c.MaxDeclines,
+		window:         window,
+		reviewScore:    c.ReviewScore,
+		declineScore:   c.DeclineScore,
+		secret:         secret,
+		declines:       make(map[string][]time.Time),
+		customers:      make(map[string]time.Time),
+		lastSweep:      time.Now(),
+	}, nil
+}
+
+// parseThresholds parses the thresholds, which are in the currency unless they
+// specify one. It returns an error if a threshold is not valid, or they are in a
+// different currency.
+func parseThresholds(t Thresholds, currency string) (limits, error) {
+	highAmount, err := money.Parse(t.HighAmount, currency)
+	if err != nil {
+		return limits{}, fmt.Errorf("high amount %q is not valid: %s", t.HighAmount, err.Error())
+	}
+
+	firstOrderAmount, err := money.Parse(t.FirstOrderAmount, highAmount.Currency)
+	if err != nil {
+		return limits{}, fmt.Errorf("first order amount %q is not valid: %s", t.FirstOrderAmount, err.Error())
+	}
+
+	if (len(currency) > 0 && highAmount.Currency != currency) || firstOrderAmount.Currency != highAmount.Currency {
+		return limits{}, fmt.Errorf("high amount %q and first order amount %q are not both in %s", t.HighAmount, t.FirstOrderAmount, highAmount.Currency)
+	}
+
+	return limits{highAmount: highAmount, firstOrderAmount: firstOrderAmount}, nil
+}
+
+// FromEnv creates a new heuristic scorer with the thresholds configured in the
+// environment. The environment variable RISK_RULES can contain the JSON encoded
+// configuration, or RISK_CONFIG can point to a file that contains it. When neither
+// is set, the default thresholds are used. The creditcard numbers in its history are
+// fingerprinted with the secret. It returns an error if the configuration could not
+// be read.
+func FromEnv(secret []byte) (Scorer, error) {
+	var payload []byte
+
+	switch {
+	case len(os.Getenv("RISK_RULES")) > 0:
+		payload = []byte(os.Getenv("RISK_RULES"))
+	case len(os.Getenv("RISK_CONFIG")) > 0:
+		var err error
+		payload, err = ioutil.ReadFile(os.Getenv("RISK_CONFIG"))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return NewHeuristic(DefaultConfig, secret)
+	}
+
+	var c Config
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("error parsing risk rules: %s", err.Error())
+	}
+
+	return NewHeuristic(c, secret)
+}
+
+// Score returns the risk assessment of the payment.
+func (h *Heuristic) Score(p Payment) Assessment {
+	var signals []Signal
+
+	l, known := limits{}, false
+	if p.Amount != nil {
+		l, known = h.limits[p.Amount.Currency]
+	}
+
+	if p.Amount != nil && (!known || atLeast(*p.Amount, l.highAmount)) {
+		signals = append(signals, SignalHighAmount)
+	}
+
+	if len(p.Cardholder) > 0 && len(p.BillingName) > 0 && !sameName(p.Cardholder, p.BillingName) {
+		signals = append(signals, SignalNameMismatch)
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	h.maybeSweep(now)
+	declines := h.recentDeclines(h.fingerprint(p.Card), now)
+	returning := h.returning(p.CustomerID, now)
+	h.mu.Unlock()
+
+	if declines >= h.maxDeclines {
+		signals = append(signals, SignalRepeatedDeclines)
+	}
+
+	if len(p.CustomerID) > 0 && !returning && p.Amount != nil && (!known || atLeast(*p.Amount, l.firstOrderAmount)) {
+		signals = append(signals, SignalFirstTimeHighValue)
+	}
+
+	a := Assessment{
+		Decision: Approved,
+		Signals:  signals,
+	}
+
+	for _, s := range signals {
+		a.Score += weights[s]
+	}
+	if a.Score > 100 {
+		a.Score = 100
+	}
+
+	switch {
+	case a.Score >= h.declineScore:
+		a.Decision = Declined
+	case a.Score >= h.reviewScore:
+		a.Decision = Review
+	}
+
+	return a
+}
+
+// Observe records the outcome of the payment. Declined payments count towards
+// repeated declines of the creditcard, and approved payments mark the customer
+// as a returning customer.
+func (h *Heuristic) Observe(p Payment, d Decision) {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.maybeSweep(now)
+
+	switch d {
+	case Approved:
+		if len(p.CustomerID) > 0 {
+			h.customers[p.CustomerID] = now
+		}
+		return
+	case Review:
+		return
+	}
+
+	key := h.fingerprint(p.Card)
+	h.recentDeclines(key, now)
+	h.declines[key] = append(h.declines[key], now)
+}
+
+// recentDeclines removes the declines of the creditcard that are outside of the
+// window and returns the number of declines that are left. The caller must hold
+// the lock.
+func (h *Heuristic) recentDeclines(key string, now time.Time) int {
+	recent := h.declines[key][:0]
+	for _, t := range h.declines[key] {
+		if now.Sub(t) < h.window {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) == 0 {
+		delete(h.declines, key)
+		return 0
+	}
+
+	h.declines[key] = recent
+	return len(recent)
+}
+
+// returning returns true when the customer paid in the customer window. The caller
+// must hold the lock.
+func (h *Heuristic) returning(customerID string, now time.Time) bool {
+	last, ok := h.customers[customerID]
+	return ok && now.Sub(last) < h.customerWindow
+}
+
+// maybeSweep removes the history that is outside of its window when the sweep
+// interval has passed, so creditcards and customers that don't pay again don't
+// stay in memory. The caller must hold the lock.
+func (h *Heuristic) maybeSweep(now time.Time) {
+	if now.Sub(h.lastSweep) < sweepInterval {
+		return
+	}
+
+	for key := range h.declines {
+		h.recentDeclines(key, now)
+	}
+
+	for customerID := range h.customers {
+		if !h.returning(customerID, now) {
+			delete(h.customers, customerID)
+		}
+	}
+
+	h.lastSweep = now
+}
+
+// fingerprint returns an HMAC-SHA256 digest of the creditcard number with the
+// secret, so the history doesn't keep creditcard numbers in memory, and the
+// numbers can't be recovered from it by hashing every possible number.
+func (h *Heuristic) fingerprint(card string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(card))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// atLeast returns true when the amount is at least the threshold, which is in the
+// same currency.
+func atLeast(amount money.Money, threshold money.Money) bool {
+	cmp, err := amount.Cmp(threshold)
+	return err == nil && cmp >= 0
+}
+
+// sameName returns true when the names have at least one word in common. Case,
+// punctuation, and initials are ignored, so "J. Smith" matches "John Smith". Names
+// that only contain initials can't be compared and always match.
+func sameName(a, b string) bool {
+	wa, wb := nameWords(a), nameWords(b)
+	if len(wa) == 0 || len(wb) == 0 {
+		return true
+	}
+
+	words := make(map[string]bool)
+	for _, w := range wa {
+		words[w] = true
+	}
+
+	for _, w := range wb {
+		if words[w] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nameWords returns the lowercase words of the name that are longer than an initial.
+func nameWords(name string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	words := fields[:0]
+	for _, f := range fields {
+		if len([]rune(f)) > 1 {
+			words = append(words, f)
+		}
+	}
+
+	return words
+}
@@ -0,0 +1,284 @@
+package risk
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// amount returns the parsed amount, or fails the test.
+func amount(t *testing.T, s string) *money.Money {
+	t.Helper()
+
+	m, err := money.Parse(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+// hasSignal returns true when the assessment contains the signal.
+func hasSignal(a Assessment, s Signal) bool {
+	for _, signal := range a.Signals {
+		if signal == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        Payment
+		signals  []Signal
+		decision Decision
+	}{
+		{"small amount", Payment{Amount: amount(t, "10.00")}, nil, Approved},
+		{"high amount", Payment{Amount: amount(t, "1000.00")}, []Signal{SignalHighAmount}, Review},
+		{"same name", Payment{Amount: amount(t, "10.00"), Cardholder: "J. Smith", BillingName: "John Smith"}, nil, Approved},
+		{"other name", Payment{Amount: amount(t, "10.00"), Cardholder: "Jane Doe", BillingName: "John Smith"}, []Signal{SignalNameMismatch}, Review},
+		{"first order", Payment{Amount: amount(t, "250.00"), CustomerID: "customer-1"}, []Signal{SignalFirstTimeHighValue}, Approved},
+		{"first order with high amount and other name", Payment{Amount: amount(t, "1000.00"), CustomerID: "customer-2", Cardholder: "Jane Doe", BillingName: "John Smith"}, []Signal{SignalHighAmount, SignalNameMismatch, SignalFirstTimeHighValue}, Declined},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHeuristic(DefaultConfig, make([]byte, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a := h.Score(tt.p)
+			if len(a.Signals) != len(tt.signals) {
+				t.Errorf("Score() has signals %v, want %v", a.Signals, tt.signals)
+			}
+			for _, s := range tt.signals {
+				if !hasSignal(a, s) {
+					t.Errorf("Score() has signals %v, want %v", a.Signals, tt.signals)
+				}
+			}
+			if a.Decision != tt.decision {
+				t.Errorf("Score() decision = %s with score %d, want %s", a.Decision, a.Score, tt.decision)
+			}
+		})
+	}
+}
+
+func TestObserve(t *testing.T) {
+	h, err := NewHeuristic(DefaultConfig, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Payment{Card: "4111111111111111", Amount: amount(t, "300.00"), CustomerID: "customer-1"}
+
+	// Declines of the same creditcard add up
+	for i := 0; i < DefaultConfig.MaxDeclines; i++ {
+		if a := h.Score(p); hasSignal(a, SignalRepeatedDeclines) {
+			t.Fatalf("Score() after %d declines has signal %s", i, SignalRepeatedDeclines)
+		}
+		h.Observe(p, Declined)
+	}
+
+	if a := h.Score(p); !hasSignal(a, SignalRepeatedDeclines) {
+		t.Errorf("Score() after %d declines = %v, want signal %s", DefaultConfig.MaxDeclines, a.Signals, SignalRepeatedDeclines)
+	}
+
+	// A customer that paid before is a returning customer
+	h.Observe(Payment{Card: "5555555555554444", CustomerID: "customer-1"}, Approved)
+
+	if a := h.Score(p); hasSignal(a, SignalFirstTimeHighValue) {
+		t.Errorf("Score() of a returning customer = %v, want no signal %s", a.Signals, SignalFirstTimeHighValue)
+	}
+}
+
+func TestNewHeuristicRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Config
+	}{
+		{"high amount", Config{HighAmount: "lots"}},
+		{"first order amount", Config{FirstOrderAmount: "-1"}},
+		{"decline window", Config{DeclineWindow: "a day"}},
+		{"review score above decline score", Config{ReviewScore: 80, DeclineScore: 60}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewHeuristic(tt.c, make([]byte, 32)); err == nil {
+			t.Errorf("NewHeuristic() with an invalid %s error = nil, want an error", tt.name)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	os.Setenv("RISK_RULES", `{"highAmount": "50.00"}`)
+	defer os.Unsetenv("RISK_RULES")
+
+	s, err := FromEnv(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := s.Score(Payment{Amount: amount(t, "50.00")}); !hasSignal(a, SignalHighAmount) {
+		t.Errorf("Score() = %v, want signal %s with the configured high amount", a.Signals, SignalHighAmount)
+	}
+
+	os.Setenv("RISK_RULES", `{"highAmount": `)
+	if _, err := FromEnv(make([]byte, 32)); err == nil {
+		t.Errorf("FromEnv() of malformed rules error = nil, want an error")
+	}
+}
+
+func TestHighAmountPerCurrency(t *testing.T) {
+	h, err := NewHeuristic(Config{
+		Currencies: map[string]Thresholds{
+			"eur": {HighAmount: "900.00", FirstOrderAmount: "225.00"},
+			"JPY": {HighAmount: "150000", FirstOrderAmount: "40000"},
+		},
+	}, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount string
+		want   bool
+	}{
+		{"999.99", false},
+		{"1000.00", true},
+		{"899.99 EUR", false},
+		{"900.00 EUR", true},
+		{"149999 JPY", false},
+		{"150000 JPY", true},
+		{"1.00 GBP", true},
+	}
+
+	for _, tt := range tests {
+		a := h.Score(Payment{Card: "4111111111111111", Amount: amount(t, tt.amount)})
+		if got := hasSignal(a, SignalHighAmount); got != tt.want {
+			t.Errorf("Score() of %s has signal %s = %v, want %v", tt.amount, SignalHighAmount, got, tt.want)
+		}
+	}
+}
+
+func TestFirstOrderAmountPerCurrency(t *testing.T) {
+	h, err := NewHeuristic(Config{
+		Currencies: map[string]Thresholds{
+			"EUR": {HighAmount: "900.00", FirstOrderAmount: "225.00"},
+		},
+	}, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Payment{Card: "4111111111111111", Amount: amount(t, "230.00 EUR"), CustomerID: "customer-1"}
+	if a := h.Score(p); !hasSignal(a, SignalFirstTimeHighValue) {
+		t.Errorf("Score() of a new customer = %v, want signal %s", a.Signals, SignalFirstTimeHighValue)
+	}
+
+	h.Observe(p, Approved)
+	if a := h.Score(p); hasSignal(a, SignalFirstTimeHighValue) {
+		t.Errorf("Score() of a returning customer = %v, want no signal %s", a.Signals, SignalFirstTimeHighValue)
+	}
+}
+
+func TestNewHeuristicRejectsInvalidThresholds(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Config
+	}{
+		{"unknown currency", Config{Currencies: map[string]Thresholds{"XXX": {HighAmount: "1", FirstOrderAmount: "1"}}}},
+		{"threshold in another currency", Config{Currencies: map[string]Thresholds{"EUR": {HighAmount: "900.00 GBP", FirstOrderAmount: "225.00"}}}},
+		{"missing threshold", Config{Currencies: map[string]Thresholds{"EUR": {HighAmount: "900.00"}}}},
+		{"thresholds in different currencies", Config{HighAmount: "1000.00 EUR", FirstOrderAmount: "250.00 USD"}},
+		{"too many decimals", Config{Currencies: map[string]Thresholds{"JPY": {HighAmount: "1000.5", FirstOrderAmount: "250"}}}},
+		{"customer window", Config{CustomerWindow: "-1h"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewHeuristic(tt.c, make([]byte, 32)); err == nil {
+				t.Errorf("NewHeuristic() returned no error")
+			}
+		})
+	}
+}
+
+func TestHistoryIsEvicted(t *testing.T) {
+	h, err := NewHeuristic(Config{DeclineWindow: "1h", CustomerWindow: "24h"}, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Observe(Payment{Card: "4111111111111111"}, Declined)
+	h.Observe(Payment{Card: "4111111111111111", CustomerID: "customer-1"}, Approved)
+
+	// Move the history back in time, past its windows and the sweep interval
+	h.mu.Lock()
+	for key := range h.declines {
+		h.declines[key] = []time.Time{time.Now().Add(-2 * time.Hour)}
+	}
+	h.customers["customer-1"] = time.Now().Add(-25 * time.Hour)
+	h.lastSweep = time.Now().Add(-2 * sweepInterval)
+	h.mu.Unlock()
+
+	h.Score(Payment{Card: "5555555555554444"})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.declines) != 0 || len(h.customers) != 0 {
+		t.Errorf("history has %d creditcards and %d customers, want none", len(h.declines), len(h.customers))
+	}
+}
+
+func TestFingerprintDependsOnSecret(t *testing.T) {
+	other := make([]byte, 32)
+	other[0] = 1
+
+	a, _ := NewHeuristic(DefaultConfig, make([]byte, 32))
+	b, _ := NewHeuristic(DefaultConfig, other)
+
+	if a.fingerprint("4111111111111111") != a.fingerprint("4111111111111111") {
+		t.Errorf("fingerprint() of the same creditcard differs")
+	}
+	if a.fingerprint("4111111111111111") == b.fingerprint("4111111111111111") {
+		t.Errorf("fingerprint() with another secret is the same")
+	}
+
+	// Without the secret, the creditcard number can't be found by hashing it
+	sum := sha256.Sum256([]byte("4111111111111111"))
+	if a.fingerprint("4111111111111111") == hex.EncodeToString(sum[:]) {
+		t.Errorf("fingerprint() is the SHA-256 digest of the creditcard number")
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	defer os.Unsetenv("RISK_KEY")
+
+	os.Unsetenv("RISK_KEY")
+	if key, err := KeyFromEnv(); key != nil || err != nil {
+		t.Errorf("KeyFromEnv() = %v, %v, want no key", key, err)
+	}
+
+	os.Setenv("RISK_KEY", base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	if _, err := KeyFromEnv(); err == nil {
+		t.Errorf("KeyFromEnv() accepted a 16 byte key")
+	}
+
+	os.Setenv("RISK_KEY", "not base64")
+	if _, err := KeyFromEnv(); err == nil {
+		t.Errorf("KeyFromEnv() accepted a key that isn't base64 encoded")
+	}
+
+	os.Setenv("RISK_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if key, err := KeyFromEnv(); len(key) != 32 || err != nil {
+		t.Errorf("KeyFromEnv() = %v, %v, want a 32 byte key", key, err)
+	}
+}
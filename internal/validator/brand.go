@@ -0,0 +1,205 @@
+package validator
+
+import (
+	"strconv"
+)
+
+// Brand is the card network a creditcard belongs to.
+type Brand string
+
+const (
+	// Visa cards
+	Visa Brand = "Visa"
+
+	// Mastercard cards
+	Mastercard Brand = "Mastercard"
+
+	// AmericanExpress cards
+	AmericanExpress Brand = "American Express"
+
+	// Discover cards
+	Discover Brand = "Discover"
+
+	// JCB cards
+	JCB Brand = "JCB"
+
+	// DinersClub cards
+	DinersClub Brand = "Diners Club"
+
+	// UnionPay cards
+	UnionPay Brand = "UnionPay"
+
+	// Maestro cards
+	Maestro Brand = "Maestro"
+
+	// UnknownBrand is used for cards that don't belong to a known network.
+	UnknownBrand Brand = "Unknown"
+)
+
+// iinRange is a range of issuer identification numbers. Both bounds
+// have the same number of digits and are inclusive.
+type iinRange struct {
+	low  int
+	high int
+}
+
+// brandSpec describes the IIN ranges, the valid number lengths, and the
+// length of the cvv code of a card network.
+type brandSpec struct {
+	brand   Brand
+	ranges  []iinRange
+	lengths []int
+	cvv     int
+}
+
+// brands contains the specifications of the known card networks. Networks with
+// more specific ranges come before networks with overlapping broader ranges.
+var brands = []brandSpec{
+	{
+		brand:   AmericanExpress,
+		ranges:  []iinRange{{34, 34}, {37, 37}},
+		lengths: []int{15},
+		cvv:     4,
+	},
+	{
+		brand:   DinersClub,
+		ranges:  []iinRange{{300, 305}, {3095, 3095}, {36, 36}, {38, 39}},
+		lengths: []int{14, 15, 16, 17, 18, 19},
+		cvv:     3,
+	},
+	{
+		brand:   JCB,
+		ranges:  []iinRange{{3528, 3589}},
+		lengths: []int{16, 17, 18, 19},
+		cvv:     3,
+	},
+	{
+		brand:   Visa,
+		ranges:  []iinRange{{4, 4}},
+		lengths: []int{13, 16, 19},
+		cvv:     3,
+	},
+	{
+		brand:   Mastercard,
+		ranges:  []iinRange{{51, 55}, {2221, 2720}},
+		lengths: []int{16},
+		cvv:     3,
+	},
+	{
+		brand:   Discover,
+		ranges:  []iinRange{{6011, 6011}, {622126, 622925}, {644, 649}, {65, 65}},
+		lengths: []int{16, 17, 18, 19},
+		cvv:     3,
+	},
+	{
+		brand:   UnionPay,
+		ranges:  []iinRange{{62, 62}, {81, 81}},
+		lengths: []int{16, 17, 18, 19},
+		cvv:     3,
+	},
+	{
+		brand:   Maestro,
+		ranges:  []iinRange{{5018, 5018}, {5020, 5020}, {5038, 5038}, {5893, 5893}, {6304, 6304}, {6759, 6759}, {6761, 6763}},
+		lengths: []int{12, 13, 14, 15, 16, 17, 18, 19},
+		cvv:     3,
+	},
+}
+
+// unknownSpec is used for cards that don't belong to a known network.
+var unknownSpec = brandSpec{
+	brand:   UnknownBrand,
+	lengths: []int{12, 13, 14, 15, 16, 17, 18, 19},
+	cvv:     3,
+}
+
+// DetectBrand determines the card network of the creditcard number using
+// the issuer identification number ranges.
+func DetectBrand(number string) Brand {
+	return specFor(number).brand
+}
+
+// knownBrand returns true when the name, ignoring case, is the name of a
+// known card network.
+func knownBrand(name string) bool {
+	for _, spec := range brands {
+		if contains([]string{string(spec.brand)}, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// specFor returns the specification of the card network the creditcard
+// number belongs to.
+func specFor(number string) brandSpec {
+	for _, spec := range brands {
+		for _, r := range spec.ranges {
+			if r.matches(number) {
+				return spec
+			}
+		}
+	}
+	return unknownSpec
+}
+
+// matches returns true when the number starts with a prefix in the range.
+func (r iinRange) matches(number string) bool {
+	digits := len(strconv.Itoa(r.low))
+	if len(number) < digits {
+		return false
+	}
+
+	prefix, err := strconv.Atoi(number[:digits])
+	if err != nil {
+		return false
+	}
+
+	return prefix >= r.low && prefix <= r.high
+}
+
+// validLength returns true when the length is valid for the card network.
+func (s brandSpec) validLength(length int) bool {
+	for _, l := range s.lengths {
+		if l == length {
+			return true
+		}
+	}
+	return false
+}
+
+// luhn returns true when the number consists of digits only and passes
+// the Luhn algorithm.
+func luhn(number string) bool {
+	if len(number) == 0 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// digitsOnly returns true when the string only contains digits.
+func digitsOnly(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
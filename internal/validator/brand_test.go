@@ -0,0 +1,206 @@
+package validator
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/retgits/creditcard"
+)
+
+// number returns a creditcard number of the length that starts with the prefix,
+// padded with zeros, and ends with the check digit that makes it pass the Luhn
+// algorithm.
+func number(prefix string, length int) string {
+	n := prefix + strings.Repeat("0", length-len(prefix)-1)
+
+	for d := 0; d <= 9; d++ {
+		if candidate := n + strconv.Itoa(d); luhn(candidate) {
+			return candidate
+		}
+	}
+
+	panic("no check digit for " + n)
+}
+
+// withNumber returns the valid creditcard with the number.
+func withNumber(n string) creditcard.Card {
+	card := visa
+	card.Number = n
+	return card
+}
+
+func TestDetectBrand(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   Brand
+	}{
+		{"34", AmericanExpress},
+		{"37", AmericanExpress},
+		{"35", UnknownBrand},
+		{"300", DinersClub},
+		{"305", DinersClub},
+		{"306", UnknownBrand},
+		{"3095", DinersClub},
+		{"3094", UnknownBrand},
+		{"36", DinersClub},
+		{"38", DinersClub},
+		{"39", DinersClub},
+		{"3527", UnknownBrand},
+		{"3528", JCB},
+		{"3589", JCB},
+		{"3590", UnknownBrand},
+		{"4", Visa},
+		{"50", UnknownBrand},
+		{"51", Mastercard},
+		{"55", Mastercard},
+		{"56", UnknownBrand},
+		{"2220", UnknownBrand},
+		{"2221", Mastercard},
+		{"2720", Mastercard},
+		{"2721", UnknownBrand},
+		{"6011", Discover},
+		{"6012", UnknownBrand},
+		{"622125", UnionPay},
+		{"622126", Discover},
+		{"622925", Discover},
+		{"622926", UnionPay},
+		{"643", UnknownBrand},
+		{"644", Discover},
+		{"649", Discover},
+		{"65", Discover},
+		{"62", UnionPay},
+		{"81", UnionPay},
+		{"5018", Maestro},
+		{"5020", Maestro},
+		{"5038", Maestro},
+		{"5893", Maestro},
+		{"6304", Maestro},
+		{"6759", Maestro},
+		{"6761", Maestro},
+		{"6763", Maestro},
+		{"6764", UnknownBrand},
+		{"9", UnknownBrand},
+	}
+
+	for _, tt := range tests {
+		if got := DetectBrand(number(tt.prefix, 16)); got != tt.want {
+			t.Errorf("DetectBrand() of a number starting with %s = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+
+	// Numbers shorter than the prefix of a range don't match it
+	for _, n := range []string{"", "5", "2", "abcd"} {
+		if got := DetectBrand(n); got != UnknownBrand {
+			t.Errorf("DetectBrand(%q) = %s, want %s", n, got, UnknownBrand)
+		}
+	}
+}
+
+func TestNumberLength(t *testing.T) {
+	tests := []struct {
+		prefix string
+		valid  []int
+		brand  Brand
+	}{
+		{"37", []int{15}, AmericanExpress},
+		{"36", []int{14, 15, 16, 17, 18, 19}, DinersClub},
+		{"3528", []int{16, 17, 18, 19}, JCB},
+		{"4", []int{13, 16, 19}, Visa},
+		{"51", []int{16}, Mastercard},
+		{"2221", []int{16}, Mastercard},
+		{"6011", []int{16, 17, 18, 19}, Discover},
+		{"62", []int{16, 17, 18, 19}, UnionPay},
+		{"6759", []int{12, 13, 14, 15, 16, 17, 18, 19}, Maestro},
+		{"9", []int{12, 13, 14, 15, 16, 17, 18, 19}, UnknownBrand},
+	}
+
+	for _, tt := range tests {
+		valid := make(map[int]bool)
+		for _, l := range tt.valid {
+			valid[l] = true
+		}
+
+		for length := 11; length <= 20; length++ {
+			var r Result
+			NumberRule{}.Check(Payment{Card: withNumber(number(tt.prefix, length))}, &r)
+
+			if got := r.Valid(); got != valid[length] {
+				t.Errorf("NumberRule of a %s number with %d digits is valid = %v, want %v", tt.brand, length, got, valid[length])
+			}
+		}
+	}
+}
+
+func TestNumberRuleRejectsInvalidNumbers(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+	}{
+		{"empty", ""},
+		{"wrong check digit", "4111111111111112"},
+		{"letters", "411111111111111a"},
+		{"spaces", "4111 1111 1111 1111"},
+		{"dashes", "4111-1111-1111-1111"},
+	}
+
+	for _, tt := range tests {
+		var r Result
+		NumberRule{}.Check(Payment{Card: withNumber(tt.number)}, &r)
+
+		if !hasCode(r, CodeInvalidNumber) {
+			t.Errorf("NumberRule of %s = %v, want %s", tt.name, r.Codes(), CodeInvalidNumber)
+		}
+	}
+}
+
+func TestCVVLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+		cvv    string
+		valid  bool
+	}{
+		{"Visa with 3 digits", number("4", 16), "123", true},
+		{"Visa with 4 digits", number("4", 16), "1234", false},
+		{"Visa with 2 digits", number("4", 16), "12", false},
+		{"Mastercard with 3 digits", number("2720", 16), "123", true},
+		{"Mastercard with 4 digits", number("2720", 16), "1234", false},
+		{"American Express with 4 digits", number("34", 15), "1234", true},
+		{"American Express with 3 digits", number("34", 15), "123", false},
+		{"American Express with 5 digits", number("34", 15), "12345", false},
+		{"Discover with 3 digits", number("65", 16), "123", true},
+		{"unknown network with 3 digits", number("9", 16), "123", true},
+		{"letters", number("4", 16), "12a", false},
+		{"empty", number("4", 16), "", false},
+	}
+
+	for _, tt := range tests {
+		card := withNumber(tt.number)
+		card.CVV = tt.cvv
+
+		var r Result
+		CVVRule{}.Check(Payment{Card: card}, &r)
+
+		if got := r.Valid(); got != tt.valid {
+			t.Errorf("CVVRule of %s is valid = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+
+	// Stored creditcards don't need a cvv code, but one that is sent is checked
+	card := withNumber(number("34", 15))
+	card.CVV = ""
+
+	var r Result
+	CVVRule{}.Check(Payment{Card: card, Stored: true}, &r)
+	if !r.Valid() {
+		t.Errorf("CVVRule of a stored card without a cvv code = %v, want valid", r.Codes())
+	}
+
+	card.CVV = "123"
+	r = Result{}
+	CVVRule{}.Check(Payment{Card: card, Stored: true}, &r)
+	if !hasCode(r, CodeInvalidCVV) {
+		t.Errorf("CVVRule of a stored card with a short cvv code = %v, want %s", r.Codes(), CodeInvalidCVV)
+	}
+}
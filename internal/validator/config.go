@@ -0,0 +1,261 @@
+package validator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// Config contains the rules the validator runs, in order. The default rules
+// always run, before the configured rules, unless they are configured
+// themselves, which sets their position, or they are disabled.
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+
+	// Disable contains the names of the default rules that don't run, like cvv.
+	Disable []string `json:"disable,omitempty"`
+}
+
+// RuleConfig configures a single rule. Only the fields that apply to the
+// rule with the name are used.
+type RuleConfig struct {
+	// Name is the name of the rule, like expiry or brands.
+	Name string `json:"name"`
+
+	// Brands contains the accepted brands for the brands rule.
+	Brands []string `json:"brands,omitempty"`
+
+	// Min is the minimum amount for the amount rule. An amount without a
+	// currency is in USD.
+	Min string `json:"min,omitempty"`
+
+	// Max is the maximum amount for the amount rule, in the same currency
+	// as Min.
+	Max string `json:"max,omitempty"`
+
+	// Limits contains the minimum and maximum amounts for the amount rule in
+	// other currencies, keyed by their ISO 4217 code.
+	Limits map[string]LimitConfig `json:"limits,omitempty"`
+
+	// Currencies contains the accepted currencies for the currency rule.
+	Currencies []string `json:"currencies,omitempty"`
+
+	// Blocked contains the blocked BIN ranges for the bins rule.
+	Blocked []string `json:"blocked,omitempty"`
+}
+
+// LimitConfig configures the minimum and maximum amount in a currency.
+type LimitConfig struct {
+	// Min is the minimum amount, like "1.00". No minimum is checked when empty.
+	Min string `json:"min,omitempty"`
+
+	// Max is the maximum amount, like "5000.00". No maximum is checked when empty.
+	Max string `json:"max,omitempty"`
+}
+
+// Factory creates a rule from its configuration.
+type Factory func(c RuleConfig) (Rule, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{
+		"expiry": func(c RuleConfig) (Rule, error) {
+			return ExpiryRule{}, nil
+		},
+		"number": func(c RuleConfig) (Rule, error) {
+			return NumberRule{}, nil
+		},
+		"cvv": func(c RuleConfig) (Rule, error) {
+			return CVVRule{}, nil
+		},
+		"brands": func(c RuleConfig) (Rule, error) {
+			if len(c.Brands) == 0 {
+				return nil, fmt.Errorf("rule brands needs at least one brand")
+			}
+			for _, b := range c.Brands {
+				if !knownBrand(b) {
+					return nil, fmt.Errorf("rule brands has an unknown brand %q", b)
+				}
+			}
+			return BrandRule{Brands: c.Brands}, nil
+		},
+		"amount": func(c RuleConfig) (Rule, error) {
+			limits := make(map[string]AmountLimit)
+			if len(c.Min) > 0 || len(c.Max) > 0 {
+				limit, err := parseLimit(LimitConfig{Min: c.Min, Max: c.Max}, "")
+				if err != nil {
+					return nil, fmt.Errorf("rule amount has an invalid limit: %s", err.Error())
+				}
+				limits[limitCurrency(limit)] = limit
+			}
+			for currency, lc := range c.Limits {
+				if !money.KnownCurrency(currency) {
+					return nil, fmt.Errorf("rule amount has limits for an unknown currency %q", currency)
+				}
+				limit, err := parseLimit(lc, strings.ToUpper(currency))
+				if err != nil {
+					return nil, fmt.Errorf("rule amount has an invalid limit for %s: %s", currency, err.Error())
+				}
+				limits[strings.ToUpper(currency)] = limit
+			}
+			if len(limits) == 0 {
+				return nil, fmt.Errorf("rule amount needs at least one limit")
+			}
+			return AmountRule{Limits: limits}, nil
+		},
+		"currency": func(c RuleConfig) (Rule, error) {
+			if len(c.Currencies) == 0 {
+				return nil, fmt.Errorf("rule currency needs at least one currency")
+			}
+			for _, currency := range c.Currencies {
+				if !money.KnownCurrency(currency) {
+					return nil, fmt.Errorf("rule currency has an unknown currency %q", currency)
+				}
+			}
+			return CurrencyRule{Currencies: c.Currencies}, nil
+		},
+		"bins": func(c RuleConfig) (Rule, error) {
+			return BINRule{Blocked: c.Blocked}, nil
+		},
+	}
+)
+
+// parseLimit parses the minimum and maximum amount, which are in the currency unless
+// they specify one. It returns an error if an amount is not valid, the amounts are in
+// another currency, or the minimum is more than the maximum.
+func parseLimit(lc LimitConfig, currency string) (AmountLimit, error) {
+	var limit AmountLimit
+
+	for _, l := range []struct {
+		value string
+		dst   **money.Money
+	}{{lc.Min, &limit.Min}, {lc.Max, &limit.Max}} {
+		if len(l.value) == 0 {
+			continue
+		}
+
+		m, err := money.Parse(l.value, currency)
+		if err != nil {
+			return AmountLimit{}, fmt.Errorf("%q is not valid: %s", l.value, err.Error())
+		}
+		if len(currency) > 0 && m.Currency != currency {
+			return AmountLimit{}, fmt.Errorf("%q is not in %s", l.value, currency)
+		}
+
+		// The first amount with a currency sets it for the other
+		currency = m.Currency
+		*l.dst = &m
+	}
+
+	if limit.Min != nil && limit.Max != nil {
+		if cmp, _ := limit.Min.Cmp(*limit.Max); cmp > 0 {
+			return AmountLimit{}, fmt.Errorf("minimum %s is more than maximum %s", limit.Min, limit.Max)
+		}
+	}
+
+	return limit, nil
+}
+
+// limitCurrency returns the currency of the limit.
+func limitCurrency(l AmountLimit) string {
+	if l.Min != nil {
+		return l.Min.Currency
+	}
+	return l.Max.Currency
+}
+
+// Register makes a rule available in the configuration under the name. If
+// a rule with the name already exists, it is replaced.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	factories[name] = f
+}
+
+// FromConfig creates a new instance of the validator with the rules in the
+// configuration, after the default rules that aren't configured or disabled. It
+// returns an error if a rule is unknown or misconfigured, or a disabled rule is
+// not a default rule.
+func FromConfig(c Config) (Validator, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	skip := make(map[string]bool)
+	for _, rc := range c.Rules {
+		skip[rc.Name] = true
+	}
+
+	defaults := make(map[string]bool)
+	for _, rule := range DefaultRules() {
+		defaults[rule.Name()] = true
+	}
+
+	for _, name := range c.Disable {
+		if !defaults[name] {
+			return nil, fmt.Errorf("validation rule %q can't be disabled, as it isn't a default rule", name)
+		}
+		skip[name] = true
+	}
+
+	var rules []Rule
+	for _, rule := range DefaultRules() {
+		if !skip[rule.Name()] {
+			rules = append(rules, rule)
+		}
+	}
+
+	for _, rc := range c.Rules {
+		f, ok := factories[rc.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown validation rule %q", rc.Name)
+		}
+
+		rule, err := f(rc)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	// Without any rule, New would fall back to the default rules
+	if len(rules) == 0 {
+		return &chain{}, nil
+	}
+
+	return New(rules...), nil
+}
+
+// FromEnv creates a new instance of the validator with the rules configured
+// in the environment. The environment variable VALIDATION_RULES can contain
+// the JSON encoded configuration, or VALIDATION_CONFIG can point to a file
+// that contains it. When neither is set, the default rules are used. It
+// returns an error if the configuration could not be read.
+func FromEnv() (Validator, error) {
+	var payload []byte
+
+	switch {
+	case len(os.Getenv("VALIDATION_RULES")) > 0:
+		payload = []byte(os.Getenv("VALIDATION_RULES"))
+	case len(os.Getenv("VALIDATION_CONFIG")) > 0:
+		var err error
+		payload, err = ioutil.ReadFile(os.Getenv("VALIDATION_CONFIG"))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return New(), nil
+	}
+
+	var c Config
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("error parsing validation rules: %s", err.Error())
+	}
+
+	return FromConfig(c)
+}
@@ -0,0 +1,173 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/retgits/creditcard"
+)
+
+func TestFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{"no rules", Config{}, false},
+		{"configured rules", Config{Rules: []RuleConfig{{Name: "brands", Brands: []string{"Visa"}}, {Name: "amount", Max: "100.00"}}}, false},
+		{"unknown rule", Config{Rules: []RuleConfig{{Name: "luck"}}}, true},
+		{"brands without brands", Config{Rules: []RuleConfig{{Name: "brands"}}}, true},
+		{"currency without currencies", Config{Rules: []RuleConfig{{Name: "currency"}}}, true},
+		{"amount with invalid limit", Config{Rules: []RuleConfig{{Name: "amount", Min: "one"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromConfig(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FromConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// closedRule declines every payment.
+type closedRule struct{}
+
+func (closedRule) Name() string { return "closed" }
+
+func (closedRule) Check(p Payment, r *Result) {
+	r.Add("closed", "", "the shop is closed")
+}
+
+func TestRegister(t *testing.T) {
+	Register("closed", func(c RuleConfig) (Rule, error) {
+		return closedRule{}, nil
+	})
+
+	v, err := FromConfig(Config{Rules: []RuleConfig{{Name: "closed"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := v.Validate(Payment{Card: visa, Amount: "10.00"}); !hasCode(r, "closed") {
+		t.Errorf("Validate() = %v, want the registered rule to decline", r.Codes())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(file, []byte(`{"rules":[{"name":"currency","currencies":["EUR"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     string
+		value   string
+		wantErr bool
+		want    Code
+	}{
+		{"rules", "VALIDATION_RULES", `{"rules":[{"name":"amount","max":"5.00"}]}`, false, CodeAmountTooHigh},
+		{"malformed rules", "VALIDATION_RULES", `{"rules":`, true, ""},
+		{"file", "VALIDATION_CONFIG", file, false, CodeCurrencyNotAccepted},
+		{"missing file", "VALIDATION_CONFIG", filepath.Join(dir, "missing.json"), true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(tt.env, tt.value)
+			defer os.Unsetenv(tt.env)
+
+			v, err := FromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if r := v.Validate(Payment{Card: visa, Amount: "10.00"}); !hasCode(r, tt.want) {
+				t.Errorf("Validate() = %v, want %s", r.Codes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFromConfigKeepsDefaultRules(t *testing.T) {
+	expired := visa
+	expired.ExpiryYear = 2001
+
+	noCVV := visa
+	noCVV.CVV = ""
+
+	badNumber := visa
+	badNumber.Number = "4111111111111112"
+
+	tests := []struct {
+		name string
+		c    Config
+		card creditcard.Card
+		want Code
+	}{
+		{"expired with another rule", Config{Rules: []RuleConfig{{Name: "brands", Brands: []string{"Visa"}}}}, expired, CodeExpired},
+		{"invalid number with another rule", Config{Rules: []RuleConfig{{Name: "bins"}}}, badNumber, CodeInvalidNumber},
+		{"no cvv with another rule", Config{Rules: []RuleConfig{{Name: "bins"}}}, noCVV, CodeInvalidCVV},
+		{"no cvv with cvv disabled", Config{Rules: []RuleConfig{{Name: "bins"}}, Disable: []string{"cvv"}}, noCVV, ""},
+		{"expired with everything disabled", Config{Disable: []string{"expiry", "number", "cvv"}}, expired, ""},
+		{"expired with the rule configured", Config{Rules: []RuleConfig{{Name: "bins"}, {Name: "expiry"}}}, expired, CodeExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := FromConfig(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := v.Validate(Payment{Card: tt.card, Amount: "10.00"})
+			if tt.want == "" && !r.Valid() {
+				t.Errorf("Validate() = %v, want valid", r.Codes())
+			}
+			if tt.want != "" && !hasCode(r, tt.want) {
+				t.Errorf("Validate() = %v, want %s", r.Codes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFromConfigRunsDefaultRulesOnce(t *testing.T) {
+	v, err := FromConfig(Config{Rules: []RuleConfig{{Name: "bins"}, {Name: "expiry"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, rule := range v.(*chain).rules {
+		names = append(names, rule.Name())
+	}
+
+	want := []string{"number", "cvv", "bins", "expiry"}
+	if len(names) != len(want) {
+		t.Fatalf("FromConfig() runs %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("FromConfig() runs %v, want %v", names, want)
+		}
+	}
+}
+
+func TestFromConfigDisablesOnlyDefaultRules(t *testing.T) {
+	if _, err := FromConfig(Config{Disable: []string{"bins"}}); err == nil {
+		t.Errorf("FromConfig() disabled a rule that isn't a default rule")
+	}
+}
@@ -1,45 +1,102 @@
-// Package validator validates the creditcard and leverages the
-// github.com/retgits/creditcard module to check expiry, creditcard
-// number, and cvv code.
+// Package validator validates payments by running them through a chain of
+// rules. The built-in rules check the expiry, leveraging the
+// github.com/retgits/creditcard module, and the creditcard number and cvv
+// code for the card network the creditcard belongs to. They can be combined
+// with rules for the card brand, amount, currency, and blocked BIN ranges.
 package validator
 
 import (
 	"fmt"
 
+	"github.com/retgits/acme-serverless-payment/internal/money"
 	"github.com/retgits/creditcard"
 )
 
-type check struct{}
+// Payment contains the data of a payment that needs to be validated.
+type Payment struct {
+	// Card used for the payment.
+	Card creditcard.Card
 
-// New creates a new instance of the validator.
-func New() check {
-	return check{}
+	// Stored is true when the creditcard was taken from the vault. Stored
+	// creditcards don't have to come with a cvv code.
+	Stored bool
+
+	// Amount is the monetary value of the payment, like "12.50" or "12.50 EUR".
+	Amount string
+
+	// Currency is the ISO 4217 code of the currency of the payment, when
+	// the amount doesn't contain one.
+	Currency string
+
+	// Money is the parsed amount. It is set by the validator before the
+	// rules run, and is nil when the amount isn't valid.
+	Money *money.Money
+}
+
+// Validator is the interface that describes the methods a validator
+// needs to implement to be able to validate payments for the ACME
+// Serverless Fitness Shop.
+type Validator interface {
+	Validate(p Payment) Result
 }
 
-// Creditcard validates the creditcard using the logic from github.com/retgits/creditcard.
-func (v *check) Creditcard(card creditcard.Card) error {
-	// Validate the card
-	res := card.Validate()
+// chain contains the rules that implement the methods of the
+// Validator interface.
+type chain struct {
+	rules []Rule
+}
 
-	if res.IsExpired == true {
-		return fmt.Errorf("creditcard has expired")
+// New creates a new instance of the validator that runs the payment through
+// the rules, in order. Without rules, the default rules are used.
+func New(rules ...Rule) Validator {
+	if len(rules) == 0 {
+		rules = DefaultRules()
 	}
 
-	if res.ValidCardNumber == false {
-		return fmt.Errorf("creditcard number is not valid")
+	return &chain{
+		rules: rules,
 	}
+}
 
-	if res.ValidExpiryMonth == false || res.ValidExpiryYear == false {
-		return fmt.Errorf("creditcard expiration is not valid")
+// Validate parses the amount of the payment and runs the payment through all rules.
+// The result contains the card network of the creditcard, the parsed amount, and
+// lists every check the payment didn't pass.
+func (c *chain) Validate(p Payment) Result {
+	r := Result{
+		Brand: DetectBrand(p.Card.Number),
 	}
 
-	if res.ValidCVV == false {
-		return fmt.Errorf("creditcard cvv is not valid")
+	m, err := money.Parse(p.Amount, p.Currency)
+	switch {
+	case err != nil:
+		r.Add(amountCode(err), "total", fmt.Sprintf("amount %q is not valid: %s", p.Amount, err.Error()))
+	case m.IsZero():
+		r.Add(CodeZeroAmount, "total", "amount must be more than zero")
+	default:
+		p.Money = &m
+		p.Currency = m.Currency
+		r.Amount = &m
 	}
 
-	if res.ValidCardNumber == false {
-		return fmt.Errorf("creditcard cvv is not valid")
+	for _, rule := range c.rules {
+		rule.Check(p, &r)
 	}
 
-	return nil
+	return r
+}
+
+// amountCode returns the decline code for the error returned when parsing an amount.
+func amountCode(err error) Code {
+	switch err {
+	case money.ErrNegative:
+		return CodeNegativeAmount
+	case money.ErrPrecision:
+		return CodeInvalidPrecision
+	case money.ErrUnknownCurrency:
+		return CodeUnknownCurrency
+	case money.ErrTooLarge:
+		return CodeAmountTooHigh
+	default:
+		return CodeInvalidAmount
+	}
 }
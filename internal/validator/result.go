@@ -0,0 +1,138 @@
+package validator
+
+import (
+	"strings"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// Code is a stable, machine-readable reason why a payment is declined.
+type Code string
+
+const (
+	// CodeExpired means the creditcard has expired.
+	CodeExpired Code = "card_expired"
+
+	// CodeInvalidNumber means the creditcard number is not valid.
+	CodeInvalidNumber Code = "invalid_number"
+
+	// CodeInvalidExpiryMonth means the expiry month is not a valid month.
+	CodeInvalidExpiryMonth Code = "invalid_expiry_month"
+
+	// CodeInvalidExpiryYear means the expiry year is not a valid year.
+	CodeInvalidExpiryYear Code = "invalid_expiry_year"
+
+	// CodeInvalidCVV means the cvv code is not valid.
+	CodeInvalidCVV Code = "invalid_cvv"
+
+	// CodeInvalidAmount means the amount of the payment is not a number.
+	CodeInvalidAmount Code = "invalid_amount"
+
+	// CodeNegativeAmount means the amount of the payment is negative.
+	CodeNegativeAmount Code = "negative_amount"
+
+	// CodeZeroAmount means the amount of the payment is zero.
+	CodeZeroAmount Code = "zero_amount"
+
+	// CodeInvalidPrecision means the amount has more decimals than the
+	// currency allows.
+	CodeInvalidPrecision Code = "invalid_amount_precision"
+
+	// CodeUnknownCurrency means the currency is not a known ISO 4217 currency.
+	CodeUnknownCurrency Code = "unknown_currency"
+
+	// CodeAmountTooLow means the amount is less than the minimum.
+	CodeAmountTooLow Code = "amount_too_low"
+
+	// CodeAmountTooHigh means the amount is more than the maximum, or
+	// more than the service can handle.
+	CodeAmountTooHigh Code = "amount_too_high"
+
+	// CodeBrandNotAccepted means the brand of the creditcard is not accepted.
+	CodeBrandNotAccepted Code = "brand_not_accepted"
+
+	// CodeCurrencyNotAccepted means the currency of the payment is not accepted.
+	CodeCurrencyNotAccepted Code = "currency_not_accepted"
+
+	// CodeBlockedBIN means the creditcard number is in a blocked BIN range.
+	CodeBlockedBIN Code = "card_blocked"
+
+	// CodeInvalidToken means the card token is not known.
+	CodeInvalidToken Code = "invalid_card_token"
+
+	// CodeVelocityExceeded means too many payments were attempted with the same
+	// creditcard, for the same order, or from the same client.
+	CodeVelocityExceeded Code = "velocity_exceeded"
+
+	// CodeRiskDeclined means the risk that the payment is fraudulent is too high.
+	CodeRiskDeclined Code = "risk_declined"
+)
+
+// Failure is a single check the payment didn't pass.
+type Failure struct {
+	// Code is the machine-readable reason of the failure.
+	Code Code
+
+	// Field is the field of the payment that caused the failure.
+	Field string
+
+	// Message is the human-readable reason of the failure.
+	Message string
+}
+
+// Result is the result of validating a payment.
+type Result struct {
+	// Brand is the card network the creditcard belongs to.
+	Brand Brand
+
+	// Amount is the parsed amount of the payment, or nil when the
+	// amount isn't valid.
+	Amount *money.Money
+
+	// Failures contains every check the payment didn't pass.
+	Failures []Failure
+}
+
+// Valid returns true when the payment passed all checks.
+func (r Result) Valid() bool {
+	return len(r.Failures) == 0
+}
+
+// Codes returns the codes of all failed checks.
+func (r Result) Codes() []Code {
+	codes := make([]Code, len(r.Failures))
+	for i, f := range r.Failures {
+		codes[i] = f.Code
+	}
+	return codes
+}
+
+// Err returns an error describing all failed checks, or nil when the
+// payment passed all checks.
+func (r Result) Err() error {
+	if r.Valid() {
+		return nil
+	}
+	return resultError(r)
+}
+
+// Add appends a failed check to the result.
+func (r *Result) Add(code Code, field string, message string) {
+	r.Failures = append(r.Failures, Failure{
+		Code:    code,
+		Field:   field,
+		Message: message,
+	})
+}
+
+// resultError is the error representation of a Result.
+type resultError Result
+
+// Error returns the messages of all failed checks.
+func (e resultError) Error() string {
+	messages := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		messages[i] = f.Message
+	}
+	return strings.Join(messages, ", ")
+}
@@ -0,0 +1,88 @@
+package validator
+
+import (
+	"testing"
+
+	"github.com/retgits/creditcard"
+)
+
+// visa is a valid creditcard.
+var visa = creditcard.Card{
+	Type:        "Visa",
+	Number:      "4111111111111111",
+	ExpiryMonth: 12,
+	ExpiryYear:  2099,
+	CVV:         "123",
+}
+
+// hasCode returns true when the result contains the decline code.
+func hasCode(r Result, code Code) bool {
+	for _, c := range r.Codes() {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidate(t *testing.T) {
+	expired := visa
+	expired.ExpiryYear = 2001
+
+	badNumber := visa
+	badNumber.Number = "4111111111111112"
+
+	badMonth := visa
+	badMonth.ExpiryMonth = 13
+
+	badNumberAndCVV := visa
+	badNumberAndCVV.Number = "4111111111111112"
+	badNumberAndCVV.CVV = "12"
+
+	tests := []struct {
+		name string
+		card creditcard.Card
+		want []Code
+	}{
+		{"valid", visa, nil},
+		{"expired", expired, []Code{CodeExpired}},
+		{"invalid number", badNumber, []Code{CodeInvalidNumber}},
+		{"invalid month isn't reported as expired", badMonth, []Code{CodeInvalidExpiryMonth}},
+		{"every failure is reported", badNumberAndCVV, []Code{CodeInvalidNumber, CodeInvalidCVV}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New().Validate(Payment{Card: tt.card, Amount: "10.00"})
+
+			if r.Valid() != (len(tt.want) == 0) {
+				t.Errorf("Validate().Valid() = %v, want %v", r.Valid(), len(tt.want) == 0)
+			}
+
+			got := r.Codes()
+			if len(got) != len(tt.want) {
+				t.Fatalf("Validate().Codes() = %v, want %v", got, tt.want)
+			}
+			for _, code := range tt.want {
+				if !hasCode(r, code) {
+					t.Errorf("Validate().Codes() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResultErr(t *testing.T) {
+	if err := (Result{}).Err(); err != nil {
+		t.Errorf("Err() of a valid result = %v, want nil", err)
+	}
+
+	var r Result
+	r.Add(CodeInvalidNumber, "number", "creditcard number is not valid")
+	r.Add(CodeInvalidCVV, "cvv", "creditcard cvv is not valid")
+
+	want := "creditcard number is not valid, creditcard cvv is not valid"
+	if err := r.Err(); err == nil || err.Error() != want {
+		t.Errorf("Err() = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,240 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+// Rule is the interface that describes the methods a single check of
+// the validator needs to implement.
+type Rule interface {
+	// Name returns the name of the rule, as used in the configuration.
+	Name() string
+
+	// Check adds a Failure to the result for every check the payment
+	// doesn't pass.
+	Check(p Payment, r *Result)
+}
+
+// DefaultRules returns the rules that run unless they are disabled. These
+// check the expiry, creditcard number, and cvv code.
+func DefaultRules() []Rule {
+	return []Rule{
+		ExpiryRule{},
+		NumberRule{},
+		CVVRule{},
+	}
+}
+
+// ExpiryRule checks the creditcard has a valid expiry month and year
+// and hasn't expired.
+type ExpiryRule struct{}
+
+// Name returns the name of the rule.
+func (ExpiryRule) Name() string {
+	return "expiry"
+}
+
+// Check validates the expiration of the creditcard.
+func (ExpiryRule) Check(p Payment, r *Result) {
+	res := p.Card.Validate()
+
+	// A card with an invalid expiration is always expired, so that
+	// is only reported when the expiration itself is valid
+	if res.IsExpired && res.ValidExpiryMonth && res.ValidExpiryYear {
+		r.Add(CodeExpired, "expiry", "creditcard has expired")
+	}
+
+	if !res.ValidExpiryMonth {
+		r.Add(CodeInvalidExpiryMonth, "expiryMonth", "creditcard expiration month is not valid")
+	}
+
+	if !res.ValidExpiryYear {
+		r.Add(CodeInvalidExpiryYear, "expiryYear", "creditcard expiration year is not valid")
+	}
+}
+
+// NumberRule checks the creditcard number passes the Luhn algorithm and has
+// a valid length for the card network it belongs to.
+type NumberRule struct{}
+
+// Name returns the name of the rule.
+func (NumberRule) Name() string {
+	return "number"
+}
+
+// Check validates the creditcard number.
+func (NumberRule) Check(p Payment, r *Result) {
+	spec := specFor(p.Card.Number)
+
+	switch {
+	case !luhn(p.Card.Number):
+		r.Add(CodeInvalidNumber, "number", "creditcard number is not valid")
+	case !spec.validLength(len(p.Card.Number)):
+		r.Add(CodeInvalidNumber, "number", fmt.Sprintf("creditcard number has an invalid length for %s", spec.brand))
+	}
+}
+
+// CVVRule checks the cvv code has the right length for the card network,
+// like the four digit CID of American Express cards.
+type CVVRule struct{}
+
+// Name returns the name of the rule.
+func (CVVRule) Name() string {
+	return "cvv"
+}
+
+// Check validates the cvv code. Stored creditcards without a cvv code are skipped.
+func (CVVRule) Check(p Payment, r *Result) {
+	if p.Stored && len(p.Card.CVV) == 0 {
+		return
+	}
+
+	spec := specFor(p.Card.Number)
+
+	if len(p.Card.CVV) != spec.cvv || !digitsOnly(p.Card.CVV) {
+		r.Add(CodeInvalidCVV, "cvv", fmt.Sprintf("creditcard cvv is not valid, %s cards need %d digits", spec.brand, spec.cvv))
+	}
+}
+
+// BrandRule checks the card network of the creditcard is accepted.
+type BrandRule struct {
+	// Brands contains the names of the accepted card networks, like Visa.
+	Brands []string
+}
+
+// Name returns the name of the rule.
+func (BrandRule) Name() string {
+	return "brands"
+}
+
+// Check validates the card network of the creditcard is in the list of accepted brands.
+func (b BrandRule) Check(p Payment, r *Result) {
+	brand := DetectBrand(p.Card.Number)
+	if !contains(b.Brands, string(brand)) {
+		r.Add(CodeBrandNotAccepted, "number", fmt.Sprintf("creditcard brand %q is not accepted", brand))
+	}
+}
+
+// AmountRule checks the amount of the payment is within the limits of its currency.
+type AmountRule struct {
+	// Limits contains the limits, keyed by the ISO 4217 code of their currency.
+	// Payments in a currency without limits are declined.
+	Limits map[string]AmountLimit
+}
+
+// AmountLimit contains the minimum and maximum amount in a currency.
+type AmountLimit struct {
+	// Min is the minimum amount. No minimum is checked when nil.
+	Min *money.Money
+
+	// Max is the maximum amount. No maximum is checked when nil.
+	Max *money.Money
+}
+
+// Name returns the name of the rule.
+func (AmountRule) Name() string {
+	return "amount"
+}
+
+// Check validates the amount of the payment is between the minimum and maximum of its
+// currency. Payments in a currency without limits are declined, as they can't be checked.
+// Payments with an invalid amount are skipped, as the validator already declined those.
+func (a AmountRule) Check(p Payment, r *Result) {
+	if p.Money == nil {
+		return
+	}
+
+	limit, ok := a.Limits[p.Money.Currency]
+	if !ok {
+		r.Add(CodeCurrencyNotAccepted, "currency", fmt.Sprintf("currency %q has no amount limits", p.Money.Currency))
+		return
+	}
+
+	if limit.Min != nil {
+		if cmp, err := p.Money.Cmp(*limit.Min); err != nil || cmp < 0 {
+			r.Add(CodeAmountTooLow, "total", fmt.Sprintf("amount is less than the minimum of %s", limit.Min))
+		}
+	}
+
+	if limit.Max != nil {
+		if cmp, err := p.Money.Cmp(*limit.Max); err != nil || cmp > 0 {
+			r.Add(CodeAmountTooHigh, "total", fmt.Sprintf("amount is more than the maximum of %s", limit.Max))
+		}
+	}
+}
+
+// CurrencyRule checks the currency of the payment is accepted.
+type CurrencyRule struct {
+	// Currencies contains the ISO 4217 codes of the accepted currencies.
+	Currencies []string
+}
+
+// Name returns the name of the rule.
+func (CurrencyRule) Name() string {
+	return "currency"
+}
+
+// Check validates the currency of the payment is in the list of accepted currencies.
+// Payments with an invalid amount are skipped, as the validator already declined those.
+func (c CurrencyRule) Check(p Payment, r *Result) {
+	if p.Money == nil {
+		return
+	}
+
+	if !contains(c.Currencies, p.Currency) {
+		r.Add(CodeCurrencyNotAccepted, "currency", fmt.Sprintf("currency %q is not accepted", p.Currency))
+	}
+}
+
+// BINRule checks the creditcard number isn't in a blocked BIN range.
+type BINRule struct {
+	// Blocked contains the blocked ranges. A range is either a prefix, like
+	// "4000", or two prefixes of equal length separated by a dash, like
+	// "400000-400099".
+	Blocked []string
+}
+
+// Name returns the name of the rule.
+func (BINRule) Name() string {
+	return "bins"
+}
+
+// Check validates the creditcard number doesn't start with a blocked prefix.
+func (b BINRule) Check(p Payment, r *Result) {
+	for _, blocked := range b.Blocked {
+		if inRange(p.Card.Number, blocked) {
+			r.Add(CodeBlockedBIN, "number", "creditcard is not accepted")
+			return
+		}
+	}
+}
+
+// inRange returns true when the number starts with the prefix, or starts with
+// a prefix between the lower and upper bound of the range.
+func inRange(number string, blocked string) bool {
+	parts := strings.SplitN(blocked, "-", 2)
+	if len(parts) == 1 {
+		return strings.HasPrefix(number, blocked)
+	}
+
+	low, high := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if len(low) != len(high) || len(number) < len(low) {
+		return false
+	}
+
+	prefix := number[:len(low)]
+	return prefix >= low && prefix <= high
+}
+
+// contains returns true when the list contains the value, ignoring case.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package validator
+
+import (
+	"testing"
+
+	"github.com/retgits/acme-serverless-payment/internal/money"
+)
+
+func TestRules(t *testing.T) {
+	mastercard := visa
+	mastercard.Type = ""
+	mastercard.Number = "5555555555554444"
+
+	parse := func(s string) *money.Money {
+		if s == "" {
+			return nil
+		}
+		m, err := money.Parse(s, money.DefaultCurrency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &m
+	}
+	limit := func(min, max string) AmountRule {
+		return AmountRule{Limits: map[string]AmountLimit{money.DefaultCurrency: {Min: parse(min), Max: parse(max)}}}
+	}
+
+	tests := []struct {
+		name string
+		rule Rule
+		p    Payment
+		want Code
+	}{
+		{"accepted brand", BrandRule{Brands: []string{"visa"}}, Payment{Card: visa, Amount: "10.00"}, ""},
+		{"brand not accepted", BrandRule{Brands: []string{"Visa"}}, Payment{Card: mastercard, Amount: "10.00"}, CodeBrandNotAccepted},
+		{"amount within limits", limit("1.00", "100.00"), Payment{Card: visa, Amount: "10.00"}, ""},
+		{"amount below minimum", limit("1.00", ""), Payment{Card: visa, Amount: "0.99"}, CodeAmountTooLow},
+		{"amount above maximum", limit("", "100.00"), Payment{Card: visa, Amount: "100.01"}, CodeAmountTooHigh},
+		{"accepted currency", CurrencyRule{Currencies: []string{"USD", "EUR"}}, Payment{Card: visa, Amount: "10.00", Currency: "eur"}, ""},
+		{"currency not accepted", CurrencyRule{Currencies: []string{"USD"}}, Payment{Card: visa, Amount: "10.00 GBP"}, CodeCurrencyNotAccepted},
+		{"blocked prefix", BINRule{Blocked: []string{"4111"}}, Payment{Card: visa, Amount: "10.00"}, CodeBlockedBIN},
+		{"blocked range", BINRule{Blocked: []string{"411000-411200"}}, Payment{Card: visa, Amount: "10.00"}, CodeBlockedBIN},
+		{"outside blocked range", BINRule{Blocked: []string{"411200-411300"}}, Payment{Card: visa, Amount: "10.00"}, ""},
+		{"range of unequal prefixes", BINRule{Blocked: []string{"41-4112"}}, Payment{Card: visa, Amount: "10.00"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(tt.rule).Validate(tt.p)
+
+			if tt.want == "" && !r.Valid() {
+				t.Errorf("Validate() with rule %s = %v, want valid", tt.rule.Name(), r.Codes())
+			}
+			if tt.want != "" && !hasCode(r, tt.want) {
+				t.Errorf("Validate() with rule %s = %v, want %s", tt.rule.Name(), r.Codes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Code
+	}{
+		{"10.00", "", ""},
+		{"1500", "JPY", ""},
+		{"ten", "", CodeInvalidAmount},
+		{"-10.00", "", CodeNegativeAmount},
+		{"0.00", "", CodeZeroAmount},
+		{"10.001", "", CodeInvalidPrecision},
+		{"1500.5", "JPY", CodeInvalidPrecision},
+		{"10.00 XXX", "", CodeUnknownCurrency},
+		{"99999999999999999999", "", CodeAmountTooHigh},
+	}
+
+	for _, tt := range tests {
+		r := New(BINRule{}).Validate(Payment{Card: visa, Amount: tt.amount, Currency: tt.currency})
+
+		if tt.want == "" && (!r.Valid() || r.Amount == nil) {
+			t.Errorf("Validate() of %q = %v, want valid with the parsed amount", tt.amount, r.Codes())
+		}
+		if tt.want != "" && (!hasCode(r, tt.want) || r.Amount != nil) {
+			t.Errorf("Validate() of %q = %v, want %s", tt.amount, r.Codes(), tt.want)
+		}
+	}
+}
+
+func TestValidateUsesDefaultCurrency(t *testing.T) {
+	r := New(CurrencyRule{Currencies: []string{money.DefaultCurrency}}).Validate(Payment{Card: visa, Amount: "10.00"})
+
+	if !r.Valid() || r.Amount.Currency != money.DefaultCurrency {
+		t.Errorf("Validate() of a payment without currency = %v, want valid in %s", r.Codes(), money.DefaultCurrency)
+	}
+}
+
+func TestAmountRule(t *testing.T) {
+	v, err := FromConfig(Config{Rules: []RuleConfig{{
+		Name: "amount",
+		Min:  "1.00",
+		Max:  "5000.00",
+		Limits: map[string]LimitConfig{
+			"eur": {Min: "1.00", Max: "4500.00"},
+			"JPY": {Max: "700000"},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount string
+		want   Code
+	}{
+		{"0.99", CodeAmountTooLow},
+		{"1.00", ""},
+		{"5000.00", ""},
+		{"5000.01", CodeAmountTooHigh},
+		{"4500.00 EUR", ""},
+		{"4500.01 EUR", CodeAmountTooHigh},
+		{"0.50 EUR", CodeAmountTooLow},
+		{"700000 JPY", ""},
+		{"700001 JPY", CodeAmountTooHigh},
+		{"1.00 GBP", CodeCurrencyNotAccepted},
+		{"1.005", CodeInvalidPrecision},
+	}
+
+	for _, tt := range tests {
+		r := v.Validate(Payment{Card: visa, Amount: tt.amount})
+
+		if tt.want == "" && !r.Valid() {
+			t.Errorf("Validate() of %s = %v, want valid", tt.amount, r.Codes())
+		}
+		if tt.want != "" && !hasCode(r, tt.want) {
+			t.Errorf("Validate() of %s = %v, want %s", tt.amount, r.Codes(), tt.want)
+		}
+	}
+}
+
+func TestAmountRuleConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		rc   RuleConfig
+	}{
+		{"no limits", RuleConfig{}},
+		{"too many decimals", RuleConfig{Max: "10.005"}},
+		{"too many decimals for the currency", RuleConfig{Limits: map[string]LimitConfig{"JPY": {Max: "10.50"}}}},
+		{"limits in different currencies", RuleConfig{Min: "1.00", Max: "5000.00 EUR"}},
+		{"limit in another currency", RuleConfig{Limits: map[string]LimitConfig{"EUR": {Max: "5000.00 GBP"}}}},
+		{"unknown currency", RuleConfig{Limits: map[string]LimitConfig{"XXX": {Max: "10"}}}},
+		{"minimum more than maximum", RuleConfig{Min: "10.00", Max: "1.00"}},
+		{"not a number", RuleConfig{Min: "one"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rc.Name = "amount"
+			if _, err := FromConfig(Config{Rules: []RuleConfig{tt.rc}}); err == nil {
+				t.Errorf("FromConfig() returned no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Package vault contains the interfaces that the Payment service in the ACME
+// Serverless Fitness Shop needs to exchange creditcard numbers for opaque tokens.
+// Once a creditcard has a token, payments can reference the token instead of the
+// creditcard, and the service only logs, ledgers, and emits the token or the
+// masked creditcard number. In order to add a new storage service, the Vault
+// interface needs to be implemented.
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/retgits/creditcard"
+)
+
+// TokenPrefix is the prefix of every token, so tokens can't be mistaken for
+// creditcard numbers.
+const TokenPrefix = "tok_"
+
+// ErrNotFound is returned when the vault doesn't have a creditcard for the token.
+var ErrNotFound = errors.New("token not found")
+
+// Vault is the interface that describes the methods the storage service needs
+// to implement to be able to keep creditcards safe. The cvv code of a creditcard
+// is never stored. Every token belongs to the customer the creditcard was
+// tokenized for, and can only be used by that customer.
+type Vault interface {
+	// Tokenize stores the creditcard of the customer and returns its token. A
+	// creditcard number that has been tokenized for the customer before gets
+	// the same token, and its expiry is updated.
+	Tokenize(customerID string, card creditcard.Card) (string, error)
+
+	// Detokenize returns the creditcard for the token, without its cvv code,
+	// or ErrNotFound when the vault doesn't have a creditcard for the token,
+	// or the token belongs to another customer.
+	Detokenize(customerID string, token string) (creditcard.Card, error)
+}
+
+// IsToken returns true when the value looks like a token.
+func IsToken(value string) bool {
+	return strings.HasPrefix(value, TokenPrefix)
+}
+
+// KeyFromEnv returns the key in VAULT_KEY, which the creditcards in the vault are
+// encrypted with. It returns an error if the key is not a base64 encoded 32 byte key.
+func KeyFromEnv() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("VAULT_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("VAULT_KEY must contain a base64 encoded 32 byte key")
+	}
+
+	return key, nil
+}
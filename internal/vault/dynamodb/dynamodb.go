@@ -0,0 +1,273 @@
+// Package dynamodb uses Amazon DynamoDB, a fully managed NoSQL database service, to keep
+// the tokenized creditcards, so every instance of the Payment service, like every Lambda
+// function, shares the same vault. The creditcards are encrypted with AES-256-GCM before
+// they are stored. The table needs a string partition key called "ID".
+package dynamodb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/retgits/acme-serverless-payment/internal/vault"
+	"github.com/retgits/creditcard"
+)
+
+// indexPrefix is the prefix of the IDs of the items that map a customer and
+// creditcard number to their token.
+const indexPrefix = "index_"
+
+// card is the representation of a tokenized creditcard before it is encrypted.
+// The cvv code is never stored.
+type card struct {
+	Customer    string `json:"customer"`
+	Type        string `json:"type,omitempty"`
+	Number      string `json:"number"`
+	ExpiryMonth int    `json:"expiryMonth"`
+	ExpiryYear  int    `json:"expiryYear"`
+}
+
+// item is the representation of a tokenized creditcard, or of the token of a
+// customer and creditcard number, in DynamoDB.
+type item struct {
+	ID    string `dynamodbav:"ID"`
+	Card  []byte `dynamodbav:"Card,omitempty"`
+	Token string `dynamodbav:"Token,omitempty"`
+}
+
+// store contains the DynamoDB client and implements the methods
+// of the Vault interface.
+type store struct {
+	svc   *dynamodb.DynamoDB
+	table string
+	key   []byte
+	aead  cipher.AEAD
+}
+
+// New creates a new instance of the Vault with DynamoDB as the storage layer. The
+// table is determined by the environment variable VAULT_TABLE. The environment
+// variable VAULT_KEY contains the base64 encoded 32 byte key the creditcards are
+// encrypted with. The AWS region is determined by the environment variable REGION.
+// To use a local stand-in, like DynamoDB Local, set DYNAMODB_ENDPOINT to its URL.
+// The method returns an error if the key is not valid.
+func New() (vault.Vault, error) {
+	key, err := vault.KeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}
+
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
+	awsSession := session.Must(session.NewSession(cfg))
+
+	return &store{
+		svc:   dynamodb.New(awsSession),
+		table: os.Getenv("VAULT_TABLE"),
+		key:   key,
+		aead:  aead,
+	}, nil
+}
+
+// Tokenize stores the creditcard of the customer and returns its token. A creditcard
+// number that has been tokenized for the customer before gets the same token, and its
+// expiry is updated.
+func (s *store) Tokenize(customerID string, c creditcard.Card) (string, error) {
+	if len(customerID) == 0 {
+		return "", errors.New("creditcards can only be tokenized for a customer")
+	}
+
+	index := indexPrefix + s.index(customerID, c.Number)
+
+	token, err := s.token(index)
+	if err != nil {
+		return "", err
+	}
+
+	// Claim a new token for the customer and creditcard number. When another
+	// request claimed one first, that token is used
+	if len(token) == 0 {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		token = vault.TokenPrefix + hex.EncodeToString(b)
+
+		err := s.put(item{ID: index, Token: token}, true)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			if token, err = s.token(index); err != nil {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	sealed, err := s.seal(card{
+		Customer:    customerID,
+		Type:        c.Type,
+		Number:      c.Number,
+		ExpiryMonth: c.ExpiryMonth,
+		ExpiryYear:  c.ExpiryYear,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.put(item{ID: token, Card: sealed}, false); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Detokenize returns the creditcard for the token, without its cvv code, or ErrNotFound
+// when the token is not known or belongs to another customer.
+func (s *store) Detokenize(customerID string, token string) (creditcard.Card, error) {
+	if len(customerID) == 0 || !vault.IsToken(token) {
+		return creditcard.Card{}, vault.ErrNotFound
+	}
+
+	i, found, err := s.get(token)
+	if err != nil {
+		return creditcard.Card{}, err
+	}
+	if !found || len(i.Card) == 0 {
+		return creditcard.Card{}, vault.ErrNotFound
+	}
+
+	c, err := s.open(i.Card)
+	if err != nil {
+		return creditcard.Card{}, err
+	}
+
+	if !hmac.Equal([]byte(c.Customer), []byte(customerID)) {
+		return creditcard.Card{}, vault.ErrNotFound
+	}
+
+	return creditcard.Card{
+		Type:        c.Type,
+		Number:      c.Number,
+		ExpiryMonth: c.ExpiryMonth,
+		ExpiryYear:  c.ExpiryYear,
+	}, nil
+}
+
+// token returns the token stored under the index, or an empty string.
+func (s *store) token(index string) (string, error) {
+	i, _, err := s.get(index)
+	return i.Token, err
+}
+
+// get returns the item with the ID. The boolean is false when there is none.
+func (s *store) get(id string) (item, bool, error) {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return item{}, false, err
+	}
+
+	if out.Item == nil {
+		return item{}, false, nil
+	}
+
+	var i item
+	err = dynamodbattribute.UnmarshalMap(out.Item, &i)
+
+	return i, err == nil, err
+}
+
+// put stores the item. When onlyNew is set, the item is only stored if there is
+// no item with the same ID yet.
+func (s *store) put(i item, onlyNew bool) error {
+	av, err := dynamodbattribute.MarshalMap(i)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	}
+	if onlyNew {
+		input.ConditionExpression = aws.String("attribute_not_exists(ID)")
+	}
+
+	_, err = s.svc.PutItem(input)
+
+	return err
+}
+
+// index returns the keyed hash of the customer ID and creditcard number.
+func (s *store) index(customerID string, number string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(customerID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the creditcard and returns the nonce and ciphertext.
+func (s *store) seal(c card) ([]byte, error) {
+	plaintext, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts the nonce and ciphertext created by seal.
+func (s *store) open(sealed []byte) (card, error) {
+	size := s.aead.NonceSize()
+	if len(sealed) < size {
+		return card{}, errors.New("tokenized creditcard is not valid")
+	}
+
+	plaintext, err := s.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return card{}, err
+	}
+
+	var c card
+	err = json.Unmarshal(plaintext, &c)
+
+	return c, err
+}
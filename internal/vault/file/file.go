@@ -0,0 +1,229 @@
+// Package file keeps the tokenized creditcards in a local file that is encrypted
+// with AES-256-GCM. This is useful for services that run on a single machine with
+// a persistent disk, and for development.
+package file
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/retgits/acme-serverless-payment/internal/vault"
+	"github.com/retgits/creditcard"
+)
+
+// card is the representation of a tokenized creditcard in the file. The cvv
+// code is never stored.
+type card struct {
+	Customer    string `json:"customer"`
+	Type        string `json:"type,omitempty"`
+	Number      string `json:"number"`
+	ExpiryMonth int    `json:"expiryMonth"`
+	ExpiryYear  int    `json:"expiryYear"`
+}
+
+// contents is the decrypted content of the file.
+type contents struct {
+	// Cards contains the creditcards keyed by token.
+	Cards map[string]card `json:"cards"`
+
+	// Tokens contains the tokens keyed by a keyed hash of the customer ID
+	// and creditcard number, so a creditcard number gets the same token
+	// every time it's used by the same customer.
+	Tokens map[string]string `json:"tokens"`
+}
+
+// store contains the decrypted content of the file and implements the methods
+// of the Vault interface.
+type store struct {
+	mu   sync.Mutex
+	path string
+	key  []byte
+	aead cipher.AEAD
+	data contents
+}
+
+// New creates a new instance of the Vault with an encrypted file as the storage
+// layer. The file is determined by the environment variable VAULT_FILE and is
+// created when the first creditcard is tokenized. The environment variable
+// VAULT_KEY contains the base64 encoded 32 byte key the file is encrypted with.
+// The method returns an error if the key is not valid or the file could not be
+// decrypted.
+func New() (vault.Vault, error) {
+	key, err := vault.KeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		path: os.Getenv("VAULT_FILE"),
+		key:  key,
+		aead: aead,
+		data: contents{
+			Cards:  make(map[string]card),
+			Tokens: make(map[string]string),
+		},
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Tokenize stores the creditcard of the customer and returns its token. A creditcard
+// number that has been tokenized for the customer before gets the same token, and its
+// expiry is updated.
+func (s *store) Tokenize(customerID string, c creditcard.Card) (string, error) {
+	if len(customerID) == 0 {
+		return "", fmt.Errorf("creditcards can only be tokenized for a customer")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.index(customerID, c.Number)
+
+	token, ok := s.data.Tokens[index]
+	if !ok {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", err
+		}
+		token = vault.TokenPrefix + hex.EncodeToString(b)
+	}
+
+	stored := card{
+		Customer:    customerID,
+		Type:        c.Type,
+		Number:      c.Number,
+		ExpiryMonth: c.ExpiryMonth,
+		ExpiryYear:  c.ExpiryYear,
+	}
+
+	if ok && s.data.Cards[token] == stored {
+		return token, nil
+	}
+
+	previous, existed := s.data.Cards[token]
+	s.data.Tokens[index] = token
+	s.data.Cards[token] = stored
+
+	if err := s.save(); err != nil {
+		// Keep the content in line with the file
+		if existed {
+			s.data.Cards[token] = previous
+		} else {
+			delete(s.data.Tokens, index)
+			delete(s.data.Cards, token)
+		}
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Detokenize returns the creditcard for the token, without its cvv code, or ErrNotFound
+// when the token is not known or belongs to another customer.
+func (s *store) Detokenize(customerID string, token string) (creditcard.Card, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.data.Cards[token]
+	if !ok || len(customerID) == 0 || !hmac.Equal([]byte(c.Customer), []byte(customerID)) {
+		return creditcard.Card{}, vault.ErrNotFound
+	}
+
+	return creditcard.Card{
+		Type:        c.Type,
+		Number:      c.Number,
+		ExpiryMonth: c.ExpiryMonth,
+		ExpiryYear:  c.ExpiryYear,
+	}, nil
+}
+
+// index returns the keyed hash of the customer ID and creditcard number.
+func (s *store) index(customerID string, number string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(customerID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// load decrypts the file, if it exists. The caller must hold the lock, or
+// be the only one with access to the store.
+func (s *store) load() error {
+	payload, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	size := s.aead.NonceSize()
+	if len(payload) < size {
+		return fmt.Errorf("vault file %s is not valid", s.path)
+	}
+
+	plaintext, err := s.aead.Open(nil, payload[:size], payload[size:], nil)
+	if err != nil {
+		return fmt.Errorf("vault file %s could not be decrypted: %s", s.path, err.Error())
+	}
+
+	return json.Unmarshal(plaintext, &s.data)
+}
+
+// save encrypts the content and replaces the file. The content is written
+// to a temporary file first, so the file is never left half written. The
+// caller must hold the lock.
+func (s *store) save() error {
+	plaintext, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(s.aead.Seal(nonce, nonce, plaintext, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
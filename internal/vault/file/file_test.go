@@ -0,0 +1,158 @@
+package file
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/retgits/acme-serverless-payment/internal/vault"
+	"github.com/retgits/creditcard"
+)
+
+// setup configures a vault file in a temporary directory, and returns a
+// function that removes it.
+func setup(t *testing.T) func() {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("VAULT_FILE", filepath.Join(dir, "vault"))
+	os.Setenv("VAULT_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+
+	return func() {
+		os.Unsetenv("VAULT_FILE")
+		os.Unsetenv("VAULT_KEY")
+		os.RemoveAll(dir)
+	}
+}
+
+var visa = creditcard.Card{
+	Type:        "Visa",
+	Number:      "4111111111111111",
+	ExpiryMonth: 12,
+	ExpiryYear:  2099,
+	CVV:         "123",
+}
+
+func TestRoundTrip(t *testing.T) {
+	defer setup(t)()
+
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := v.Tokenize("customer-1", visa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vault.IsToken(token) {
+		t.Errorf("Tokenize() = %q, want a token", token)
+	}
+
+	// The file is encrypted
+	payload, err := ioutil.ReadFile(os.Getenv("VAULT_FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{visa.Number, "customer-1"} {
+		if bytes.Contains(payload, []byte(secret)) {
+			t.Errorf("vault file contains %s", secret)
+		}
+	}
+
+	// The card can be read back after the file is opened again
+	v, err = New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := v.Detokenize("customer-1", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := visa
+	want.CVV = ""
+	if got != want {
+		t.Errorf("Detokenize() = %+v, want %+v", got, want)
+	}
+
+	// The file can't be opened with another key
+	os.Setenv("VAULT_KEY", base64.StdEncoding.EncodeToString([]byte("another key of exactly 32 bytes!")))
+	if _, err := New(); err == nil {
+		t.Errorf("New() with another key returned no error")
+	}
+}
+
+func TestTokenizeSameNumber(t *testing.T) {
+	defer setup(t)()
+
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := v.Tokenize("customer-1", visa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A creditcard number that was tokenized before gets the same token,
+	// with the new expiry
+	renewed := visa
+	renewed.ExpiryYear = 2100
+	if again, err := v.Tokenize("customer-1", renewed); err != nil || again != token {
+		t.Errorf("Tokenize() of the same number = %q, %v, want %q", again, err, token)
+	}
+
+	if got, err := v.Detokenize("customer-1", token); err != nil || got.ExpiryYear != 2100 {
+		t.Errorf("Detokenize() = %+v, %v, want the new expiry", got, err)
+	}
+
+	if _, err := v.Detokenize("customer-1", vault.TokenPrefix+"unknown"); err != vault.ErrNotFound {
+		t.Errorf("Detokenize() of an unknown token error = %v, want %v", err, vault.ErrNotFound)
+	}
+}
+
+func TestTokensBelongToCustomer(t *testing.T) {
+	defer setup(t)()
+
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := v.Tokenize("customer-1", visa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, err := v.Tokenize("customer-1", visa); err != nil || again != token {
+		t.Errorf("Tokenize() for the same customer = %q, %v, want %q", again, err, token)
+	}
+
+	other, err := v.Tokenize("customer-2", visa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token {
+		t.Errorf("Tokenize() for another customer returned the same token")
+	}
+
+	for _, customerID := range []string{"customer-2", ""} {
+		if _, err := v.Detokenize(customerID, token); err != vault.ErrNotFound {
+			t.Errorf("Detokenize(%q) of the token of customer-1 = %v, want ErrNotFound", customerID, err)
+		}
+	}
+
+	if _, err := v.Tokenize("", visa); err == nil {
+		t.Errorf("Tokenize() without a customer returned no error")
+	}
+}
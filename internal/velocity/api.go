@@ -0,0 +1,222 @@
+// Package velocity contains the interfaces that the Payment service in the
+// ACME Serverless Fitness Shop needs to limit how often payments are attempted
+// with the same creditcard, for the same order, or from the same client. This
+// stops card-testing attacks, where stolen creditcards are tried in rapid
+// succession. In order to add a new storage service for the counters, the
+// Counter interface needs to be implemented.
+package velocity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Dimension is what the attempts are counted by.
+type Dimension string
+
+const (
+	// Card counts attempts per creditcard.
+	Card Dimension = "card"
+
+	// Order counts attempts per order ID.
+	Order Dimension = "order"
+
+	// Client counts attempts per client IP address.
+	Client Dimension = "client"
+)
+
+// Counter is the interface that describes the methods the storage service
+// needs to implement to be able to count attempts in a sliding window.
+type Counter interface {
+	// Add records an attempt for the key at the given time and returns the
+	// number of attempts for the key in the window that ends at that time,
+	// including this one.
+	Add(key string, window time.Duration, now time.Time) (int64, error)
+}
+
+// Limit is the maximum number of attempts in a sliding window.
+type Limit struct {
+	// Max is the maximum number of attempts in the window.
+	Max int64
+
+	// Window is the duration of the sliding window.
+	Window time.Duration
+}
+
+// Attempt contains the details of a payment attempt that are counted.
+// Empty details are not counted.
+type Attempt struct {
+	// Card is the creditcard number.
+	Card string
+
+	// OrderID is the unique identifier of the order.
+	OrderID string
+
+	// ClientIP is the IP address of the client that sent the request.
+	ClientIP string
+}
+
+// Violation describes a limit that an attempt exceeded.
+type Violation struct {
+	// Dimension is what the attempts were counted by.
+	Dimension Dimension
+
+	// Count is the number of attempts in the window, including this one.
+	Count int64
+
+	// Limit is the limit that was exceeded.
+	Limit Limit
+}
+
+// Limiter counts payment attempts and checks them against the limits.
+type Limiter struct {
+	counter Counter
+	limits  map[Dimension]Limit
+	secret  []byte
+}
+
+// DefaultLimits contains the limits that are used when no limits are configured.
+var DefaultLimits = map[Dimension]Limit{
+	Card:   {Max: 5, Window: 10 * time.Minute},
+	Order:  {Max: 10, Window: 10 * time.Minute},
+	Client: {Max: 30, Window: 10 * time.Minute},
+}
+
+// New creates a new Limiter that uses the counter to keep track of attempts.
+// Dimensions without a limit are not counted. The keys of the counters are
+// derived with the secret, which must be the same for every instance that
+// shares the counters.
+func New(c Counter, limits map[Dimension]Limit, secret []byte) *Limiter {
+	return &Limiter{
+		counter: c,
+		limits:  limits,
+		secret:  secret,
+	}
+}
+
+// KeyFromEnv returns the secret in VELOCITY_KEY, which the keys of the counters
+// are derived with, or nil when it isn't set. It returns an error if the secret
+// is not a base64 encoded 32 byte key.
+func KeyFromEnv() ([]byte, error) {
+	v := os.Getenv("VELOCITY_KEY")
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("VELOCITY_KEY must contain a base64 encoded 32 byte key")
+	}
+
+	return key, nil
+}
+
+// NewKey returns a random 32 byte secret to derive the keys of the counters with.
+// Keys derived with it only match within the same process, so it can only be used
+// with counters that don't outlive the process.
+func NewKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// LimitConfig is the JSON representation of a limit.
+type LimitConfig struct {
+	// Max is the maximum number of attempts in the window.
+	Max int64 `json:"max"`
+
+	// Window is the duration of the sliding window, like 10m.
+	Window string `json:"window"`
+}
+
+// FromEnv creates a new Limiter that uses the counter and the secret, with the limits
+// configured in the environment. The environment variable VELOCITY_LIMITS can contain
+// the JSON encoded limits, keyed by dimension. When it isn't set, the default limits
+// are used. It returns an error if a limit is not valid.
+func FromEnv(c Counter, secret []byte) (*Limiter, error) {
+	payload := os.Getenv("VELOCITY_LIMITS")
+	if len(payload) == 0 {
+		return New(c, DefaultLimits, secret), nil
+	}
+
+	var config map[Dimension]LimitConfig
+	if err := json.Unmarshal([]byte(payload), &config); err != nil {
+		return nil, fmt.Errorf("error parsing velocity limits: %s", err.Error())
+	}
+
+	limits := make(map[Dimension]Limit)
+	for d, lc := range config {
+		if d != Card && d != Order && d != Client {
+			return nil, fmt.Errorf("unknown velocity dimension %q", d)
+		}
+
+		window, err := time.ParseDuration(lc.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("velocity limit %s has an invalid window %q", d, lc.Window)
+		}
+
+		if lc.Max < 1 {
+			return nil, fmt.Errorf("velocity limit %s needs a max of at least 1", d)
+		}
+
+		limits[d] = Limit{Max: lc.Max, Window: window}
+	}
+
+	return New(c, limits, secret), nil
+}
+
+// Check records the attempt in every dimension that has a limit and returns the
+// limits that the attempt exceeded. It returns an error if the attempt could not
+// be counted.
+func (l *Limiter) Check(a Attempt) ([]Violation, error) {
+	now := time.Now()
+
+	keys := map[Dimension]string{
+		Card:   a.Card,
+		Order:  a.OrderID,
+		Client: a.ClientIP,
+	}
+
+	var violations []Violation
+	for _, d := range []Dimension{Card, Order, Client} {
+		limit, ok := l.limits[d]
+		if !ok || len(keys[d]) == 0 {
+			continue
+		}
+
+		count, err := l.counter.Add(l.key(d, keys[d]), limit.Window, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if count > limit.Max {
+			violations = append(violations, Violation{
+				Dimension: d,
+				Count:     count,
+				Limit:     limit,
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+// key returns the key of the counter for the value in the dimension. Values are
+// hashed with the secret, so the counters don't contain creditcard numbers or IP
+// addresses, and those can't be recovered by trying every possible value.
+func (l *Limiter) key(d Dimension, value string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(value))
+	return fmt.Sprintf("velocity:%s:%s", d, hex.EncodeToString(mac.Sum(nil)[:16]))
+}
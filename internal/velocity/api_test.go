@@ -0,0 +1,100 @@
+package velocity
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// counter is a Counter that counts attempts per key, without a window.
+type counter map[string]int64
+
+func (c counter) Add(key string, window time.Duration, now time.Time) (int64, error) {
+	c[key]++
+	return c[key], nil
+}
+
+func TestCheck(t *testing.T) {
+	c := counter{}
+	l := New(c, map[Dimension]Limit{Card: {Max: 2, Window: time.Minute}}, make([]byte, 32))
+	a := Attempt{Card: "4111111111111111", OrderID: "order-1", ClientIP: "203.0.113.7"}
+
+	for i := 1; i <= 3; i++ {
+		violations, err := l.Check(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i > 2; (len(violations) > 0) != want {
+			t.Errorf("attempt %d: Check() = %v, want a violation %v", i, violations, want)
+		}
+	}
+
+	// Only the dimension with a limit is counted, without the creditcard number
+	if len(c) != 1 {
+		t.Errorf("Check() counted %d keys, want 1", len(c))
+	}
+	for key := range c {
+		if strings.Contains(key, "4111111111111111") || !strings.HasPrefix(key, "velocity:card:") {
+			t.Errorf("Check() counted key %q", key)
+		}
+	}
+}
+
+func TestKeyDependsOnSecret(t *testing.T) {
+	other := make([]byte, 32)
+	other[0] = 1
+
+	a := New(counter{}, DefaultLimits, make([]byte, 32))
+	b := New(counter{}, DefaultLimits, other)
+
+	if a.key(Card, "4111111111111111") != a.key(Card, "4111111111111111") {
+		t.Errorf("key() of the same value differs")
+	}
+	if a.key(Card, "4111111111111111") == b.key(Card, "4111111111111111") {
+		t.Errorf("key() with another secret is the same")
+	}
+	if a.key(Card, "4111111111111111") == a.key(Client, "4111111111111111") {
+		t.Errorf("key() in another dimension is the same")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[Dimension]Limit
+		wantErr bool
+	}{
+		{"not set", "", DefaultLimits, false},
+		{"limits", `{"card": {"max": 3, "window": "1h"}}`, map[Dimension]Limit{Card: {Max: 3, Window: time.Hour}}, false},
+		{"unknown dimension", `{"country": {"max": 3, "window": "1h"}}`, nil, true},
+		{"invalid window", `{"card": {"max": 3, "window": "-1h"}}`, nil, true},
+		{"invalid max", `{"card": {"max": 0, "window": "1h"}}`, nil, true},
+		{"malformed", `{"card": `, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("VELOCITY_LIMITS", tt.value)
+			defer os.Unsetenv("VELOCITY_LIMITS")
+
+			l, err := FromEnv(counter{}, make([]byte, 32))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(l.limits) != len(tt.want) {
+				t.Fatalf("FromEnv() limits = %v, want %v", l.limits, tt.want)
+			}
+			for d, limit := range tt.want {
+				if l.limits[d] != limit {
+					t.Errorf("FromEnv() limit %s = %v, want %v", d, l.limits[d], limit)
+				}
+			}
+		})
+	}
+}
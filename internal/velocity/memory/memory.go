@@ -0,0 +1,80 @@
+// Package memory counts payment attempts in memory. Counters are lost when
+// the process stops and aren't shared between instances, so this is only
+// useful for testing and for services that run as a single long-lived instance.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/retgits/acme-serverless-payment/internal/velocity"
+)
+
+// sweepInterval is how often counters without recent attempts are removed.
+const sweepInterval = time.Minute
+
+// attempts are the times of the attempts for a key, oldest first.
+type attempts struct {
+	window time.Duration
+	times  []time.Time
+}
+
+// counter is an in-memory sliding window log that implements the methods
+// of the Counter interface.
+type counter struct {
+	mu        sync.Mutex
+	keys      map[string]*attempts
+	lastSweep time.Time
+}
+
+// New creates a new instance of the Counter with memory as the storage layer.
+func New() velocity.Counter {
+	return &counter{
+		keys:      make(map[string]*attempts),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add records an attempt for the key at the given time and returns the number
+// of attempts for the key in the window that ends at that time, including this one.
+func (c *counter) Add(key string, window time.Duration, now time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > sweepInterval {
+		c.sweep(now)
+	}
+
+	a, ok := c.keys[key]
+	if !ok {
+		a = &attempts{}
+		c.keys[key] = a
+	}
+
+	a.window = window
+	a.prune(now)
+	a.times = append(a.times, now)
+
+	return int64(len(a.times)), nil
+}
+
+// sweep removes the counters without attempts in their window. The caller
+// must hold the lock.
+func (c *counter) sweep(now time.Time) {
+	for key, a := range c.keys {
+		a.prune(now)
+		if len(a.times) == 0 {
+			delete(c.keys, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// prune removes the attempts that are outside of the window.
+func (a *attempts) prune(now time.Time) {
+	i := 0
+	for i < len(a.times) && now.Sub(a.times[i]) >= a.window {
+		i++
+	}
+	a.times = a.times[i:]
+}
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowExpiry(t *testing.T) {
+	c := New()
+	start := time.Now()
+	window := 10 * time.Minute
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		want int64
+	}{
+		{"first attempt", 0, 1},
+		{"inside the window", time.Minute, 2},
+		{"just before the first attempt expires", window - time.Nanosecond, 3},
+		{"first attempt expired", window, 3},
+		{"second attempt expired", window + time.Minute, 3},
+		{"every attempt expired", 3 * window, 1},
+	}
+
+	for _, tt := range tests {
+		got, err := c.Add("key", window, start.Add(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Add() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeysAreCountedSeparately(t *testing.T) {
+	c := New()
+	now := time.Now()
+
+	c.Add("a", time.Minute, now)
+	c.Add("a", time.Minute, now)
+
+	if got, _ := c.Add("b", time.Minute, now); got != 1 {
+		t.Errorf("Add() of another key = %d, want 1", got)
+	}
+}
+
+func TestSweepRemovesExpiredKeys(t *testing.T) {
+	c := New().(*counter)
+	start := time.Now()
+
+	c.Add("expired", time.Minute, start)
+	c.Add("recent", time.Hour, start)
+
+	// The next attempt after the sweep interval removes the keys without
+	// attempts in their window
+	c.Add("new", time.Minute, start.Add(sweepInterval+time.Second))
+
+	if _, ok := c.keys["expired"]; ok {
+		t.Errorf("counter kept a key without attempts in its window")
+	}
+	if _, ok := c.keys["recent"]; !ok {
+		t.Errorf("counter removed a key with attempts in its window")
+	}
+}
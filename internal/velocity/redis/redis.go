@@ -0,0 +1,63 @@
+// Package redis uses Redis, or any service that is compatible with its protocol,
+// to count payment attempts. Every key is a sorted set with the time of each
+// attempt, so the counters are shared by all instances of the Payment service.
+package redis
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gofrs/uuid"
+	"github.com/retgits/acme-serverless-payment/internal/velocity"
+)
+
+// counter contains the Redis client and implements the methods of the
+// Counter interface.
+type counter struct {
+	client *redis.Client
+}
+
+// New creates a new instance of the Counter with Redis as the storage layer.
+// The address of the server, like localhost:6379, is determined by the
+// environment variable REDIS_ADDR. The password and database are determined
+// by the environment variables REDIS_PASSWORD and REDIS_DB.
+func New() velocity.Counter {
+	db, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
+
+	return &counter{
+		client: redis.NewClient(&redis.Options{
+			Addr:     os.Getenv("REDIS_ADDR"),
+			Password: os.Getenv("REDIS_PASSWORD"),
+			DB:       db,
+		}),
+	}
+}
+
+// Add records an attempt for the key at the given time and returns the number
+// of attempts for the key in the window that ends at that time, including this
+// one. The attempts outside of the window are removed in the same transaction,
+// and the key expires when there are no attempts in the window anymore.
+func (c *counter) Add(key string, window time.Duration, now time.Time) (int64, error) {
+	// Scores are in microseconds, so they fit in the float64 of a sorted set
+	score := float64(now.UnixNano() / int64(time.Microsecond))
+	start := now.Add(-window).UnixNano() / int64(time.Microsecond)
+
+	var count *redis.IntCmd
+	_, err := c.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(key, "-inf", strconv.FormatInt(start, 10))
+		pipe.ZAdd(key, &redis.Z{
+			Score:  score,
+			Member: uuid.Must(uuid.NewV4()).String(),
+		})
+		count = pipe.ZCard(key)
+		pipe.PExpire(key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count.Val(), nil
+}
@@ -0,0 +1,115 @@
+package redis
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis/v7"
+)
+
+// newCounter starts a Redis stand-in, which is closed when the test ends, and
+// returns it together with a counter that keeps its attempts in it.
+func newCounter(t *testing.T) (*miniredis.Miniredis, *counter) {
+	t.Helper()
+
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	c := &counter{client: redis.NewClient(&redis.Options{Addr: srv.Addr()})}
+	t.Cleanup(func() { c.client.Close() })
+
+	return srv, c
+}
+
+func TestWindowExpiry(t *testing.T) {
+	_, c := newCounter(t)
+	start := time.Now()
+	window := 10 * time.Minute
+
+	// Scores are in microseconds, so the attempts are that far apart at least
+	tests := []struct {
+		name string
+		at   time.Duration
+		want int64
+	}{
+		{"first attempt", 0, 1},
+		{"inside the window", time.Minute, 2},
+		{"just before the first attempt expires", window - time.Microsecond, 3},
+		{"first attempt expired", window, 3},
+		{"second attempt expired", window + time.Minute, 3},
+		{"every attempt expired", 3 * window, 1},
+	}
+
+	for _, tt := range tests {
+		got, err := c.Add("key", window, start.Add(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Add() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyExpires(t *testing.T) {
+	srv, c := newCounter(t)
+
+	if _, err := c.Add("key", time.Minute, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := srv.TTL("key"); ttl != time.Minute {
+		t.Errorf("key expires in %s, want %s", ttl, time.Minute)
+	}
+
+	// The key is removed once there are no attempts in the window anymore
+	srv.FastForward(time.Minute)
+	if srv.Exists("key") {
+		t.Errorf("key still exists after the window passed")
+	}
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	_, c := newCounter(t)
+	const n = 50
+
+	var wg sync.WaitGroup
+	counts := make(chan int64, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			got, err := c.Add("key", time.Hour, time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			counts <- got
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	// Every attempt is counted once, and every Add sees a different count
+	seen := make(map[int64]bool)
+	for got := range counts {
+		if seen[got] {
+			t.Errorf("Add() returned %d more than once", got)
+		}
+		seen[got] = true
+	}
+
+	if len(seen) != n {
+		t.Errorf("Add() returned %d different counts, want %d", len(seen), n)
+	}
+
+	if got, _ := c.Add("key", time.Hour, time.Now()); got != n+1 {
+		t.Errorf("Add() after %d concurrent attempts = %d, want %d", n, got, n+1)
+	}
+}
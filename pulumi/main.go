@@ -179,6 +179,11 @@ func main() {
 			return err
 		}
 
+		// The partial batch responses of the function are only used when the mapping
+		// has ReportBatchItemFailures enabled, which this version of the AWS provider
+		// can't set. REPORT_BATCH_ITEM_FAILURES is therefore left unset, so the function
+		// fails the invocation when the payment in the message could not be processed,
+		// and the message is received again instead of being deleted
 		_, err = lambda.NewEventSourceMapping(ctx, fmt.Sprintf("%s-lambda-payment", ctx.Stack()), &lambda.EventSourceMappingArgs{
 			BatchSize:      pulumi.Int(1),
 			Enabled:        pulumi.Bool(true),